@@ -0,0 +1,200 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"time"
+)
+
+//=====================ACTION===================
+//
+//        MQTT指令的请求/应答, 每个指令都有结果
+//
+//=====================END======================
+
+// 应答状态
+const (
+	RESULT_OK       = "ok"       // 执行成功
+	RESULT_INVALID  = "invalid"  // 请求不合法, 未执行
+	RESULT_ERROR    = "error"    // 执行失败
+	RESULT_TIMEOUT  = "timeout"  // 未在timeout内完成
+	RESULT_ACCEPTED = "accepted" // 已受理, 完成后再次应答
+)
+
+// 未指定replyTo时的应答主题(命名空间内)
+const TOPIC_REPLY = "reply"
+
+/**
+ * 指令的请求信封, 与指令内容位于同一层级
+ * MQTT 3.1.1没有response-topic/correlation-data, 因此放在载荷中
+ */
+type ActionEnvelope struct {
+	RequestID string `json:"requestID,omitempty"` // 请求ID, 原样返回
+	ReplyTo   string `json:"replyTo,omitempty"`   // 应答主题(完整主题), 缺省为{prefix}/reply
+	Timeout   int64  `json:"timeout,omitempty"`   // 超时时间(秒), 超时后应答timeout
+}
+
+/**
+ * 指令应答
+ */
+type ActionResult struct {
+	RequestID string      `json:"requestID,omitempty"`
+	Topic     string      `json:"topic"`              // 请求的主题
+	SensorID  string      `json:"sensorID,omitempty"` // 请求的传感器
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	Data      interface{} `json:"data,omitempty"` // 执行结果
+	Created   time.Time   `json:"created"`
+}
+
+/**
+ * 请求不合法, 指令未被执行
+ */
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func invalid(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ValidationError{Err: err}
+}
+
+func IsValidationError(err error) bool {
+	var ve *ValidationError
+	return errors.As(err, &ve)
+}
+
+var ErrActionTimeout = errors.New("action timeout")
+
+/**
+ * 指令是否已开始产生副作用, 用于判断超时时能否应答timeout
+ */
+type actionGate struct {
+	committed bool
+	expired   bool
+	sync.Mutex
+}
+
+type actionGateKey struct{}
+
+/**
+ * 指令开始产生副作用(写CONFIG、写线圈、重启等)前调用
+ * 已应答timeout(或ctx已结束)时返回错误, 指令不得继续执行; 成功后超时不再应答timeout, 等待执行完成
+ */
+func commitAction(ctx context.Context) error {
+	g, ok := ctx.Value(actionGateKey{}).(*actionGate)
+	if !ok {
+		return ctx.Err()
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.expired {
+		return ErrActionTimeout
+	}
+	g.committed = true
+	return nil
+}
+
+/**
+ * 超时: 未开始产生副作用时标记为超时并返回true
+ */
+func (g *actionGate) expire() bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.committed {
+		return false
+	}
+	g.expired = true
+	return true
+}
+
+/**
+ * 执行指令并应答
+ * @param sensorID 请求的传感器
+ * @param exec 执行过程, 返回执行结果或错误(ValidationError为请求不合法)
+ *             产生副作用前调用commitAction(ctx), 超时后ctx被取消
+ */
+func (c *Collector) reply(message mqtt.Message, env ActionEnvelope, sensorID string, exec func(ctx context.Context) (interface{}, error)) {
+	res := ActionResult{RequestID: env.RequestID, Topic: message.Topic(), SensorID: sensorID}
+	type outcome struct {
+		data interface{}
+		err  error
+	}
+	gate := &actionGate{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), actionGateKey{}, gate))
+	defer cancel()
+	done := make(chan outcome, 1)
+	go func() {
+		data, err := exec(ctx)
+		done <- outcome{data, err}
+	}()
+
+	var timeout <-chan time.Time
+	if env.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(env.Timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for res.Status == "" {
+		select {
+		case o := <-done:
+			res.Data = o.data
+			switch {
+			case o.err == nil:
+				res.Status = RESULT_OK
+			case IsValidationError(o.err):
+				res.Status = RESULT_INVALID
+				res.Error = o.err.Error()
+			default:
+				res.Status = RESULT_ERROR
+				res.Error = o.err.Error()
+			}
+		case <-timeout:
+			// 已开始执行时等待完成, 应答实际结果
+			timeout = nil
+			if gate.expire() {
+				cancel()
+				res.Status = RESULT_TIMEOUT
+			}
+		}
+	}
+	c.publishReply(env, res)
+}
+
+/**
+ * 发布应答
+ */
+func (c *Collector) publishReply(env ActionEnvelope, res ActionResult) {
+	res.Created = time.Now()
+	if res.Status != RESULT_OK && res.Status != RESULT_ACCEPTED {
+		fmt.Printf("[WARN] 指令未成功 主题:%s 请求:%s 状态:%s %s\n", res.Topic, res.RequestID, res.Status, res.Error)
+	}
+	topic := env.ReplyTo
+	if topic == "" {
+		topic = c.Topic(TOPIC_REPLY)
+	}
+	if validTopic(topic) != nil {
+		fmt.Println("[WARN] 非法的应答主题 " + topic)
+		return
+	}
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	send, _ := json.Marshal(res)
+	c.publishStream(client, STREAM_REPLY, topic, send)
+}
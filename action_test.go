@@ -0,0 +1,99 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func actionResult(t *testing.T, client *fakeClient, topic string) ActionResult {
+	msgs := client.messages(topic)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one reply on %s, got %d", topic, len(msgs))
+	}
+	var res ActionResult
+	if err := json.Unmarshal(msgs[0].payload, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestActionReply(t *testing.T) {
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s"},
+	}}), WithMQTTClient(client))
+
+	request := func(topic, payload string) {
+		c.SwitchSensorHandler(client, fakeMessage{topic: topic, payload: []byte(payload)})
+	}
+	request("sensor/action/switch", `{"sensorID":"s","operation":"close","requestID":"1","replyTo":"app/1"}`)
+	if res := actionResult(t, client, "app/1"); res.Status != RESULT_OK || res.RequestID != "1" || res.SensorID != "s" {
+		t.Errorf("unexpected reply %+v", res)
+	}
+
+	request("sensor/action/switch", `{"sensorID":"x","operation":"close","requestID":"2","replyTo":"app/2"}`)
+	if res := actionResult(t, client, "app/2"); res.Status != RESULT_INVALID || res.Error == "" {
+		t.Errorf("unknown sensor not rejected %+v", res)
+	}
+
+	request("sensor/action/switch", `{"sensorID":`)
+	if res := actionResult(t, client, c.Topic(TOPIC_REPLY)); res.Status != RESULT_INVALID {
+		t.Errorf("malformed request not rejected %+v", res)
+	}
+
+	c.ConfigPatchHandler(client, fakeMessage{topic: "sensor/action/config", payload: []byte(`{"operation":"merge","requestID":"3","replyTo":"app/3"}`)})
+	if res := actionResult(t, client, "app/3"); res.Status != RESULT_INVALID {
+		t.Errorf("config change without version accepted %+v", res)
+	}
+}
+
+func TestActionTimeout(t *testing.T) {
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{}), WithMQTTClient(client))
+	committed := make(chan error, 1)
+	c.reply(fakeMessage{topic: "sensor/action/restart"}, ActionEnvelope{RequestID: "1", Timeout: 1}, "", func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		// 应答timeout后不能再产生副作用
+		err := commitAction(ctx)
+		committed <- err
+		return nil, err
+	})
+	if res := actionResult(t, client, c.Topic(TOPIC_REPLY)); res.Status != RESULT_TIMEOUT || res.RequestID != "1" {
+		t.Errorf("unexpected reply %+v", res)
+	}
+	if err := <-committed; err == nil {
+		t.Error("action committed after timeout reply")
+	}
+
+	// 已开始执行的指令等待完成, 应答实际结果
+	client = newFakeClient()
+	c = NewCollector(WithConfig(&LocalDeviceDetail{}), WithMQTTClient(client))
+	c.reply(fakeMessage{topic: "sensor/action/restart"}, ActionEnvelope{RequestID: "2", Timeout: 1}, "", func(ctx context.Context) (interface{}, error) {
+		if err := commitAction(ctx); err != nil {
+			return nil, err
+		}
+		time.Sleep(1500 * time.Millisecond)
+		return "done", nil
+	})
+	if res := actionResult(t, client, c.Topic(TOPIC_REPLY)); res.Status != RESULT_OK || res.Data != "done" {
+		t.Errorf("committed action not awaited %+v", res)
+	}
+}
+
+func TestConfigChangeAfterTimeout(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Version: 1}))
+	gate := &actionGate{}
+	gate.expire()
+	ctx := context.WithValue(context.Background(), actionGateKey{}, gate)
+	if _, err := c.PatchConfig(ctx, 1, PATCH_MERGE, []byte(`{"name":"x"}`)); err != ErrActionTimeout {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if dl := c.Config(); dl.Version != 1 || dl.Name == "x" {
+		t.Errorf("config changed after timeout reply %+v", dl)
+	}
+}
@@ -0,0 +1,487 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//=====================ALARM====================
+//
+//     测量值的上下限报警, 含回差、延时及确认
+//
+//=====================END======================
+
+// 报警状态
+const (
+	ALARM_ACTIVE       = "active"       // 报警中, 未确认
+	ALARM_ACKNOWLEDGED = "acknowledged" // 报警中, 已确认
+	ALARM_CLEARED      = "cleared"      // 已恢复
+)
+
+// 报警类型
+const (
+	ALARM_HIGH = "high" // 超过高限
+	ALARM_LOW  = "low"  // 低于低限
+)
+
+// 报警等级
+const (
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning" // 缺省
+	SEVERITY_CRITICAL = "critical"
+)
+
+var severities = map[string]bool{SEVERITY_INFO: true, SEVERITY_WARNING: true, SEVERITY_CRITICAL: true}
+
+// 报警事件的主题(命名空间内)
+const TOPIC_ALARM = "alarm"
+
+// 报警记录的文件名前缀, 与传感器目录同在历史数据目录下
+const alarmFilePrefix = "alarms-"
+
+/**
+ * 报警规则, high/low至少配置一个, 各自独立报警
+ * 超限持续onDelay后报警; 回到限值以内deadband(回差)并持续offDelay后恢复
+ */
+type AlarmRule struct {
+	ID       string   `json:"id" yaml:"id" toml:"id"`                                                 // 规则ID
+	SensorID string   `json:"sensorID" yaml:"sensorID" toml:"sensorID"`                               // 传感器ID
+	Item     string   `json:"item" yaml:"item" toml:"item"`                                           // 测量项, 例如Oxygen
+	High     *float64 `json:"high,omitempty" yaml:"high,omitempty" toml:"high,omitempty"`             // 高于该值报警
+	Low      *float64 `json:"low,omitempty" yaml:"low,omitempty" toml:"low,omitempty"`                // 低于该值报警
+	Deadband float64  `json:"deadband,omitempty" yaml:"deadband,omitempty" toml:"deadband,omitempty"` // 回差
+	OnDelay  int64    `json:"onDelay,omitempty" yaml:"onDelay,omitempty" toml:"onDelay,omitempty"`    // 报警延时(秒)
+	OffDelay int64    `json:"offDelay,omitempty" yaml:"offDelay,omitempty" toml:"offDelay,omitempty"` // 恢复延时(秒)
+	Severity string   `json:"severity,omitempty" yaml:"severity,omitempty" toml:"severity,omitempty"` // info/warning/critical, 缺省warning
+}
+
+func (r *AlarmRule) severity() string {
+	if r.Severity == "" {
+		return SEVERITY_WARNING
+	}
+	return r.Severity
+}
+
+/**
+ * 已配置的报警类型及限值
+ */
+func (r *AlarmRule) limits() map[string]float64 {
+	ret := make(map[string]float64)
+	if r.High != nil {
+		ret[ALARM_HIGH] = *r.High
+	}
+	if r.Low != nil {
+		ret[ALARM_LOW] = *r.Low
+	}
+	return ret
+}
+
+func (r *AlarmRule) validate() error {
+	if r.ID == "" {
+		return errors.New("empty alarm id")
+	}
+	if r.SensorID == "" || r.Item == "" {
+		return fmt.Errorf("alarm %s requires sensorID and item", r.ID)
+	}
+	if r.High == nil && r.Low == nil {
+		return fmt.Errorf("alarm %s requires high or low", r.ID)
+	}
+	if r.High != nil && r.Low != nil && *r.Low >= *r.High {
+		return fmt.Errorf("alarm %s: low must be less than high", r.ID)
+	}
+	if r.Deadband < 0 || r.OnDelay < 0 || r.OffDelay < 0 {
+		return fmt.Errorf("alarm %s: deadband and delays must not be negative", r.ID)
+	}
+	if r.Severity != "" && !severities[r.Severity] {
+		return fmt.Errorf("alarm %s: unknown severity %s", r.ID, r.Severity)
+	}
+	return nil
+}
+
+func (dl *LocalDeviceDetail) validateAlarms() error {
+	ids := make(map[string]bool)
+	for _, r := range dl.Alarms {
+		if r == nil {
+			return errors.New("empty alarm")
+		}
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate alarm id %s", r.ID)
+		}
+		ids[r.ID] = true
+	}
+	return nil
+}
+
+/**
+ * 报警, 状态变化时发布到TOPIC_ALARM并写入报警记录
+ */
+type Alarm struct {
+	ID           string     `json:"id"` // 每次报警生成
+	RuleID       string     `json:"ruleID"`
+	SensorID     string     `json:"sensorID"`
+	Item         string     `json:"item"`
+	Kind         string     `json:"kind"` // high/low
+	Severity     string     `json:"severity"`
+	State        string     `json:"state"`
+	Value        float64    `json:"value"` // 本次状态变化时的测量值
+	Limit        float64    `json:"limit"`
+	Activated    time.Time  `json:"activated"`
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+	AckedBy      string     `json:"ackedBy,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	Cleared      *time.Time `json:"cleared,omitempty"`
+	Updated      time.Time  `json:"updated"` // 本次状态变化的时间
+}
+
+/**
+ * 单个规则单个报警类型的状态
+ */
+type alarmState struct {
+	exceedSince time.Time // 未报警时开始超限的时间
+	normalSince time.Time // 报警时开始恢复的时间
+	alarm       *Alarm    // 当前报警, 为nil时正常
+}
+
+/**
+ * 按测量值更新状态, 以测量时间计算延时
+ * @return 状态变化时的报警
+ */
+func (st *alarmState) update(r *AlarmRule, kind string, limit, value float64, t time.Time) (Alarm, bool) {
+	var exceeded bool
+	switch {
+	case kind == ALARM_HIGH && st.alarm == nil:
+		exceeded = value > limit
+	case kind == ALARM_HIGH:
+		exceeded = value > limit-r.Deadband
+	case st.alarm == nil:
+		exceeded = value < limit
+	default:
+		exceeded = value < limit+r.Deadband
+	}
+
+	if st.alarm == nil {
+		if !exceeded {
+			st.exceedSince = time.Time{}
+			return Alarm{}, false
+		}
+		if st.exceedSince.IsZero() {
+			st.exceedSince = t
+		}
+		if t.Sub(st.exceedSince) < time.Duration(r.OnDelay)*time.Second {
+			return Alarm{}, false
+		}
+		st.exceedSince = time.Time{}
+		st.alarm = &Alarm{ID: bson.NewObjectId().Hex(), RuleID: r.ID, SensorID: r.SensorID, Item: r.Item, Kind: kind, Severity: r.severity(),
+			State: ALARM_ACTIVE, Value: value, Limit: limit, Activated: t, Updated: t}
+		return *st.alarm, true
+	}
+
+	if exceeded {
+		st.normalSince = time.Time{}
+		return Alarm{}, false
+	}
+	if st.normalSince.IsZero() {
+		st.normalSince = t
+	}
+	if t.Sub(st.normalSince) < time.Duration(r.OffDelay)*time.Second {
+		return Alarm{}, false
+	}
+	return st.clear(value, t), true
+}
+
+func (st *alarmState) clear(value float64, t time.Time) Alarm {
+	a := *st.alarm
+	a.State = ALARM_CLEARED
+	a.Value = value
+	a.Cleared = &t
+	a.Updated = t
+	st.alarm = nil
+	st.normalSince = time.Time{}
+	return a
+}
+
+type alarmKey struct {
+	ruleID string
+	kind   string
+}
+
+/**
+ * 各规则的报警状态
+ */
+type alarmEngine struct {
+	states map[alarmKey]*alarmState
+	sync.Mutex
+}
+
+func newAlarmEngine() *alarmEngine {
+	return &alarmEngine{states: make(map[alarmKey]*alarmState)}
+}
+
+/**
+ * 移除已删除的规则及报警类型, 调用者需持有锁
+ * @return 随之恢复的报警
+ */
+func (e *alarmEngine) prune(rules []*AlarmRule) []Alarm {
+	exists := make(map[alarmKey]bool)
+	for _, r := range rules {
+		for kind := range r.limits() {
+			exists[alarmKey{r.ID, kind}] = true
+		}
+	}
+	var ret []Alarm
+	now := time.Now()
+	for k, st := range e.states {
+		if exists[k] {
+			continue
+		}
+		if st.alarm != nil {
+			a := st.clear(st.alarm.Value, now)
+			a.Comment = "rule removed"
+			ret = append(ret, a)
+		}
+		delete(e.states, k)
+	}
+	return ret
+}
+
+// ========================collector===========================
+
+/**
+ * 按测量结果更新相关的报警
+ */
+func (c *Collector) evaluateAlarms(p ReadResult) {
+	rules := c.Config().Alarms
+	c.alarms.Lock()
+	changed := c.alarms.prune(rules)
+	for _, r := range rules {
+		if r.SensorID != p.SensorID {
+			continue
+		}
+		for _, v := range p.Items {
+			if v.Name != r.Item {
+				continue
+			}
+			for kind, limit := range r.limits() {
+				key := alarmKey{r.ID, kind}
+				st, ok := c.alarms.states[key]
+				if !ok {
+					st = &alarmState{}
+					c.alarms.states[key] = st
+				}
+				if a, ok := st.update(r, kind, limit, v.Value, p.Created); ok {
+					changed = append(changed, a)
+				}
+			}
+		}
+	}
+	c.alarms.Unlock()
+	for _, a := range changed {
+		c.emitAlarm(a)
+	}
+}
+
+/**
+ * 当前未恢复的报警, 按报警时间排序
+ */
+func (c *Collector) ActiveAlarms() []Alarm {
+	rules := c.Config().Alarms
+	c.alarms.Lock()
+	changed := c.alarms.prune(rules)
+	ret := []Alarm{}
+	for _, st := range c.alarms.states {
+		if st.alarm != nil {
+			ret = append(ret, *st.alarm)
+		}
+	}
+	c.alarms.Unlock()
+	for _, a := range changed {
+		c.emitAlarm(a)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Activated.Before(ret[j].Activated)
+	})
+	return ret
+}
+
+func ActiveAlarms() []Alarm {
+	return Default().ActiveAlarms()
+}
+
+/**
+ * 确认报警, 已确认或已恢复的报警不能再确认
+ * @param by 确认人
+ */
+func (c *Collector) AcknowledgeAlarm(id, by, comment string) (Alarm, error) {
+	c.alarms.Lock()
+	var found *Alarm
+	for _, st := range c.alarms.states {
+		if st.alarm != nil && st.alarm.ID == id {
+			found = st.alarm
+			break
+		}
+	}
+	if found == nil {
+		c.alarms.Unlock()
+		return Alarm{}, invalid(errors.New("no active alarm " + id))
+	}
+	if found.State == ALARM_ACKNOWLEDGED {
+		a := *found
+		c.alarms.Unlock()
+		return a, invalid(errors.New("alarm already acknowledged"))
+	}
+	now := time.Now()
+	found.State = ALARM_ACKNOWLEDGED
+	found.Acknowledged = &now
+	found.AckedBy = by
+	found.Comment = comment
+	found.Updated = now
+	a := *found
+	c.alarms.Unlock()
+	c.emitAlarm(a)
+	return a, nil
+}
+
+func AcknowledgeAlarm(id, by, comment string) (Alarm, error) {
+	return Default().AcknowledgeAlarm(id, by, comment)
+}
+
+/**
+ * 报警状态变化: 写入报警记录, 发布到报警主题及实时事件
+ */
+func (c *Collector) emitAlarm(a Alarm) {
+	level := "[WARN]"
+	if a.State == ALARM_CLEARED || a.Severity == SEVERITY_INFO {
+		level = "[INFO]"
+	}
+	fmt.Printf("%s 报警%s 传感器:%s %s %s %g 限值:%g\n", level, a.State, a.SensorID, a.Item, a.Kind, a.Value, a.Limit)
+	if h := c.History(); h != nil {
+		if err := h.AppendAlarm(a); err != nil {
+			fmt.Println("[WARN] 写入报警记录失败", err)
+		}
+	}
+	c.publishEvent(StreamEvent{Type: EVENT_ALARM, Time: a.Updated, SensorID: a.SensorID, Attach: c.sensorAttach(a.SensorID), Alarm: &a})
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	send, _ := json.Marshal(a)
+	c.publishStream(client, STREAM_ALARM, c.Topic(TOPIC_ALARM), send)
+}
+
+/**
+ * 报警记录, 按状态变化时间排序
+ * @param sensorID 为空时返回全部
+ * @param limit 为0时不限制
+ */
+func (c *Collector) AlarmHistory(sensorID string, from, to time.Time, limit int) ([]Alarm, error) {
+	h := c.History()
+	if h == nil {
+		return nil, errors.New("history unavailable")
+	}
+	from, to = recordRange(from, to)
+	ret := []Alarm{}
+	err := h.ScanAlarms(from, to, func(a Alarm) bool {
+		if sensorID == "" || a.SensorID == sensorID {
+			ret = append(ret, a)
+		}
+		return limit <= 0 || len(ret) < limit
+	})
+	return ret, err
+}
+
+func AlarmHistory(sensorID string, from, to time.Time, limit int) ([]Alarm, error) {
+	return Default().AlarmHistory(sensorID, from, to, limit)
+}
+
+// ========================store===========================
+
+/**
+ * 追加报警记录, 按日期存入历史数据目录下的alarms-{date}.log
+ */
+func (h *History) AppendAlarm(a Alarm) error {
+	return h.appendLine(h.dir, alarmFilePrefix, a.Updated, a)
+}
+
+/**
+ * 按时间顺序读取[from, to)内的报警记录, fn返回false时停止
+ */
+func (h *History) ScanAlarms(from, to time.Time, fn func(a Alarm) bool) error {
+	return h.scanRecords(h.dir, alarmFilePrefix, from, to, func(line []byte) (interface{}, time.Time, bool) {
+		var a Alarm
+		err := json.Unmarshal(line, &a)
+		return a, a.Updated, err == nil
+	}, func(v interface{}) bool {
+		return fn(v.(Alarm))
+	})
+}
+
+// ========================mqtt/http===========================
+
+/**
+ * 报警确认请求
+ * @Topic sensor/action/alarm/ack
+ */
+type AlarmAck struct {
+	AlarmID string `json:"alarmID"`
+	By      string `json:"by,omitempty"`      // 确认人
+	Comment string `json:"comment,omitempty"` // 备注
+
+	ActionEnvelope
+}
+
+/**
+ * 确认报警, 结果为确认后的报警
+ * @Topic sensor/action/alarm/ack
+ */
+func (c *Collector) AlarmAckHandler(client mqtt.Client, message mqtt.Message) {
+	var ack AlarmAck
+	err := json.Unmarshal(message.Payload(), &ack)
+	c.reply(message, ack.ActionEnvelope, "", func(ctx context.Context) (interface{}, error) {
+		if err != nil {
+			return nil, invalid(err)
+		}
+		if err := commitAction(ctx); err != nil {
+			return nil, err
+		}
+		return c.AcknowledgeAlarm(ack.AlarmID, ack.By, ack.Comment)
+	})
+}
+
+func AlarmAckHandler(client mqtt.Client, message mqtt.Message) {
+	Default().AlarmAckHandler(client, message)
+}
+
+func (c *Collector) apiAlarms(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	return c.ActiveAlarms(), nil
+}
+
+func (c *Collector) apiAlarmHistory(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	query := r.URL.Query()
+	from, to, limit, err := parseHistoryQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.AlarmHistory(query.Get("sensor"), from, to, limit)
+}
+
+func (c *Collector) apiAckAlarm(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	var ack AlarmAck
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &ack); err != nil {
+			return nil, err
+		}
+	}
+	return c.AcknowledgeAlarm(p["id"], ack.By, ack.Comment)
+}
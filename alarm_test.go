@@ -0,0 +1,150 @@
+package sensor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlarm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alarm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	low := 3.0
+	client := newFakeClient()
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{Alarms: []*AlarmRule{
+		{ID: "o2", SensorID: "s", Item: "Oxygen", Low: &low, Deadband: 0.5, OnDelay: 60, OffDelay: 60, Severity: SEVERITY_CRITICAL},
+	}}), WithMQTTClient(client))
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	read := func(sec int, v float64) {
+		c.evaluateAlarms(ReadResult{SensorID: "s", Created: base.Add(time.Duration(sec) * time.Second), Items: []MeasureItem{{Name: "Oxygen", Value: v}}})
+	}
+	events := func() []Alarm {
+		var ret []Alarm
+		for _, msg := range client.messages(c.Topic(TOPIC_ALARM)) {
+			var a Alarm
+			_ = json.Unmarshal(msg.payload, &a)
+			ret = append(ret, a)
+		}
+		return ret
+	}
+
+	// 报警延时内恢复不报警
+	read(0, 2.5)
+	read(30, 3.1)
+	read(50, 2.5)
+	read(100, 2.5)
+	if len(c.ActiveAlarms()) != 0 {
+		t.Fatalf("alarm raised before delay %+v", c.ActiveAlarms())
+	}
+	read(110, 2.4)
+	active := c.ActiveAlarms()
+	if len(active) != 1 || active[0].State != ALARM_ACTIVE || active[0].Kind != ALARM_LOW || active[0].Severity != SEVERITY_CRITICAL || active[0].Value != 2.4 || !active[0].Activated.Equal(base.Add(110*time.Second)) {
+		t.Fatalf("unexpected active alarms %+v", active)
+	}
+	id := active[0].ID
+	if ev := events(); len(ev) != 1 || ev[0].ID != id || ev[0].State != ALARM_ACTIVE {
+		t.Errorf("unexpected alarm events %+v", ev)
+	}
+
+	c.AlarmAckHandler(client, fakeMessage{topic: "sensor/action/alarm/ack", payload: []byte(`{"alarmID":"` + id + `","by":"op","comment":"aerator on","replyTo":"app/1"}`)})
+	if res := actionResult(t, client, "app/1"); res.Status != RESULT_OK {
+		t.Errorf("ack failed %+v", res)
+	}
+	if active = c.ActiveAlarms(); active[0].State != ALARM_ACKNOWLEDGED || active[0].AckedBy != "op" || active[0].Acknowledged == nil {
+		t.Errorf("unexpected acknowledged alarm %+v", active)
+	}
+	srv := httptest.NewServer(c.apiHandler())
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+API_PREFIX+"/alarms/"+id+"/ack", "application/json", strings.NewReader(`{"by":"op"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("double ack: %d", resp.StatusCode)
+	}
+	if _, err := c.AcknowledgeAlarm("none", "", ""); !IsValidationError(err) {
+		t.Errorf("unknown alarm acknowledged: %v", err)
+	}
+
+	// 回差内不恢复, 超出回差并持续恢复延时后恢复
+	read(200, 3.2)
+	read(300, 3.6)
+	read(330, 3.4)
+	read(340, 3.6)
+	if len(c.ActiveAlarms()) != 1 {
+		t.Fatalf("alarm cleared within deadband or delay")
+	}
+	read(400, 3.7)
+	if active = c.ActiveAlarms(); len(active) != 0 {
+		t.Fatalf("alarm not cleared %+v", active)
+	}
+	ev := events()
+	if len(ev) != 3 || ev[2].State != ALARM_CLEARED || ev[2].ID != id || ev[2].Cleared == nil || ev[2].AckedBy != "op" {
+		t.Errorf("unexpected alarm events %+v", ev)
+	}
+
+	// 删除规则时恢复
+	read(500, 1)
+	read(600, 1)
+	if len(c.ActiveAlarms()) != 1 {
+		t.Fatal("alarm not raised again")
+	}
+	c.SetConfig(&LocalDeviceDetail{})
+	if len(c.ActiveAlarms()) != 0 {
+		t.Error("alarm of removed rule still active")
+	}
+	if ev = events(); len(ev) != 5 || ev[4].State != ALARM_CLEARED || ev[4].Comment != "rule removed" {
+		t.Errorf("unexpected alarm events %+v", ev)
+	}
+
+	list, err := c.AlarmHistory("s", base, time.Now(), 0)
+	if err != nil || len(list) != 5 || list[0].State != ALARM_ACTIVE || list[3].State != ALARM_ACKNOWLEDGED || list[4].Comment != "rule removed" {
+		t.Errorf("unexpected alarm history %+v %v", list, err)
+	}
+	if list, _ = c.AlarmHistory("other", base, time.Now(), 0); len(list) != 0 {
+		t.Errorf("unexpected alarm history of other sensor %+v", list)
+	}
+	resp, err = http.Get(srv.URL + API_PREFIX + "/alarms/history?sensor=s&limit=2&from=" + base.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list = nil
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(list) != 2 {
+		t.Errorf("unexpected http alarm history %d %+v", resp.StatusCode, list)
+	}
+}
+
+func TestAlarmValidate(t *testing.T) {
+	low, high := 3.0, 10.0
+	for _, rules := range [][]*AlarmRule{
+		{{SensorID: "s", Item: "Oxygen", Low: &low}},
+		{{ID: "a", Item: "Oxygen", Low: &low}},
+		{{ID: "a", SensorID: "s", Item: "Oxygen"}},
+		{{ID: "a", SensorID: "s", Item: "Oxygen", Low: &high, High: &low}},
+		{{ID: "a", SensorID: "s", Item: "Oxygen", Low: &low, Deadband: -1}},
+		{{ID: "a", SensorID: "s", Item: "Oxygen", Low: &low, Severity: "fatal"}},
+		{{ID: "a", SensorID: "s", Item: "Oxygen", Low: &low}, {ID: "a", SensorID: "s", Item: "Temp", High: &high}},
+		{nil},
+	} {
+		dl := &LocalDeviceDetail{Alarms: rules}
+		if err := dl.validateAlarms(); err == nil {
+			t.Errorf("invalid rules %+v accepted", rules)
+		}
+	}
+	dl := &LocalDeviceDetail{Alarms: []*AlarmRule{{ID: "a", SensorID: "s", Item: "Oxygen", Low: &low, High: &high}}}
+	if err := dl.validateAlarms(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,753 @@
+package sensor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sensor/count"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//=====================API======================
+//
+//           HTTP管理接口, JSON资源
+//
+//=====================END======================
+
+const API_PREFIX = "/api/v1"
+
+// 请求体的最大长度
+const API_MAX_BODY = 1 << 20
+
+/**
+ * 错误应答
+ */
+type APIError struct {
+	Error string `json:"error"`
+}
+
+/**
+ * 指定状态码的错误
+ */
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+func withStatus(status int, err error) error {
+	return &httpError{status: status, err: err}
+}
+
+/**
+ * DTU会话
+ */
+type SessionInfo struct {
+	AttachIP   string   `json:"attachIP"`
+	RemoteAddr string   `json:"remoteAddr"`
+	Sensors    []string `json:"sensors"` // 附着的传感器
+}
+
+/**
+ * 传感器及其状态
+ */
+type SensorInfo struct {
+	SensorID        string     `json:"sensorID"`
+	Addr            byte       `json:"addr"`
+	Type            byte       `json:"type"`
+	Attach          string     `json:"attach"`
+	Interval        int64      `json:"interval"`
+	Status          string     `json:"status"`              // normal/detached/closed/backing-off
+	Connected       bool       `json:"connected"`           // DTU是否已连接
+	ErrorCount      int        `json:"errorCount"`          // 连续错误次数
+	RetryTime       *time.Time `json:"retryTime,omitempty"` // backing-off时的恢复时间
+	PendingCommands int        `json:"pendingCommands"`     // 未完成的写指令数
+
+	Reading *ReadResult `json:"reading,omitempty"` // 最近一次成功的测量结果
+}
+
+/**
+ * 寄存器读取结果
+ */
+type RegisterValues struct {
+	Register uint16   `json:"register"`
+	Values   []uint16 `json:"values"`
+}
+
+/**
+ * 写寄存器请求
+ */
+type RegisterWrite struct {
+	Value  uint16 `json:"value"`
+	TTL    int64  `json:"ttl,omitempty"`
+	Policy string `json:"policy,omitempty"`
+}
+
+type apiParams map[string]string
+
+/**
+ * 接口定义, 同时用于生成OpenAPI描述
+ */
+type apiRoute struct {
+	Method   string
+	Pattern  string // 相对API_PREFIX, 路径参数写作{name}
+	Summary  string
+	Query    []string    // 查询参数
+	Request  interface{} // 请求体类型, 为nil时没有请求体
+	Response interface{} // 应答体类型, 为nil时没有应答体
+	Status   int         // 成功时的状态码
+	handler  func(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error)
+}
+
+func (c *Collector) apiRoutes() []apiRoute {
+	return []apiRoute{
+		{Method: http.MethodGet, Pattern: "/sessions", Summary: "已连接的DTU", Response: []SessionInfo{}, Status: http.StatusOK, handler: c.apiSessions},
+		{Method: http.MethodGet, Pattern: "/sensors", Summary: "传感器列表", Response: []SensorInfo{}, Status: http.StatusOK, handler: c.apiSensors},
+		{Method: http.MethodPost, Pattern: "/sensors", Summary: "新增传感器, 需要If-Match或version", Query: []string{"version"}, Request: LocalSensorInformation{}, Response: SensorInfo{}, Status: http.StatusCreated, handler: c.apiAddSensor},
+		{Method: http.MethodGet, Pattern: "/sensors/{id}", Summary: "传感器详情", Response: SensorInfo{}, Status: http.StatusOK, handler: c.apiSensor},
+		{Method: http.MethodPatch, Pattern: "/sensors/{id}", Summary: "以merge-patch修改传感器, 需要If-Match或version", Query: []string{"version"}, Request: json.RawMessage{}, Response: SensorInfo{}, Status: http.StatusOK, handler: c.apiModifySensor},
+		{Method: http.MethodDelete, Pattern: "/sensors/{id}", Summary: "移除传感器, 需要If-Match或version", Query: []string{"version"}, Status: http.StatusNoContent, handler: c.apiRemoveSensor},
+		{Method: http.MethodPost, Pattern: "/sensors/{id}/open", Summary: "开启传感器", Response: SensorInfo{}, Status: http.StatusOK, handler: c.apiSwitch},
+		{Method: http.MethodPost, Pattern: "/sensors/{id}/close", Summary: "关闭传感器", Response: SensorInfo{}, Status: http.StatusOK, handler: c.apiSwitch},
+		{Method: http.MethodPost, Pattern: "/sensors/{id}/clear", Summary: "清除错误次数并开启", Response: SensorInfo{}, Status: http.StatusOK, handler: c.apiClear},
+		{Method: http.MethodPost, Pattern: "/sensors/{id}/measure", Summary: "立即测量", Response: ReadResult{}, Status: http.StatusOK, handler: c.apiMeasure},
+		{Method: http.MethodGet, Pattern: "/sensors/{id}/registers/{register}", Summary: "读取寄存器", Query: []string{"count"}, Response: RegisterValues{}, Status: http.StatusOK, handler: c.apiReadRegisters},
+		{Method: http.MethodPut, Pattern: "/sensors/{id}/registers/{register}", Summary: "写寄存器(写指令)", Request: RegisterWrite{}, Response: CommandResult{}, Status: http.StatusAccepted, handler: c.apiWriteRegister},
+		{Method: http.MethodGet, Pattern: "/sensors/{id}/history", Summary: "历史数据, from/to为RFC3339或Unix时间(秒), resolution为raw/1m/1h", Query: []string{"item", "from", "to", "resolution", "limit"}, Response: HistoryResult{}, Status: http.StatusOK, handler: c.apiHistory},
+		{Method: http.MethodGet, Pattern: "/sensors/{id}/commands", Summary: "未完成的写指令", Response: []SensorCommand{}, Status: http.StatusOK, handler: c.apiPendingCommands},
+		{Method: http.MethodPost, Pattern: "/sensors/{id}/commands", Summary: "提交写指令(校准/恢复出厂/修改地址)", Request: SensorCommand{}, Response: CommandResult{}, Status: http.StatusAccepted, handler: c.apiSubmitCommand},
+		{Method: http.MethodGet, Pattern: "/commands/{id}", Summary: "写指令结果", Response: CommandResult{}, Status: http.StatusOK, handler: c.apiCommand},
+		{Method: http.MethodGet, Pattern: "/alarms", Summary: "未恢复的报警", Response: []Alarm{}, Status: http.StatusOK, handler: c.apiAlarms},
+		{Method: http.MethodGet, Pattern: "/alarms/history", Summary: "报警记录, from/to为RFC3339或Unix时间(秒)", Query: []string{"sensor", "from", "to", "limit"}, Response: []Alarm{}, Status: http.StatusOK, handler: c.apiAlarmHistory},
+		{Method: http.MethodPost, Pattern: "/alarms/{id}/ack", Summary: "确认报警", Request: AlarmAck{}, Response: Alarm{}, Status: http.StatusOK, handler: c.apiAckAlarm},
+		{Method: http.MethodGet, Pattern: "/relays", Summary: "继电器状态", Response: []RelayStatus{}, Status: http.StatusOK, handler: c.apiRelays},
+		{Method: http.MethodGet, Pattern: "/relays/audit", Summary: "控制记录, from/to为RFC3339或Unix时间(秒)", Query: []string{"relay", "from", "to", "limit"}, Response: []ControlAudit{}, Status: http.StatusOK, handler: c.apiControlHistory},
+		{Method: http.MethodPost, Pattern: "/relays/{id}/override", Summary: "手动覆盖, state为auto时解除", Request: RelayOverride{}, Response: RelayStatus{}, Status: http.StatusOK, handler: c.apiOverrideRelay},
+		{Method: http.MethodGet, Pattern: "/config", Summary: "当前CONFIG(隐藏密钥), ETag为版本", Response: LocalDeviceDetail{}, Status: http.StatusOK, handler: c.apiConfig},
+		{Method: http.MethodPut, Pattern: "/config", Summary: "替换CONFIG, 需要If-Match或version", Query: []string{"version"}, Request: LocalDeviceDetail{}, Response: LocalDeviceDetail{}, Status: http.StatusOK, handler: c.apiReplaceConfig},
+		{Method: http.MethodPatch, Pattern: "/config", Summary: "以json-patch或merge-patch修改CONFIG, 需要If-Match或version", Query: []string{"version"}, Request: json.RawMessage{}, Response: LocalDeviceDetail{}, Status: http.StatusOK, handler: c.apiPatchConfig},
+		{Method: http.MethodGet, Pattern: "/events", Summary: "实时事件(Server-Sent Events), 事件名为reading/status/log", Query: []string{"sensor", "attach", "item", "type", "access_token"}, Response: StreamEvent{}, Status: http.StatusOK, handler: c.apiEvents},
+		{Method: http.MethodGet, Pattern: "/events/ws", Summary: "实时事件(WebSocket), 每条消息为一个事件", Query: []string{"sensor", "attach", "item", "type", "access_token"}, Response: StreamEvent{}, Status: http.StatusSwitchingProtocols, handler: c.apiEventsWS},
+		{Method: http.MethodGet, Pattern: "/logs", Summary: "最近的日志", Query: []string{"limit"}, Response: []LogEntry{}, Status: http.StatusOK, handler: c.apiLogs},
+		{Method: http.MethodPost, Pattern: "/restart", Summary: "重新加载CONFIG并重启TCP", Status: http.StatusAccepted, handler: c.apiRestart},
+		{Method: http.MethodGet, Pattern: "/openapi.json", Summary: "OpenAPI描述", Response: map[string]interface{}{}, Status: http.StatusOK, handler: c.apiOpenAPI},
+	}
+}
+
+/**
+ * 管理接口, 挂载于API_PREFIX
+ */
+func (c *Collector) apiHandler() http.Handler {
+	routes := c.apiRoutes()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, API_PREFIX)
+		var allow []string
+		for _, route := range routes {
+			params, ok := matchPattern(route.Pattern, path)
+			if !ok {
+				continue
+			}
+			if route.Method != r.Method {
+				allow = append(allow, route.Method)
+				continue
+			}
+			if route.Pattern != "/openapi.json" && !c.apiAuthorized(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, APIError{Error: "unauthorized"})
+				return
+			}
+			if route.Method != http.MethodGet {
+				if err := checkMutation(r); err != nil {
+					writeAPIError(w, err)
+					return
+				}
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, API_MAX_BODY)
+			res, err := route.handler(w, r, params)
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			if _, ok := res.(apiResponded); ok {
+				return
+			}
+			if res == nil {
+				w.WriteHeader(route.Status)
+				return
+			}
+			writeJSON(w, route.Status, res)
+			return
+		}
+		if len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			writeJSON(w, http.StatusMethodNotAllowed, APIError{Error: "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusNotFound, APIError{Error: "not found"})
+	})
+}
+
+/**
+ * 配置http_token后需要 Authorization: Bearer {token}
+ * 无法设置请求头时(EventSource/WebSocket)可使用access_token参数
+ */
+func (c *Collector) apiAuthorized(r *http.Request) bool {
+	token := c.Config().HTTPToken
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		auth = "Bearer " + r.URL.Query().Get("access_token")
+		if auth == "Bearer " {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+/**
+ * 监听非本机地址时必须配置http_token
+ */
+func checkHTTPExposure(address, token string) error {
+	if address == "" || token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid http_address: %w", err)
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("http_token is required when http_address %s is not loopback", address)
+}
+
+/**
+ * 请求来自其他站点的页面(Origin与Host不一致)时拒绝, 没有Origin的请求(非浏览器)不检查
+ */
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+/**
+ * 修改类请求防止跨站伪造(CSRF): 检查Origin, 请求体必须为JSON
+ * 跨站的表单只能以text/plain等类型提交, 无法伪造JSON请求
+ */
+func checkMutation(r *http.Request) error {
+	if !sameOrigin(r) {
+		return withStatus(http.StatusForbidden, errors.New("cross-origin request rejected"))
+	}
+	if r.ContentLength == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return withStatus(http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+	}
+	return nil
+}
+
+func matchPattern(pattern, path string) (apiParams, bool) {
+	ps := strings.Split(strings.Trim(pattern, "/"), "/")
+	vs := strings.Split(strings.Trim(path, "/"), "/")
+	if len(ps) != len(vs) {
+		return nil, false
+	}
+	params := make(apiParams)
+	for i, p := range ps {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if vs[i] == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = vs[i]
+		} else if p != vs[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+/**
+ * 错误 -> 状态码
+ */
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var he *httpError
+	switch {
+	case errors.As(err, &he):
+		status = he.status
+	case errors.Is(err, ErrVersionConflict):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrSensorUnavailable):
+		status = http.StatusConflict
+	case IsValidationError(err):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrDTUNotConnected), errors.Is(err, ErrTaskQueueFull), errors.Is(err, ErrSessionClosed):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrBusTimeout):
+		status = http.StatusGatewayTimeout
+	}
+	writeJSON(w, status, APIError{Error: err.Error()})
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return invalid(fmt.Errorf("invalid body: %w", err))
+	}
+	return nil
+}
+
+// ========================resources===========================
+
+func (c *Collector) apiSessions(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ret := []SessionInfo{}
+	dl := c.Config()
+	c.sessions.Range(func(key, value interface{}) bool {
+		si := SessionInfo{AttachIP: key.(string), RemoteAddr: value.(*DeviceSession).conn.RemoteAddr().String(), Sensors: []string{}}
+		for _, v := range dl.GetLocalSensorList(si.AttachIP) {
+			si.Sensors = append(si.Sensors, v.SensorID)
+		}
+		ret = append(ret, si)
+		return true
+	})
+	return ret, nil
+}
+
+func (c *Collector) sensorInfo(ls *LocalSensorInformation) SensorInfo {
+	si := SensorInfo{
+		SensorID:        ls.SensorID,
+		Addr:            ls.Addr,
+		Type:            ls.Type,
+		Attach:          ls.Attach,
+		Interval:        ls.Interval,
+		Status:          c.sensorState(ls),
+		ErrorCount:      c.tracker.GetErrorCount(ls.SensorID),
+		PendingCommands: len(c.PendingCommands(ls.SensorID)),
+	}
+	_, err := c.GetDeviceSession(ls.Attach)
+	si.Connected = err == nil
+	if p, ok := c.LatestReading(ls.SensorID); ok {
+		si.Reading = &p
+	}
+	if si.Status == SENSOR_BACKING_OFF {
+		t := c.tracker.GetRetryTime(ls.SensorID)
+		si.RetryTime = &t
+	}
+	return si
+}
+
+func (c *Collector) apiSensors(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ret := []SensorInfo{}
+	for _, v := range c.Config().LocalSensorInformation {
+		ret = append(ret, c.sensorInfo(v))
+	}
+	return ret, nil
+}
+
+/**
+ * 路径中的传感器, 不存在时404
+ */
+func (c *Collector) apiLocalSensor(p apiParams) (*LocalSensorInformation, error) {
+	ls, err := c.GetLocalSensor(p["id"])
+	if err != nil {
+		return nil, withStatus(http.StatusNotFound, err)
+	}
+	return ls, nil
+}
+
+func (c *Collector) apiSensor(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	return c.sensorInfo(ls), nil
+}
+
+/**
+ * 传感器配置修改后的应答, ETag为新版本
+ */
+func (c *Collector) apiSensorChanged(w http.ResponseWriter, sensorID string, dl *LocalDeviceDetail, err error) (interface{}, error) {
+	c.reportConfigChange(&SensorAction{SensorID: sensorID}, dl, err)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(dl.Version, 10)))
+	ls, err := c.GetLocalSensor(sensorID)
+	if err != nil {
+		return nil, nil
+	}
+	return c.sensorInfo(ls), nil
+}
+
+func (c *Collector) apiAddSensor(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	version, err := configPrecondition(r)
+	if err != nil {
+		return nil, err
+	}
+	var ls LocalSensorInformation
+	if err := decodeBody(r, &ls); err != nil {
+		return nil, err
+	}
+	if _, err := c.GetLocalSensor(ls.SensorID); err == nil {
+		return nil, withStatus(http.StatusConflict, fmt.Errorf("sensor %s already exists", ls.SensorID))
+	}
+	dl, err := c.AddSensorConfig(r.Context(), version, ls)
+	if err == nil {
+		w.Header().Set("Location", API_PREFIX+"/sensors/"+ls.SensorID)
+	}
+	return c.apiSensorChanged(w, ls.SensorID, dl, err)
+}
+
+func (c *Collector) apiModifySensor(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	version, err := configPrecondition(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	var patch struct {
+		SensorID *string `json:"sensorID"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, invalid(fmt.Errorf("invalid body: %w", err))
+	}
+	if patch.SensorID != nil && *patch.SensorID != ls.SensorID {
+		return nil, invalid(errors.New("sensorID cannot be changed"))
+	}
+	dl, err := c.ModifySensorConfig(r.Context(), version, ls.SensorID, data)
+	return c.apiSensorChanged(w, ls.SensorID, dl, err)
+}
+
+func (c *Collector) apiRemoveSensor(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	version, err := configPrecondition(r)
+	if err != nil {
+		return nil, err
+	}
+	dl, err := c.RemoveSensorConfig(r.Context(), version, ls.SensorID)
+	return c.apiSensorChanged(w, ls.SensorID, dl, err)
+}
+
+func (c *Collector) apiSwitch(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	operation := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if err := c.SwitchSensor(ls.SensorID, operation); err != nil {
+		return nil, err
+	}
+	return c.sensorInfo(ls), nil
+}
+
+func (c *Collector) apiClear(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ClearException(ls.SensorID, count.CLEAR_ONE_EXCEPTION); err != nil {
+		return nil, err
+	}
+	return c.sensorInfo(ls), nil
+}
+
+func (c *Collector) apiMeasure(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := c.Measure(ls.SensorID)
+	if err != nil {
+		return nil, busError(err)
+	}
+	return rs, nil
+}
+
+/**
+ * 传感器无应答或应答错误时为502
+ */
+func busError(err error) error {
+	for _, e := range []error{ErrSensorUnavailable, ErrDTUNotConnected, ErrTaskQueueFull, ErrSessionClosed, ErrBusTimeout} {
+		if errors.Is(err, e) {
+			return err
+		}
+	}
+	if IsValidationError(err) {
+		return err
+	}
+	return withStatus(http.StatusBadGateway, err)
+}
+
+/**
+ * 寄存器地址, 支持0x前缀
+ */
+func registerParam(p apiParams) (uint16, error) {
+	v, err := strconv.ParseUint(p["register"], 0, 16)
+	if err != nil {
+		return 0, invalid(fmt.Errorf("invalid register %s", p["register"]))
+	}
+	return uint16(v), nil
+}
+
+func (c *Collector) apiReadRegisters(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := registerParam(p)
+	if err != nil {
+		return nil, err
+	}
+	count := uint64(1)
+	if v := r.URL.Query().Get("count"); v != "" {
+		if count, err = strconv.ParseUint(v, 10, 16); err != nil {
+			return nil, invalid(fmt.Errorf("invalid count %s", v))
+		}
+	}
+	values, err := c.ReadRegisters(ls.SensorID, reg, uint16(count))
+	if err != nil {
+		return nil, busError(err)
+	}
+	return RegisterValues{Register: reg, Values: values}, nil
+}
+
+func (c *Collector) apiWriteRegister(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := registerParam(p)
+	if err != nil {
+		return nil, err
+	}
+	var rw RegisterWrite
+	if err := decodeBody(r, &rw); err != nil {
+		return nil, err
+	}
+	return c.apiCommandAccepted(w, SensorCommand{SensorID: ls.SensorID, Name: COMMAND_WRITE, Register: reg, Value: rw.Value, TTL: rw.TTL, Policy: rw.Policy})
+}
+
+func (c *Collector) apiPendingCommands(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	ret := c.PendingCommands(ls.SensorID)
+	if ret == nil {
+		ret = []SensorCommand{}
+	}
+	return ret, nil
+}
+
+func (c *Collector) apiSubmitCommand(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	ls, err := c.apiLocalSensor(p)
+	if err != nil {
+		return nil, err
+	}
+	var cmd SensorCommand
+	if err := decodeBody(r, &cmd); err != nil {
+		return nil, err
+	}
+	cmd.SensorID = ls.SensorID
+	// 通过HTTP提交的指令不应答MQTT
+	cmd.ActionEnvelope = ActionEnvelope{}
+	return c.apiCommandAccepted(w, cmd)
+}
+
+/**
+ * 提交写指令, Location为指令结果
+ */
+func (c *Collector) apiCommandAccepted(w http.ResponseWriter, cmd SensorCommand) (interface{}, error) {
+	res, err := c.SubmitCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("Location", API_PREFIX+"/commands/"+res.ID)
+	return res, nil
+}
+
+func (c *Collector) apiCommand(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	if res, ok := c.CommandResult(p["id"]); ok {
+		return res, nil
+	}
+	c.commands.Lock()
+	defer c.commands.Unlock()
+	for _, list := range c.commands.pending {
+		for _, v := range list {
+			if v.ID == p["id"] {
+				return v.result(COMMAND_PENDING, nil), nil
+			}
+		}
+	}
+	return nil, withStatus(http.StatusNotFound, errors.New("command not found"))
+}
+
+func (c *Collector) apiConfig(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	dl := c.Config()
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(dl.Version, 10)))
+	return dl.Redacted(), nil
+}
+
+/**
+ * 修改CONFIG的版本前置条件, If-Match优先
+ */
+func configPrecondition(r *http.Request) (int64, error) {
+	v := strings.TrimPrefix(r.Header.Get("If-Match"), "W/")
+	if v == "" {
+		v = r.URL.Query().Get("version")
+	}
+	if v == "" {
+		return 0, withStatus(http.StatusPreconditionRequired, ErrVersionRequired)
+	}
+	if unquoted, err := strconv.Unquote(v); err == nil {
+		v = unquoted
+	}
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, invalid(fmt.Errorf("invalid version %s", v))
+	}
+	return version, nil
+}
+
+func (c *Collector) apiConfigChanged(w http.ResponseWriter, dl *LocalDeviceDetail, err error) (interface{}, error) {
+	c.reportConfigChange(&SensorAction{}, dl, err)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(dl.Version, 10)))
+	return dl.Redacted(), nil
+}
+
+func (c *Collector) apiReplaceConfig(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	version, err := configPrecondition(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	dl, err := c.ApplyConfigChange(r.Context(), version, func(doc []byte) ([]byte, error) {
+		return data, nil
+	})
+	return c.apiConfigChanged(w, dl, err)
+}
+
+/**
+ * Content-Type为application/json-patch+json时按RFC 6902, 否则按RFC 7386
+ */
+func (c *Collector) apiPatchConfig(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	version, err := configPrecondition(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	operation := PATCH_MERGE
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json-patch+json") {
+		operation = PATCH_JSON
+	}
+	dl, err := c.PatchConfig(r.Context(), version, operation, data)
+	return c.apiConfigChanged(w, dl, err)
+}
+
+func (c *Collector) apiLogs(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return nil, invalid(fmt.Errorf("invalid limit %s", v))
+		}
+	}
+	return c.RecentLogs(limit), nil
+}
+
+func (c *Collector) apiHistory(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	query := r.URL.Query()
+	q := HistoryQuery{SensorID: p["id"], Resolution: query.Get("resolution")}
+	for _, v := range query["item"] {
+		q.Items = append(q.Items, strings.Split(v, ",")...)
+	}
+	var err error
+	if q.From, err = parseAPITime(query.Get("from")); err != nil {
+		return nil, err
+	}
+	if q.To, err = parseAPITime(query.Get("to")); err != nil {
+		return nil, err
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, invalid(fmt.Errorf("invalid limit %s", v))
+		}
+	}
+	return c.QueryHistory(q)
+}
+
+/**
+ * RFC3339或Unix时间(秒), 为空时返回零值
+ */
+func parseAPITime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, invalid(fmt.Errorf("invalid time %s", v))
+	}
+	return t, nil
+}
+
+func (c *Collector) apiRestart(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	fmt.Println("[INFO] 正在重启TCP")
+	// CONFIG无法加载时不重启, 继续使用当前CONFIG
+	if _, err := c.ReloadConfig(); err != nil {
+		return nil, err
+	}
+	c.RestartTCPSystem()
+	return nil, nil
+}
+
+func (c *Collector) apiOpenAPI(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	return c.OpenAPI(), nil
+}
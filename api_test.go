@@ -0,0 +1,238 @@
+package sensor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * 模拟DTU: 回应状态扫描, 测量及读寄存器, 原样返回写指令
+ */
+func fakeDTU(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 20)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x01})
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			frame := buf[:n]
+			switch {
+			case bytes.Equal(frame[1:6], []byte{0x03, 0x00, 0x00, 0x00, 0x04}):
+				// Oxygen 5.27, Temp 25
+				_, _ = conn.Write(ComposeBody([]byte{1}, []byte{0x03}, []byte{0x08, 0x02, 0x0F, 0x00, 0x02, 0x00, 0xFA, 0x00, 0x01}))
+			case frame[1] == 0x03:
+				_, _ = conn.Write(ComposeBody([]byte{1}, []byte{0x03}, []byte{0x02, 0x00, 0x2A}))
+			default:
+				_, _ = conn.Write(frame)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{Name: "c1", HTTPAddress: "127.0.0.1:0", BrokerPassword: "p", LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 3600, SensorID: "s"},
+	}}), WithListenAddress("127.0.0.1:0"), WithMQTTClient(newFakeClient()))
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(context.Background())
+	conn := fakeDTU(t, c.Addr().String())
+	defer conn.Close()
+
+	base := "http://" + c.HTTPAddr().String() + API_PREFIX
+	call := func(method, path, body string, header map[string]string, out interface{}) *http.Response {
+		req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			_ = json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp
+	}
+
+	var sensors []SensorInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		call(http.MethodGet, "/sensors", "", nil, &sensors)
+		if len(sensors) == 1 && sensors[0].Connected && sensors[0].Status == SENSOR_NORMAL {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(sensors) != 1 || !sensors[0].Connected || sensors[0].Status != SENSOR_NORMAL {
+		t.Fatalf("unexpected sensors %+v", sensors)
+	}
+	var sessions []SessionInfo
+	if call(http.MethodGet, "/sessions", "", nil, &sessions); len(sessions) != 1 || sessions[0].Sensors[0] != "s" {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+	if resp := call(http.MethodGet, "/sensors/x", "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown sensor: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodDelete, "/sensors", "", nil, nil); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("unexpected method: %d", resp.StatusCode)
+	}
+
+	var rs ReadResult
+	if resp := call(http.MethodPost, "/sensors/s/measure", "", nil, &rs); resp.StatusCode != http.StatusOK || len(rs.Items) != 2 || rs.Items[0].Value != 5.27 || rs.Items[1].Value != 25 {
+		t.Errorf("unexpected measure %d %+v", resp.StatusCode, rs)
+	}
+	var si SensorInfo
+	if call(http.MethodGet, "/sensors/s", "", nil, &si); si.Reading == nil || len(si.Reading.Items) != 2 {
+		t.Errorf("latest reading missing %+v", si)
+	}
+	var rv RegisterValues
+	if resp := call(http.MethodGet, "/sensors/s/registers/0x1006?count=1", "", nil, &rv); resp.StatusCode != http.StatusOK || rv.Register != 0x1006 || len(rv.Values) != 1 || rv.Values[0] != 42 {
+		t.Errorf("unexpected registers %d %+v", resp.StatusCode, rv)
+	}
+	if resp := call(http.MethodGet, "/sensors/s/registers/0x1006?count=9", "", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("too many registers: %d", resp.StatusCode)
+	}
+	var cr CommandResult
+	resp := call(http.MethodPut, "/sensors/s/registers/0x1000", `{"value":7}`, nil, &cr)
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != API_PREFIX+"/commands/"+cr.ID {
+		t.Errorf("unexpected write %d %+v", resp.StatusCode, cr)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && cr.Status != COMMAND_ACKED {
+		call(http.MethodGet, "/commands/"+cr.ID, "", nil, &cr)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if cr.Status != COMMAND_ACKED {
+		t.Errorf("write not acknowledged %+v", cr)
+	}
+
+	if call(http.MethodPost, "/sensors/s/close", "", nil, &si); si.Status != SENSOR_CLOSED {
+		t.Errorf("sensor not closed %+v", si)
+	}
+	if resp := call(http.MethodPost, "/sensors/s/measure", "", nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("measure on closed sensor: %d", resp.StatusCode)
+	}
+
+	var dl LocalDeviceDetail
+	if resp := call(http.MethodGet, "/config", "", nil, &dl); resp.Header.Get("ETag") != `"0"` || dl.BrokerPassword != SECRET_REDACTED {
+		t.Errorf("unexpected config %s %+v", resp.Header.Get("ETag"), dl)
+	}
+	if resp := call(http.MethodPatch, "/config", `{"name":"c2"}`, nil, nil); resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("config change without version: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/config", `{"name":"c2"}`, map[string]string{"If-Match": `"5"`}, nil); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("config change with stale version: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/config", `{"name":"c2"}`, map[string]string{"If-Match": `"0"`}, &dl); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"1"` || dl.Name != "c2" {
+		t.Errorf("config not patched %d %+v", resp.StatusCode, dl)
+	}
+	if c.Config().BrokerPassword != "p" {
+		t.Error("redacted secret written back")
+	}
+
+	sensor := `{"sensorID":"s2","addr":2,"attach":"127.0.0.1","interval":3600}`
+	if resp := call(http.MethodPost, "/sensors", sensor, nil, nil); resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("sensor added without version: %d", resp.StatusCode)
+	}
+	resp = call(http.MethodPost, "/sensors", sensor, map[string]string{"If-Match": `"1"`}, &si)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != API_PREFIX+"/sensors/s2" || resp.Header.Get("ETag") != `"2"` || si.SensorID != "s2" {
+		t.Errorf("sensor not added %d %+v", resp.StatusCode, si)
+	}
+	if resp := call(http.MethodPost, "/sensors", sensor, map[string]string{"If-Match": `"2"`}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate sensor: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/sensors/s2", `{"interval":0}`, map[string]string{"If-Match": `"2"`}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid sensor change: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/sensors/s2", `{"sensorID":"s3"}`, map[string]string{"If-Match": `"2"`}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("sensorID changed: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/sensors/s2", `{"interval":60}`, map[string]string{"If-Match": `"2"`}, &si); resp.StatusCode != http.StatusOK || si.Interval != 60 {
+		t.Errorf("sensor not modified %d %+v", resp.StatusCode, si)
+	}
+	if resp := call(http.MethodDelete, "/sensors/s2", "", map[string]string{"If-Match": `"3"`}, nil); resp.StatusCode != http.StatusNoContent || resp.Header.Get("ETag") != `"4"` {
+		t.Errorf("sensor not removed %d", resp.StatusCode)
+	}
+	if _, err := c.GetLocalSensor("s2"); err == nil {
+		t.Error("removed sensor still configured")
+	}
+	var logs []LogEntry
+	if call(http.MethodGet, "/logs?limit=1", "", nil, &logs); len(logs) != 1 || logs[0].Message != "CONFIG已更新 版本:4" || logs[0].SensorID != "s2" {
+		t.Errorf("unexpected logs %+v", logs)
+	}
+
+	// 跨站请求: 其他站点的页面、非JSON请求体
+	if resp := call(http.MethodPost, "/sensors/s/close", "", map[string]string{"Origin": "http://evil.example"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin request: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/config", `{"name":"c3"}`, map[string]string{"If-Match": `"4"`, "Content-Type": "text/plain"}, nil); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain request: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPatch, "/config", `{"http_address":"0.0.0.0:6666"}`, map[string]string{"If-Match": `"4"`}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("public http_address without token: %d", resp.StatusCode)
+	}
+
+	call(http.MethodPatch, "/config", `{"http_token":"t0ken"}`, map[string]string{"If-Match": `"4"`}, nil)
+	if resp := call(http.MethodGet, "/sensors", "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without token: %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodGet, "/sensors", "", map[string]string{"Authorization": "Bearer t0ken"}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("request with token: %d", resp.StatusCode)
+	}
+	var doc struct {
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	call(http.MethodGet, "/openapi.json", "", nil, &doc)
+	if doc.Paths["/sensors/{id}/measure"]["post"] == nil || doc.Components.Schemas["SensorInfo"] == nil || doc.Components.Schemas["LocalSensorInformation"] == nil {
+		t.Errorf("incomplete openapi description %+v", doc.Paths)
+	}
+}
+
+func TestHTTPExposure(t *testing.T) {
+	cases := map[string]bool{"127.0.0.1:6666": true, "localhost:6666": true, "[::1]:6666": true, "0.0.0.0:6666": false, ":6666": false, "192.168.1.2:6666": false}
+	for address, ok := range cases {
+		if err := checkHTTPExposure(address, ""); (err == nil) != ok {
+			t.Errorf("%s: %v", address, err)
+		}
+		if err := checkHTTPExposure(address, "t0ken"); err != nil {
+			t.Errorf("%s with token: %v", address, err)
+		}
+	}
+	c := NewCollector(WithConfig(&LocalDeviceDetail{}))
+	if err := c.StartHTTP(":0"); err == nil {
+		t.Error("started on all interfaces without http_token")
+	}
+}
@@ -0,0 +1,264 @@
+package sensor
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=====================AUTH=====================
+//
+//          指令签名验证, 防止伪造及重放
+//
+//=====================END======================
+
+// 签名算法
+const (
+	AUTH_HMAC_SHA256 = "hmac-sha256"
+	AUTH_ED25519     = "ed25519"
+)
+
+const (
+	AUTH_MAX_SKEW int64 = 300 // 缺省允许的时间偏差(秒)
+	AUTH_ANY            = "*" // allow中匹配其他指令
+)
+
+var (
+	ErrUnsigned     = errors.New("command is not signed")
+	ErrUnknownKey   = errors.New("unknown key")
+	ErrNotAllowed   = errors.New("key is not allowed to issue this command")
+	ErrStale        = errors.New("timestamp out of range")
+	ErrReplayed     = errors.New("nonce already used")
+	ErrBadSignature = errors.New("signature mismatch")
+)
+
+/**
+ * 配置后 action/... 及 setting/... 指令必须签名
+ */
+type CommandAuthOptions struct {
+	Keys    map[string]*CommandKey `json:"keys" yaml:"keys" toml:"keys"`                                           // keyID -> 密钥
+	Allow   map[string][]string    `json:"allow" yaml:"allow" toml:"allow"`                                        // 指令(相对主题, 如action/restart) -> 允许的keyID, *为其他指令
+	MaxSkew int64                  `json:"max_skew,omitempty" yaml:"max_skew,omitempty" toml:"max_skew,omitempty"` // 允许的时间偏差(秒), 缺省300
+}
+
+type CommandKey struct {
+	Algorithm string `json:"algorithm" yaml:"algorithm" toml:"algorithm"`                                  // hmac-sha256 / ed25519
+	Secret    string `json:"secret,omitempty" yaml:"secret,omitempty" toml:"secret,omitempty"`             // HMAC密钥, 可使用密钥引用
+	PublicKey string `json:"public_key,omitempty" yaml:"public_key,omitempty" toml:"public_key,omitempty"` // Ed25519公钥(base64)
+}
+
+/**
+ * 签名的指令, payload为原指令内容
+ * 签名内容为 主题\n时间戳\nnonce\npayload
+ */
+type SignedCommand struct {
+	Key       string `json:"key"`
+	Timestamp int64  `json:"timestamp"` // Unix秒
+	Nonce     string `json:"nonce"`
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+func signingInput(topic string, timestamp int64, nonce string, payload []byte) []byte {
+	msg := topic + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + nonce + "\n"
+	return append([]byte(msg), payload...)
+}
+
+/**
+ * 生成签名的指令
+ * @param sign HMACSigner 或 Ed25519Signer
+ */
+func SignCommand(topic, keyID, nonce string, payload []byte, sign func(msg []byte) []byte) ([]byte, error) {
+	sc := SignedCommand{Key: keyID, Timestamp: time.Now().Unix(), Nonce: nonce, Payload: payload}
+	sc.Signature = sign(signingInput(topic, sc.Timestamp, nonce, payload))
+	return json.Marshal(sc)
+}
+
+func HMACSigner(secret string) func(msg []byte) []byte {
+	return func(msg []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(msg)
+		return mac.Sum(nil)
+	}
+}
+
+func Ed25519Signer(key ed25519.PrivateKey) func(msg []byte) []byte {
+	return func(msg []byte) []byte {
+		return ed25519.Sign(key, msg)
+	}
+}
+
+func (k *CommandKey) verify(msg, sig []byte) bool {
+	switch k.Algorithm {
+	case AUTH_HMAC_SHA256:
+		return hmac.Equal(HMACSigner(k.Secret)(msg), sig)
+	case AUTH_ED25519:
+		pub, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		return err == nil && len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, msg, sig)
+	}
+	return false
+}
+
+func (ca *CommandAuthOptions) maxSkew() int64 {
+	if ca.MaxSkew == 0 {
+		return AUTH_MAX_SKEW
+	}
+	return ca.MaxSkew
+}
+
+func (ca *CommandAuthOptions) allowed(command, keyID string) bool {
+	keys, ok := ca.Allow[command]
+	if !ok {
+		keys = ca.Allow[AUTH_ANY]
+	}
+	for _, v := range keys {
+		if v == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+func (ca *CommandAuthOptions) validate() error {
+	if ca.MaxSkew < 0 {
+		return errors.New("invalid command_auth max_skew")
+	}
+	for id, k := range ca.Keys {
+		if k == nil {
+			return fmt.Errorf("empty command_auth key %s", id)
+		}
+		switch k.Algorithm {
+		case AUTH_HMAC_SHA256:
+			if k.Secret == "" {
+				return fmt.Errorf("command_auth key %s requires secret", id)
+			}
+		case AUTH_ED25519:
+			if pub, err := base64.StdEncoding.DecodeString(k.PublicKey); err != nil || len(pub) != ed25519.PublicKeySize {
+				return fmt.Errorf("command_auth key %s requires a base64 ed25519 public_key", id)
+			}
+		default:
+			return fmt.Errorf("command_auth key %s: unknown algorithm %s", id, k.Algorithm)
+		}
+	}
+	for command, keys := range ca.Allow {
+		for _, v := range keys {
+			if _, ok := ca.Keys[v]; !ok {
+				return fmt.Errorf("command_auth allow %s: unknown key %s", command, v)
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * 已使用的nonce, 超出时间偏差后移除
+ */
+type nonceCache struct {
+	seen map[string]time.Time // keyID/nonce -> 过期时间
+	sync.Mutex
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+/**
+ * 记录nonce, 已使用过时返回false
+ */
+func (nc *nonceCache) use(key string, expire time.Time) bool {
+	nc.Lock()
+	defer nc.Unlock()
+	now := time.Now()
+	for k, v := range nc.seen {
+		if now.After(v) {
+			delete(nc.seen, k)
+		}
+	}
+	if _, ok := nc.seen[key]; ok {
+		return false
+	}
+	nc.seen[key] = expire
+	return true
+}
+
+/**
+ * 相对主题对应的指令名, 不是指令时返回false
+ */
+func commandName(topic string) (string, bool) {
+	name := strings.TrimPrefix(topic, TOPIC_LEGACY_ROOT+"/")
+	return name, strings.HasPrefix(name, "action/") || strings.HasPrefix(name, "setting/")
+}
+
+/**
+ * 验证签名的指令, 返回原指令内容
+ * 未配置command_auth时原样返回
+ */
+func (c *Collector) verifyCommand(command string, message mqtt.Message) ([]byte, string, error) {
+	auth := c.Config().CommandAuth
+	if auth == nil {
+		return message.Payload(), "", nil
+	}
+	var sc SignedCommand
+	if err := json.Unmarshal(message.Payload(), &sc); err != nil || sc.Key == "" || len(sc.Signature) == 0 {
+		return nil, "", ErrUnsigned
+	}
+	k, ok := auth.Keys[sc.Key]
+	if !ok {
+		return nil, sc.Key, ErrUnknownKey
+	}
+	if !auth.allowed(command, sc.Key) {
+		return nil, sc.Key, ErrNotAllowed
+	}
+	skew := auth.maxSkew()
+	if d := time.Now().Unix() - sc.Timestamp; d > skew || d < -skew {
+		return nil, sc.Key, ErrStale
+	}
+	if !k.verify(signingInput(message.Topic(), sc.Timestamp, sc.Nonce, sc.Payload), sc.Signature) {
+		return nil, sc.Key, ErrBadSignature
+	}
+	// 签名验证后再记录nonce, 避免伪造的请求占用nonce
+	if sc.Nonce == "" || !c.nonces.use(sc.Key+"/"+sc.Nonce, time.Unix(sc.Timestamp+skew, 0)) {
+		return nil, sc.Key, ErrReplayed
+	}
+	return sc.Payload, sc.Key, nil
+}
+
+/**
+ * 以原指令内容替换载荷
+ */
+type verifiedMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m verifiedMessage) Payload() []byte {
+	return m.payload
+}
+
+/**
+ * 指令的回调在执行前验证签名, 被拒绝的指令上报日志
+ * @param topic 相对主题
+ */
+func (c *Collector) authorize(topic string, callback mqtt.MessageHandler) mqtt.MessageHandler {
+	command, ok := commandName(topic)
+	if !ok {
+		return callback
+	}
+	return func(client mqtt.Client, message mqtt.Message) {
+		payload, keyID, err := c.verifyCommand(command, message)
+		if err != nil {
+			c.PushMQLog(MQ_LOG_FAIL, fmt.Sprintf("指令被拒绝 主题:%s key:%s %s", message.Topic(), keyID, err))
+			return
+		}
+		callback(client, verifiedMessage{Message: message, payload: payload})
+	}
+}
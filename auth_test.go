@@ -0,0 +1,122 @@
+package sensor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestCommandAuth(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", TopicPrefix: "farm/{collector}",
+		CommandAuth: &CommandAuthOptions{
+			Keys: map[string]*CommandKey{
+				"ops":   {Algorithm: AUTH_HMAC_SHA256, Secret: "s3cret"},
+				"admin": {Algorithm: AUTH_ED25519, PublicKey: base64.StdEncoding.EncodeToString(pub)},
+			},
+			Allow: map[string][]string{"action/restart": {"admin"}, AUTH_ANY: {"ops", "admin"}},
+		},
+		LocalSensorInformation: []*LocalSensorInformation{
+			{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s1"},
+		}}), WithMQTTClient(client))
+	if err := c.Config().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarts := 0
+	c.MQTTMapping("action/switch", c.SwitchSensorHandler)
+	c.MQTTMapping("action/restart", func(client mqtt.Client, message mqtt.Message) {
+		restarts++
+	})
+	deliver := func(topic string, payload []byte) {
+		client.Lock()
+		handler := client.handlers[topic]
+		client.Unlock()
+		handler(client, fakeMessage{topic: topic, payload: payload})
+		c.waitHandlers(context.Background())
+	}
+	rejected := func() int {
+		n := 0
+		for _, v := range client.messages("farm/c1/log") {
+			if strings.Contains(string(v.payload), "指令被拒绝") {
+				n++
+			}
+		}
+		return n
+	}
+	ls, _ := c.GetLocalSensor("s1")
+
+	closeCmd := []byte(`{"sensorID":"s1","operation":"close","replyTo":"app/1"}`)
+	deliver("farm/c1/action/switch", closeCmd)
+	if ls.IsClosed() || rejected() != 1 {
+		t.Fatal("unsigned command not rejected")
+	}
+
+	signed, _ := SignCommand("farm/c1/action/switch", "ops", "n1", closeCmd, HMACSigner("s3cret"))
+	deliver("farm/c1/action/switch", signed)
+	if !ls.IsClosed() || actionResult(t, client, "app/1").Status != RESULT_OK {
+		t.Fatal("signed command not executed")
+	}
+	ls.Open()
+	deliver("farm/c1/action/switch", signed)
+	if ls.IsClosed() || rejected() != 2 {
+		t.Error("replayed command not rejected")
+	}
+
+	forged, _ := SignCommand("farm/c1/action/switch", "ops", "n2", closeCmd, HMACSigner("wrong"))
+	deliver("farm/c1/action/switch", forged)
+	// 签名用于其他主题
+	moved, _ := SignCommand("farm/c2/action/switch", "ops", "n3", closeCmd, HMACSigner("s3cret"))
+	deliver("farm/c1/action/switch", moved)
+	stale, _ := json.Marshal(SignedCommand{Key: "ops", Timestamp: time.Now().Unix() - 3600, Nonce: "n4", Payload: closeCmd,
+		Signature: HMACSigner("s3cret")(signingInput("farm/c1/action/switch", time.Now().Unix()-3600, "n4", closeCmd))})
+	deliver("farm/c1/action/switch", stale)
+	if ls.IsClosed() || rejected() != 5 {
+		t.Error("invalid signature or timestamp not rejected")
+	}
+
+	restart := []byte(`{}`)
+	byOps, _ := SignCommand("farm/c1/action/restart", "ops", "n5", restart, HMACSigner("s3cret"))
+	deliver("farm/c1/action/restart", byOps)
+	if restarts != 0 || rejected() != 6 {
+		t.Error("command issued by a key outside the allowlist")
+	}
+	byAdmin, _ := SignCommand("farm/c1/action/restart", "admin", "n6", restart, Ed25519Signer(priv))
+	deliver("farm/c1/action/restart", byAdmin)
+	if restarts != 1 {
+		t.Error("ed25519 signed command not executed")
+	}
+}
+
+func TestCommandAuthSecrets(t *testing.T) {
+	dl := &LocalDeviceDetail{CommandAuth: &CommandAuthOptions{Keys: map[string]*CommandKey{
+		"ops": {Algorithm: AUTH_HMAC_SHA256, Secret: "s3cret"},
+	}}}
+	if dl.Redacted().CommandAuth.Keys["ops"].Secret != SECRET_REDACTED || dl.CommandAuth.Keys["ops"].Secret != "s3cret" {
+		t.Error("hmac secret not redacted")
+	}
+	next := dl.Redacted()
+	next.inheritSecrets(dl)
+	if next.CommandAuth.Keys["ops"].Secret != "s3cret" {
+		t.Error("redacted hmac secret not inherited")
+	}
+
+	for _, auth := range []*CommandAuthOptions{
+		{Keys: map[string]*CommandKey{"a": {Algorithm: AUTH_HMAC_SHA256}}},
+		{Keys: map[string]*CommandKey{"a": {Algorithm: AUTH_ED25519, PublicKey: "short"}}},
+		{Keys: map[string]*CommandKey{"a": {Algorithm: "rsa", Secret: "x"}}},
+		{Allow: map[string][]string{"action/restart": {"missing"}}},
+	} {
+		if err := (&LocalDeviceDetail{CommandAuth: auth}).Validate(); err == nil {
+			t.Errorf("expected error for %+v", auth)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//=====================BACKFILL=================
+//
+//      按上位机请求分批补发本地存储的历史测量结果
+//
+//=====================END======================
+
+const (
+	BACKFILL_BATCH_SIZE     = 100                    // 缺省每批的测量结果数
+	BACKFILL_MAX_BATCH_SIZE = 1000                   // 每批的上限
+	BACKFILL_INTERVAL       = 100 * time.Millisecond // 缺省批次间隔
+	BACKFILL_MAX_INTERVAL   = time.Minute            // 批次间隔的上限
+	BACKFILL_MAX_RUNNING    = 2                      // 同时进行的补发数
+)
+
+/**
+ * 补发请求, 批次及最终的应答都发布到replyTo
+ * @Topic sensor/action/backfill
+ */
+type BackfillRequest struct {
+	SensorID  string    `json:"sensorID"`
+	From      time.Time `json:"from"`                // 包含, 缺省为to之前24小时
+	To        time.Time `json:"to"`                  // 不包含, 缺省为当前时间
+	BatchSize int       `json:"batchSize,omitempty"` // 每批的测量结果数, 缺省100
+	Interval  int64     `json:"interval,omitempty"`  // 批次间隔(毫秒), 缺省100
+	Cancel    bool      `json:"cancel,omitempty"`    // 取消requestID对应的补发
+
+	ActionEnvelope // 未指定requestID时生成, 在应答中返回
+}
+
+/**
+ * 一批测量结果, readings均标记为backfill
+ * 最后一批done为true(可能没有数据), 之后发布ActionResult
+ */
+type BackfillBatch struct {
+	RequestID string       `json:"requestID"`
+	SensorID  string       `json:"sensorID"`
+	Seq       int          `json:"seq"` // 从1开始
+	Readings  []ReadResult `json:"readings"`
+	Done      bool         `json:"done"`
+	Total     int          `json:"total,omitempty"` // done时为已发送的总数
+}
+
+/**
+ * 补发结果, 在ActionResult的data中
+ */
+type BackfillSummary struct {
+	Count   int        `json:"count"`          // 已发送的测量结果数
+	Batches int        `json:"batches"`        // 已发送的批次数(不含done)
+	Next    *time.Time `json:"next,omitempty"` // 中断时继续补发的from
+}
+
+var (
+	ErrBackfillBusy     = errors.New("too many backfills running")
+	ErrBackfillCanceled = errors.New("backfill canceled")
+)
+
+/**
+ * 进行中的补发 requestID -> 取消
+ */
+type backfillRegistry struct {
+	running map[string]chan struct{}
+	sync.Mutex
+}
+
+func newBackfillRegistry() *backfillRegistry {
+	return &backfillRegistry{running: make(map[string]chan struct{})}
+}
+
+func (r *backfillRegistry) start(requestID string) (chan struct{}, error) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.running[requestID]; ok {
+		return nil, invalid(errors.New("duplicate requestID " + requestID))
+	}
+	if len(r.running) >= BACKFILL_MAX_RUNNING {
+		return nil, ErrBackfillBusy
+	}
+	cancel := make(chan struct{})
+	r.running[requestID] = cancel
+	return cancel, nil
+}
+
+func (r *backfillRegistry) finish(requestID string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.running, requestID)
+}
+
+func (r *backfillRegistry) cancel(requestID string) bool {
+	r.Lock()
+	defer r.Unlock()
+	cancel, ok := r.running[requestID]
+	if ok {
+		close(cancel)
+		delete(r.running, requestID)
+	}
+	return ok
+}
+
+/**
+ * 补全并检查请求
+ */
+func (req *BackfillRequest) normalize() error {
+	q := HistoryQuery{SensorID: req.SensorID, From: req.From, To: req.To}
+	if err := q.normalize(); err != nil {
+		return err
+	}
+	req.From, req.To = q.From, q.To
+	if req.BatchSize < 0 || req.BatchSize > BACKFILL_MAX_BATCH_SIZE {
+		return fmt.Errorf("batchSize must be between 1 and %d", BACKFILL_MAX_BATCH_SIZE)
+	}
+	if req.BatchSize == 0 {
+		req.BatchSize = BACKFILL_BATCH_SIZE
+	}
+	if req.Interval < 0 || time.Duration(req.Interval)*time.Millisecond > BACKFILL_MAX_INTERVAL {
+		return fmt.Errorf("interval must be between 0 and %d", BACKFILL_MAX_INTERVAL/time.Millisecond)
+	}
+	if req.Interval == 0 {
+		req.Interval = int64(BACKFILL_INTERVAL / time.Millisecond)
+	}
+	return nil
+}
+
+/**
+ * 按时间顺序分批发布[from, to)内的测量结果
+ * 每批等待中间件确认后再发送下一批, MQ断开、发布超时、取消或收集器停止时中断, summary.next为继续补发的from
+ * @param topic 批次发布的完整主题
+ */
+func (c *Collector) Backfill(req BackfillRequest, topic string) (BackfillSummary, error) {
+	run, err := c.startBackfill(req, topic)
+	if err != nil {
+		return BackfillSummary{}, err
+	}
+	return run()
+}
+
+/**
+ * 检查请求并登记补发, 登记后即可被取消
+ * @return 进行补发的过程, 必须调用以结束登记
+ */
+func (c *Collector) startBackfill(req BackfillRequest, topic string) (func() (BackfillSummary, error), error) {
+	if err := req.normalize(); err != nil {
+		return nil, invalid(err)
+	}
+	if err := validTopic(topic); err != nil {
+		return nil, invalid(err)
+	}
+	h := c.History()
+	if h == nil {
+		return nil, errors.New("history unavailable")
+	}
+	if req.RequestID == "" {
+		req.RequestID = bson.NewObjectId().Hex()
+	}
+	canceled, err := c.backfills.start(req.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	return func() (BackfillSummary, error) {
+		defer c.backfills.finish(req.RequestID)
+		return c.runBackfill(h, req, topic, canceled)
+	}, nil
+}
+
+func (c *Collector) runBackfill(h *History, req BackfillRequest, topic string, canceled chan struct{}) (BackfillSummary, error) {
+	var summary BackfillSummary
+
+	var deadline <-chan time.Time
+	if req.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(req.Timeout) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	interval := time.Duration(req.Interval) * time.Millisecond
+	send := func(batch BackfillBatch) error {
+		client, ok := c.connectedClient()
+		if !ok {
+			return errors.New("mqtt not connected")
+		}
+		payload, _ := json.Marshal(batch)
+		token := c.publishStream(client, STREAM_REPLY, topic, payload)
+		if !token.WaitTimeout(PUBLISH_TIMEOUT) {
+			return errors.New("mqtt publish timeout")
+		}
+		return token.Error()
+	}
+	batch := make([]ReadResult, 0, req.BatchSize)
+	// 发送batch, 第二批起先按间隔等待; 失败时batch保留未发送的数据
+	flush := func() error {
+		if summary.Batches > 0 {
+			select {
+			case <-time.After(interval):
+			case <-canceled:
+				return ErrBackfillCanceled
+			case <-deadline:
+				return errors.New("backfill timeout")
+			case <-c.draining:
+				return errors.New("collector stopping")
+			}
+		}
+		if err := send(BackfillBatch{RequestID: req.RequestID, SensorID: req.SensorID, Seq: summary.Batches + 1, Readings: batch}); err != nil {
+			return err
+		}
+		summary.Count += len(batch)
+		summary.Batches++
+		batch = batch[:0]
+		return nil
+	}
+
+	var sendErr error
+	err := h.Scan(req.SensorID, req.From, req.To, func(p ReadResult) bool {
+		p.Backfill = true
+		batch = append(batch, p)
+		if len(batch) < req.BatchSize {
+			return true
+		}
+		sendErr = flush()
+		return sendErr == nil
+	})
+	if err == nil && sendErr == nil && len(batch) > 0 {
+		sendErr = flush()
+	}
+	if err == nil {
+		err = sendErr
+	}
+	if err == nil {
+		err = send(BackfillBatch{RequestID: req.RequestID, SensorID: req.SensorID, Seq: summary.Batches + 1, Readings: []ReadResult{}, Done: true, Total: summary.Count})
+	}
+	if err != nil {
+		if len(batch) > 0 {
+			next := batch[0].Created
+			summary.Next = &next
+		}
+		fmt.Printf("[WARN] 补发中断 传感器:%s 请求:%s 已发送:%d %s\n", req.SensorID, req.RequestID, summary.Count, err)
+		return summary, err
+	}
+	fmt.Printf("[INFO] 补发完成 传感器:%s 请求:%s 共%d条\n", req.SensorID, req.RequestID, summary.Count)
+	return summary, nil
+}
+
+/**
+ * 取消进行中的补发
+ */
+func (c *Collector) CancelBackfill(requestID string) error {
+	if !c.backfills.cancel(requestID) {
+		return invalid(errors.New("no running backfill " + requestID))
+	}
+	return nil
+}
+
+/**
+ * 补发历史测量结果, 批次发布到replyTo(缺省为应答主题)
+ * @Topic sensor/action/backfill
+ * 登记后立即应答accepted, 补发在后台进行, 完成或中断后再次应答, 期间可以接收取消请求
+ * cancel为true时取消requestID对应的补发
+ */
+func (c *Collector) BackfillHandler(client mqtt.Client, message mqtt.Message) {
+	var req BackfillRequest
+	err := json.Unmarshal(message.Payload(), &req)
+	if err == nil && !req.Cancel && req.RequestID == "" {
+		req.RequestID = bson.NewObjectId().Hex()
+	}
+	// 补发自行处理超时, 在超时后停止发送
+	env := req.ActionEnvelope
+	env.Timeout = 0
+	if err != nil || req.Cancel {
+		c.reply(message, env, req.SensorID, func(context.Context) (interface{}, error) {
+			if err != nil {
+				return nil, invalid(err)
+			}
+			return nil, c.CancelBackfill(req.RequestID)
+		})
+		return
+	}
+	topic := req.ReplyTo
+	if topic == "" {
+		topic = c.Topic(TOPIC_REPLY)
+	}
+	run, err := c.startBackfill(req, topic)
+	if err != nil {
+		c.reply(message, env, req.SensorID, func(context.Context) (interface{}, error) {
+			return nil, err
+		})
+		return
+	}
+	c.publishReply(env, ActionResult{RequestID: env.RequestID, Topic: message.Topic(), SensorID: req.SensorID, Status: RESULT_ACCEPTED})
+	// 不占用MQTT回调, 否则之后的取消请求无法送达
+	go c.reply(message, env, req.SensorID, func(context.Context) (interface{}, error) {
+		return run()
+	})
+}
+
+func BackfillHandler(client mqtt.Client, message mqtt.Message) {
+	Default().BackfillHandler(client, message)
+}
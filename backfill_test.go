@@ -0,0 +1,176 @@
+package sensor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/**
+ * 发布到topic的批次及最终应答, 跳过受理应答
+ */
+func backfillMessages(t *testing.T, client *fakeClient, topic string) ([]BackfillBatch, *ActionResult) {
+	var batches []BackfillBatch
+	var res *ActionResult
+	for _, msg := range client.messages(topic) {
+		var probe map[string]json.RawMessage
+		if err := json.Unmarshal(msg.payload, &probe); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := probe["status"]; ok {
+			var r ActionResult
+			_ = json.Unmarshal(msg.payload, &r)
+			if r.Status != RESULT_ACCEPTED {
+				res = &r
+			}
+			continue
+		}
+		var batch BackfillBatch
+		_ = json.Unmarshal(msg.payload, &batch)
+		batches = append(batches, batch)
+	}
+	return batches, res
+}
+
+/**
+ * 等待最终应答
+ */
+func waitBackfill(t *testing.T, client *fakeClient, topic string) ([]BackfillBatch, *ActionResult) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if batches, res := backfillMessages(t, client, topic); res != nil {
+			return batches, res
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no backfill result on %s", topic)
+	return nil, nil
+}
+
+func backfillSummary(res *ActionResult) BackfillSummary {
+	var summary BackfillSummary
+	data, _ := json.Marshal(res.Data)
+	_ = json.Unmarshal(data, &summary)
+	return summary
+}
+
+func TestBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := newFakeClient()
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{}), WithMQTTClient(client))
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		c.recordHistory(ReadResult{SensorID: "s", Created: base.Add(time.Duration(i) * time.Second), Items: []MeasureItem{{Name: "Oxygen", Value: float64(i)}}})
+	}
+	request := func(payload string) {
+		c.BackfillHandler(client, fakeMessage{topic: "sensor/action/backfill", payload: []byte(payload)})
+	}
+
+	request(`{"sensorID":"s","batchSize":2,"interval":1,"requestID":"b1","replyTo":"app/1"}`)
+	var accepted ActionResult
+	if msgs := client.messages("app/1"); len(msgs) == 0 || json.Unmarshal(msgs[0].payload, &accepted) != nil || accepted.Status != RESULT_ACCEPTED || accepted.RequestID != "b1" {
+		t.Fatalf("backfill not accepted %+v", accepted)
+	}
+	batches, res := waitBackfill(t, client, "app/1")
+	if res == nil || res.Status != RESULT_OK || res.RequestID != "b1" {
+		t.Fatalf("unexpected reply %+v", res)
+	}
+	if summary := backfillSummary(res); summary.Count != 5 || summary.Batches != 3 || summary.Next != nil {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if len(batches) != 4 || !batches[3].Done || batches[3].Total != 5 || len(batches[3].Readings) != 0 {
+		t.Fatalf("unexpected batches %+v", batches)
+	}
+	n := 0
+	for i, batch := range batches[:3] {
+		if batch.Seq != i+1 || batch.RequestID != "b1" || batch.Done {
+			t.Errorf("unexpected batch %+v", batch)
+		}
+		for _, p := range batch.Readings {
+			if !p.Backfill || p.Items[0].Value != float64(n) {
+				t.Errorf("unexpected reading %d %+v", n, p)
+			}
+			n++
+		}
+	}
+
+	// 中断后从next继续
+	client.Lock()
+	client.offline = true
+	client.Unlock()
+	summary, err := c.Backfill(BackfillRequest{SensorID: "s", From: base.Add(time.Second)}, "app/2")
+	if err == nil || summary.Count != 0 || summary.Next == nil || !summary.Next.Equal(base.Add(time.Second)) {
+		t.Errorf("unexpected summary when disconnected %+v %v", summary, err)
+	}
+	client.Lock()
+	client.offline = false
+	client.Unlock()
+
+	// 请求与MQTT回调一样逐个处理, 补发进行中仍能接收取消
+	messages := make(chan string)
+	handled := make(chan struct{})
+	go func() {
+		for payload := range messages {
+			request(payload)
+			handled <- struct{}{}
+		}
+	}()
+	defer close(messages)
+	serial := func(payload string) {
+		select {
+		case messages <- payload:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler blocked, %s not delivered", payload)
+		}
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler blocked by %s", payload)
+		}
+	}
+	serial(`{"sensorID":"s","batchSize":1,"interval":60000,"requestID":"b3","replyTo":"app/3"}`)
+	serial(`{"sensorID":"s","batchSize":1,"interval":60000,"requestID":"b4","replyTo":"app/4"}`)
+	serial(`{"sensorID":"s","batchSize":1,"requestID":"b3","replyTo":"app/5"}`)
+	if res := actionResult(t, client, "app/5"); res.Status != RESULT_INVALID {
+		t.Errorf("duplicate requestID accepted %+v", res)
+	}
+	serial(`{"sensorID":"s","batchSize":1,"requestID":"b5","replyTo":"app/6"}`)
+	if res := actionResult(t, client, "app/6"); res.Status != RESULT_ERROR || res.Error != ErrBackfillBusy.Error() {
+		t.Errorf("backfill over limit accepted %+v", res)
+	}
+	serial(`{"requestID":"b3","cancel":true,"replyTo":"app/7"}`)
+	if res := actionResult(t, client, "app/7"); res.Status != RESULT_OK {
+		t.Errorf("cancel failed %+v", res)
+	}
+	serial(`{"requestID":"b4","cancel":true,"replyTo":"app/8"}`)
+	batches, res = waitBackfill(t, client, "app/3")
+	if summary := backfillSummary(res); res.Status != RESULT_ERROR || len(batches) != 1 || summary.Count != 1 || summary.Next == nil || !summary.Next.Equal(base.Add(time.Second)) {
+		t.Errorf("unexpected canceled backfill %+v %+v", res, batches)
+	}
+	_, _ = waitBackfill(t, client, "app/4")
+	serial(`{"requestID":"b3","cancel":true,"replyTo":"app/9"}`)
+	if res := actionResult(t, client, "app/9"); res.Status != RESULT_INVALID {
+		t.Errorf("cancel of finished backfill accepted %+v", res)
+	}
+
+	for _, v := range []string{
+		`{"sensorID":"s","batchSize":1001,"replyTo":"app/10"}`,
+		`{"sensorID":"s","interval":-1,"replyTo":"app/10"}`,
+		`{"sensorID":"","replyTo":"app/10"}`,
+	} {
+		client.Lock()
+		client.published = nil
+		client.Unlock()
+		request(v)
+		if res := actionResult(t, client, "app/10"); res.Status != RESULT_INVALID || res.RequestID == "" {
+			t.Errorf("invalid request %s accepted %+v", v, res)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package sensor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//=====================BUS======================
+//
+//     按需的总线请求, 与定时任务共用DTU任务队列
+//
+//=====================END======================
+
+// 按需任务类型
+const (
+	RegisterRead = 0x81
+	CoilWrite    = 0x82
+)
+
+const (
+	BUS_REQUEST_TIMEOUT = 30 * time.Second // 排队及执行的最长时间
+	REGISTER_READ_MAX   = 7                // DTU单次读取20字节, 最多7个寄存器
+)
+
+var (
+	ErrSensorUnavailable = errors.New("sensor unavailable")
+	ErrDTUNotConnected   = errors.New("dtu not connected")
+	ErrTaskQueueFull     = errors.New("task queue is full")
+	ErrBusTimeout        = errors.New("bus request timeout")
+)
+
+/**
+ * 按需任务的结果
+ */
+type taskOutcome struct {
+	result ReadResult
+	err    error
+}
+
+/**
+ * 放入DTU任务队列并等待执行结果
+ */
+func (c *Collector) requestBus(ls *LocalSensorInformation, body TaskSensorBody) (ReadResult, error) {
+	if ls.IsClosed() || c.tracker.IsForbidden(ls.SensorID) {
+		return ReadResult{}, invalid(ErrSensorUnavailable)
+	}
+	body.SensorID = ls.SensorID
+	body.SensorAddr = ls.Addr
+	return c.queueTask(ls.Attach, body)
+}
+
+/**
+ * 放入attach的DTU任务队列并等待执行结果, 不检查传感器状态
+ */
+func (c *Collector) queueTask(attach string, body TaskSensorBody) (ReadResult, error) {
+	ch, ok := c.GetTaskChannel(attach)
+	ds, err := c.GetDeviceSession(attach)
+	if !ok || err != nil {
+		return ReadResult{}, ErrDTUNotConnected
+	}
+	body.SensorAttachIP = attach
+	body.collector = c
+	done := make(chan taskOutcome, 1)
+	body.done = done
+	select {
+	case ch <- body:
+	default:
+		return ReadResult{}, ErrTaskQueueFull
+	}
+
+	timer := time.NewTimer(BUS_REQUEST_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ds.Done():
+		return ReadResult{}, ErrSessionClosed
+	case <-c.draining:
+		return ReadResult{}, ErrSensorUnavailable
+	case <-timer.C:
+		return ReadResult{}, ErrBusTimeout
+	}
+}
+
+/**
+ * 立即测量一次, 结果与定时测量一样发布
+ */
+func (c *Collector) Measure(sensorID string) (ReadResult, error) {
+	ls, err := c.GetLocalSensor(sensorID)
+	if err != nil {
+		return ReadResult{}, invalid(err)
+	}
+	return c.requestBus(ls, TaskSensorBody{Type: ls.Type})
+}
+
+func Measure(sensorID string) (ReadResult, error) {
+	return Default().Measure(sensorID)
+}
+
+/**
+ * 读取寄存器(功能码0x03)
+ * @param count 寄存器数量, 1~REGISTER_READ_MAX
+ */
+func (c *Collector) ReadRegisters(sensorID string, register, count uint16) ([]uint16, error) {
+	ls, err := c.GetLocalSensor(sensorID)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	if count < 1 || count > REGISTER_READ_MAX {
+		return nil, invalid(fmt.Errorf("count must be between 1 and %d", REGISTER_READ_MAX))
+	}
+	request := ComposeBody([]byte{ls.Addr}, InfoMK["ReadFunc"], append(ToBigEndian(register), ToBigEndian(count)...))
+	rs, err := c.requestBus(ls, TaskSensorBody{Type: RegisterRead, RequestData: request})
+	if err != nil {
+		return nil, err
+	}
+	if len(rs.WriteData) != int(count)*2 {
+		return nil, errors.New("unexpected respond")
+	}
+	values := make([]uint16, count)
+	for i := range values {
+		values[i], _ = BytesToIntU(rs.WriteData[i*2 : i*2+2])
+	}
+	return values, nil
+}
+
+func ReadRegisters(sensorID string, register, count uint16) ([]uint16, error) {
+	return Default().ReadRegisters(sensorID, register, count)
+}
+
+/**
+ * 在DTU任务队列中执行寄存器读取, 原始数据放在WriteData
+ */
+func (c *Collector) executeRegisterRead(body TaskSensorBody) (ReadResult, error) {
+	ds, err := c.GetDeviceSession(body.SensorAttachIP)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	fmt.Printf("[INFO] 读取请求 ID:%s 请求数据:%b\n", body.SensorID, body.RequestData)
+	return ds.SendWord(body.RequestData, func(meta DeviceMeta, data []byte) (ReadResult, error) {
+		p, err := ds.GetResultInstance(meta)
+		if err != nil {
+			return p, err
+		}
+		p.SensorID = body.SensorID
+		p.WriteData = data
+		return p, nil
+	})
+}
+
+/**
+ * 写单个线圈(功能码0x05), 用于DTU上的继电器等输出设备
+ * 与传感器共用DTU任务队列, 设备原样返回请求时视为成功
+ * @param attach DTU地址
+ * @param addr 设备地址
+ */
+func (c *Collector) WriteCoil(attach string, addr byte, coil uint16, on bool) error {
+	if addr < 1 || addr > 247 {
+		return invalid(errors.New("addr must be between 1 and 247"))
+	}
+	value := []byte{0x00, 0x00}
+	if on {
+		value = []byte{0xFF, 0x00}
+	}
+	request := ComposeBody([]byte{addr}, InfoMK["WriteCoilFunc"], append(ToBigEndian(coil), value...))
+	_, err := c.queueTask(attach, TaskSensorBody{Type: CoilWrite, SensorAddr: addr, RequestData: request})
+	return err
+}
+
+func WriteCoil(attach string, addr byte, coil uint16, on bool) error {
+	return Default().WriteCoil(attach, addr, coil, on)
+}
+
+/**
+ * 在DTU任务队列中执行线圈写入
+ */
+func (c *Collector) executeCoilWrite(body TaskSensorBody) (ReadResult, error) {
+	ds, err := c.GetDeviceSession(body.SensorAttachIP)
+	if err != nil {
+		return ReadResult{}, err
+	}
+	fmt.Printf("[INFO] 线圈写入 DTU:%s 设备地址:%d 请求数据:%b\n", body.SensorAttachIP, body.SensorAddr, body.RequestData)
+	rs, err := ds.SendWord(body.RequestData, func(meta DeviceMeta, data []byte) (ReadResult, error) {
+		p, err := ds.GetResultInstance(meta)
+		if err != nil {
+			return p, err
+		}
+		if len(data) != 4 {
+			return p, errors.New("decode build error")
+		}
+		err = p.DecodeOrder(data)
+		return p, err
+	})
+	if err != nil {
+		return rs, err
+	}
+	if rs.DeviceAddr != body.SensorAddr || !bytes.Equal(append(rs.WriteReg, rs.WriteData...), body.RequestData[2:6]) {
+		return rs, errors.New("unexpected respond")
+	}
+	return rs, nil
+}
@@ -1,11 +1,41 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
 	"sensor"
 	"sensor/mq"
 )
 
 func main() {
+	config := flag.String("config", sensor.GetConfigPath(), "CONFIG文件路径(.json/.yaml/.yml/.toml), 也可通过环境变量"+sensor.CONFIG_ENV+"指定")
+	genKey := flag.String("genkey", "", "生成加密密钥文件到指定路径后退出")
+	encrypt := flag.String("encrypt", "", "使用CONFIG中的secret_key_file加密该值, 输出enc:引用后退出")
+	shutdownTimeout := flag.Duration("shutdown-timeout", sensor.SHUTDOWN_TIMEOUT, "收到SIGINT/SIGTERM后等待进行中的请求及MQTT消息的最长时间")
+	flag.Parse()
+	sensor.SetConfigPath(*config)
+
+	if *genKey != "" {
+		if err := sensor.GenerateSecretKey(*genKey); err != nil {
+			fmt.Println("[FAIL] 生成密钥失败", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *encrypt != "" {
+		enc, err := sensor.GetLocalDevicesInstance().EncryptSecret(*encrypt)
+		if err != nil {
+			fmt.Println("[FAIL] 加密失败", err)
+			os.Exit(1)
+		}
+		fmt.Println(enc)
+		return
+	}
+
 	mq.SensorMapping()
-	sensor.SensorServiceStart()
+	if err := sensor.Default().Run(*shutdownTimeout); err != nil {
+		fmt.Println("[FAIL]", err)
+		os.Exit(1)
+	}
 }
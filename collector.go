@@ -0,0 +1,431 @@
+package sensor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"net/http"
+	"os"
+	"sensor/count"
+	"sync"
+	"time"
+)
+
+//=====================COLLECTOR================
+//
+//      收集器 持有CONFIG/TimeWheel/Session/MQTT
+//
+//=====================END======================
+
+/**
+ * 收集器(下位机服务)
+ * 一个进程内可以运行多个互相隔离的收集器, 包级函数均作用于Default()
+ */
+type Collector struct {
+	configPath  string
+	config      *LocalDeviceDetail
+	configErr   error      // 从文件加载CONFIG的错误
+	configMutex sync.Mutex // 串行化所有对CONFIG的修改
+
+	address      string         // DTU监听地址
+	listener     net.Listener   // DTU监听
+	listening    bool           // 正在接受DTU连接
+	tw           *TimeWheel     // 定时任务
+	sessions     sync.Map       // DTU会话 attachIP -> *DeviceSession
+	taskChannels sync.Map       // 每个DTU的任务阻塞队列 attachIP -> chan TaskSensorBody
+	client       mqtt.Client    // MQTT连接
+	connectMu    sync.Mutex     // 串行化MQTT连接, 连接期间不持有mu
+	tracker      *count.Tracker // 传感器错误记录
+	logLevel     int            // MQ日志上报等级
+	outbox       *Outbox        // MQ不可用时的数据缓存
+	outboxOnce   sync.Once
+	history      *History // 测量结果的本地存储
+	historyOnce  sync.Once
+	backfills    *backfillRegistry // 进行中的历史数据补发
+	alarms       *alarmEngine      // 报警状态
+	control      *controlEngine    // 继电器控制状态
+	commands     *commandQueue     // 传感器写指令
+	sparkplug    *SparkplugNode    // Sparkplug B, 未配置时为nil
+	sensorMu     sync.RWMutex      // 传感器状态会被总线任务与HTTP/MQTT同时读写
+	sensorStatus map[string]string // 已上报的传感器状态
+	statusMu     sync.Mutex
+	nonces       *nonceCache // 已使用的指令nonce
+	events       *eventHub   // 实时事件的订阅者
+	metrics      *collectorMetrics
+	httpServer   *http.Server
+	httpListener net.Listener          // 管理接口监听
+	readings     map[string]ReadResult // 各传感器最近一次测量结果
+	readingMu    sync.Mutex
+	logs         []LogEntry // 最近的日志
+	logMu        sync.Mutex
+
+	subscriptions map[string]mqtt.MessageHandler // 已订阅的主题, 重连后重新订阅
+	subMu         sync.Mutex
+	handlerSlots  chan struct{} // 执行中的订阅回调, 见dispatch
+	handling      int32
+	nextConnect   time.Time     // 连接失败后的下次连接时间
+	connectDelay  time.Duration // 当前的退避间隔
+
+	draining chan struct{} // 开始停止后被close, 不再执行新的总线请求
+	inflight int32         // 进行中的总线请求数
+	done     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+}
+
+type CollectorOption func(c *Collector)
+
+/**
+ * 指定CONFIG路径, 扩展名决定格式(.json/.yaml/.yml/.toml)
+ */
+func WithConfigPath(path string) CollectorOption {
+	return func(c *Collector) {
+		c.configPath = path
+	}
+}
+
+/**
+ * 直接使用已加载的CONFIG
+ */
+func WithConfig(dl *LocalDeviceDetail) CollectorOption {
+	return func(c *Collector) {
+		c.bind(dl)
+		c.config = dl
+	}
+}
+
+/**
+ * 指定DTU监听地址, 默认ADDRESS
+ */
+func WithListenAddress(address string) CollectorOption {
+	return func(c *Collector) {
+		c.address = address
+	}
+}
+
+func WithTimeWheel(tw *TimeWheel) CollectorOption {
+	return func(c *Collector) {
+		c.tw = tw
+	}
+}
+
+func WithMQTTClient(client mqtt.Client) CollectorOption {
+	return func(c *Collector) {
+		c.client = client
+	}
+}
+
+func WithTracker(tracker *count.Tracker) CollectorOption {
+	return func(c *Collector) {
+		c.tracker = tracker
+	}
+}
+
+func NewCollector(options ...CollectorOption) *Collector {
+	c := &Collector{
+		configPath:    DefaultConfigPath(),
+		address:       ADDRESS,
+		logLevel:      MQ_LOG_FAIL,
+		commands:      newCommandQueue(),
+		sensorStatus:  make(map[string]string),
+		nonces:        newNonceCache(),
+		events:        newEventHub(),
+		metrics:       newCollectorMetrics(),
+		readings:      make(map[string]ReadResult),
+		backfills:     newBackfillRegistry(),
+		alarms:        newAlarmEngine(),
+		control:       newControlEngine(),
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		handlerSlots:  make(chan struct{}, MQTT_MAX_HANDLERS),
+		draining:      make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.tracker == nil {
+		c.tracker = count.NewTracker()
+	}
+	c.tracker.OnChange(c.reportSensorStatus)
+	return c
+}
+
+var (
+	defaultCollector     *Collector
+	defaultCollectorOnce sync.Once
+)
+
+/**
+ * 默认收集器, 包级函数均作用于该收集器
+ */
+func Default() *Collector {
+	defaultCollectorOnce.Do(func() {
+		defaultCollector = NewCollector(WithTracker(count.DefaultTracker()))
+	})
+	return defaultCollector
+}
+
+/**
+ * 默认CONFIG路径, 可由环境变量CONFIG_ENV覆盖
+ */
+func DefaultConfigPath() string {
+	if path := os.Getenv(CONFIG_ENV); path != "" {
+		return path
+	}
+	return "cnf/conf.json"
+}
+
+// ========================config===========================
+
+/**
+ * 设置CONFIG路径, 应在首次加载CONFIG前调用
+ */
+func (c *Collector) SetConfigPath(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configPath = path
+}
+
+func (c *Collector) GetConfigPath() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.configPath
+}
+
+/**
+ * 当前CONFIG, 首次调用时从CONFIG路径加载
+ */
+func (c *Collector) Config() *LocalDeviceDetail {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config == nil {
+		c.config, c.configErr = ReadConfig(c.configPath)
+		if c.configErr != nil {
+			emit("%s\n", c.configErr)
+		}
+		c.bind(c.config)
+	}
+	return c.config
+}
+
+/**
+ * 最近一次从文件加载CONFIG的错误, 加载成功或通过SetConfig替换后为nil
+ */
+func (c *Collector) ConfigError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.configErr
+}
+
+/**
+ * 替换当前CONFIG(不写入文件)
+ */
+func (c *Collector) SetConfig(dl *LocalDeviceDetail) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bind(dl)
+	c.config = dl
+	c.configErr = nil
+}
+
+/**
+ * 重新从CONFIG路径加载
+ * 加载失败时保留当前CONFIG并返回错误, 错误同时由ConfigError报告
+ */
+func (c *Collector) ReloadConfig() (*LocalDeviceDetail, error) {
+	dl, err := ReadConfig(c.GetConfigPath())
+	if err != nil {
+		emit("%s\n", err)
+		cur := c.Config()
+		c.mu.Lock()
+		c.configErr = err
+		c.mu.Unlock()
+		return cur, err
+	}
+	c.SetConfig(dl)
+	return dl, nil
+}
+
+/**
+ * 保存CONFIG到该收集器的CONFIG路径
+ */
+func (c *Collector) SaveConfig(dl *LocalDeviceDetail) error {
+	return dl.DumpConfigTo(c.GetConfigPath())
+}
+
+/**
+ * 把传感器关联到该收集器
+ */
+func (c *Collector) bind(dl *LocalDeviceDetail) {
+	for _, v := range dl.LocalSensorInformation {
+		if v != nil {
+			v.collector = c
+		}
+	}
+}
+
+func (c *Collector) Tracker() *count.Tracker {
+	return c.tracker
+}
+
+// ========================lifecycle===========================
+
+/**
+ * 启动收集器: 加载CONFIG, 启动TimeWheel, 开始监听DTU及HTTP
+ * ctx结束时收集器随之停止
+ */
+func (c *Collector) Start(ctx context.Context) error {
+	c.Config()
+	// 密钥无法解析时不能以空CONFIG运行
+	if err := c.ConfigError(); errors.Is(err, ErrSecretUnresolved) {
+		return err
+	}
+	c.GetTimeWheel()
+
+	ln, err := net.Listen(NETWORK, c.address)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.listener = ln
+	c.mu.Unlock()
+	if addr := c.Config().HTTPAddress; addr != "" {
+		if err := c.StartHTTP(addr); err != nil {
+			_ = ln.Close()
+			return err
+		}
+	}
+	go c.serve(ln)
+	go c.runOutbox()
+	go c.runHistory()
+	go c.runCommands()
+	go c.runControl()
+	go c.runSparkplug()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Stop(context.Background())
+		case <-c.done:
+		}
+	}()
+	return nil
+}
+
+/**
+ * 停止收集器:
+ * 1. 停止监听, 不再接受新的DTU
+ * 2. 停止TimeWheel, 不再执行新的总线请求
+ * 3. 等待进行中的总线请求完成, 关闭HTTP
+ * 4. 上报全部传感器离线
+ * 5. 断开全部DTU并等待资源释放
+ * 6. 发送剩余的MQTT消息后断开, 未发送的缓存保留到下次启动
+ * 各步骤等待至ctx结束, 超时后继续执行后续步骤并返回ctx的错误
+ */
+func (c *Collector) Stop(ctx context.Context) error {
+	var err error
+	c.stopOnce.Do(func() {
+		fmt.Println("[INFO] 正在停止收集器")
+		c.StopDeviceTCP()
+
+		close(c.draining)
+		c.mu.Lock()
+		if c.tw != nil {
+			c.tw.Stop()
+		}
+		c.mu.Unlock()
+
+		if e := c.waitHandlers(ctx); e != nil {
+			fmt.Println("[WARN] 等待进行中的MQTT指令超时", e)
+		}
+		if err = c.waitInflight(ctx); err != nil {
+			fmt.Println("[WARN] 等待进行中的请求超时", err)
+		}
+		c.stopHTTP(ctx)
+
+		c.publishOffline(ctx)
+
+		c.sessions.Range(func(key, value interface{}) bool {
+			value.(*DeviceSession).Close()
+			return true
+		})
+		if e := c.waitSessionsReleased(ctx); e != nil && err == nil {
+			err = e
+		}
+
+		c.stopSparkplug(ctx)
+		c.disconnectMQTT(ctx)
+		c.closeOutbox()
+		close(c.done)
+		fmt.Println("[INFO] 收集器已停止")
+	})
+	return err
+}
+
+/**
+ * 是否已开始停止
+ */
+func (c *Collector) IsStopping() bool {
+	select {
+	case <-c.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Collector) waitSessionsReleased(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for len(c.ShowNodeIPs()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+/**
+ * 阻塞直到收集器停止
+ */
+func (c *Collector) Wait() {
+	<-c.done
+}
+
+/**
+ * 实际监听地址
+ */
+func (c *Collector) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
+
+func (c *Collector) serve(ln net.Listener) {
+	c.mu.Lock()
+	c.listening = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		// 重启TCP时新的监听可能已经开始
+		if c.listener == ln {
+			c.listening = false
+		}
+		c.mu.Unlock()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println("[FAIL] " + "退出TCP")
+			return
+		}
+		go c.HandleProcessor(conn)
+	}
+}
@@ -0,0 +1,108 @@
+package sensor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCollectorIsolation(t *testing.T) {
+	a := NewCollector(WithConfig(&LocalDeviceDetail{Name: "a"}), WithListenAddress("127.0.0.1:0"))
+	b := NewCollector(WithConfig(&LocalDeviceDetail{Name: "b"}), WithListenAddress("127.0.0.1:0"))
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop(context.Background())
+
+	if a.Config().Name != "a" || b.Config().Name != "b" || a.GetTimeWheel() == b.GetTimeWheel() {
+		t.Error("collectors share config or scheduler")
+	}
+	a.Tracker().AddErrorOperationBan("s1")
+	if b.Tracker().IsForbidden("s1") {
+		t.Error("collectors share error tracker")
+	}
+
+	// 模拟DTU连接
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(a.ShowNodeIPs()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := a.GetDeviceSession("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.ShowNodeIPs()) != 0 {
+		t.Error("collectors share sessions")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a.Wait()
+	if len(a.ShowNodeIPs()) != 0 {
+		t.Error("sessions not released on stop")
+	}
+}
+
+func TestCollectorGracefulStop(t *testing.T) {
+	dl := &LocalDeviceDetail{LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 1, SensorID: "s"},
+	}}
+	c := NewCollector(WithConfig(dl), WithListenAddress("127.0.0.1:0"))
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 模拟DTU: 回应状态扫描, 测量请求延迟回应
+	requested := make(chan struct{})
+	replied := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 20)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x01})
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		close(requested)
+		time.Sleep(300 * time.Millisecond)
+		_, err := conn.Write([]byte{0x01, 0x03, 0x00, 0x00})
+		replied <- err
+	}()
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no measure request")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-replied; err != nil {
+		t.Error("session closed before in-flight request finished", err)
+	}
+	if len(c.ShowNodeIPs()) != 0 || c.inflight != 0 {
+		t.Error("resources not released on stop")
+	}
+	if err := c.GetTimeWheel().AddTask(time.Second, 1, "k", nil, TaskSensorPush); err == nil {
+		t.Error("task accepted after stop")
+	}
+}
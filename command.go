@@ -0,0 +1,517 @@
+package sensor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+//=====================COMMAND==================
+//
+//      传感器写指令队列, 失败的指令在恢复后重试
+//
+//=====================END======================
+
+// 指令名及对应的寄存器(功能码0x06)
+const (
+	COMMAND_ZERO    = "zero"    // 零点校准
+	COMMAND_TILT    = "tilt"    // 斜率校准
+	COMMAND_FACTORY = "factory" // 恢复出厂设置
+	COMMAND_ADDR    = "addr"    // 修改设备地址, value为新地址
+	COMMAND_WRITE   = "write"   // 写任意寄存器
+)
+
+// 投递策略
+const (
+	COMMAND_AT_MOST_ONCE = "at-most-once" // 已发送到总线后不再重试
+	COMMAND_UNTIL_ACKED  = "until-acked"  // 重试直到传感器确认或过期
+)
+
+// 指令状态
+const (
+	COMMAND_PENDING  = "pending"
+	COMMAND_ACKED    = "acked"
+	COMMAND_FAILED   = "failed"
+	COMMAND_EXPIRED  = "expired"
+	COMMAND_REJECTED = "rejected"
+)
+
+const (
+	COMMAND_TTL            int64 = 3600             // 缺省有效时间(秒)
+	COMMAND_QUEUE_SIZE           = 32               // 单个传感器最多缓存的指令数
+	COMMAND_HISTORY_SIZE         = 64               // 保留的已完成指令数
+	COMMAND_RETRY_INTERVAL       = 30 * time.Second // 检查过期及重试的间隔
+)
+
+// 指令任务类型, 与测量任务共用DTU的任务队列
+const CommandWrite = 0x80
+
+var commandRegisters = map[string][]byte{
+	COMMAND_ZERO:    InfoMK["WZero"],
+	COMMAND_TILT:    InfoMK["WTilt"],
+	COMMAND_FACTORY: InfoMK["WFactory"],
+	COMMAND_ADDR:    InfoMK["RAddr"],
+}
+
+/**
+ * 传感器写指令
+ * @Topic sensor/action/command
+ */
+type SensorCommand struct {
+	ID       string    `json:"id"`                 // 指令ID, 缺省时生成
+	SensorID string    `json:"sensorID"`           // 传感器ID
+	Name     string    `json:"name"`               // 指令名
+	Register uint16    `json:"register,omitempty"` // 寄存器地址, 仅write
+	Value    uint16    `json:"value"`              // 写入值, zero/tilt/factory缺省为1
+	TTL      int64     `json:"ttl,omitempty"`      // 有效时间(秒)
+	Policy   string    `json:"policy,omitempty"`   // 投递策略, 缺省at-most-once
+	Created  time.Time `json:"created"`
+
+	ActionEnvelope // 通过MQTT提交时的应答信息, timeout内未完成时应答timeout并不再发送
+
+	topic     string              // 提交的MQTT主题, 为空时不应答
+	attempts  int                 // 已发送到总线的次数
+	queue     chan TaskSensorBody // 已放入的DTU任务队列, DTU重新连接后需重新放入
+	executing bool                // 正在执行
+}
+
+/**
+ * 指令结果, 状态变化时发布到TOPIC_COMMAND_RESULT
+ */
+type CommandResult struct {
+	ID       string    `json:"id"`
+	SensorID string    `json:"sensorID"`
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+/**
+ * 以传感器为单位的指令队列, 每个传感器同一时间只执行队首的指令
+ */
+type commandQueue struct {
+	pending map[string][]*SensorCommand // sensorID -> 指令
+	history []CommandResult
+	sync.Mutex
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{pending: make(map[string][]*SensorCommand)}
+}
+
+func (q *commandQueue) contains(cmd *SensorCommand) bool {
+	for _, v := range q.pending[cmd.SensorID] {
+		if v == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *commandQueue) head(sensorID string) *SensorCommand {
+	if list := q.pending[sensorID]; len(list) > 0 {
+		return list[0]
+	}
+	return nil
+}
+
+/**
+ * 移出队列并记录结果, 调用者需持有锁
+ */
+func (q *commandQueue) finish(cmd *SensorCommand, status string, err error) CommandResult {
+	list := q.pending[cmd.SensorID]
+	for i, v := range list {
+		if v == cmd {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(q.pending, cmd.SensorID)
+	} else {
+		q.pending[cmd.SensorID] = list
+	}
+	res := cmd.result(status, err)
+	q.history = append(q.history, res)
+	if len(q.history) > COMMAND_HISTORY_SIZE {
+		q.history = q.history[len(q.history)-COMMAND_HISTORY_SIZE:]
+	}
+	return res
+}
+
+func (cmd *SensorCommand) result(status string, err error) CommandResult {
+	res := CommandResult{ID: cmd.ID, SensorID: cmd.SensorID, Name: cmd.Name, Status: status, Attempts: cmd.attempts, Created: time.Now()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (cmd *SensorCommand) expired() bool {
+	return time.Since(cmd.Created) > time.Duration(cmd.TTL)*time.Second
+}
+
+/**
+ * 写入的寄存器和值
+ */
+func (cmd *SensorCommand) registerValue() []byte {
+	if cmd.Name == COMMAND_WRITE {
+		return append(ToBigEndian(cmd.Register), ToBigEndian(cmd.Value)...)
+	}
+	reg := commandRegisters[cmd.Name]
+	if cmd.Value == 0 && cmd.Name != COMMAND_ADDR {
+		return append([]byte{}, reg...)
+	}
+	return append(append([]byte{}, reg[:2]...), ToBigEndian(cmd.Value)...)
+}
+
+/**
+ * 检查并补全指令
+ */
+func (cmd *SensorCommand) normalize() error {
+	if _, ok := commandRegisters[cmd.Name]; !ok && cmd.Name != COMMAND_WRITE {
+		return errors.New("unknown command " + cmd.Name)
+	}
+	if cmd.Name == COMMAND_ADDR && (cmd.Value < 1 || cmd.Value > 247) {
+		return errors.New("addr must be between 1 and 247")
+	}
+	switch cmd.Policy {
+	case "":
+		cmd.Policy = COMMAND_AT_MOST_ONCE
+	case COMMAND_AT_MOST_ONCE, COMMAND_UNTIL_ACKED:
+	default:
+		return errors.New("unknown policy " + cmd.Policy)
+	}
+	if cmd.TTL <= 0 {
+		cmd.TTL = COMMAND_TTL
+	}
+	if cmd.ID == "" {
+		cmd.ID = bson.NewObjectId().Hex()
+	}
+	cmd.Created = time.Now()
+	return nil
+}
+
+// ========================collector===========================
+
+/**
+ * 提交写指令, DTU未连接或传感器异常时缓存, 恢复后发送
+ */
+func (c *Collector) SubmitCommand(cmd SensorCommand) (CommandResult, error) {
+	if err := cmd.normalize(); err != nil {
+		return c.rejectCommand(&cmd, err)
+	}
+	if _, err := c.GetLocalSensor(cmd.SensorID); err != nil {
+		return c.rejectCommand(&cmd, err)
+	}
+
+	c.commands.Lock()
+	if len(c.commands.pending[cmd.SensorID]) >= COMMAND_QUEUE_SIZE {
+		c.commands.Unlock()
+		return c.rejectCommand(&cmd, errors.New("command queue is full"))
+	}
+	c.commands.pending[cmd.SensorID] = append(c.commands.pending[cmd.SensorID], &cmd)
+	res := cmd.result(COMMAND_PENDING, nil)
+	c.commands.Unlock()
+
+	if cmd.Timeout > 0 {
+		time.AfterFunc(time.Duration(cmd.Timeout)*time.Second, func() {
+			c.timeoutCommand(&cmd)
+		})
+	}
+	c.publishCommandResult(&cmd, res)
+	c.dispatchCommands(cmd.SensorID)
+	return res, nil
+}
+
+func SubmitCommand(cmd SensorCommand) (CommandResult, error) {
+	return Default().SubmitCommand(cmd)
+}
+
+func (c *Collector) rejectCommand(cmd *SensorCommand, err error) (CommandResult, error) {
+	res := cmd.result(COMMAND_REJECTED, err)
+	c.publishCommandResult(cmd, res)
+	return res, invalid(err)
+}
+
+/**
+ * 未完成的指令
+ */
+func (c *Collector) PendingCommands(sensorID string) []SensorCommand {
+	c.commands.Lock()
+	defer c.commands.Unlock()
+	var ret []SensorCommand
+	for _, v := range c.commands.pending[sensorID] {
+		ret = append(ret, *v)
+	}
+	return ret
+}
+
+/**
+ * 最近完成的指令结果
+ */
+func (c *Collector) CommandResult(id string) (CommandResult, bool) {
+	c.commands.Lock()
+	defer c.commands.Unlock()
+	for i := len(c.commands.history) - 1; i >= 0; i-- {
+		if c.commands.history[i].ID == id {
+			return c.commands.history[i], true
+		}
+	}
+	return CommandResult{}, false
+}
+
+/**
+ * 把传感器队首的指令放入DTU任务队列
+ * DTU未连接, 传感器被禁止或关闭时等待恢复
+ */
+func (c *Collector) dispatchCommands(sensorID string) {
+	ls, err := c.GetLocalSensor(sensorID)
+	if err != nil || ls.IsClosed() || c.tracker.IsForbidden(sensorID) {
+		return
+	}
+	ch, ok := c.GetTaskChannel(ls.Attach)
+	if !ok {
+		return
+	}
+
+	c.commands.Lock()
+	defer c.commands.Unlock()
+	cmd := c.commands.head(sensorID)
+	if cmd == nil || cmd.executing || cmd.queue == ch {
+		return
+	}
+	body := TaskSensorBody{
+		Type:           CommandWrite,
+		SensorID:       sensorID,
+		SensorAttachIP: ls.Attach,
+		commandID:      cmd.ID,
+		collector:      c,
+	}
+	select {
+	case ch <- body:
+		cmd.queue = ch
+	default:
+		// 任务队列已满, 等待下次重试
+	}
+}
+
+/**
+ * DTU重新连接后发送其上传感器的指令
+ */
+func (c *Collector) dispatchAttachCommands(attachIP string) {
+	for _, v := range c.Config().GetLocalSensorList(attachIP) {
+		c.dispatchCommands(v.SensorID)
+	}
+}
+
+/**
+ * 在DTU任务队列中执行指令
+ */
+func (c *Collector) executeCommand(body TaskSensorBody) {
+	c.commands.Lock()
+	cmd := c.commands.head(body.SensorID)
+	if cmd == nil || cmd.ID != body.commandID {
+		// 已过期
+		c.commands.Unlock()
+		return
+	}
+	cmd.executing = true
+	c.commands.Unlock()
+
+	err := c.writeCommand(cmd)
+
+	c.commands.Lock()
+	cmd.executing = false
+	cmd.queue = nil
+	var res *CommandResult
+	switch {
+	case err == nil:
+		r := c.commands.finish(cmd, COMMAND_ACKED, nil)
+		res = &r
+	case cmd.attempts > 0 && cmd.Policy == COMMAND_AT_MOST_ONCE:
+		r := c.commands.finish(cmd, COMMAND_FAILED, err)
+		res = &r
+	default:
+		// 等待DTU重新连接或传感器恢复后重试
+		fmt.Printf("[WARN] 指令执行失败, 等待重试 ID:%s 指令:%s %v\n", cmd.SensorID, cmd.Name, err)
+	}
+	c.commands.Unlock()
+
+	if res == nil {
+		return
+	}
+	c.publishCommandResult(cmd, *res)
+	if res.Status == COMMAND_ACKED && cmd.Name == COMMAND_ADDR {
+		c.applyCommandAddr(cmd)
+	}
+	// 继续执行下一条
+	c.dispatchCommands(body.SensorID)
+}
+
+/**
+ * 发送指令并等待传感器回应
+ * 传感器原样返回寄存器和值时视为确认
+ */
+func (c *Collector) writeCommand(cmd *SensorCommand) error {
+	ls, err := c.GetLocalSensor(cmd.SensorID)
+	if err != nil {
+		return err
+	}
+	if ls.IsClosed() || c.tracker.IsForbidden(cmd.SensorID) {
+		return errors.New("sensor unavailable")
+	}
+	ds, err := c.GetDeviceSession(ls.Attach)
+	if err != nil {
+		return err
+	}
+	data := cmd.registerValue()
+	request := ComposeBody([]byte{ls.Addr}, InfoMK["WriteFunc"], data)
+	fmt.Printf("[INFO] 指令请求 ID:%s 指令:%s 请求数据:%b\n", cmd.SensorID, cmd.Name, request)
+
+	c.commands.Lock()
+	cmd.attempts++
+	c.commands.Unlock()
+	rs, err := ds.SendWord(request, func(meta DeviceMeta, data []byte) (ReadResult, error) {
+		p, err := ds.GetResultInstance(meta)
+		if err != nil {
+			return p, err
+		}
+		if len(data) != 4 {
+			return p, errors.New("decode build error")
+		}
+		err = p.DecodeOrder(data)
+		return p, err
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(append(rs.WriteReg, rs.WriteData...), data) {
+		return errors.New("unexpected respond")
+	}
+	return nil
+}
+
+/**
+ * 设备地址修改成功后同步CONFIG
+ */
+func (c *Collector) applyCommandAddr(cmd *SensorCommand) {
+	patch, _ := json.Marshal(map[string]uint16{"addr": cmd.Value})
+	if _, err := c.ModifySensorConfig(context.Background(), c.Config().Version, cmd.SensorID, patch); err != nil {
+		c.PushMQLog(MQ_LOG_FAIL, "设备地址已修改, CONFIG同步失败: "+err.Error(), cmd.SensorID)
+	}
+}
+
+/**
+ * 移除过期指令并重试其余指令, 收集器停止时退出
+ */
+func (c *Collector) runCommands() {
+	ticker := time.NewTicker(COMMAND_RETRY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.draining:
+			return
+		case <-ticker.C:
+			c.retryCommands()
+		}
+	}
+}
+
+func (c *Collector) retryCommands() {
+	var results []CommandResult
+	var sensors []string
+	c.commands.Lock()
+	var expired []*SensorCommand
+	for sensorID, list := range c.commands.pending {
+		for _, v := range list {
+			if !v.executing && v.expired() {
+				expired = append(expired, v)
+			}
+		}
+		sensors = append(sensors, sensorID)
+	}
+	for _, v := range expired {
+		results = append(results, c.commands.finish(v, COMMAND_EXPIRED, nil))
+	}
+	c.commands.Unlock()
+
+	for i, v := range results {
+		c.publishCommandResult(expired[i], v)
+	}
+	for _, v := range sensors {
+		c.dispatchCommands(v)
+	}
+}
+
+/**
+ * 请求超时时移除未执行的指令
+ */
+func (c *Collector) timeoutCommand(cmd *SensorCommand) {
+	c.commands.Lock()
+	if cmd.executing || !c.commands.contains(cmd) {
+		c.commands.Unlock()
+		return
+	}
+	res := c.commands.finish(cmd, COMMAND_EXPIRED, errors.New("request timeout"))
+	c.commands.Unlock()
+	c.publishCommandResult(cmd, res)
+}
+
+/**
+ * 发布指令结果, 通过MQTT提交的指令完成时同时应答
+ */
+func (c *Collector) publishCommandResult(cmd *SensorCommand, res CommandResult) {
+	fmt.Printf("[INFO] 指令%s ID:%s 指令:%s %s\n", res.Status, res.SensorID, res.Name, res.Error)
+	if cmd.topic != "" && res.Status != COMMAND_PENDING {
+		reply := ActionResult{RequestID: cmd.RequestID, Topic: cmd.topic, SensorID: cmd.SensorID, Error: res.Error, Data: res}
+		switch res.Status {
+		case COMMAND_ACKED:
+			reply.Status = RESULT_OK
+		case COMMAND_REJECTED:
+			reply.Status = RESULT_INVALID
+		case COMMAND_EXPIRED:
+			reply.Status = RESULT_TIMEOUT
+		default:
+			reply.Status = RESULT_ERROR
+		}
+		c.publishReply(cmd.ActionEnvelope, reply)
+	}
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	send, _ := json.Marshal(res)
+	c.publishStream(client, STREAM_COMMAND, c.Topic(TOPIC_COMMAND_RESULT), send)
+}
+
+/**
+ * 提交写指令
+ * @Topic sensor/action/command
+ * payload 为 SensorCommand
+ */
+func (c *Collector) CommandHandler(client mqtt.Client, message mqtt.Message) {
+	var cmd SensorCommand
+	if err := json.Unmarshal(message.Payload(), &cmd); err != nil {
+		c.publishReply(cmd.ActionEnvelope, ActionResult{Topic: message.Topic(), Status: RESULT_INVALID, Error: err.Error()})
+		return
+	}
+	// 广播的指令只处理本收集器的传感器
+	if _, err := c.GetLocalSensor(cmd.SensorID); err != nil && c.IsBroadcastTopic(message.Topic()) {
+		return
+	}
+	cmd.topic = message.Topic()
+	_, _ = c.SubmitCommand(cmd)
+}
+
+func CommandHandler(client mqtt.Client, message mqtt.Message) {
+	Default().CommandHandler(client, message)
+}
@@ -0,0 +1,87 @@
+package sensor
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubmitCommandRejected(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s"},
+	}}))
+	if res, err := c.SubmitCommand(SensorCommand{SensorID: "x", Name: COMMAND_ZERO}); err == nil || res.Status != COMMAND_REJECTED {
+		t.Error("command for unknown sensor accepted")
+	}
+	if _, err := c.SubmitCommand(SensorCommand{SensorID: "s", Name: "reboot"}); err == nil {
+		t.Error("unknown command accepted")
+	}
+	if _, err := c.SubmitCommand(SensorCommand{SensorID: "s", Name: COMMAND_ADDR, Value: 300}); err == nil {
+		t.Error("invalid addr accepted")
+	}
+	if res, err := c.SubmitCommand(SensorCommand{SensorID: "s", Name: COMMAND_ZERO}); err != nil || res.Status != COMMAND_PENDING {
+		t.Fatal(res, err)
+	}
+	if len(c.PendingCommands("s")) != 1 {
+		t.Error("command not queued while DTU offline")
+	}
+}
+
+func TestCommandRetryOnReconnect(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s"},
+	}}), WithListenAddress("127.0.0.1:0"))
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(context.Background())
+
+	// DTU未连接时缓存
+	res, err := c.SubmitCommand(SensorCommand{SensorID: "s", Name: COMMAND_WRITE, Register: 0x1000, Value: 7, Policy: COMMAND_UNTIL_ACKED})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟DTU: 回应状态扫描, 原样返回写指令
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	written := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 20)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x01})
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		written <- buf[:n]
+		_, _ = conn.Write(buf[:n])
+	}()
+
+	select {
+	case frame := <-written:
+		if !bytes.Equal(frame, ComposeBody([]byte{1}, []byte{0x06}, []byte{0x10, 0x00, 0x00, 0x07})) {
+			t.Errorf("unexpected frame %v", frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command not sent after DTU connected")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if r, ok := c.CommandResult(res.ID); ok {
+			if r.Status != COMMAND_ACKED || r.Attempts != 1 {
+				t.Errorf("unexpected result %+v", r)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("command not acknowledged")
+}
@@ -3,10 +3,11 @@ package sensor
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -90,7 +91,7 @@ func SplitAndValidate(src []byte) (DeviceMeta, []byte, error) {
 			return meta, src[2:base], nil
 		} else if src[1] == 0x03 {
 			return meta, src[3:base], nil
-		} else if src[1] == 0x06 {
+		} else if src[1] == 0x06 || src[1] == 0x05 {
 			return meta, src[2:base], nil
 		}
 	}
@@ -153,36 +154,89 @@ const (
 // 传感器参数 包含自定义任务和状态等信息
 type LocalSensorInformation struct {
 	// ==========OPTIONS============
-	TaskHandler func(body TaskSensorBody, wg *sync.WaitGroup) `json:"-"` // 自定义传感器任务
-	Status      int                                           `json:"-"` // 传感器状态
+	TaskHandler func(body TaskSensorBody, wg *sync.WaitGroup) `json:"-" yaml:"-" toml:"-"` // 自定义传感器任务
+	Status      int                                           `json:"-" yaml:"-" toml:"-"` // 传感器状态
 	// ==========CONFIGS============
-	Addr     byte   `json:"addr"`     // 传感器设备地址
-	Type     byte   `json:"type"`     // 传感器类型
-	Attach   string `json:"attach"`   // 传感器附着的透传设备
-	Interval int64  `json:"interval"` // 最大间隔时间(秒)
-	SensorID string `json:"sensorID"` // 传感器ID
+	Addr     byte   `json:"addr" yaml:"addr" toml:"addr"`             // 传感器设备地址
+	Type     byte   `json:"type" yaml:"type" toml:"type"`             // 传感器类型
+	Attach   string `json:"attach" yaml:"attach" toml:"attach"`       // 传感器附着的透传设备
+	Interval int64  `json:"interval" yaml:"interval" toml:"interval"` // 最大间隔时间(秒)
+	SensorID string `json:"sensorID" yaml:"sensorID" toml:"sensorID"` // 传感器ID
+
+	Retention int64 `json:"retention,omitempty" yaml:"retention,omitempty" toml:"retention,omitempty"` // 历史数据保留时间(秒), 缺省为history_retention
+
+	collector *Collector // 所属的收集器
 }
 
 // 下位机参数
 type LocalDeviceDetail struct {
-	Name           string  `json:"name"`             // 收集器名称
-	BrokerIP       string  `json:"broker_ip"`        // 中间件地址
-	BrokerPort     string  `json:"broker_port"`      // 中间件端口
-	BrokerScheme   string  `json:"broker_scheme"`    // 中间件协议
-	BrokerUsername string  `json:"broker_username"`  // 中间件用户名
-	BrokerPassword string  `json:"broker_password"`  // 中间件密码
-	BrokerClientID *string `json:"broker_client_id"` // ClientID
-
-	LocalSensorInformation []*LocalSensorInformation `json:"localSensorInformation"` // 传感器集合
+	Version         int64   `json:"version" yaml:"version" toml:"version"`                                                          // CONFIG版本, 每次远程修改后递增
+	Name            string  `json:"name" yaml:"name" toml:"name"`                                                                   // 收集器名称
+	BrokerIP        string  `json:"broker_ip" yaml:"broker_ip" toml:"broker_ip"`                                                    // 中间件地址
+	BrokerPort      string  `json:"broker_port" yaml:"broker_port" toml:"broker_port"`                                              // 中间件端口
+	BrokerScheme    string  `json:"broker_scheme" yaml:"broker_scheme" toml:"broker_scheme"`                                        // 中间件协议
+	BrokerUsername  string  `json:"broker_username" yaml:"broker_username" toml:"broker_username"`                                  // 中间件用户名
+	BrokerPassword  string  `json:"broker_password" yaml:"broker_password" toml:"broker_password"`                                  // 中间件密码
+	BrokerClientID  *string `json:"broker_client_id,omitempty" yaml:"broker_client_id,omitempty" toml:"broker_client_id"`           // ClientID
+	SecretsFile     string  `json:"secrets_file,omitempty" yaml:"secrets_file,omitempty" toml:"secrets_file,omitempty"`             // 密钥文件(secret:引用)
+	SecretKeyFile   string  `json:"secret_key_file,omitempty" yaml:"secret_key_file,omitempty" toml:"secret_key_file,omitempty"`    // 加密密钥(enc:引用)
+	Site            string  `json:"site,omitempty" yaml:"site,omitempty" toml:"site,omitempty"`                                     // 站点, 用于topic_prefix中的{site}
+	TopicPrefix     string  `json:"topic_prefix,omitempty" yaml:"topic_prefix,omitempty" toml:"topic_prefix,omitempty"`             // MQTT主题前缀, 可含{site}/{collector}
+	BroadcastPrefix string  `json:"broadcast_prefix,omitempty" yaml:"broadcast_prefix,omitempty" toml:"broadcast_prefix,omitempty"` // 广播指令的主题前缀
+	OutboxDir       string  `json:"outbox_dir,omitempty" yaml:"outbox_dir,omitempty" toml:"outbox_dir,omitempty"`                   // 数据缓存目录, 缺省为CONFIG所在目录下的outbox
+	OutboxMaxBytes  int64   `json:"outbox_max_bytes,omitempty" yaml:"outbox_max_bytes,omitempty" toml:"outbox_max_bytes,omitempty"` // 数据缓存上限(字节)
+	OutboxMaxAge    int64   `json:"outbox_max_age,omitempty" yaml:"outbox_max_age,omitempty" toml:"outbox_max_age,omitempty"`       // 数据缓存保留时间(秒)
+
+	// ==========历史数据============
+	HistoryDir       string `json:"history_dir,omitempty" yaml:"history_dir,omitempty" toml:"history_dir,omitempty"`                   // 历史数据目录, 缺省为CONFIG所在目录下的history
+	HistoryRetention int64  `json:"history_retention,omitempty" yaml:"history_retention,omitempty" toml:"history_retention,omitempty"` // 历史数据保留时间(秒), 缺省30天
+
+	Alarms []*AlarmRule `json:"alarms,omitempty" yaml:"alarms,omitempty" toml:"alarms,omitempty"` // 报警规则
+
+	// ==========增氧控制============
+	Relays       []*Relay       `json:"relays,omitempty" yaml:"relays,omitempty" toml:"relays,omitempty"` // 继电器
+	ControlRules []*ControlRule `json:"rules,omitempty" yaml:"rules,omitempty" toml:"rules,omitempty"`    // 控制规则
+
+	// ==========MQTT连接============
+	MQTTKeepAlive            int64 `json:"mqtt_keepalive,omitempty" yaml:"mqtt_keepalive,omitempty" toml:"mqtt_keepalive,omitempty"`                                        // MQTT心跳间隔(秒)
+	MQTTCleanSession         *bool `json:"mqtt_clean_session,omitempty" yaml:"mqtt_clean_session,omitempty" toml:"mqtt_clean_session,omitempty"`                            // 缺省为true, false时使用持久会话
+	MQTTMaxReconnectInterval int64 `json:"mqtt_max_reconnect_interval,omitempty" yaml:"mqtt_max_reconnect_interval,omitempty" toml:"mqtt_max_reconnect_interval,omitempty"` // 重连的最大间隔(秒)
+
+	// ==========TLS============
+	BrokerCAFile             string   `json:"broker_ca_file,omitempty" yaml:"broker_ca_file,omitempty" toml:"broker_ca_file,omitempty"`                                        // 中间件的CA证书(PEM), 缺省使用系统根证书
+	BrokerCertFile           string   `json:"broker_cert_file,omitempty" yaml:"broker_cert_file,omitempty" toml:"broker_cert_file,omitempty"`                                  // 客户端证书(PEM)
+	BrokerKeyFile            string   `json:"broker_key_file,omitempty" yaml:"broker_key_file,omitempty" toml:"broker_key_file,omitempty"`                                     // 客户端私钥(PEM)
+	BrokerServerName         string   `json:"broker_server_name,omitempty" yaml:"broker_server_name,omitempty" toml:"broker_server_name,omitempty"`                            // 校验证书时使用的域名, 缺省为broker_ip
+	BrokerInsecureSkipVerify bool     `json:"broker_insecure_skip_verify,omitempty" yaml:"broker_insecure_skip_verify,omitempty" toml:"broker_insecure_skip_verify,omitempty"` // 不校验中间件证书, 仅用于测试环境
+	BrokerPinSHA256          []string `json:"broker_pin_sha256,omitempty" yaml:"broker_pin_sha256,omitempty" toml:"broker_pin_sha256,omitempty"`                               // 固定的证书公钥SHA-256(base64), 中间件证书链须匹配其一
+
+	Streams   map[string]*StreamOptions `json:"streams,omitempty" yaml:"streams,omitempty" toml:"streams,omitempty"`       // 各数据流的QoS/保留/编码
+	Sparkplug *SparkplugOptions         `json:"sparkplug,omitempty" yaml:"sparkplug,omitempty" toml:"sparkplug,omitempty"` // Sparkplug B, 修改后需重启生效
+
+	HomeAssistant *HomeAssistantOptions `json:"homeassistant,omitempty" yaml:"homeassistant,omitempty" toml:"homeassistant,omitempty"` // Home Assistant自动发现
+	CommandAuth   *CommandAuthOptions   `json:"command_auth,omitempty" yaml:"command_auth,omitempty" toml:"command_auth,omitempty"`    // 指令签名, 配置后未签名的指令被拒绝
+
+	// ==========HTTP============
+	HTTPAddress string `json:"http_address,omitempty" yaml:"http_address,omitempty" toml:"http_address,omitempty"` // 管理接口监听地址, 为空时不启动, 修改后需重启生效
+	HTTPToken   string `json:"http_token,omitempty" yaml:"http_token,omitempty" toml:"http_token,omitempty"`       // 管理接口的Bearer令牌, 可使用密钥引用
+
+	LocalSensorInformation []*LocalSensorInformation `json:"localSensorInformation" yaml:"localSensorInformation" toml:"localSensorInformation"` // 传感器集合
+
+	secretRefs map[string]string // 密钥字段的原引用
 }
 
-func GetBrokerClientID() string {
-	id := GetLocalDevicesInstance().BrokerClientID
-	if id == nil {
+/**
+ * ClientID缺省时随机生成
+ */
+func (dl *LocalDeviceDetail) GetBrokerClientID() string {
+	if dl.BrokerClientID == nil {
 		return bson.NewObjectId().String()
-	} else {
-		return *id
 	}
+	return *dl.BrokerClientID
+}
+
+func GetBrokerClientID() string {
+	return GetLocalDevicesInstance().GetBrokerClientID()
 }
 
 func GetBrokerPassword() string {
@@ -205,33 +259,39 @@ func GetBrokerScheme() string {
 	return GetLocalDevicesInstance().BrokerScheme
 }
 
+// 指定CONFIG路径的环境变量
+const CONFIG_ENV = "SENSOR_CONFIG"
+
+/**
+ * 设置CONFIG路径, 应在首次加载CONFIG前调用
+ */
+func SetConfigPath(path string) {
+	Default().SetConfigPath(path)
+}
+
+func GetConfigPath() string {
+	return Default().GetConfigPath()
+}
+
 // 加载测试
 func GetConfigTest() *LocalDeviceDetail {
-	config := LoadConfig("cnf/conf.json")
+	config := LoadConfig(GetConfigPath())
 	return config
 }
 
-// 本地传感器信息()
-var localDeviceDetail *LocalDeviceDetail = nil
-
 /**
  * 参数加载
  */
 func GetLocalDevicesInstance() *LocalDeviceDetail {
-	if localDeviceDetail == nil {
-		localDeviceDetail = GetConfigTest()
-		return localDeviceDetail
-	} else {
-		return localDeviceDetail
-	}
+	return Default().Config()
 }
 
 /**
  * 重新加载
  */
 func ReloadDeviceInstance() *LocalDeviceDetail {
-	localDeviceDetail = GetConfigTest()
-	return localDeviceDetail
+	dl, _ := Default().ReloadConfig()
+	return dl
 }
 
 /**
@@ -240,75 +300,110 @@ func ReloadDeviceInstance() *LocalDeviceDetail {
  *
  */
 func (dl *LocalDeviceDetail) ReplaceLocalDeviceInstance() {
-	localDeviceDetail = dl
+	Default().SetConfig(dl)
 }
 
 const configFileSizeLimit = 10 << 20
 
-// Config加载
+// Config加载, 密钥无法解析时为空CONFIG
 func LoadConfig(path string) *LocalDeviceDetail {
+	config, err := ReadConfig(path)
+	if err != nil {
+		emit("%s\n", err)
+	}
+	return config
+}
+
+/**
+ * 读取CONFIG, 出错时仍返回已解析的部分(可能为空CONFIG)
+ * 密钥无法解析时返回空CONFIG及ErrSecretUnresolved
+ */
+func ReadConfig(path string) (*LocalDeviceDetail, error) {
 	var config LocalDeviceDetail
 	configFile, err := os.Open(path)
 	if err != nil {
-		emit("Failed to open config file '%s': %s\n", path, err)
-		return &config
+		return &config, fmt.Errorf("Failed to open config file '%s': %w", path, err)
 	}
+	defer configFile.Close()
 
 	fi, _ := configFile.Stat()
 	if size := fi.Size(); size > (configFileSizeLimit) {
-		emit("config file (%q) size exceeds reasonable limit (%d) - aborting", path, size)
-		return &config
+		return &config, fmt.Errorf("config file (%q) size exceeds reasonable limit (%d) - aborting", path, size)
 	}
 
 	if fi.Size() == 0 {
-		emit("config file (%q) is empty, skipping", path)
-		return &config
+		return &config, fmt.Errorf("config file (%q) is empty, skipping", path)
 	}
 
 	buffer := make([]byte, fi.Size())
-	_, err = configFile.Read(buffer)
-	buffer, err = StripComments(buffer)
+	_, err = io.ReadFull(configFile, buffer)
 	if err != nil {
-		emit("Failed to strip comments from json: %s\n", err)
-		return &config
+		return &config, fmt.Errorf("Failed to read config file '%s': %w", path, err)
 	}
 
-	buffer = []byte(os.ExpandEnv(string(buffer)))
+	format := ConfigFormat(path)
+	err = DecodeConfig(format, []byte(os.ExpandEnv(string(buffer))), &config)
+	if err != nil {
+		return &config, fmt.Errorf("Failed unmarshalling %s: %w", format, err)
+	}
+	// 密钥字段中的环境变量写回时保持原文, 不以展开后的明文写回
+	var raw LocalDeviceDetail
+	if DecodeConfig(format, buffer, &raw) == nil {
+		config.keepEnvSecrets(&raw)
+	} else {
+		fmt.Println("[WARN] CONFIG中的环境变量无法还原, 密钥字段将以明文写回")
+	}
 
-	err = json.Unmarshal(buffer, &config)
+	// 密钥无法解析时不返回已解析的部分, 避免引用被当作明文使用
+	err = config.ResolveSecrets()
 	if err != nil {
-		emit("Failed unmarshalling json: %s\n", err)
-		return &config
+		return &LocalDeviceDetail{}, fmt.Errorf("Failed to resolve secrets: %w", err)
 	}
-	return &config
+	return &config, nil
 }
 
 /*
  * 保存CONFIG
+ * 按CONFIG路径的格式写回, 并保留原文件中的注释行, 密钥不以明文写回
  */
 func (dl *LocalDeviceDetail) DumpConfig() error {
-	fp, err := os.Create("cnf/conf.json")
+	return dl.DumpConfigTo(GetConfigPath())
+}
+
+func (dl *LocalDeviceDetail) DumpConfigTo(path string) error {
+	format := ConfigFormat(path)
+	sealed, err := dl.sealSecrets()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer fp.Close()
-
-	data, err := json.Marshal(dl)
+	data, err := EncodeConfig(format, sealed)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	n, err := fp.Write(data)
-	if err != nil {
+	mode := os.FileMode(0644)
+	if origin, err := ioutil.ReadFile(path); err == nil {
+		data = KeepComments(format, origin, data)
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode()
+		}
+	}
+
+	// 先写临时文件再替换, 避免写入中断时损坏CONFIG
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
 		return err
 	}
-	fmt.Println("[INFO] 已更新CONFIG文件 | 长度:", n)
+	fmt.Println("[INFO] 已更新CONFIG文件 | 长度:", len(data))
 	return nil
 }
 
 // 注释清除
 func StripComments(data []byte) ([]byte, error) {
-	data = bytes.Replace(data, []byte("\r"), []byte(""), 0)
+	data = bytes.Replace(data, []byte("\r"), []byte(""), -1)
 	lines := bytes.Split(data, []byte("\n"))
 	filtered := make([][]byte, 0)
 
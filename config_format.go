@@ -0,0 +1,207 @@
+package sensor
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"strings"
+)
+
+//=====================FORMAT===================
+//
+//            CONFIG格式 json/yaml/toml
+//
+//=====================END======================
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_YAML = "yaml"
+	FORMAT_TOML = "toml"
+)
+
+/**
+ * 根据文件扩展名得到CONFIG格式, 未知扩展名按json处理
+ */
+func ConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	case ".toml":
+		return FORMAT_TOML
+	default:
+		return FORMAT_JSON
+	}
+}
+
+/**
+ * CONFIG反序列化
+ * json格式允许以#开头的注释行
+ */
+func DecodeConfig(format string, data []byte, dl *LocalDeviceDetail) error {
+	switch format {
+	case FORMAT_YAML:
+		return yaml.Unmarshal(data, dl)
+	case FORMAT_TOML:
+		_, err := toml.Decode(string(data), dl)
+		return err
+	default:
+		data, err := StripComments(data)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, dl)
+	}
+}
+
+/**
+ * CONFIG序列化
+ */
+func EncodeConfig(format string, dl *LocalDeviceDetail) ([]byte, error) {
+	switch format {
+	case FORMAT_YAML:
+		return yaml.Marshal(dl)
+	case FORMAT_TOML:
+		// toml无法跳过func类型的字段(TaskHandler), 经json转为map后再编码
+		m, err := configTree(dl)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		enc := toml.NewEncoder(&buf)
+		enc.Indent = ""
+		err = enc.Encode(m)
+		return buf.Bytes(), err
+	default:
+		data, err := json.MarshalIndent(dl, "", "  ")
+		return append(data, '\n'), err
+	}
+}
+
+/**
+ * 把CONFIG转换为通用的map结构, 数值保持整数, 去除null字段
+ */
+func configTree(dl *LocalDeviceDetail) (map[string]interface{}, error) {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err = dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return normalizeTree(m).(map[string]interface{}), nil
+}
+
+func normalizeTree(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if e == nil {
+				delete(t, k)
+				continue
+			}
+			t[k] = normalizeTree(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalizeTree(e)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+/**
+ * 把原文件中的注释行重新插入到新生成的内容中
+ * 注释跟随其后第一个字段(按字段名及出现次序匹配), 文件末尾的注释保持在末尾
+ * @param format CONFIG格式
+ * @param origin 原文件内容
+ * @param data 新生成的内容
+ */
+func KeepComments(format string, origin, data []byte) []byte {
+	type position struct {
+		key string
+		n   int
+	}
+	blocks := make(map[position][]string)
+	seen := make(map[string]int)
+	var pending []string
+	for _, line := range strings.Split(strings.Replace(string(origin), "\r", "", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			pending = append(pending, trimmed)
+			continue
+		}
+		key := configLineKey(format, trimmed)
+		if key == "" {
+			continue
+		}
+		if len(pending) > 0 {
+			blocks[position{key, seen[key]}] = pending
+			pending = nil
+		}
+		seen[key]++
+	}
+	if len(blocks) == 0 && len(pending) == 0 {
+		return data
+	}
+
+	var out []string
+	seen = make(map[string]int)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if key := configLineKey(format, trimmed); key != "" {
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			for _, c := range blocks[position{key, seen[key]}] {
+				out = append(out, indent+c)
+			}
+			seen[key]++
+		}
+		out = append(out, line)
+	}
+	out = append(out, pending...)
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+/**
+ * 获取一行CONFIG中的字段名, 非字段行返回空
+ * toml的表头([table]/[[table]])整体作为字段名
+ */
+func configLineKey(format, line string) string {
+	switch format {
+	case FORMAT_YAML:
+		line = strings.TrimPrefix(line, "- ")
+		i := strings.Index(line, ":")
+		if i <= 0 || (i+1 < len(line) && line[i+1] != ' ') {
+			return ""
+		}
+		return strings.Trim(line[:i], `"'`)
+	case FORMAT_TOML:
+		if strings.HasPrefix(line, "[") {
+			return line
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return ""
+		}
+		return strings.Trim(strings.TrimSpace(line[:i]), `"'`)
+	default:
+		if !strings.HasPrefix(line, `"`) {
+			return ""
+		}
+		i := strings.Index(line[1:], `"`)
+		if i < 0 || !strings.HasPrefix(strings.TrimSpace(line[i+2:]), ":") {
+			return ""
+		}
+		return line[1 : i+1]
+	}
+}
@@ -0,0 +1,90 @@
+package sensor
+
+import (
+	"strings"
+	"testing"
+)
+
+var formatSample = map[string]string{
+	FORMAT_JSON: `{
+  # 收集器名称
+  "name": "示例收集器名",
+  "broker_port": "1883",
+  "localSensorInformation": [
+    {
+      # 传感器物理地址
+      "addr": 6,
+      "attach": "172.20.10.4",
+      "interval": 10,
+      "sensorID": "a"
+    }
+  ]
+}
+`,
+	FORMAT_YAML: `# 收集器名称
+name: 示例收集器名
+broker_port: "1883"
+localSensorInformation:
+  # 传感器物理地址
+  - addr: 6
+    attach: 172.20.10.4
+    interval: 10
+    sensorID: a
+# 结尾
+`,
+	FORMAT_TOML: `# 收集器名称
+name = "示例收集器名"
+broker_port = "1883"
+
+# 传感器
+[[localSensorInformation]]
+# 传感器物理地址
+addr = 6
+attach = "172.20.10.4"
+interval = 10
+sensorID = "a"
+`,
+}
+
+func TestConfigFormat(t *testing.T) {
+	if ConfigFormat("cnf/conf.yml") != FORMAT_YAML || ConfigFormat("a.TOML") != FORMAT_TOML || ConfigFormat("cnf/conf.json") != FORMAT_JSON {
+		t.Fail()
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	for format, origin := range formatSample {
+		var dl LocalDeviceDetail
+		if err := DecodeConfig(format, []byte(origin), &dl); err != nil {
+			t.Fatal(format, err)
+		}
+		if dl.Name != "示例收集器名" || dl.BrokerPort != "1883" || len(dl.LocalSensorInformation) != 1 || dl.LocalSensorInformation[0].Addr != 6 {
+			t.Fatalf("%s: unexpected %+v", format, dl)
+		}
+
+		dl.LocalSensorInformation[0].Interval = 30
+		data, err := EncodeConfig(format, &dl)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		data = KeepComments(format, []byte(origin), data)
+		out := string(data)
+		t.Log(out)
+		for _, line := range strings.Split(origin, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") && !strings.Contains(out, strings.TrimSpace(line)) {
+				t.Errorf("%s: lost comment %q", format, line)
+			}
+		}
+		if strings.Index(out, "# 传感器物理地址") > strings.Index(out, "addr") {
+			t.Errorf("%s: comment moved after its key", format)
+		}
+
+		var back LocalDeviceDetail
+		if err := DecodeConfig(format, data, &back); err != nil {
+			t.Fatal(format, err)
+		}
+		if back.LocalSensorInformation[0].Interval != 30 {
+			t.Errorf("%s: interval not written back", format)
+		}
+	}
+}
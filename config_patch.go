@@ -0,0 +1,358 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//=====================PATCH====================
+//
+//                 CONFIG局部更新
+//
+//=====================END======================
+
+// 局部更新所支持的格式
+const (
+	PATCH_JSON  = "json-patch"  // RFC 6902
+	PATCH_MERGE = "merge-patch" // RFC 7386
+)
+
+var (
+	ErrVersionRequired = errors.New("missing config version precondition")
+	ErrVersionConflict = errors.New("config version conflict")
+	ErrUnknownPatch    = errors.New("unknown patch operation")
+)
+
+/**
+ * 以补丁的方式修改当前CONFIG
+ * 修改来自远程, 密钥字段不能改为新的引用, 中间件连接、指令签名及文件路径不能修改
+ * @param ctx 来自MQTT指令时, 已应答timeout则不再保存
+ * @param version 期望的当前CONFIG版本, 与本地不一致时拒绝修改, 避免更新丢失
+ * @param patch 对CONFIG的JSON文档进行修改的过程
+ * @return 修改后的CONFIG
+ */
+func (c *Collector) ApplyConfigChange(ctx context.Context, version int64, patch func(doc []byte) ([]byte, error)) (*LocalDeviceDetail, error) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+
+	cur := c.Config()
+	if cur.Version != version {
+		return nil, invalid(fmt.Errorf("%w: expected %d, current %d", ErrVersionConflict, version, cur.Version))
+	}
+
+	doc, err := json.Marshal(cur)
+	if err != nil {
+		return nil, err
+	}
+	// 以下错误均视为请求不合法
+	if doc, err = patch(doc); err != nil {
+		return nil, invalid(err)
+	}
+
+	var next LocalDeviceDetail
+	if err = json.Unmarshal(doc, &next); err != nil {
+		return nil, invalid(err)
+	}
+	if err = next.checkRemoteSecrets(cur); err != nil {
+		return nil, invalid(err)
+	}
+	next.inheritSecrets(cur)
+	if err = next.ResolveSecrets(); err != nil {
+		return nil, invalid(err)
+	}
+	if err = next.checkRemoteChange(cur); err != nil {
+		return nil, invalid(err)
+	}
+	if err = next.Validate(); err != nil {
+		return nil, invalid(err)
+	}
+	next.Version = cur.Version + 1
+	next.inheritRuntime(cur)
+
+	if err = commitAction(ctx); err != nil {
+		return nil, err
+	}
+	if err = c.SaveConfig(&next); err != nil {
+		return nil, err
+	}
+	c.SetConfig(&next)
+	c.reloadSensorTasks(&next, cur)
+	c.republishPresence(cur)
+	c.sparkplugRebirth()
+	return &next, nil
+}
+
+/**
+ * 使用RFC 6902/RFC 7386补丁修改CONFIG
+ * @param operation PATCH_JSON 或 PATCH_MERGE
+ */
+func (c *Collector) PatchConfig(ctx context.Context, version int64, operation string, data []byte) (*LocalDeviceDetail, error) {
+	switch operation {
+	case PATCH_JSON:
+		p, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		return c.ApplyConfigChange(ctx, version, p.Apply)
+	case PATCH_MERGE:
+		return c.ApplyConfigChange(ctx, version, func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, data)
+		})
+	default:
+		return nil, invalid(ErrUnknownPatch)
+	}
+}
+
+/**
+ * 新增传感器
+ */
+func (c *Collector) AddSensorConfig(ctx context.Context, version int64, ls LocalSensorInformation) (*LocalDeviceDetail, error) {
+	return c.ApplyConfigChange(ctx, version, func(doc []byte) ([]byte, error) {
+		return editSensors(doc, func(list []json.RawMessage) ([]json.RawMessage, error) {
+			item, err := json.Marshal(ls)
+			if err != nil {
+				return nil, err
+			}
+			return append(list, item), nil
+		})
+	})
+}
+
+/**
+ * 移除传感器
+ */
+func (c *Collector) RemoveSensorConfig(ctx context.Context, version int64, sensorID string) (*LocalDeviceDetail, error) {
+	return c.ApplyConfigChange(ctx, version, func(doc []byte) ([]byte, error) {
+		return editSensors(doc, func(list []json.RawMessage) ([]json.RawMessage, error) {
+			i, err := findSensor(list, sensorID)
+			if err != nil {
+				return nil, err
+			}
+			return append(list[:i], list[i+1:]...), nil
+		})
+	})
+}
+
+/**
+ * 以merge-patch修改单个传感器, 例如 {"interval": 30}
+ */
+func (c *Collector) ModifySensorConfig(ctx context.Context, version int64, sensorID string, mergePatch []byte) (*LocalDeviceDetail, error) {
+	return c.ApplyConfigChange(ctx, version, func(doc []byte) ([]byte, error) {
+		return editSensors(doc, func(list []json.RawMessage) ([]json.RawMessage, error) {
+			i, err := findSensor(list, sensorID)
+			if err != nil {
+				return nil, err
+			}
+			if list[i], err = jsonpatch.MergePatch(list[i], mergePatch); err != nil {
+				return nil, err
+			}
+			return list, nil
+		})
+	})
+}
+
+/**
+ * 修改CONFIG文档中的传感器集合
+ */
+func editSensors(doc []byte, edit func(list []json.RawMessage) ([]json.RawMessage, error)) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, err
+	}
+	var list []json.RawMessage
+	if raw, ok := m["localSensorInformation"]; ok {
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+	}
+	list, err := edit(list)
+	if err != nil {
+		return nil, err
+	}
+	if m["localSensorInformation"], err = json.Marshal(list); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+func findSensor(list []json.RawMessage, sensorID string) (int, error) {
+	for i, v := range list {
+		var ls LocalSensorInformation
+		if err := json.Unmarshal(v, &ls); err != nil {
+			return 0, err
+		}
+		if ls.SensorID == sensorID {
+			return i, nil
+		}
+	}
+	return 0, errors.New("not find sensorID for this device")
+}
+
+/**
+ * CONFIG合法性检查
+ */
+func (dl *LocalDeviceDetail) Validate() error {
+	if err := validTopic(dl.TopicPrefix); err != nil {
+		return fmt.Errorf("invalid topic_prefix: %w", err)
+	}
+	if err := validTopic(dl.BroadcastPrefix); err != nil {
+		return fmt.Errorf("invalid broadcast_prefix: %w", err)
+	}
+	if dl.HistoryRetention < 0 {
+		return errors.New("invalid history_retention")
+	}
+	if dl.MQTTKeepAlive < 0 || dl.MQTTMaxReconnectInterval < 0 {
+		return errors.New("invalid mqtt keepalive or reconnect interval")
+	}
+	// 持久会话以ClientID区分, 随机ClientID无法恢复会话
+	if !dl.CleanSession() && dl.BrokerClientID == nil {
+		return errors.New("mqtt_clean_session=false requires broker_client_id")
+	}
+	if err := checkHTTPExposure(dl.HTTPAddress, dl.HTTPToken); err != nil {
+		return err
+	}
+	if err := dl.validateTLS(); err != nil {
+		return err
+	}
+	if err := dl.validateStreams(); err != nil {
+		return err
+	}
+	if dl.Sparkplug != nil {
+		if err := dl.Sparkplug.validate(dl); err != nil {
+			return err
+		}
+	}
+	if err := dl.validateHomeAssistant(); err != nil {
+		return err
+	}
+	if err := dl.validateAlarms(); err != nil {
+		return err
+	}
+	if err := dl.validateControl(); err != nil {
+		return err
+	}
+	if dl.CommandAuth != nil {
+		if err := dl.CommandAuth.validate(); err != nil {
+			return err
+		}
+	}
+	ids := make(map[string]bool)
+	keys := make(map[TaskSensorKey]bool)
+	for _, v := range dl.LocalSensorInformation {
+		if v == nil {
+			return errors.New("empty sensor")
+		}
+		if v.SensorID == "" {
+			return errors.New("empty sensorID")
+		}
+		if strings.ContainsAny(v.SensorID, "/+#") {
+			return fmt.Errorf("invalid sensorID %s", v.SensorID)
+		}
+		if ids[v.SensorID] {
+			return fmt.Errorf("duplicate sensorID %s", v.SensorID)
+		}
+		ids[v.SensorID] = true
+		if !IsIp(v.Attach) {
+			return fmt.Errorf("invalid attach ip %q for sensor %s", v.Attach, v.SensorID)
+		}
+		if v.Interval <= 0 {
+			return fmt.Errorf("invalid interval %d for sensor %s", v.Interval, v.SensorID)
+		}
+		if v.Retention < 0 {
+			return fmt.Errorf("invalid retention %d for sensor %s", v.Retention, v.SensorID)
+		}
+		// 任务key不可重复, 否则TimeWheel会拒绝该任务
+		key := TaskSensorKey{v.Addr, v.Attach, v.Type}
+		if keys[key] {
+			return fmt.Errorf("duplicate addr %d on %s for sensor %s", v.Addr, v.Attach, v.SensorID)
+		}
+		keys[key] = true
+	}
+	return nil
+}
+
+/**
+ * 不能远程修改的字段, 只能修改本地CONFIG文件:
+ * 中间件地址及账号(修改后继承的密码会被发送到新的中间件)、指令签名(可以关闭签名)、本地文件路径
+ */
+func (dl *LocalDeviceDetail) protectedFields() map[string]interface{} {
+	return map[string]interface{}{
+		"broker_ip":                   dl.BrokerIP,
+		"broker_port":                 dl.BrokerPort,
+		"broker_scheme":               dl.BrokerScheme,
+		"broker_username":             dl.BrokerUsername,
+		"broker_password":             dl.BrokerPassword,
+		"broker_client_id":            dl.BrokerClientID,
+		"broker_ca_file":              dl.BrokerCAFile,
+		"broker_cert_file":            dl.BrokerCertFile,
+		"broker_key_file":             dl.BrokerKeyFile,
+		"broker_server_name":          dl.BrokerServerName,
+		"broker_insecure_skip_verify": dl.BrokerInsecureSkipVerify,
+		"broker_pin_sha256":           dl.BrokerPinSHA256,
+		"secrets_file":                dl.SecretsFile,
+		"secret_key_file":             dl.SecretKeyFile,
+		"outbox_dir":                  dl.OutboxDir,
+		"history_dir":                 dl.HistoryDir,
+		"command_auth":                dl.CommandAuth,
+	}
+}
+
+/**
+ * 检查远程修改是否改变了不可远程修改的字段, 密钥字段比较解析后的值
+ */
+func (dl *LocalDeviceDetail) checkRemoteChange(old *LocalDeviceDetail) error {
+	oldFields := old.protectedFields()
+	var changed []string
+	for name, v := range dl.protectedFields() {
+		if !reflect.DeepEqual(v, oldFields[name]) {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return fmt.Errorf("%s cannot be changed remotely", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+/**
+ * 保留原传感器的运行时状态(状态与自定义任务)
+ */
+func (dl *LocalDeviceDetail) inheritRuntime(old *LocalDeviceDetail) {
+	for _, v := range dl.LocalSensorInformation {
+		for _, o := range old.LocalSensorInformation {
+			if o.SensorID == v.SensorID {
+				v.Status = o.status()
+				v.TaskHandler = o.TaskHandler
+				break
+			}
+		}
+	}
+}
+
+/**
+ * 按新CONFIG重新安排已连接DTU上的传感器任务, 不需要重启TCP
+ */
+func (c *Collector) reloadSensorTasks(dl, old *LocalDeviceDetail) {
+	for _, v := range old.LocalSensorInformation {
+		_ = v.RemoveTask()
+	}
+	for _, v := range dl.LocalSensorInformation {
+		ch, ok := c.GetTaskChannel(v.Attach)
+		if !ok {
+			// DTU未连接, 等待连接时由TaskSetup创建
+			continue
+		}
+		if err := v.CreateTask(-1, ch); err != nil {
+			fmt.Println("[WARN] 重新创建任务失败 ID:"+v.SensorID, err)
+			continue
+		}
+		fmt.Println("[INFO] 进入队列 ID:" + v.SensorID)
+	}
+}
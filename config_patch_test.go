@@ -0,0 +1,106 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dl := LocalDeviceDetail{LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 6, Attach: "172.20.10.4", Interval: 10, SensorID: "a"},
+		{Addr: 3, Attach: "172.20.10.7", Interval: 5, SensorID: "b"},
+	}}
+	if err := dl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	dl.LocalSensorInformation[1].SensorID = "a"
+	if dl.Validate() == nil {
+		t.Error("duplicate sensorID accepted")
+	}
+	dl.LocalSensorInformation[1].SensorID = "b"
+
+	dl.LocalSensorInformation[1].Attach = "172.20.10"
+	if dl.Validate() == nil {
+		t.Error("invalid attach accepted")
+	}
+	dl.LocalSensorInformation[1].Attach = "172.20.10.4"
+	dl.LocalSensorInformation[1].Addr = 6
+	if dl.Validate() == nil {
+		t.Error("duplicate addr on same attach accepted")
+	}
+	dl.LocalSensorInformation[1].Addr = 3
+
+	clean := false
+	dl.MQTTCleanSession = &clean
+	if dl.Validate() == nil {
+		t.Error("persistent session without client id accepted")
+	}
+}
+
+func TestEditSensors(t *testing.T) {
+	doc := []byte(`{"name":"n","localSensorInformation":[{"addr":6,"sensorID":"a"},{"addr":3,"sensorID":"b"}]}`)
+	out, err := editSensors(doc, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		i, err := findSensor(list, "a")
+		if err != nil {
+			return nil, err
+		}
+		return append(list[:i], list[i+1:]...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl LocalDeviceDetail
+	if err := json.Unmarshal(out, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Name != "n" || len(dl.LocalSensorInformation) != 1 || dl.LocalSensorInformation[0].SensorID != "b" {
+		t.Errorf("unexpected result %s", out)
+	}
+
+	if _, err := findSensor(nil, "x"); err == nil {
+		t.Error("unknown sensorID found")
+	}
+}
+
+func TestPatchConfigVersionConflict(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Version: 3}))
+	_, err := c.PatchConfig(context.Background(), 4, PATCH_MERGE, []byte(`{"name":"x"}`))
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected version conflict, got %v", err)
+	}
+}
+
+func TestSettingConfigUnversioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := newFakeClient()
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{Version: 2, LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s"},
+	}}), WithMQTTClient(client))
+
+	// 未携带version的替换同样需要校验
+	data, _ := json.Marshal(LocalDeviceDetail{LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "a"},
+		{Addr: 2, Attach: "127.0.0.1", Interval: 60, SensorID: "a"},
+	}})
+	payload, _ := json.Marshal(SensorAction{Data: data, ActionEnvelope: ActionEnvelope{ReplyTo: "app/1"}})
+	c.SettingConfigHandler(client, fakeMessage{topic: "sensor/setting/all", payload: payload})
+	if res := actionResult(t, client, "app/1"); res.Status != RESULT_INVALID {
+		t.Errorf("invalid config accepted %+v", res)
+	}
+	if dl := c.Config(); dl.Version != 2 || dl.LocalSensorInformation[0].SensorID != "s" {
+		t.Errorf("config changed %+v", dl)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "conf.json")); !os.IsNotExist(err) {
+		t.Errorf("invalid config saved: %v", err)
+	}
+}
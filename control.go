@@ -0,0 +1,797 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//=====================CONTROL==================
+//
+//      按测量结果自动开关增氧机等继电器(线圈), 含最短开关时间、互锁、手动覆盖及时段
+//
+//=====================END======================
+
+const (
+	CONTROL_INTERVAL = 5 * time.Second  // 检查时段、覆盖到期及暂缓的切换
+	CONTROL_RETRY    = 30 * time.Second // 写线圈失败后的重试间隔
+)
+
+// 继电器状态及手动覆盖
+const (
+	RELAY_ON      = "on"
+	RELAY_OFF     = "off"
+	RELAY_UNKNOWN = "unknown" // 启动后尚未写入
+	RELAY_AUTO    = "auto"    // 按规则控制, 覆盖时为解除手动覆盖
+	RELAY_MANUAL  = "manual"  // 手动覆盖中
+)
+
+// 控制记录的动作
+const (
+	CONTROL_SWITCH   = "switch"   // 已切换
+	CONTROL_FAILED   = "failed"   // 写线圈失败
+	CONTROL_BLOCKED  = "blocked"  // 因最短开关时间或互锁暂缓切换
+	CONTROL_OVERRIDE = "override" // 设置手动覆盖
+	CONTROL_RELEASE  = "release"  // 解除手动覆盖(含到期)
+)
+
+// 控制记录的主题(命名空间内)
+const TOPIC_CONTROL = "control"
+
+// 控制记录的文件名前缀, 与传感器目录同在历史数据目录下
+const controlFilePrefix = "control-"
+
+/**
+ * 继电器, DTU上的一个线圈(功能码0x05)
+ */
+type Relay struct {
+	ID        string   `json:"id" yaml:"id" toml:"id"`                                                    // 继电器ID, 例如pond-a-aerator
+	Attach    string   `json:"attach" yaml:"attach" toml:"attach"`                                        // 所在DTU
+	Addr      byte     `json:"addr" yaml:"addr" toml:"addr"`                                              // 设备地址
+	Coil      uint16   `json:"coil" yaml:"coil" toml:"coil"`                                              // 线圈地址
+	MinOn     int64    `json:"minOn,omitempty" yaml:"minOn,omitempty" toml:"minOn,omitempty"`             // 最短开启时间(秒)
+	MinOff    int64    `json:"minOff,omitempty" yaml:"minOff,omitempty" toml:"minOff,omitempty"`          // 最短关闭时间(秒)
+	Interlock []string `json:"interlock,omitempty" yaml:"interlock,omitempty" toml:"interlock,omitempty"` // 互锁的继电器, 其中任一开启时不开启
+}
+
+/**
+ * 控制规则, 同一继电器的任一规则请求开启时开启, 否则关闭
+ * on为空时仅按时段开启
+ */
+type ControlRule struct {
+	ID       string   `json:"id" yaml:"id" toml:"id"`                                                 // 规则ID
+	Relay    string   `json:"relay" yaml:"relay" toml:"relay"`                                        // 继电器ID
+	SensorID string   `json:"sensorID,omitempty" yaml:"sensorID,omitempty" toml:"sensorID,omitempty"` // 条件中测量项所属的传感器
+	On       string   `json:"on,omitempty" yaml:"on,omitempty" toml:"on,omitempty"`                   // 开启条件, 例如 Oxygen < 4.0
+	Off      string   `json:"off,omitempty" yaml:"off,omitempty" toml:"off,omitempty"`                // 关闭条件, 缺省为开启条件不成立
+	For      int64    `json:"for,omitempty" yaml:"for,omitempty" toml:"for,omitempty"`                // 开启条件持续的秒数
+	OffFor   int64    `json:"offFor,omitempty" yaml:"offFor,omitempty" toml:"offFor,omitempty"`       // 关闭条件持续的秒数
+	Schedule []string `json:"schedule,omitempty" yaml:"schedule,omitempty" toml:"schedule,omitempty"` // 生效时段 HH:MM-HH:MM(本地时间), 缺省全天
+}
+
+/**
+ * 解析时段, 结束早于开始时跨越零点
+ * @return 开始及结束的分钟数
+ */
+func parseSchedule(s string) (int, int, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid schedule %s", s)
+	}
+	var minutes [2]int
+	for i, v := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(v))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid schedule %s", s)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("empty schedule %s", s)
+	}
+	return minutes[0], minutes[1], nil
+}
+
+/**
+ * 当前是否在生效时段内
+ */
+func (r *ControlRule) inSchedule(now time.Time) bool {
+	if len(r.Schedule) == 0 {
+		return true
+	}
+	m := now.Hour()*60 + now.Minute()
+	for _, v := range r.Schedule {
+		start, end, err := parseSchedule(v)
+		if err != nil {
+			continue
+		}
+		if start < end && m >= start && m < end || start > end && (m >= start || m < end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ControlRule) validate(relays map[string]bool) error {
+	if r.ID == "" {
+		return errors.New("empty rule id")
+	}
+	if !relays[r.Relay] {
+		return fmt.Errorf("rule %s: unknown relay %s", r.ID, r.Relay)
+	}
+	if r.On == "" && len(r.Schedule) == 0 {
+		return fmt.Errorf("rule %s requires on or schedule", r.ID)
+	}
+	if r.On == "" && r.Off != "" {
+		return fmt.Errorf("rule %s: off requires on", r.ID)
+	}
+	if r.On != "" && r.SensorID == "" {
+		return fmt.Errorf("rule %s requires sensorID", r.ID)
+	}
+	for _, v := range []string{r.On, r.Off} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseCondition(v); err != nil {
+			return fmt.Errorf("rule %s: %s", r.ID, err)
+		}
+	}
+	if r.For < 0 || r.OffFor < 0 {
+		return fmt.Errorf("rule %s: for and offFor must not be negative", r.ID)
+	}
+	for _, v := range r.Schedule {
+		if _, _, err := parseSchedule(v); err != nil {
+			return fmt.Errorf("rule %s: %s", r.ID, err)
+		}
+	}
+	return nil
+}
+
+func (dl *LocalDeviceDetail) validateControl() error {
+	relays := make(map[string]bool)
+	for _, v := range dl.Relays {
+		if v == nil || v.ID == "" {
+			return errors.New("empty relay id")
+		}
+		if relays[v.ID] {
+			return fmt.Errorf("duplicate relay id %s", v.ID)
+		}
+		if v.Attach == "" || v.Addr < 1 || v.Addr > 247 {
+			return fmt.Errorf("relay %s requires attach and addr between 1 and 247", v.ID)
+		}
+		if v.MinOn < 0 || v.MinOff < 0 {
+			return fmt.Errorf("relay %s: minOn and minOff must not be negative", v.ID)
+		}
+		relays[v.ID] = true
+	}
+	for _, v := range dl.Relays {
+		for _, id := range v.Interlock {
+			if !relays[id] || id == v.ID {
+				return fmt.Errorf("relay %s: invalid interlock %s", v.ID, id)
+			}
+		}
+	}
+	ids := make(map[string]bool)
+	for _, r := range dl.ControlRules {
+		if r == nil {
+			return errors.New("empty rule")
+		}
+		if err := r.validate(relays); err != nil {
+			return err
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate rule id %s", r.ID)
+		}
+		ids[r.ID] = true
+	}
+	return nil
+}
+
+/**
+ * 控制记录, 每次切换、失败、暂缓及手动覆盖都会记录
+ */
+type ControlAudit struct {
+	Time   time.Time          `json:"time"`
+	Relay  string             `json:"relay"`
+	Action string             `json:"action"`
+	State  string             `json:"state,omitempty"`  // 目标状态on/off
+	Rule   string             `json:"rule,omitempty"`   // 相关的规则
+	Reason string             `json:"reason,omitempty"` // 例如满足的条件或暂缓的原因
+	Values map[string]float64 `json:"values,omitempty"` // 条件变化时的测量值
+	By     string             `json:"by,omitempty"`     // 手动覆盖的操作人
+	Error  string             `json:"error,omitempty"`
+}
+
+/**
+ * 继电器的当前状态
+ */
+type RelayStatus struct {
+	ID      string     `json:"id"`
+	State   string     `json:"state"` // on/off/unknown
+	Changed *time.Time `json:"changed,omitempty"`
+	Mode    string     `json:"mode"`              // auto/manual
+	Until   *time.Time `json:"until,omitempty"`   // 手动覆盖的到期时间
+	Rule    string     `json:"rule,omitempty"`    // 开启时为请求开启的规则
+	Blocked string     `json:"blocked,omitempty"` // 暂缓切换的原因
+	Pending bool       `json:"pending,omitempty"` // 正在写线圈
+}
+
+/**
+ * 单个规则的条件状态, 与报警一样以测量时间计算持续时间
+ */
+type ruleState struct {
+	since  time.Time          // 未请求开启时开启条件开始成立的时间, 否则为关闭条件
+	want   bool               // 请求开启
+	reason string             // 最近一次变化时成立的条件
+	values map[string]float64 // 最近一次变化时的测量值
+}
+
+/**
+ * 按测量值更新条件状态, 缺少测量项时保持不变
+ */
+func (st *ruleState) update(r *ControlRule, values map[string]float64, t time.Time) {
+	on, err := parseCondition(r.On)
+	if err != nil {
+		return
+	}
+	met, err := on.eval(values)
+	if err != nil {
+		return
+	}
+	cond, delay := r.On, r.For
+	if st.want {
+		cond, delay, met = "not ("+r.On+")", r.OffFor, !met
+		if r.Off != "" {
+			off, err := parseCondition(r.Off)
+			if err != nil {
+				return
+			}
+			if met, err = off.eval(values); err != nil {
+				return
+			}
+			cond = r.Off
+		}
+	}
+	if !met {
+		st.since = time.Time{}
+		return
+	}
+	if st.since.IsZero() {
+		st.since = t
+	}
+	if t.Sub(st.since) < time.Duration(delay)*time.Second {
+		return
+	}
+	st.want = !st.want
+	st.since = time.Time{}
+	st.reason = cond
+	st.values = values
+}
+
+/**
+ * 手动覆盖
+ */
+type relayOverride struct {
+	on      bool
+	until   time.Time // 为零时直到解除
+	by      string
+	comment string
+}
+
+type relayState struct {
+	on        bool
+	known     bool      // 启动后已写入
+	changed   time.Time // 最近一次切换的时间
+	rule      string    // 开启时为请求开启的规则
+	override  *relayOverride
+	pending   bool // 正在写线圈
+	pendingOn bool
+	retryAt   time.Time // 写入失败后的重试时间
+	blocked   string    // 暂缓切换的原因
+}
+
+func (st *relayState) state() string {
+	switch {
+	case !st.known:
+		return RELAY_UNKNOWN
+	case st.on:
+		return RELAY_ON
+	default:
+		return RELAY_OFF
+	}
+}
+
+/**
+ * 继电器的切换请求
+ */
+type relaySwitch struct {
+	relay Relay
+	on    bool
+	audit ControlAudit
+}
+
+/**
+ * 各规则及继电器的状态
+ */
+type controlEngine struct {
+	rules  map[string]*ruleState
+	relays map[string]*relayState
+	sync.Mutex
+}
+
+func newControlEngine() *controlEngine {
+	return &controlEngine{rules: make(map[string]*ruleState), relays: make(map[string]*relayState)}
+}
+
+func (e *controlEngine) rule(id string) *ruleState {
+	st, ok := e.rules[id]
+	if !ok {
+		st = &ruleState{}
+		e.rules[id] = st
+	}
+	return st
+}
+
+func (e *controlEngine) relay(id string) *relayState {
+	st, ok := e.relays[id]
+	if !ok {
+		st = &relayState{}
+		e.relays[id] = st
+	}
+	return st
+}
+
+/**
+ * 移除已删除的规则及继电器, 调用者需持有锁
+ */
+func (e *controlEngine) prune(dl *LocalDeviceDetail) {
+	rules := make(map[string]bool)
+	for _, r := range dl.ControlRules {
+		rules[r.ID] = true
+	}
+	for id := range e.rules {
+		if !rules[id] {
+			delete(e.rules, id)
+		}
+	}
+	relays := make(map[string]bool)
+	for _, v := range dl.Relays {
+		relays[v.ID] = true
+	}
+	for id := range e.relays {
+		if !relays[id] {
+			delete(e.relays, id)
+		}
+	}
+}
+
+/**
+ * 继电器的目标状态, 调用者需持有锁
+ */
+func (e *controlEngine) desired(relay *Relay, rules []*ControlRule, st *relayState, now time.Time) (bool, ControlAudit) {
+	audit := ControlAudit{Relay: relay.ID, Action: CONTROL_SWITCH}
+	if ov := st.override; ov != nil {
+		audit.Reason, audit.By = "manual override", ov.by
+		if ov.comment != "" {
+			audit.Reason += ": " + ov.comment
+		}
+		return ov.on, audit
+	}
+	for _, r := range rules {
+		if r.Relay != relay.ID || !r.inSchedule(now) {
+			continue
+		}
+		if r.On == "" {
+			audit.Rule, audit.Reason = r.ID, "schedule "+strings.Join(r.Schedule, ",")
+			return true, audit
+		}
+		if rs := e.rules[r.ID]; rs != nil && rs.want {
+			audit.Rule, audit.Reason, audit.Values = r.ID, rs.reason, rs.values
+			return true, audit
+		}
+	}
+	// 说明关闭的原因
+	audit.Reason = "no rule requests on"
+	for _, r := range rules {
+		if r.ID != st.rule {
+			continue
+		}
+		audit.Rule = r.ID
+		if rs := e.rules[r.ID]; !r.inSchedule(now) {
+			audit.Reason = "outside schedule"
+		} else if rs != nil {
+			audit.Reason, audit.Values = rs.reason, rs.values
+		}
+	}
+	return false, audit
+}
+
+/**
+ * 暂缓切换的原因, 调用者需持有锁
+ * 手动覆盖不受最短开关时间限制, 互锁始终有效
+ */
+func (e *controlEngine) blocked(relay *Relay, relays []*Relay, st *relayState, on bool, now time.Time) string {
+	if st.override == nil && st.known {
+		if st.on && now.Sub(st.changed) < time.Duration(relay.MinOn)*time.Second {
+			return "min on time"
+		}
+		if !st.on && now.Sub(st.changed) < time.Duration(relay.MinOff)*time.Second {
+			return "min off time"
+		}
+	}
+	if !on {
+		return ""
+	}
+	for _, v := range relays {
+		if v.ID == relay.ID || !containsString(relay.Interlock, v.ID) && !containsString(v.Interlock, relay.ID) {
+			continue
+		}
+		if other := e.relays[v.ID]; other != nil && (other.known && other.on || other.pending && other.pendingOn) {
+			return "interlock " + v.ID
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ========================collector===========================
+
+/**
+ * 按测量结果更新相关规则的条件并切换继电器
+ */
+func (c *Collector) evaluateControl(p ReadResult) {
+	dl := c.Config()
+	values := make(map[string]float64)
+	for _, v := range p.Items {
+		values[v.Name] = v.Value
+	}
+	c.control.Lock()
+	for _, r := range dl.ControlRules {
+		if r.On != "" && r.SensorID == p.SensorID {
+			c.control.rule(r.ID).update(r, values, p.Created)
+		}
+	}
+	c.control.Unlock()
+	c.applyControl(time.Now())
+}
+
+/**
+ * 按规则及手动覆盖切换继电器
+ * DTU未连接、正在写入或等待重试的继电器跳过, 写线圈在后台进行(调用者可能在DTU任务队列中)
+ */
+func (c *Collector) applyControl(now time.Time) {
+	dl := c.Config()
+	var audits []ControlAudit
+	var switches []relaySwitch
+	c.control.Lock()
+	c.control.prune(dl)
+	for _, relay := range dl.Relays {
+		st := c.control.relay(relay.ID)
+		if ov := st.override; ov != nil && !ov.until.IsZero() && !now.Before(ov.until) {
+			st.override = nil
+			audits = append(audits, ControlAudit{Time: now, Relay: relay.ID, Action: CONTROL_RELEASE, Reason: "override expired", By: ov.by})
+		}
+		if st.pending || now.Before(st.retryAt) {
+			continue
+		}
+		if _, ok := c.GetTaskChannel(relay.Attach); !ok {
+			continue
+		}
+		on, audit := c.control.desired(relay, dl.ControlRules, st, now)
+		if st.known && st.on == on {
+			st.blocked = ""
+			continue
+		}
+		audit.State = RELAY_OFF
+		if on {
+			audit.State = RELAY_ON
+		}
+		if blocked := c.control.blocked(relay, dl.Relays, st, on, now); blocked != "" {
+			if st.blocked != blocked {
+				audit.Time, audit.Action, audit.Reason = now, CONTROL_BLOCKED, blocked
+				audits = append(audits, audit)
+			}
+			st.blocked = blocked
+			continue
+		}
+		st.blocked = ""
+		st.pending, st.pendingOn = true, on
+		switches = append(switches, relaySwitch{relay: *relay, on: on, audit: audit})
+	}
+	c.control.Unlock()
+
+	for _, a := range audits {
+		c.recordControl(a)
+	}
+	for _, v := range switches {
+		go c.switchRelay(v)
+	}
+}
+
+/**
+ * 写线圈并记录结果, 失败时在CONTROL_RETRY后重试
+ */
+func (c *Collector) switchRelay(s relaySwitch) {
+	err := c.WriteCoil(s.relay.Attach, s.relay.Addr, s.relay.Coil, s.on)
+	now := time.Now()
+	s.audit.Time = now
+	if err != nil {
+		s.audit.Action = CONTROL_FAILED
+		s.audit.Error = err.Error()
+	}
+	// 先记录再结束写入, 状态可见时记录已存在
+	c.recordControl(s.audit)
+
+	c.control.Lock()
+	if st, ok := c.control.relays[s.relay.ID]; ok {
+		st.pending = false
+		if err == nil {
+			st.on, st.known, st.changed = s.on, true, now
+			st.rule = ""
+			if s.on {
+				st.rule = s.audit.Rule
+			}
+		} else {
+			st.retryAt = now.Add(CONTROL_RETRY)
+		}
+	}
+	c.control.Unlock()
+}
+
+/**
+ * 手动覆盖请求
+ * @Topic sensor/action/relay/override
+ */
+type RelayOverride struct {
+	RelayID  string `json:"relayID"`
+	State    string `json:"state"`              // on/off, auto为解除覆盖
+	Duration int64  `json:"duration,omitempty"` // 持续秒数, 缺省直到解除
+	By       string `json:"by,omitempty"`       // 操作人
+	Comment  string `json:"comment,omitempty"`  // 备注
+
+	ActionEnvelope
+}
+
+/**
+ * 手动开关继电器或解除覆盖, 立即按新状态切换
+ */
+func (c *Collector) OverrideRelay(o RelayOverride) (RelayStatus, error) {
+	if c.relayConfig(o.RelayID) == nil {
+		return RelayStatus{}, invalid(errors.New("unknown relay " + o.RelayID))
+	}
+	if o.State != RELAY_ON && o.State != RELAY_OFF && o.State != RELAY_AUTO {
+		return RelayStatus{}, invalid(errors.New("state must be on, off or auto"))
+	}
+	if o.Duration < 0 {
+		return RelayStatus{}, invalid(errors.New("duration must not be negative"))
+	}
+	now := time.Now()
+	audit := ControlAudit{Time: now, Relay: o.RelayID, Action: CONTROL_OVERRIDE, State: o.State, Reason: o.Comment, By: o.By}
+	c.control.Lock()
+	st := c.control.relay(o.RelayID)
+	if o.State == RELAY_AUTO {
+		if st.override == nil {
+			c.control.Unlock()
+			return RelayStatus{}, invalid(errors.New("relay not overridden"))
+		}
+		st.override = nil
+		audit.Action, audit.State = CONTROL_RELEASE, ""
+	} else {
+		ov := &relayOverride{on: o.State == RELAY_ON, by: o.By, comment: o.Comment}
+		if o.Duration > 0 {
+			ov.until = now.Add(time.Duration(o.Duration) * time.Second)
+		}
+		st.override = ov
+	}
+	c.control.Unlock()
+
+	c.recordControl(audit)
+	c.applyControl(now)
+	status, _ := c.relayStatus(o.RelayID)
+	return status, nil
+}
+
+func OverrideRelay(o RelayOverride) (RelayStatus, error) {
+	return Default().OverrideRelay(o)
+}
+
+func (c *Collector) relayConfig(id string) *Relay {
+	for _, v := range c.Config().Relays {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (c *Collector) relayStatus(id string) (RelayStatus, bool) {
+	if c.relayConfig(id) == nil {
+		return RelayStatus{}, false
+	}
+	c.control.Lock()
+	defer c.control.Unlock()
+	ret := RelayStatus{ID: id, State: RELAY_UNKNOWN, Mode: RELAY_AUTO}
+	st, ok := c.control.relays[id]
+	if !ok {
+		return ret, true
+	}
+	ret.State, ret.Rule, ret.Blocked, ret.Pending = st.state(), st.rule, st.blocked, st.pending
+	if st.known {
+		changed := st.changed
+		ret.Changed = &changed
+	}
+	if st.override != nil {
+		ret.Mode = RELAY_MANUAL
+		if !st.override.until.IsZero() {
+			until := st.override.until
+			ret.Until = &until
+		}
+	}
+	return ret, true
+}
+
+/**
+ * 各继电器的当前状态
+ */
+func (c *Collector) Relays() []RelayStatus {
+	ret := []RelayStatus{}
+	for _, v := range c.Config().Relays {
+		if status, ok := c.relayStatus(v.ID); ok {
+			ret = append(ret, status)
+		}
+	}
+	return ret
+}
+
+func Relays() []RelayStatus {
+	return Default().Relays()
+}
+
+/**
+ * 写入控制记录并发布到控制主题
+ */
+func (c *Collector) recordControl(a ControlAudit) {
+	level := "[INFO]"
+	if a.Action == CONTROL_FAILED || a.Action == CONTROL_BLOCKED {
+		level = "[WARN]"
+	}
+	fmt.Printf("%s 继电器%s %s %s %s %s %s\n", level, a.Action, a.Relay, a.State, a.Rule, a.Reason, a.Error)
+	if h := c.History(); h != nil {
+		if err := h.AppendControl(a); err != nil {
+			fmt.Println("[WARN] 写入控制记录失败", err)
+		}
+	}
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	send, _ := json.Marshal(a)
+	c.publishStream(client, STREAM_CONTROL, c.Topic(TOPIC_CONTROL), send)
+}
+
+/**
+ * 控制记录, 按时间排序
+ * @param relayID 为空时返回全部
+ * @param limit 为0时不限制
+ */
+func (c *Collector) ControlHistory(relayID string, from, to time.Time, limit int) ([]ControlAudit, error) {
+	h := c.History()
+	if h == nil {
+		return nil, errors.New("history unavailable")
+	}
+	from, to = recordRange(from, to)
+	ret := []ControlAudit{}
+	err := h.ScanControl(from, to, func(a ControlAudit) bool {
+		if relayID == "" || a.Relay == relayID {
+			ret = append(ret, a)
+		}
+		return limit <= 0 || len(ret) < limit
+	})
+	return ret, err
+}
+
+func ControlHistory(relayID string, from, to time.Time, limit int) ([]ControlAudit, error) {
+	return Default().ControlHistory(relayID, from, to, limit)
+}
+
+/**
+ * 定时检查时段、覆盖到期及暂缓的切换, 收集器停止时退出
+ */
+func (c *Collector) runControl() {
+	ticker := time.NewTicker(CONTROL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.draining:
+			return
+		case now := <-ticker.C:
+			c.applyControl(now)
+		}
+	}
+}
+
+// ========================store===========================
+
+/**
+ * 追加控制记录, 按日期存入历史数据目录下的control-{date}.log
+ */
+func (h *History) AppendControl(a ControlAudit) error {
+	return h.appendLine(h.dir, controlFilePrefix, a.Time, a)
+}
+
+/**
+ * 按时间顺序读取[from, to)内的控制记录, fn返回false时停止
+ */
+func (h *History) ScanControl(from, to time.Time, fn func(a ControlAudit) bool) error {
+	return h.scanRecords(h.dir, controlFilePrefix, from, to, func(line []byte) (interface{}, time.Time, bool) {
+		var a ControlAudit
+		err := json.Unmarshal(line, &a)
+		return a, a.Time, err == nil
+	}, func(v interface{}) bool {
+		return fn(v.(ControlAudit))
+	})
+}
+
+// ========================mqtt/http===========================
+
+/**
+ * 手动覆盖, 结果为继电器状态
+ * @Topic sensor/action/relay/override
+ */
+func (c *Collector) RelayOverrideHandler(client mqtt.Client, message mqtt.Message) {
+	var o RelayOverride
+	err := json.Unmarshal(message.Payload(), &o)
+	c.reply(message, o.ActionEnvelope, "", func(ctx context.Context) (interface{}, error) {
+		if err != nil {
+			return nil, invalid(err)
+		}
+		if err := commitAction(ctx); err != nil {
+			return nil, err
+		}
+		return c.OverrideRelay(o)
+	})
+}
+
+func RelayOverrideHandler(client mqtt.Client, message mqtt.Message) {
+	Default().RelayOverrideHandler(client, message)
+}
+
+func (c *Collector) apiRelays(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	return c.Relays(), nil
+}
+
+func (c *Collector) apiOverrideRelay(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	if c.relayConfig(p["id"]) == nil {
+		return nil, withStatus(http.StatusNotFound, errors.New("relay not found"))
+	}
+	var o RelayOverride
+	if err := decodeBody(r, &o); err != nil {
+		return nil, err
+	}
+	o.RelayID = p["id"]
+	return c.OverrideRelay(o)
+}
+
+func (c *Collector) apiControlHistory(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	query := r.URL.Query()
+	from, to, limit, err := parseHistoryQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.ControlHistory(query.Get("relay"), from, to, limit)
+}
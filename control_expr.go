@@ -0,0 +1,273 @@
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//=====================EXPRESSION===============
+//
+//      控制规则的条件表达式, 例如 Oxygen < 4.0 and Temp > 10
+//
+//=====================END======================
+
+/**
+ * 条件表达式, 由测量项与常数的比较及 and/or/not(&&/||/!) 和括号组成
+ */
+type condExpr interface {
+	// values为测量项名称 -> 测量值, 缺少测量项时返回错误
+	eval(values map[string]float64) (bool, error)
+}
+
+type condAnd struct{ left, right condExpr }
+
+type condOr struct{ left, right condExpr }
+
+type condNot struct{ expr condExpr }
+
+type condCompare struct {
+	op          string
+	left, right condOperand
+}
+
+/**
+ * 比较的一侧, name为空时为常数
+ */
+type condOperand struct {
+	name  string
+	value float64
+}
+
+func (e condAnd) eval(values map[string]float64) (bool, error) {
+	v, err := e.left.eval(values)
+	if err != nil || !v {
+		return false, err
+	}
+	return e.right.eval(values)
+}
+
+func (e condOr) eval(values map[string]float64) (bool, error) {
+	v, err := e.left.eval(values)
+	if err != nil || v {
+		return v, err
+	}
+	return e.right.eval(values)
+}
+
+func (e condNot) eval(values map[string]float64) (bool, error) {
+	v, err := e.expr.eval(values)
+	return !v, err
+}
+
+func (o condOperand) get(values map[string]float64) (float64, error) {
+	if o.name == "" {
+		return o.value, nil
+	}
+	v, ok := values[o.name]
+	if !ok {
+		return 0, errors.New("no value of " + o.name)
+	}
+	return v, nil
+}
+
+func (e condCompare) eval(values map[string]float64) (bool, error) {
+	l, err := e.left.get(values)
+	if err != nil {
+		return false, err
+	}
+	r, err := e.right.get(values)
+	if err != nil {
+		return false, err
+	}
+	switch e.op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	case "==":
+		return l == r, nil
+	default:
+		return l != r, nil
+	}
+}
+
+/**
+ * 解析条件表达式
+ */
+func parseCondition(src string) (condExpr, error) {
+	tokens, err := condTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in condition", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+var condOperators = []string{"<=", ">=", "==", "!=", "&&", "||", "<", ">", "!", "(", ")"}
+
+/**
+ * 拆分为数字、名称及运算符
+ */
+func condTokens(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		ch := rune(src[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+			continue
+		case unicode.IsLetter(ch) || ch == '_':
+			j := i + 1
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+			continue
+		case unicode.IsDigit(ch) || ch == '.' || ch == '-':
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+			continue
+		}
+		matched := false
+		for _, op := range condOperators {
+			if strings.HasPrefix(src[i:], op) {
+				tokens = append(tokens, op)
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("unexpected %q in condition", src[i])
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty condition")
+	}
+	return tokens, nil
+}
+
+type condParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *condParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *condParser) or() (condExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "||" || strings.EqualFold(t, "or"); t = p.peek() {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = condOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *condParser) and() (condExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "&&" || strings.EqualFold(t, "and"); t = p.peek() {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = condAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *condParser) unary() (condExpr, error) {
+	switch t := p.peek(); {
+	case t == "!" || strings.EqualFold(t, "not"):
+		p.pos++
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return condNot{expr}, nil
+	case t == "(":
+		p.pos++
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ) in condition")
+		}
+		return expr, nil
+	}
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return nil, fmt.Errorf("expected comparison after %s", p.tokens[p.pos-2])
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return condCompare{op, left, right}, nil
+}
+
+func (p *condParser) operand() (condOperand, error) {
+	t := p.next()
+	if t == "" {
+		return condOperand{}, errors.New("unexpected end of condition")
+	}
+	if ch := rune(t[0]); unicode.IsLetter(ch) || ch == '_' {
+		switch strings.ToLower(t) {
+		case "and", "or", "not":
+			return condOperand{}, fmt.Errorf("unexpected %s in condition", t)
+		}
+		return condOperand{name: t}, nil
+	}
+	v, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return condOperand{}, fmt.Errorf("invalid number %s in condition", t)
+	}
+	return condOperand{value: v}, nil
+}
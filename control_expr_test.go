@@ -0,0 +1,34 @@
+package sensor
+
+import "testing"
+
+func TestParseCondition(t *testing.T) {
+	values := map[string]float64{"Oxygen": 3.5, "Temp": 28}
+	for src, want := range map[string]bool{
+		"Oxygen < 4.0":                              true,
+		"Oxygen<4 && Temp>30":                       false,
+		"Oxygen >= 3.5 and Temp <= 28":              true,
+		"Oxygen > 5 || Temp != 20":                  true,
+		"not (Oxygen < 4 or Temp > 30)":             false,
+		"!(Oxygen == 3.5)":                          false,
+		"-1 < Oxygen AND (Temp > 25 or false_ < 0)": true,
+	} {
+		expr, err := parseCondition(src)
+		if err != nil {
+			t.Errorf("parse %q: %v", src, err)
+			continue
+		}
+		if got, err := expr.eval(values); err != nil || got != want {
+			t.Errorf("%q = %v %v, want %v", src, got, err, want)
+		}
+	}
+	expr, _ := parseCondition("PH < 7")
+	if _, err := expr.eval(values); err == nil {
+		t.Error("missing item evaluated")
+	}
+	for _, src := range []string{"", "Oxygen", "Oxygen < ", "Oxygen < 4 and", "(Oxygen < 4", "Oxygen < 4)", "Oxygen = 4", "Oxygen < 4.0.1", "and < 4", "Oxygen < 4 Temp > 2"} {
+		if _, err := parseCondition(src); err == nil {
+			t.Errorf("invalid condition %q accepted", src)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := newFakeClient()
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{Name: "c1", HTTPAddress: "127.0.0.1:0",
+		LocalSensorInformation: []*LocalSensorInformation{{Addr: 1, Attach: "127.0.0.1", Interval: 3600, SensorID: "s"}},
+		Relays: []*Relay{
+			{ID: "a1", Attach: "127.0.0.1", Addr: 10, Coil: 1, MinOn: 3600},
+			{ID: "a2", Attach: "127.0.0.1", Addr: 10, Coil: 2, Interlock: []string{"a1"}},
+		},
+		ControlRules: []*ControlRule{
+			{ID: "r1", Relay: "a1", SensorID: "s", On: "Oxygen < 4.0", Off: "Oxygen > 6", For: 120},
+			{ID: "r2", Relay: "a2", SensorID: "s", On: "Oxygen < 3"},
+		},
+	}), WithListenAddress("127.0.0.1:0"), WithMQTTClient(client))
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(context.Background())
+	conn := fakeDTU(t, c.Addr().String())
+	defer conn.Close()
+	ls, _ := c.GetLocalSensor("s")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && ls.status() != STATUS_NORMAL {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := func(id string) RelayStatus {
+		for _, v := range c.Relays() {
+			if v.ID == id {
+				return v
+			}
+		}
+		t.Fatalf("relay %s not found", id)
+		return RelayStatus{}
+	}
+	wait := func(id, state string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if v := status(id); v.State == state && !v.Pending {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("relay %s not %s: %+v", id, state, status(id))
+	}
+	base := time.Now().Add(-time.Hour)
+	read := func(sec int, v float64) {
+		c.evaluateControl(ReadResult{SensorID: "s", Created: base.Add(time.Duration(sec) * time.Second), Items: []MeasureItem{{Name: "Oxygen", Value: v}}})
+	}
+
+	// DTU连接后写入目标状态
+	wait("a1", RELAY_OFF)
+	wait("a2", RELAY_OFF)
+
+	// 条件持续for后开启
+	read(0, 5)
+	read(60, 3.5)
+	read(120, 3.2)
+	if v := status("a1"); v.State != RELAY_OFF || v.Pending {
+		t.Fatalf("relay switched before for %+v", v)
+	}
+	read(180, 3.1)
+	wait("a1", RELAY_ON)
+	if v := status("a1"); v.Rule != "r1" || v.Mode != RELAY_AUTO || v.Changed == nil {
+		t.Errorf("unexpected status %+v", v)
+	}
+
+	// 互锁
+	read(200, 2.5)
+	if v := status("a2"); v.State != RELAY_OFF || v.Blocked != "interlock a1" {
+		t.Errorf("interlock not applied %+v", v)
+	}
+
+	// 回差内保持, 满足关闭条件后受最短开启时间限制
+	read(220, 5)
+	if v := status("a1"); v.State != RELAY_ON || v.Blocked != "" {
+		t.Errorf("relay switched within deadband %+v", v)
+	}
+	read(240, 6.5)
+	if v := status("a1"); v.State != RELAY_ON || v.Blocked != "min on time" {
+		t.Errorf("min on time not applied %+v", v)
+	}
+
+	// 手动覆盖不受最短开启时间限制
+	base2 := "http://" + c.HTTPAddr().String() + API_PREFIX
+	resp, err := http.Post(base2+"/relays/a1/override", "application/json", strings.NewReader(`{"state":"off","duration":600,"by":"op","comment":"maintenance"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st RelayStatus
+	_ = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || st.Mode != RELAY_MANUAL || st.Until == nil {
+		t.Errorf("unexpected override %d %+v", resp.StatusCode, st)
+	}
+	wait("a1", RELAY_OFF)
+	resp, err = http.Post(base2+"/relays/x/override", "application/json", strings.NewReader(`{"state":"off"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown relay: %d", resp.StatusCode)
+	}
+
+	c.RelayOverrideHandler(client, fakeMessage{topic: "sensor/action/relay/override", payload: []byte(`{"relayID":"a1","state":"auto","by":"op","replyTo":"app/1"}`)})
+	if res := actionResult(t, client, "app/1"); res.Status != RESULT_OK {
+		t.Errorf("release failed %+v", res)
+	}
+	if v := status("a1"); v.Mode != RELAY_AUTO || v.State != RELAY_OFF || v.Pending {
+		t.Errorf("unexpected status after release %+v", v)
+	}
+	for i, v := range []string{
+		`{"relayID":"a1","state":"auto","replyTo":"app/2"}`,
+		`{"relayID":"a1","state":"toggle","replyTo":"app/3"}`,
+		`{"relayID":"x","state":"on","replyTo":"app/4"}`,
+	} {
+		c.RelayOverrideHandler(client, fakeMessage{topic: "sensor/action/relay/override", payload: []byte(v)})
+		if res := actionResult(t, client, "app/"+string(rune('2'+i))); res.Status != RESULT_INVALID {
+			t.Errorf("invalid override %s accepted %+v", v, res)
+		}
+	}
+
+	// 控制记录
+	var actions []string
+	list, err := c.ControlHistory("a1", base, time.Now().Add(time.Second), 0)
+	for _, a := range list {
+		actions = append(actions, a.Action+":"+a.State)
+	}
+	if err != nil || strings.Join(actions, ",") != "switch:off,switch:on,blocked:off,override:off,switch:off,release:" {
+		t.Fatalf("unexpected audit %v %v", actions, err)
+	}
+	if on := list[1]; on.Rule != "r1" || on.Reason != "Oxygen < 4.0" || on.Values["Oxygen"] != 3.1 {
+		t.Errorf("unexpected switch audit %+v", on)
+	}
+	if off := list[4]; off.By != "op" || !strings.Contains(off.Reason, "maintenance") {
+		t.Errorf("unexpected override switch audit %+v", off)
+	}
+	var published int
+	for _, msg := range client.messages(c.Topic(TOPIC_CONTROL)) {
+		var a ControlAudit
+		if json.Unmarshal(msg.payload, &a) == nil && a.Relay == "a1" {
+			published++
+		}
+	}
+	if published != len(list) {
+		t.Errorf("published %d audits, stored %d", published, len(list))
+	}
+	resp, err = http.Get(base2 + "/relays/audit?relay=a2&from=" + base.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list = nil
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(list) != 2 || list[1].Action != CONTROL_BLOCKED || list[1].Reason != "interlock a1" {
+		t.Errorf("unexpected http audit %d %+v", resp.StatusCode, list)
+	}
+}
+
+func TestControlValidate(t *testing.T) {
+	relays := []*Relay{{ID: "a1", Attach: "127.0.0.1", Addr: 10, Coil: 1}}
+	for _, dl := range []LocalDeviceDetail{
+		{Relays: []*Relay{{ID: "a1", Addr: 10}}},
+		{Relays: []*Relay{{ID: "a1", Attach: "127.0.0.1"}}},
+		{Relays: []*Relay{{ID: "a1", Attach: "127.0.0.1", Addr: 10, MinOn: -1}}},
+		{Relays: []*Relay{{ID: "a1", Attach: "127.0.0.1", Addr: 10, Interlock: []string{"a2"}}}},
+		{Relays: []*Relay{relays[0], relays[0]}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a2", SensorID: "s", On: "Oxygen < 4"}}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a1", On: "Oxygen < 4"}}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a1", SensorID: "s", On: "Oxygen <"}}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a1"}}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a1", Schedule: []string{"25:00-02:00"}}}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a1", SensorID: "s", On: "Oxygen < 4", For: -1}}},
+		{Relays: relays, ControlRules: []*ControlRule{{ID: "r1", Relay: "a1", Schedule: []string{"02:00-04:00"}}, {ID: "r1", Relay: "a1", Schedule: []string{"22:00-23:00"}}}},
+	} {
+		if err := dl.validateControl(); err == nil {
+			t.Errorf("invalid config %+v accepted", dl)
+		}
+	}
+
+	r := &ControlRule{ID: "r1", Relay: "a1", Schedule: []string{"22:00-02:00", "12:00-12:30"}}
+	for clock, want := range map[string]bool{"23:30": true, "01:59": true, "02:00": false, "12:15": true, "12:30": false, "08:00": false} {
+		now, _ := time.Parse("15:04", clock)
+		if r.inSchedule(now) != want {
+			t.Errorf("inSchedule(%s) != %v", clock, want)
+		}
+	}
+	dl := LocalDeviceDetail{Relays: relays, ControlRules: []*ControlRule{r}}
+	if err := dl.validateControl(); err != nil {
+		t.Error(err)
+	}
+}
@@ -17,38 +17,99 @@ type SensorLog struct {
 	errorCount int       // 连续错误次数三次后 errorTag -> true
 	errorTag   bool      // 错误标识符(禁止重试)
 	retryTime  time.Time // 重试时间
+	tracker    *Tracker  // 所属的错误记录
+}
+
+/**
+ * 传感器错误记录, 每个收集器持有一个
+ */
+type Tracker struct {
+	sensorLog map[string]*SensorLog
+	onChange  func(sensorID string) // 错误记录变化时调用, 不持有锁
 	sync.Mutex
 }
 
+func NewTracker() *Tracker {
+	return &Tracker{sensorLog: make(map[string]*SensorLog)}
+}
+
+// 默认的错误记录, 供包级函数使用
+var defaultTracker = NewTracker()
+
+func DefaultTracker() *Tracker {
+	return defaultTracker
+}
+
+/**
+ * 设置错误记录变化(出错/禁止/恢复/清除)时的回调
+ */
+func (t *Tracker) OnChange(fn func(sensorID string)) {
+	t.Lock()
+	defer t.Unlock()
+	t.onChange = fn
+}
+
+/**
+ * 调用回调, 调用者不能持有锁
+ */
+func (t *Tracker) notify(sensorIDs ...string) {
+	t.Lock()
+	fn := t.onChange
+	t.Unlock()
+	if fn == nil {
+		return
+	}
+	for _, v := range sensorIDs {
+		fn(v)
+	}
+}
+
+/**
+ * 获得传感器错误记录, 不存在时创建
+ */
+func (t *Tracker) load(sensorID string) *SensorLog {
+	if v, ok := t.sensorLog[sensorID]; ok {
+		return v
+	}
+	s := &SensorLog{sensorID: sensorID, tracker: t}
+	t.sensorLog[sensorID] = s
+	return s
+}
+
 /**
  * 绝对禁用
  */
+func (t *Tracker) AddErrorOperationBan(sensorID string) int {
+	t.Lock()
+	v := t.load(sensorID)
+	v.errorTag = true
+	v.errorCount++
+	count := v.errorCount
+	t.Unlock()
+	t.notify(sensorID)
+	return count
+}
+
 func AddErrorOperationBan(sensorID string) int {
-	// 判断某个Key是否存在
-	if v, ok := sensorLog[sensorID]; ok {
-		v.errorTag = true
-		v.errorCount ++
-		return v.errorCount
-	} else {
-		s := SensorLog{}
-		s.sensorID = sensorID
-		sensorLog[sensorID] = &s
-		s.errorTag = true
-		s.errorCount = 1
-		return s.errorCount
-	}
+	return defaultTracker.AddErrorOperationBan(sensorID)
 }
 
 /**
  * 返回重试恢复时间点
  */
-func GetRetryTime(sensorID string) time.Time {
-	if v, ok := sensorLog[sensorID]; ok {
+func (t *Tracker) GetRetryTime(sensorID string) time.Time {
+	t.Lock()
+	defer t.Unlock()
+	if v, ok := t.sensorLog[sensorID]; ok {
 		return v.retryTime
 	}
 	return time.Now()
 }
 
+func GetRetryTime(sensorID string) time.Time {
+	return defaultTracker.GetRetryTime(sensorID)
+}
+
 /**
  * 重试时间
  */
@@ -63,8 +124,6 @@ func (sl *SensorLog) getRetryTime() {
 	}
 }
 
-var sensorLog = make(map[string]*SensorLog)
-
 const (
 	ERROR_DELAY_LEVEL1 = time.Minute
 	ERROR_DELAY_LEVEL2 = time.Minute * 2
@@ -76,19 +135,19 @@ const (
  * @param sensorID 传感器ID
  * @param int 错误次数
  */
+func (t *Tracker) AddErrorOperation(sensorID string) int {
+	t.Lock()
+	v := t.load(sensorID)
+	// 延迟
+	v.ForbidRequest()
+	count := v.errorCount
+	t.Unlock()
+	t.notify(sensorID)
+	return count
+}
+
 func AddErrorOperation(sensorID string) int {
-	// 判断某个Key是否存在
-	if v, ok := sensorLog[sensorID]; ok {
-		v.ForbidRequest()
-		return v.errorCount
-	} else {
-		s := SensorLog{}
-		s.sensorID = sensorID
-		sensorLog[sensorID] = &s
-		// 延迟
-		s.ForbidRequest()
-		return s.errorCount
-	}
+	return defaultTracker.AddErrorOperation(sensorID)
 }
 
 /**
@@ -96,20 +155,33 @@ func AddErrorOperation(sensorID string) int {
  * @param 传感器ID
  * @return 返回错误次数
  */
-func GetErrorCount(sensorID string) int {
-	if v, ok := sensorLog[sensorID]; ok {
+func (t *Tracker) GetErrorCount(sensorID string) int {
+	t.Lock()
+	defer t.Unlock()
+	if v, ok := t.sensorLog[sensorID]; ok {
 		return v.errorCount
 	}
 	return 0
 }
 
+func GetErrorCount(sensorID string) int {
+	return defaultTracker.GetErrorCount(sensorID)
+}
+
 /**
  * 清除单个传感器错误信息
  * @param 传感器ID
  *
  */
+func (t *Tracker) ClsErrorCount(sensorID string) {
+	t.Lock()
+	delete(t.sensorLog, sensorID)
+	t.Unlock()
+	t.notify(sensorID)
+}
+
 func ClsErrorCount(sensorID string) {
-	delete(sensorLog, sensorID)
+	defaultTracker.ClsErrorCount(sensorID)
 }
 
 const CLEAR_ALL_EXCEPTION = "all"
@@ -120,12 +192,24 @@ const SWITCH_OPEN = "open"
 /**
  * GC回收吧
  */
+func (t *Tracker) ClsAll() {
+	t.Lock()
+	var sensorIDs []string
+	for k := range t.sensorLog {
+		sensorIDs = append(sensorIDs, k)
+	}
+	t.sensorLog = make(map[string]*SensorLog)
+	t.Unlock()
+	t.notify(sensorIDs...)
+}
+
 func ClsAll() {
-	sensorLog = make(map[string]*SensorLog)
+	defaultTracker.ClsAll()
 }
 
 /**
  * 禁止请求传感器, 关闭errorTag
+ * 调用者需持有Tracker的锁
  * @param sensorID 传感器ID
  * @param delayLevel 延迟级别
  *
@@ -137,17 +221,20 @@ func (sl *SensorLog) ForbidRequest() {
 	sl.errorCount++
 	sl.errorTag = true
 	var delayLevel time.Duration
-	if sensorLog[sl.sensorID].errorCount == 1 {
+	if sl.errorCount == 1 {
 		delayLevel = ERROR_DELAY_LEVEL1
-	} else if sensorLog[sl.sensorID].errorCount == 2 {
+	} else if sl.errorCount == 2 {
 		delayLevel = ERROR_DELAY_LEVEL2
-	} else if sensorLog[sl.sensorID].errorCount == 3 {
+	} else if sl.errorCount == 3 {
 		delayLevel = ERROR_DELAY_LEVEL3
 	}
 	if delayLevel != 0 {
 		sl.getRetryTime()
 		time.AfterFunc(delayLevel, func() {
-			sensorLog[sl.sensorID].errorTag = false
+			sl.tracker.Lock()
+			sl.errorTag = false
+			sl.tracker.Unlock()
+			sl.tracker.notify(sl.sensorID)
 		})
 	}
 }
@@ -157,8 +244,10 @@ func (sl *SensorLog) ForbidRequest() {
  * @param sensorID 传感器ID
  * @return false 允许进行/true 禁止进行查询
  */
-func IsForbidden(sensorID string) bool {
-	if v, ok := sensorLog[sensorID]; ok {
+func (t *Tracker) IsForbidden(sensorID string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if v, ok := t.sensorLog[sensorID]; ok {
 		if v.errorTag {
 			return true
 		}
@@ -166,6 +255,10 @@ func IsForbidden(sensorID string) bool {
 	return false
 }
 
+func IsForbidden(sensorID string) bool {
+	return defaultTracker.IsForbidden(sensorID)
+}
+
 /**
  * 间隔时间处理
  */
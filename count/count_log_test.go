@@ -17,3 +17,17 @@ func TestAddErrorLog(t *testing.T) {
 
 	time.Sleep(time.Second * 5)
 }
+
+func TestTrackerIsolation(t *testing.T) {
+	a, b := NewTracker(), NewTracker()
+	if a.AddErrorOperationBan("s1") != 1 || !a.IsForbidden("s1") {
+		t.Fatal("ban not recorded")
+	}
+	if b.IsForbidden("s1") || b.GetErrorCount("s1") != 0 {
+		t.Error("trackers share state")
+	}
+	a.ClsErrorCount("s1")
+	if a.IsForbidden("s1") {
+		t.Error("error count not cleared")
+	}
+}
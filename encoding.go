@@ -0,0 +1,263 @@
+package sensor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/fxamacker/cbor"
+	"github.com/vmihailenco/msgpack"
+	"time"
+)
+
+//=====================ENCODING=================
+//
+//          按数据流配置QoS/保留/载荷编码
+//
+//=====================END======================
+
+// 数据流
+const (
+	STREAM_MEASURE = "measure" // 测量数据(含补发)
+	STREAM_STATUS  = "status"  // 传感器状态
+	STREAM_LOG     = "log"     // 日志
+	STREAM_COMMAND = "command" // 写指令结果
+	STREAM_REPLY   = "reply"   // 指令应答
+	STREAM_PUBLISH = "publish" // MQTTPublish, 载荷原样发布, 不编码
+	STREAM_ALARM   = "alarm"   // 报警
+	STREAM_CONTROL = "control" // 继电器控制记录
+)
+
+// 载荷编码
+const (
+	ENCODING_JSON         = "json"         // 缺省
+	ENCODING_JSON_COMPACT = "json-compact" // 去除空值, 时间转为Unix秒
+	ENCODING_CBOR         = "cbor"         // RFC 8949, 字段与json一致
+	ENCODING_MSGPACK      = "msgpack"      // MessagePack, 字段与json一致
+	ENCODING_SENML        = "senml"        // RFC 8428 SenML JSON, 仅用于测量数据
+)
+
+var streams = map[string]bool{STREAM_MEASURE: true, STREAM_STATUS: true, STREAM_LOG: true, STREAM_COMMAND: true, STREAM_REPLY: true, STREAM_PUBLISH: true, STREAM_ALARM: true, STREAM_CONTROL: true}
+
+var encodings = map[string]bool{ENCODING_JSON: true, ENCODING_JSON_COMPACT: true, ENCODING_CBOR: true, ENCODING_MSGPACK: true, ENCODING_SENML: true}
+
+/**
+ * 数据流的发布配置, 缺省QoS 1/不保留/json, 传感器状态缺省保留
+ */
+type StreamOptions struct {
+	QoS      *int   `json:"qos,omitempty" yaml:"qos,omitempty" toml:"qos,omitempty"`
+	Retain   *bool  `json:"retain,omitempty" yaml:"retain,omitempty" toml:"retain,omitempty"`
+	Encoding string `json:"encoding,omitempty" yaml:"encoding,omitempty" toml:"encoding,omitempty"`
+}
+
+/**
+ * 合并缺省值后的发布配置
+ */
+type PublishSettings struct {
+	QoS      byte
+	Retain   bool
+	Encoding string
+}
+
+func (dl *LocalDeviceDetail) Stream(name string) PublishSettings {
+	ps := PublishSettings{QoS: 1, Retain: name == STREAM_STATUS, Encoding: ENCODING_JSON}
+	so, ok := dl.Streams[name]
+	if !ok || so == nil {
+		return ps
+	}
+	if so.QoS != nil {
+		ps.QoS = byte(*so.QoS)
+	}
+	if so.Retain != nil {
+		ps.Retain = *so.Retain
+	}
+	if so.Encoding != "" {
+		ps.Encoding = so.Encoding
+	}
+	return ps
+}
+
+func (dl *LocalDeviceDetail) validateStreams() error {
+	for name, so := range dl.Streams {
+		if !streams[name] {
+			return fmt.Errorf("unknown stream %q", name)
+		}
+		if so == nil {
+			continue
+		}
+		if so.QoS != nil && (*so.QoS < 0 || *so.QoS > 2) {
+			return fmt.Errorf("invalid qos %d for stream %s", *so.QoS, name)
+		}
+		if so.Encoding == "" {
+			continue
+		}
+		if !encodings[so.Encoding] {
+			return fmt.Errorf("unknown encoding %q for stream %s", so.Encoding, name)
+		}
+		if name == STREAM_PUBLISH && so.Encoding != ENCODING_JSON {
+			return errors.New("stream publish does not support encoding")
+		}
+		if so.Encoding == ENCODING_SENML && name != STREAM_MEASURE {
+			return fmt.Errorf("encoding senml is only supported for stream %s", STREAM_MEASURE)
+		}
+	}
+	return nil
+}
+
+/**
+ * 按数据流的配置编码并发布
+ * 发布失败或未在PUBLISH_TIMEOUT内完成时计入该数据流的mqtt_publish_failures_total
+ * @param payload json载荷
+ */
+func (c *Collector) publishStream(client mqtt.Client, stream, topic string, payload []byte) mqtt.Token {
+	ps := c.Config().Stream(stream)
+	data, err := Encode(ps.Encoding, payload)
+	if err != nil {
+		fmt.Printf("[WARN] %s编码失败, 使用json发布: %s\n", ps.Encoding, err)
+		data = payload
+	}
+	token := client.Publish(topic, ps.QoS, ps.Retain, data)
+	go func() {
+		if !waitToken(token, PUBLISH_TIMEOUT) || token.Error() != nil {
+			c.metrics.publishFailed(stream)
+		}
+	}()
+	return token
+}
+
+/**
+ * 将json载荷转换为指定编码
+ */
+func Encode(encoding string, payload []byte) ([]byte, error) {
+	switch encoding {
+	case "", ENCODING_JSON:
+		return payload, nil
+	case ENCODING_SENML:
+		return encodeSenML(payload)
+	}
+	v, err := decodeGeneric(payload)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case ENCODING_JSON_COMPACT:
+		v, _ = compact(v)
+		return json.Marshal(v)
+	case ENCODING_CBOR:
+		return cbor.Marshal(v, cbor.EncOptions{Sort: cbor.SortCanonical, ShortestFloat: cbor.ShortestFloat16})
+	case ENCODING_MSGPACK:
+		var buf bytes.Buffer
+		err := msgpack.NewEncoder(&buf).UseCompactEncoding(true).Encode(v)
+		return buf.Bytes(), err
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+/**
+ * 解析json, 整数保持为int64
+ */
+func decodeGeneric(payload []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return numbers(v), nil
+}
+
+func numbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = numbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = numbers(e)
+		}
+	}
+	return v
+}
+
+// 载荷中的时间字段, json-compact编码时转为Unix秒, 其他字符串(如传感器名称、日志内容)原样保留
+var timeFields = map[string]bool{
+	"created": true, "time": true, "updated": true, "activated": true, "acknowledged": true, "cleared": true,
+	"changed": true, "until": true, "from": true, "to": true, "next": true, "retryTime": true,
+}
+
+/**
+ * 去除null/空字符串/空数组/空对象, 时间字段(timeFields)转为Unix秒
+ * @return 值是否为空
+ */
+func compact(v interface{}) (interface{}, bool) {
+	switch t := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return t, t == ""
+	case map[string]interface{}:
+		for k, e := range t {
+			if s, ok := e.(string); ok && timeFields[k] {
+				if tm, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					t[k] = tm.Unix()
+					continue
+				}
+			}
+			if c, empty := compact(e); empty {
+				delete(t, k)
+			} else {
+				t[k] = c
+			}
+		}
+		return t, len(t) == 0
+	case []interface{}:
+		for i, e := range t {
+			t[i], _ = compact(e)
+		}
+		return t, len(t) == 0
+	}
+	return v, false
+}
+
+/**
+ * SenML记录
+ * backfill/status为扩展字段(RFC 8428 4.4), 只出现在第一条记录中, 不理解的接收方可以忽略
+ */
+type SenMLRecord struct {
+	BaseName string   `json:"bn,omitempty"`
+	BaseTime float64  `json:"bt,omitempty"`
+	Name     string   `json:"n"`
+	Value    *float64 `json:"v,omitempty"`
+	Backfill bool     `json:"backfill,omitempty"` // 补发的历史测量结果
+	Status   int      `json:"status,omitempty"`   // 测量结果的状态, 正常时省略
+}
+
+/**
+ * 测量数据转换为SenML, 基础名称为 urn:dev:id:{sensorID}:
+ */
+func encodeSenML(payload []byte) ([]byte, error) {
+	var rr ReadResult
+	if err := json.Unmarshal(payload, &rr); err != nil {
+		return nil, err
+	}
+	if len(rr.Items) == 0 {
+		return nil, errors.New("senml requires measure items")
+	}
+	pack := make([]SenMLRecord, len(rr.Items))
+	for i := range rr.Items {
+		pack[i] = SenMLRecord{Name: rr.Items[i].Name, Value: &rr.Items[i].Value}
+	}
+	pack[0].BaseName = "urn:dev:id:" + rr.SensorID + ":"
+	pack[0].BaseTime = float64(rr.Created.UnixNano()) / float64(time.Second)
+	pack[0].Backfill = rr.Backfill
+	pack[0].Status = rr.Status
+	return json.Marshal(pack)
+}
@@ -0,0 +1,88 @@
+package sensor
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	payload := []byte(`{"a":1,"b":[true,null],"c":"","d":1.5,"created":"2020-01-02T03:04:05Z"}`)
+	cases := map[string][]byte{
+		// {"a":1,"b":[true,null],"c":"","d":1.5,"created":"..."}, 键按长度及字典序排列
+		ENCODING_CBOR: append([]byte{0xa5, 0x61, 'a', 0x01, 0x61, 'b', 0x82, 0xf5, 0xf6, 0x61, 'c', 0x60, 0x61, 'd', 0xf9, 0x3e, 0x00, 0x67},
+			append([]byte("created"), append([]byte{0x74}, []byte("2020-01-02T03:04:05Z")...)...)...),
+		ENCODING_JSON_COMPACT: []byte(`{"a":1,"b":[true,null],"created":1577934245,"d":1.5}`),
+	}
+	for encoding, want := range cases {
+		got, err := Encode(encoding, payload)
+		if err != nil {
+			t.Fatal(encoding, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x want %x", encoding, got, want)
+		}
+	}
+
+	// 只转换时间字段, 其他可以解析为时间的字符串保持不变
+	got, err := Encode(ENCODING_JSON_COMPACT, []byte(`{"name":"2020-01-02T03:04:05Z","items":[{"time":"2020-01-02T03:04:05Z"}]}`))
+	if want := `{"items":[{"time":1577934245}],"name":"2020-01-02T03:04:05Z"}`; err != nil || string(got) != want {
+		t.Errorf("json-compact: got %s %v", got, err)
+	}
+
+	got, err = Encode(ENCODING_MSGPACK, []byte(`{"a":-1}`))
+	if err != nil || !bytes.Equal(got, []byte{0x81, 0xa1, 'a', 0xff}) {
+		t.Errorf("msgpack: got %x %v", got, err)
+	}
+	if _, err := Encode("xml", payload); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
+
+func TestEncodeSenML(t *testing.T) {
+	rr := ReadResult{SensorID: "s", Items: []MeasureItem{{"Oxygen", 7.5}, {"Temp", 21}}, Created: time.Unix(1577934245, 0)}
+	payload, _ := json.Marshal(rr)
+	got, err := Encode(ENCODING_SENML, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"bn":"urn:dev:id:s:","bt":1577934245,"n":"Oxygen","v":7.5},{"n":"Temp","v":21}]`
+	if string(got) != want {
+		t.Errorf("got %s", got)
+	}
+
+	rr.Backfill, rr.Status = true, 2
+	payload, _ = json.Marshal(rr)
+	got, _ = Encode(ENCODING_SENML, payload)
+	want = `[{"bn":"urn:dev:id:s:","bt":1577934245,"n":"Oxygen","v":7.5,"backfill":true,"status":2},{"n":"Temp","v":21}]`
+	if string(got) != want {
+		t.Errorf("backfill not carried: got %s", got)
+	}
+}
+
+func TestStreamSettings(t *testing.T) {
+	qos := 0
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Streams: map[string]*StreamOptions{
+		STREAM_LOG: {QoS: &qos, Encoding: ENCODING_CBOR},
+	}}), WithMQTTClient(client))
+	if err := c.Config().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if ps := c.Config().Stream(STREAM_STATUS); ps.QoS != 1 || !ps.Retain || ps.Encoding != ENCODING_JSON {
+		t.Errorf("unexpected status defaults %+v", ps)
+	}
+	if ps := c.Config().Stream(STREAM_LOG); ps.QoS != 0 || ps.Retain || ps.Encoding != ENCODING_CBOR {
+		t.Errorf("unexpected log settings %+v", ps)
+	}
+	c.PushMQLog(MQ_LOG_FAIL, "x")
+	if msgs := client.messages("sensor/log"); len(msgs) != 1 || msgs[0].payload[0] != 0xa3 {
+		t.Error("log not published as cbor")
+	}
+
+	c.Config().Streams[STREAM_STATUS] = &StreamOptions{Encoding: ENCODING_SENML}
+	if c.Config().Validate() == nil {
+		t.Error("senml accepted for status")
+	}
+}
@@ -3,11 +3,16 @@ module sensor
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/evanphx/json-patch v4.5.0+incompatible
 	github.com/fwhezfwhez/go-queue v0.0.0-20191024012148-0ed4385a26c2
+	github.com/fxamacker/cbor v1.5.1
 	github.com/kr/pretty v0.1.0 // indirect
-	golang.org/x/net v0.0.0-20191126235420-ef20fe5d7933 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	golang.org/x/net v0.0.0-20191126235420-ef20fe5d7933
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
-	gopkg.in/yaml.v2 v2.2.7 // indirect
+	gopkg.in/yaml.v2 v2.2.7
 )
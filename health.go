@@ -0,0 +1,163 @@
+package sensor
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//=====================HEALTH===================
+//
+//        存活及就绪检查, 供systemd/Kubernetes探测
+//
+//=====================END======================
+
+const (
+	HEALTHZ_PATH = "/healthz"
+	READYZ_PATH  = "/readyz"
+)
+
+// 检查结果
+const (
+	HEALTH_OK   = "ok"
+	HEALTH_WARN = "warn" // 不影响整体结果
+	HEALTH_FAIL = "fail"
+)
+
+// TimeWheel超过该时间未处理tick视为停滞
+const TIMEWHEEL_STALL_TIMEOUT = 10 * time.Second
+
+/**
+ * 单项检查
+ */
+type ComponentHealth struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"` // 失败时整体失败
+	Detail   string `json:"detail,omitempty"`
+}
+
+/**
+ * 检查结果, 有关键项失败时status为fail, HTTP状态码为503
+ */
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+	Sessions   map[string]bool            `json:"sessions"` // CONFIG中的DTU -> 是否已连接
+}
+
+func componentHealth(ok, critical bool, detail string) ComponentHealth {
+	ch := ComponentHealth{Status: HEALTH_OK, Critical: critical, Detail: detail}
+	if !ok {
+		ch.Status = HEALTH_WARN
+		if critical {
+			ch.Status = HEALTH_FAIL
+		}
+	}
+	return ch
+}
+
+/**
+ * 存活检查: DTU监听及TimeWheel, 失败时应重启进程
+ */
+func (c *Collector) Liveness() HealthReport {
+	return c.healthReport(false)
+}
+
+func Liveness() HealthReport {
+	return Default().Liveness()
+}
+
+/**
+ * 就绪检查: 在存活检查的基础上检查CONFIG及MQTT连接
+ */
+func (c *Collector) Readiness() HealthReport {
+	return c.healthReport(true)
+}
+
+func Readiness() HealthReport {
+	return Default().Readiness()
+}
+
+func (c *Collector) healthReport(ready bool) HealthReport {
+	report := HealthReport{Status: HEALTH_OK, Components: make(map[string]ComponentHealth), Sessions: make(map[string]bool)}
+
+	c.mu.Lock()
+	listening, ln, tw := c.listening, c.listener, c.tw
+	c.mu.Unlock()
+	detail := "not listening"
+	if listening {
+		detail = ln.Addr().String()
+	}
+	report.Components["listener"] = componentHealth(listening && !c.IsStopping(), true, detail)
+
+	if tw == nil {
+		report.Components["timewheel"] = componentHealth(false, true, "not started")
+	} else {
+		last, lag := tw.LastTick()
+		idle := time.Since(last)
+		report.Components["timewheel"] = componentHealth(idle < TIMEWHEEL_STALL_TIMEOUT, true,
+			fmt.Sprintf("last tick %s ago, lag %s", idle.Round(time.Millisecond), lag.Round(time.Millisecond)))
+	}
+
+	dl := c.Config()
+	if ready {
+		err := c.ConfigError()
+		if err == nil {
+			err = dl.Validate()
+		}
+		detail = fmt.Sprintf("version %d", dl.Version)
+		if err != nil {
+			detail = err.Error()
+		}
+		report.Components["config"] = componentHealth(err == nil, true, detail)
+
+		// 仅读取GetMQTTInstance建立的连接, 不在探测中发起连接
+		_, connected := c.connectedClient()
+		detail = "connected"
+		if !connected {
+			detail = "disconnected"
+		}
+		report.Components["mqtt"] = componentHealth(connected, true, detail)
+	}
+
+	// DTU可能正常离线, 只作提示
+	missing := 0
+	for _, v := range dl.LocalSensorInformation {
+		if _, ok := report.Sessions[v.Attach]; ok {
+			continue
+		}
+		_, err := c.GetDeviceSession(v.Attach)
+		report.Sessions[v.Attach] = err == nil
+		if err != nil {
+			missing++
+		}
+	}
+	report.Components["sessions"] = componentHealth(missing == 0, false, fmt.Sprintf("%d/%d connected", len(report.Sessions)-missing, len(report.Sessions)))
+
+	for _, v := range report.Components {
+		if v.Status == HEALTH_FAIL {
+			report.Status = HEALTH_FAIL
+		}
+	}
+	return report
+}
+
+/**
+ * 不需要令牌, 关键项失败时为503
+ */
+func (c *Collector) healthHandler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+			writeJSON(w, http.StatusMethodNotAllowed, APIError{Error: "method not allowed"})
+			return
+		}
+		report := c.healthReport(ready)
+		status := http.StatusOK
+		if report.Status != HEALTH_OK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, status, report)
+	})
+}
@@ -0,0 +1,109 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, url string) (int, HealthReport) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report HealthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, report
+}
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := newFakeClient()
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{Name: "c1", HTTPAddress: "127.0.0.1:0", HTTPToken: "t0ken", LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 3600, SensorID: "s1"},
+		{Addr: 2, Attach: "10.0.0.1", Interval: 3600, SensorID: "s2"},
+	}}), WithListenAddress("127.0.0.1:0"), WithMQTTClient(client))
+
+	if report := c.Liveness(); report.Status != HEALTH_FAIL || report.Components["listener"].Status != HEALTH_FAIL || report.Components["timewheel"].Status != HEALTH_FAIL {
+		t.Errorf("liveness before start: %+v", report)
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(context.Background())
+	conn := fakeDTU(t, c.Addr().String())
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := c.GetDeviceSession("127.0.0.1"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	base := "http://" + c.HTTPAddr().String()
+	status, report := getHealth(t, base+HEALTHZ_PATH)
+	if status != http.StatusOK || report.Status != HEALTH_OK {
+		t.Errorf("healthz: %d %+v", status, report)
+	}
+	if _, ok := report.Components["mqtt"]; ok {
+		t.Error("healthz should not check mqtt")
+	}
+	status, report = getHealth(t, base+READYZ_PATH)
+	if status != http.StatusOK || report.Status != HEALTH_OK {
+		t.Errorf("readyz: %d %+v", status, report)
+	}
+	// 部分DTU离线只作提示
+	if report.Components["sessions"].Status != HEALTH_WARN || !report.Sessions["127.0.0.1"] || report.Sessions["10.0.0.1"] {
+		t.Errorf("unexpected sessions %+v %+v", report.Components["sessions"], report.Sessions)
+	}
+
+	client.Lock()
+	client.offline = true
+	client.Unlock()
+	status, report = getHealth(t, base+READYZ_PATH)
+	if status != http.StatusServiceUnavailable || report.Components["mqtt"].Status != HEALTH_FAIL {
+		t.Errorf("readyz without mqtt: %d %+v", status, report)
+	}
+	if status, _ = getHealth(t, base+HEALTHZ_PATH); status != http.StatusOK {
+		t.Errorf("healthz without mqtt: %d", status)
+	}
+	client.Lock()
+	client.offline = false
+	client.Unlock()
+
+	// 配置文件不存在, 保留当前CONFIG
+	if dl, err := c.ReloadConfig(); err == nil || dl.Name != "c1" || len(c.Config().LocalSensorInformation) != 2 {
+		t.Errorf("config replaced after failed reload %+v %v", c.Config(), err)
+	}
+	c.RestartHandler(client, fakeMessage{topic: "sensor/action/restart", payload: []byte(`{"replyTo":"app/r"}`)})
+	if res := actionResult(t, client, "app/r"); res.Status != RESULT_ERROR || c.Config().Name != "c1" {
+		t.Errorf("restart with broken config %+v", res)
+	}
+	status, report = getHealth(t, base+READYZ_PATH)
+	if status != http.StatusServiceUnavailable || report.Components["config"].Status != HEALTH_FAIL {
+		t.Errorf("readyz with config error: %d %+v", status, report)
+	}
+
+	resp, err := http.Post(base+HEALTHZ_PATH, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST healthz: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,603 @@
+package sensor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//=====================HISTORY==================
+//
+//       测量结果的本地存储, 按传感器及时间范围查询
+//
+//=====================END======================
+
+const (
+	HISTORY_RETENTION      int64 = 30 * 24 * 3600 // 缺省保留时间(秒)
+	HISTORY_PRUNE_INTERVAL       = time.Hour      // 清理过期数据的间隔
+	HISTORY_QUERY_LIMIT          = 10000          // 单次查询最多返回的时间点数
+	HISTORY_QUERY_RANGE          = 24 * time.Hour // 未指定from时查询to之前的时长
+)
+
+// 查询的时间粒度
+const (
+	HISTORY_RAW    = "raw" // 原始数据
+	HISTORY_MINUTE = "1m"  // 按分钟聚合
+	HISTORY_HOUR   = "1h"  // 按小时聚合
+)
+
+var historyResolutions = map[string]time.Duration{
+	HISTORY_RAW:    0,
+	HISTORY_MINUTE: time.Minute,
+	HISTORY_HOUR:   time.Hour,
+}
+
+// 数据文件按UTC日期划分, 过期时整个文件删除
+const (
+	historyFileLayout = "20060102"
+	historyFileExt    = ".log"
+)
+
+/**
+ * 查询条件
+ */
+type HistoryQuery struct {
+	SensorID   string    `json:"sensorID"`
+	Items      []string  `json:"items,omitempty"`      // 测量项, 为空时返回全部
+	From       time.Time `json:"from"`                 // 包含, 缺省为to之前24小时
+	To         time.Time `json:"to"`                   // 不包含, 缺省为当前时间
+	Resolution string    `json:"resolution,omitempty"` // raw/1m/1h, 缺省raw
+	Limit      int       `json:"limit,omitempty"`      // 最多返回的时间点数, 缺省及上限为HISTORY_QUERY_LIMIT
+}
+
+/**
+ * 时间点, 聚合时value为平均值; 原始数据count为1, min/max与value相同
+ */
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int       `json:"count"`
+
+	sum float64
+}
+
+/**
+ * 单个测量项的数据
+ */
+type HistorySeries struct {
+	Item   string         `json:"item"`
+	Points []HistoryPoint `json:"points"`
+}
+
+/**
+ * 查询结果, 超出limit时next为下一页的from
+ */
+type HistoryResult struct {
+	SensorID   string          `json:"sensorID"`
+	Resolution string          `json:"resolution"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Series     []HistorySeries `json:"series"`
+	Next       *time.Time      `json:"next,omitempty"`
+}
+
+/**
+ * 补全并检查查询条件
+ */
+func (q *HistoryQuery) normalize() error {
+	if q.SensorID == "" {
+		return errors.New("empty sensorID")
+	}
+	if q.Resolution == "" {
+		q.Resolution = HISTORY_RAW
+	}
+	if _, ok := historyResolutions[q.Resolution]; !ok {
+		return errors.New("unknown resolution " + q.Resolution)
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-HISTORY_QUERY_RANGE)
+	}
+	if !q.From.Before(q.To) {
+		return errors.New("from must be before to")
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", q.Limit)
+	}
+	if q.Limit == 0 || q.Limit > HISTORY_QUERY_LIMIT {
+		q.Limit = HISTORY_QUERY_LIMIT
+	}
+	return nil
+}
+
+/**
+ * 测量结果的本地存储
+ * 每个传感器一个目录, 每天一个数据文件, 按行追加ReadResult
+ */
+type History struct {
+	dir string
+	mu  sync.RWMutex // 写入及删除数据文件时持有写锁
+}
+
+func OpenHistory(dir string) (*History, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &History{dir: dir}, nil
+}
+
+/**
+ * 传感器的数据目录, sensorID转义后作为目录名
+ */
+func (h *History) sensorDir(sensorID string) string {
+	name := url.PathEscape(sensorID)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return filepath.Join(h.dir, name)
+}
+
+/**
+ * 追加一条测量结果, 按其测量时间存入对应日期的文件
+ */
+func (h *History) Append(p ReadResult) error {
+	if p.SensorID == "" {
+		return errors.New("empty sensorID")
+	}
+	if p.Created.IsZero() {
+		p.Created = time.Now()
+	}
+	return h.appendLine(h.sensorDir(p.SensorID), "", p.Created, p)
+}
+
+/**
+ * 以json追加一行到dir中t对应日期的文件
+ * @param prefix 文件名前缀
+ */
+func (h *History) appendLine(dir, prefix string, t time.Time, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := prefix + t.UTC().Format(historyFileLayout) + historyFileExt
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/**
+ * 按时间顺序读取[from, to)内的测量结果, fn返回false时停止
+ * 读取过程中不持有锁, fn可以阻塞
+ */
+func (h *History) Scan(sensorID string, from, to time.Time, fn func(p ReadResult) bool) error {
+	return h.scanRecords(h.sensorDir(sensorID), "", from, to, func(line []byte) (interface{}, time.Time, bool) {
+		var p ReadResult
+		err := json.Unmarshal(line, &p)
+		return p, p.Created, err == nil
+	}, func(v interface{}) bool {
+		return fn(v.(ReadResult))
+	})
+}
+
+/**
+ * 按时间顺序读取dir中[from, to)内的记录(测量结果、报警、控制记录), fn返回false时停止
+ * @param decode 解析一行, 返回记录及其时间, 损坏的行(例如写入时断电)返回false并跳过
+ */
+func (h *History) scanRecords(dir, prefix string, from, to time.Time, decode func(line []byte) (interface{}, time.Time, bool), fn func(v interface{}) bool) error {
+	type record struct {
+		v interface{}
+		t time.Time
+	}
+	paths, err := h.dayFiles(dir, prefix, from, to)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		// 同一文件内一般按时间顺序, 补录的数据可能乱序, 因此按时间排序后返回
+		var list []record
+		err = h.readLines(path, func(line []byte) {
+			if v, t, ok := decode(line); ok && !t.Before(from) && t.Before(to) {
+				list = append(list, record{v, t})
+			}
+		})
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].t.Before(list[j].t)
+		})
+		for _, r := range list {
+			if !fn(r.v) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * 报警、控制记录的查询范围, 未指定to时为当前时间, 未指定from时为to之前HISTORY_QUERY_RANGE
+ */
+func recordRange(from, to time.Time) (time.Time, time.Time) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-HISTORY_QUERY_RANGE)
+	}
+	return from, to
+}
+
+/**
+ * 解析记录查询的from/to/limit参数
+ */
+func parseHistoryQuery(query url.Values) (from, to time.Time, limit int, err error) {
+	if from, err = parseAPITime(query.Get("from")); err != nil {
+		return
+	}
+	if to, err = parseAPITime(query.Get("to")); err != nil {
+		return
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			err = invalid(fmt.Errorf("invalid limit %s", v))
+		}
+	}
+	return
+}
+
+/**
+ * dir中与[from, to)有交集的数据文件, 按日期排序
+ */
+func (h *History) dayFiles(dir, prefix string, from, to time.Time) ([]string, error) {
+	h.mu.RLock()
+	files, err := ioutil.ReadDir(dir)
+	h.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range files {
+		day, ok := historyFileDay(prefix, fi.Name())
+		if ok && day.Before(to) && day.Add(24*time.Hour).After(from) {
+			paths = append(paths, filepath.Join(dir, fi.Name()))
+		}
+	}
+	return paths, nil
+}
+
+/**
+ * 文件名 -> 该文件的起始时间
+ */
+func historyFileDay(prefix, name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, historyFileExt) {
+		return time.Time{}, false
+	}
+	day, err := time.Parse(historyFileLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), historyFileExt))
+	return day, err == nil
+}
+
+/**
+ * 逐行读取数据文件, 只读取打开时已写入的部分, 读取过程中不持有锁
+ */
+func (h *History) readLines(path string, fn func(line []byte)) error {
+	h.mu.RLock()
+	f, err := os.Open(path)
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			size = fi.Size()
+		} else {
+			f.Close()
+		}
+	}
+	h.mu.RUnlock()
+	if os.IsNotExist(err) {
+		// 读取前已过期删除
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			fn(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/**
+ * 查询并按粒度聚合
+ */
+func (h *History) Query(q HistoryQuery) (HistoryResult, error) {
+	if err := q.normalize(); err != nil {
+		return HistoryResult{}, invalid(err)
+	}
+	res := HistoryResult{SensorID: q.SensorID, Resolution: q.Resolution, From: q.From, To: q.To, Series: []HistorySeries{}}
+	step := historyResolutions[q.Resolution]
+	index := make(map[string]int) // 测量项 -> Series下标
+	var current time.Time
+	points := 0
+	err := h.Scan(q.SensorID, q.From, q.To, func(p ReadResult) bool {
+		t := p.Created
+		if step > 0 {
+			t = t.Truncate(step)
+		}
+		// 原始数据每条为一个时间点
+		if step == 0 || points == 0 || !t.Equal(current) {
+			if points == q.Limit {
+				res.Next = &t
+				return false
+			}
+			points++
+			current = t
+		}
+		for _, v := range p.Items {
+			if len(q.Items) > 0 && !contains(q.Items, v.Name) {
+				continue
+			}
+			i, ok := index[v.Name]
+			if !ok {
+				i = len(res.Series)
+				index[v.Name] = i
+				res.Series = append(res.Series, HistorySeries{Item: v.Name})
+			}
+			s := &res.Series[i]
+			if n := len(s.Points); step > 0 && n > 0 && s.Points[n-1].Time.Equal(t) {
+				pt := &s.Points[n-1]
+				pt.sum += v.Value
+				pt.Count++
+				if v.Value < pt.Min {
+					pt.Min = v.Value
+				}
+				if v.Value > pt.Max {
+					pt.Max = v.Value
+				}
+				continue
+			}
+			s.Points = append(s.Points, HistoryPoint{Time: t, Min: v.Value, Max: v.Value, Count: 1, sum: v.Value})
+		}
+		return true
+	})
+	for i := range res.Series {
+		for j := range res.Series[i].Points {
+			pt := &res.Series[i].Points[j]
+			pt.Value = pt.sum / float64(pt.Count)
+		}
+	}
+	return res, err
+}
+
+/**
+ * 删除超过保留时间的数据文件
+ * @param retention 各传感器的保留时间
+ * @return 删除的文件数
+ */
+func (h *History) Prune(retention func(sensorID string) time.Duration) (int, error) {
+	dirs, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return 0, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed := 0
+	now := time.Now()
+	remove := func(dir, prefix, name string, expire time.Time) (bool, error) {
+		day, ok := historyFileDay(prefix, name)
+		if !ok || day.Add(24*time.Hour).After(expire) {
+			return false, nil
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return false, err
+		}
+		removed++
+		return true, nil
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			// 报警及控制记录按缺省保留时间清理
+			for _, prefix := range []string{alarmFilePrefix, controlFilePrefix} {
+				if _, err := remove(h.dir, prefix, d.Name(), now.Add(-retention(""))); err != nil {
+					return removed, err
+				}
+			}
+			continue
+		}
+		sensorID, err := url.PathUnescape(d.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(h.dir, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+		expire := now.Add(-retention(sensorID))
+		left := len(files)
+		for _, fi := range files {
+			ok, err := remove(dir, "", fi.Name(), expire)
+			if err != nil {
+				return removed, err
+			}
+			if ok {
+				left--
+			}
+		}
+		if left == 0 {
+			_ = os.Remove(dir)
+		}
+	}
+	return removed, nil
+}
+
+// ========================collector===========================
+
+/**
+ * 该收集器的历史数据, 首次调用时按CONFIG打开
+ * 目录缺省为CONFIG所在目录下的history, 无法打开时返回nil(不存储)
+ */
+func (c *Collector) History() *History {
+	dl := c.Config()
+	c.historyOnce.Do(func() {
+		dir := dl.HistoryDir
+		if dir == "" {
+			dir = filepath.Join(filepath.Dir(c.GetConfigPath()), "history")
+		}
+		h, err := OpenHistory(dir)
+		if err != nil {
+			fmt.Println("[FAIL] 打开历史数据失败", err)
+			return
+		}
+		c.mu.Lock()
+		c.history = h
+		c.mu.Unlock()
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.history
+}
+
+/**
+ * 传感器的保留时间, 未配置时为history_retention, 已移除的传感器同样使用history_retention
+ */
+func (c *Collector) historyRetention(sensorID string) time.Duration {
+	dl := c.Config()
+	retention := dl.HistoryRetention
+	for _, v := range dl.LocalSensorInformation {
+		if v.SensorID == sensorID && v.Retention > 0 {
+			retention = v.Retention
+			break
+		}
+	}
+	if retention <= 0 {
+		retention = HISTORY_RETENTION
+	}
+	return time.Duration(retention) * time.Second
+}
+
+func (c *Collector) recordHistory(p ReadResult) {
+	h := c.History()
+	if h == nil {
+		return
+	}
+	if err := h.Append(p); err != nil {
+		fmt.Println("[WARN] 写入历史数据失败", err)
+	}
+}
+
+/**
+ * 查询历史数据, 已移除的传感器在保留时间内仍可查询
+ */
+func (c *Collector) QueryHistory(q HistoryQuery) (HistoryResult, error) {
+	h := c.History()
+	if h == nil {
+		return HistoryResult{}, errors.New("history unavailable")
+	}
+	return h.Query(q)
+}
+
+func QueryHistory(q HistoryQuery) (HistoryResult, error) {
+	return Default().QueryHistory(q)
+}
+
+/**
+ * 定时清理过期数据, 收集器停止时退出
+ */
+func (c *Collector) runHistory() {
+	ticker := time.NewTicker(HISTORY_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		c.pruneHistory()
+		select {
+		case <-c.draining:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) pruneHistory() {
+	h := c.History()
+	if h == nil {
+		return
+	}
+	n, err := h.Prune(c.historyRetention)
+	if n > 0 {
+		fmt.Printf("[INFO] 已清理过期历史数据 %d 个文件\n", n)
+	}
+	if err != nil {
+		fmt.Println("[WARN] 清理历史数据失败", err)
+	}
+}
+
+/**
+ * 历史数据查询请求
+ */
+type HistoryRequest struct {
+	HistoryQuery
+	ActionEnvelope
+}
+
+/**
+ * 查询历史数据, 结果在应答的data中
+ * @Topic sensor/action/history
+ */
+func (c *Collector) HistoryHandler(client mqtt.Client, message mqtt.Message) {
+	var req HistoryRequest
+	err := json.Unmarshal(message.Payload(), &req)
+	c.reply(message, req.ActionEnvelope, req.SensorID, func(context.Context) (interface{}, error) {
+		if err != nil {
+			return nil, invalid(err)
+		}
+		return c.QueryHistory(req.HistoryQuery)
+	})
+}
+
+func HistoryHandler(client mqtt.Client, message mqtt.Message) {
+	Default().HistoryHandler(client, message)
+}
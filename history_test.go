@@ -0,0 +1,166 @@
+package sensor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := OpenHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2020, 1, 1, 23, 58, 0, 0, time.UTC)
+	// 跨越日期, 且写入顺序与测量时间不一致
+	for _, i := range []int{0, 2, 1, 3, 4, 5} {
+		p := ReadResult{SensorID: "../s", Created: base.Add(time.Duration(i) * 30 * time.Second), Items: []MeasureItem{
+			{Name: "Oxygen", Value: float64(i)},
+			{Name: "Temp", Value: 20},
+		}}
+		if err := h.Append(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "%2E.%2Fs", "20200102.log")); err != nil {
+		t.Errorf("unexpected layout: %v", err)
+	}
+
+	res, err := h.Query(HistoryQuery{SensorID: "../s", Items: []string{"Oxygen"}, From: base, To: base.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Series) != 1 || res.Series[0].Item != "Oxygen" || len(res.Series[0].Points) != 6 || res.Next != nil {
+		t.Fatalf("unexpected raw result %+v", res)
+	}
+	for i, v := range res.Series[0].Points {
+		if v.Value != float64(i) || v.Count != 1 {
+			t.Errorf("point %d out of order: %+v", i, v)
+		}
+	}
+
+	res, _ = h.Query(HistoryQuery{SensorID: "../s", From: base, To: base.Add(time.Hour), Resolution: HISTORY_MINUTE})
+	if len(res.Series) != 2 {
+		t.Fatalf("unexpected series %+v", res.Series)
+	}
+	oxygen := res.Series[0].Points
+	if len(oxygen) != 3 || oxygen[1].Time != base.Add(time.Minute) || oxygen[1].Value != 2.5 || oxygen[1].Min != 2 || oxygen[1].Max != 3 || oxygen[1].Count != 2 {
+		t.Errorf("unexpected aggregate %+v", oxygen)
+	}
+
+	res, _ = h.Query(HistoryQuery{SensorID: "../s", From: base, To: base.Add(time.Hour), Limit: 4})
+	if len(res.Series[0].Points) != 4 || res.Next == nil || !res.Next.Equal(base.Add(2*time.Minute)) {
+		t.Errorf("unexpected page %+v next %v", res.Series[0].Points, res.Next)
+	}
+
+	for _, q := range []HistoryQuery{
+		{},
+		{SensorID: "s", Resolution: "5m"},
+		{SensorID: "s", From: base, To: base},
+		{SensorID: "s", Limit: -1},
+	} {
+		if _, err := h.Query(q); !IsValidationError(err) {
+			t.Errorf("invalid query %+v accepted", q)
+		}
+	}
+	if res, err := h.Query(HistoryQuery{SensorID: "none"}); err != nil || len(res.Series) != 0 {
+		t.Errorf("unknown sensor: %+v %v", res, err)
+	}
+
+	n, err := h.Prune(func(sensorID string) time.Duration {
+		if sensorID != "../s" {
+			t.Errorf("unexpected sensorID %s", sensorID)
+		}
+		return time.Since(base.Add(24 * time.Hour))
+	})
+	if err != nil || n != 1 {
+		t.Errorf("prune removed %d files: %v", n, err)
+	}
+	res, _ = h.Query(HistoryQuery{SensorID: "../s", From: base, To: base.Add(time.Hour)})
+	if len(res.Series) != 2 || len(res.Series[0].Points) != 2 {
+		t.Errorf("unexpected result after prune %+v", res.Series)
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := newFakeClient()
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{HistoryRetention: 3600, LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s", Retention: 7200},
+	}}), WithMQTTClient(client))
+	if c.historyRetention("s") != 2*time.Hour || c.historyRetention("removed") != time.Hour {
+		t.Errorf("unexpected retention %s %s", c.historyRetention("s"), c.historyRetention("removed"))
+	}
+	now := time.Now()
+	c.recordHistory(ReadResult{SensorID: "s", Created: now.Add(-time.Minute), Items: []MeasureItem{{Name: "Oxygen", Value: 5.27}}})
+	if _, err := os.Stat(filepath.Join(dir, "history", "s")); err != nil {
+		t.Errorf("history not stored in default dir: %v", err)
+	}
+
+	srv := httptest.NewServer(c.apiHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + API_PREFIX + "/sensors/s/history?item=Oxygen&resolution=1h&from=" + now.Add(-time.Hour).Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res HistoryResult
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(res.Series) != 1 || len(res.Series[0].Points) != 1 || res.Series[0].Points[0].Value != 5.27 {
+		t.Errorf("unexpected http result %d %+v", resp.StatusCode, res)
+	}
+	resp, err = http.Get(srv.URL + API_PREFIX + "/sensors/s/history?from=yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid time: %d", resp.StatusCode)
+	}
+
+	c.HistoryHandler(client, fakeMessage{topic: "sensor/action/history", payload: []byte(`{"sensorID":"s","resolution":"1m","requestID":"1","replyTo":"app/1"}`)})
+	reply := actionResult(t, client, "app/1")
+	data, _ := json.Marshal(reply.Data)
+	res = HistoryResult{}
+	_ = json.Unmarshal(data, &res)
+	if reply.Status != RESULT_OK || len(res.Series) != 1 || res.Series[0].Points[0].Count != 1 {
+		t.Errorf("unexpected mqtt reply %+v", reply)
+	}
+	c.HistoryHandler(client, fakeMessage{topic: "sensor/action/history", payload: []byte(`{"sensorID":"s","resolution":"1d","replyTo":"app/2"}`)})
+	if reply := actionResult(t, client, "app/2"); reply.Status != RESULT_INVALID {
+		t.Errorf("invalid resolution accepted %+v", reply)
+	}
+}
+
+func TestParseHistoryQuery(t *testing.T) {
+	query, _ := url.ParseQuery("from=2020-01-01T00:00:00Z&to=1577840400&limit=5")
+	from, to, limit, err := parseHistoryQuery(query)
+	if err != nil || !from.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) || to.Unix() != 1577840400 || limit != 5 {
+		t.Errorf("unexpected query %v %v %d %v", from, to, limit, err)
+	}
+	for _, v := range []string{"from=yesterday", "to=x", "limit=-1", "limit=a"} {
+		query, _ := url.ParseQuery(v)
+		if _, _, _, err := parseHistoryQuery(query); !IsValidationError(err) {
+			t.Errorf("invalid query %s accepted: %v", v, err)
+		}
+	}
+	from, to = recordRange(time.Time{}, time.Time{})
+	if to.Sub(from) != HISTORY_QUERY_RANGE || time.Since(to) > time.Minute {
+		t.Errorf("unexpected default range %v %v", from, to)
+	}
+}
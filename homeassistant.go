@@ -0,0 +1,192 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"regexp"
+	"strings"
+)
+
+//=====================HOME ASSISTANT===========
+//
+//        Home Assistant MQTT自动发现
+//
+//=====================END======================
+
+// 缺省的自动发现前缀
+const HA_DISCOVERY_PREFIX = "homeassistant"
+
+// Home Assistant上线时发布到{prefix}/status
+const HA_ONLINE = "online"
+
+/**
+ * 测量项在Home Assistant及管理页面中的显示
+ */
+type MeasureItemMeta struct {
+	Unit        string `json:"unit"`                  // 单位
+	DeviceClass string `json:"deviceClass,omitempty"` // 设备类别, Home Assistant没有对应类别时为空
+	Icon        string `json:"icon,omitempty"`
+}
+
+var MeasureItemMetas = map[string]MeasureItemMeta{
+	"Oxygen": {Unit: "mg/L", Icon: "mdi:water-opacity"},
+	"Temp":   {Unit: "°C", DeviceClass: "temperature"},
+}
+
+/**
+ * 自动发现配置, 配置后需要topic_prefix(每个传感器独立的主题)
+ */
+type HomeAssistantOptions struct {
+	DiscoveryPrefix string `json:"discovery_prefix,omitempty" yaml:"discovery_prefix,omitempty" toml:"discovery_prefix,omitempty"` // 缺省homeassistant
+}
+
+func (ho *HomeAssistantOptions) prefix() string {
+	if ho.DiscoveryPrefix == "" {
+		return HA_DISCOVERY_PREFIX
+	}
+	return strings.Trim(ho.DiscoveryPrefix, "/")
+}
+
+func (dl *LocalDeviceDetail) validateHomeAssistant() error {
+	if dl.HomeAssistant == nil {
+		return nil
+	}
+	if dl.TopicPrefix == "" {
+		return errors.New("homeassistant requires topic_prefix")
+	}
+	if err := validTopic(dl.HomeAssistant.DiscoveryPrefix); err != nil {
+		return fmt.Errorf("invalid discovery_prefix: %w", err)
+	}
+	for _, stream := range []string{STREAM_MEASURE, STREAM_STATUS} {
+		if e := dl.Stream(stream).Encoding; e != ENCODING_JSON && e != ENCODING_JSON_COMPACT {
+			return fmt.Errorf("homeassistant requires json encoding for stream %s", stream)
+		}
+	}
+	return nil
+}
+
+type haAvailability struct {
+	Topic         string `json:"topic"`
+	ValueTemplate string `json:"value_template"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+/**
+ * sensor组件的自动发现配置
+ */
+type haSensorConfig struct {
+	Name              string           `json:"name"`
+	UniqueID          string           `json:"unique_id"`
+	ObjectID          string           `json:"object_id"`
+	StateTopic        string           `json:"state_topic"`
+	ValueTemplate     string           `json:"value_template"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string           `json:"device_class,omitempty"`
+	StateClass        string           `json:"state_class"`
+	Icon              string           `json:"icon,omitempty"`
+	Availability      []haAvailability `json:"availability"`
+	AvailabilityMode  string           `json:"availability_mode"`
+	Device            haDevice         `json:"device"`
+}
+
+var haIDReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+/**
+ * 自动发现中的ID只允许字母/数字/_/-
+ */
+func haID(v string) string {
+	return haIDReplacer.ReplaceAllString(v, "_")
+}
+
+/**
+ * 传感器各测量项的自动发现主题及配置
+ * 需要topic_prefix, 状态主题固定为 sensors/{sensorID}/...
+ */
+func (dl *LocalDeviceDetail) haSensorConfigs(ls *LocalSensorInformation) map[string]haSensorConfig {
+	ret := make(map[string]haSensorConfig)
+	for _, item := range MeasureItemNames[ls.Type] {
+		meta := MeasureItemMetas[item]
+		id := haID(ls.SensorID + "_" + strings.ToLower(item))
+		topic := dl.HomeAssistant.prefix() + "/sensor/" + haID(dl.Name) + "/" + id + "/config"
+		ret[topic] = haSensorConfig{
+			Name:              item,
+			UniqueID:          id,
+			ObjectID:          id,
+			StateTopic:        dl.Topic("sensors/" + ls.SensorID + "/" + TOPIC_MEASURE),
+			ValueTemplate:     "{% for i in value_json['items'] if i.name == '" + item + "' %}{{ i.value }}{% endfor %}",
+			UnitOfMeasurement: meta.Unit,
+			DeviceClass:       meta.DeviceClass,
+			StateClass:        "measurement",
+			Icon:              meta.Icon,
+			Availability: []haAvailability{
+				{Topic: dl.PresenceTopic(), ValueTemplate: "{{ value_json.status }}"},
+				{Topic: dl.Topic("sensors/" + ls.SensorID + "/" + TOPIC_STATUS), ValueTemplate: "{{ 'online' if value_json.status in ['" + SENSOR_NORMAL + "', '" + SENSOR_BACKING_OFF + "'] else 'offline' }}"},
+			},
+			AvailabilityMode: "all",
+			Device: haDevice{
+				Identifiers:  []string{ls.SensorID},
+				Name:         ls.SensorID,
+				Model:        fmt.Sprintf("type %d addr %d", ls.Type, ls.Addr),
+				Manufacturer: "pond_sensor",
+				ViaDevice:    dl.Name,
+			},
+		}
+	}
+	return ret
+}
+
+/**
+ * 发布全部传感器的自动发现配置(保留消息), 清除prev中已移除传感器的配置
+ */
+func (c *Collector) publishDiscovery(client mqtt.Client, prev *LocalDeviceDetail) {
+	dl := c.Config()
+	if dl.HomeAssistant == nil {
+		return
+	}
+	topics := make(map[string]bool)
+	for _, v := range dl.LocalSensorInformation {
+		for topic, conf := range dl.haSensorConfigs(v) {
+			send, _ := json.Marshal(conf)
+			client.Publish(topic, 1, true, send)
+			topics[topic] = true
+		}
+	}
+	if prev != nil && prev.HomeAssistant != nil {
+		for _, v := range prev.LocalSensorInformation {
+			for topic := range prev.haSensorConfigs(v) {
+				if !topics[topic] {
+					client.Publish(topic, 1, true, []byte{})
+				}
+			}
+		}
+	}
+	fmt.Printf("[INFO] 已发布自动发现配置 %d 项\n", len(topics))
+}
+
+/**
+ * 订阅Home Assistant的上线消息, 重启后重新发布自动发现配置
+ */
+func (c *Collector) subscribeHomeAssistant() {
+	dl := c.Config()
+	if dl.HomeAssistant == nil {
+		return
+	}
+	c.subMu.Lock()
+	c.subscriptions[dl.HomeAssistant.prefix()+"/status"] = c.HomeAssistantStatusHandler
+	c.subMu.Unlock()
+}
+
+func (c *Collector) HomeAssistantStatusHandler(client mqtt.Client, message mqtt.Message) {
+	if string(message.Payload()) == HA_ONLINE {
+		c.publishDiscovery(client, nil)
+	}
+}
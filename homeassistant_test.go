@@ -0,0 +1,64 @@
+package sensor
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	client := newFakeClient()
+	dl := &LocalDeviceDetail{Name: "c1", TopicPrefix: "farm/{collector}", HomeAssistant: &HomeAssistantOptions{}, LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s1"},
+	}}
+	if err := dl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCollector(WithConfig(dl), WithMQTTClient(client))
+
+	prev := &LocalDeviceDetail{Name: "c1", TopicPrefix: "farm/{collector}", HomeAssistant: &HomeAssistantOptions{}, LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s1"},
+		{Addr: 2, Attach: "127.0.0.1", Interval: 60, SensorID: "s.2"},
+	}}
+	c.publishDiscovery(client, prev)
+
+	msgs := client.messages("homeassistant/sensor/c1/s1_temp/config")
+	var conf haSensorConfig
+	if len(msgs) != 1 || !msgs[0].retained || json.Unmarshal(msgs[0].payload, &conf) != nil {
+		t.Fatal("discovery config not published")
+	}
+	if conf.UniqueID != "s1_temp" || conf.DeviceClass != "temperature" || conf.UnitOfMeasurement != "°C" || conf.StateTopic != "farm/c1/sensors/s1/measure" {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	if len(conf.Availability) != 2 || conf.Availability[0].Topic != "farm/c1/presence" || conf.Availability[1].Topic != "farm/c1/sensors/s1/status" {
+		t.Errorf("unexpected availability %+v", conf.Availability)
+	}
+	if conf.Device.Identifiers[0] != "s1" || conf.Device.ViaDevice != "c1" {
+		t.Errorf("unexpected device %+v", conf.Device)
+	}
+	msgs = client.messages("homeassistant/sensor/c1/s1_oxygen/config")
+	var oxygen haSensorConfig
+	if len(msgs) != 1 || json.Unmarshal(msgs[0].payload, &oxygen) != nil || oxygen.UnitOfMeasurement != "mg/L" || oxygen.DeviceClass != "" {
+		t.Errorf("unexpected oxygen config %+v", oxygen)
+	}
+	// 已移除的传感器清除保留配置
+	if msgs = client.messages("homeassistant/sensor/c1/s_2_oxygen/config"); len(msgs) != 1 || len(msgs[0].payload) != 0 || !msgs[0].retained {
+		t.Errorf("removed sensor not cleared %v", msgs)
+	}
+
+	c.HomeAssistantStatusHandler(client, fakeMessage{topic: "homeassistant/status", payload: []byte(HA_ONLINE)})
+	if msgs = client.messages("homeassistant/sensor/c1/s1_temp/config"); len(msgs) != 2 {
+		t.Error("discovery not republished after home assistant restart")
+	}
+}
+
+func TestHomeAssistantValidate(t *testing.T) {
+	for _, dl := range []*LocalDeviceDetail{
+		{HomeAssistant: &HomeAssistantOptions{}},
+		{TopicPrefix: "farm", HomeAssistant: &HomeAssistantOptions{DiscoveryPrefix: "ha/#"}},
+		{TopicPrefix: "farm", HomeAssistant: &HomeAssistantOptions{}, Streams: map[string]*StreamOptions{STREAM_MEASURE: {Encoding: ENCODING_CBOR}}},
+	} {
+		if err := dl.Validate(); err == nil {
+			t.Errorf("expected error for %+v", dl)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package sensor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=====================METRICS==================
+//
+//        收集器内部状态, Prometheus文本格式
+//
+//=====================END======================
+
+const (
+	METRICS_PATH         = "/metrics"
+	METRICS_NAMESPACE    = "pond_sensor"
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// 总线往返时间的分桶(秒), 超时为10秒
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type sensorKey struct {
+	attach   string
+	sensorID string
+}
+
+type exceptionKey struct {
+	sensorKey
+	function byte
+	code     byte
+}
+
+type histogram struct {
+	counts []uint64 // 与latencyBuckets对应, 非累计
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+/**
+ * 计数器, 收集器启动后累计
+ */
+type collectorMetrics struct {
+	sync.Mutex
+	requests        map[sensorKey]uint64
+	timeouts        map[sensorKey]uint64
+	crcFailures     map[sensorKey]uint64
+	dropped         map[sensorKey]uint64 // 任务队列已满时丢弃的定时测量
+	exceptions      map[exceptionKey]uint64
+	latency         map[string]*histogram // attach -> 往返时间
+	publishFailures map[string]uint64     // 数据流 -> 发布失败次数
+}
+
+func newCollectorMetrics() *collectorMetrics {
+	return &collectorMetrics{
+		requests:        make(map[sensorKey]uint64),
+		timeouts:        make(map[sensorKey]uint64),
+		crcFailures:     make(map[sensorKey]uint64),
+		dropped:         make(map[sensorKey]uint64),
+		exceptions:      make(map[exceptionKey]uint64),
+		latency:         make(map[string]*histogram),
+		publishFailures: make(map[string]uint64),
+	}
+}
+
+func (m *collectorMetrics) incr(counter map[sensorKey]uint64, key sensorKey) {
+	m.Lock()
+	defer m.Unlock()
+	counter[key]++
+}
+
+func (m *collectorMetrics) observeLatency(attach string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	h, ok := m.latency[attach]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[attach] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *collectorMetrics) exception(key sensorKey, function, code byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.exceptions[exceptionKey{key, function, code}]++
+}
+
+func (m *collectorMetrics) publishFailed(stream string) {
+	m.Lock()
+	defer m.Unlock()
+	m.publishFailures[stream]++
+}
+
+/**
+ * 请求帧的设备地址对应的传感器, 未配置时sensorID为空
+ */
+func (c *Collector) requestSensor(attach string, request []byte) sensorKey {
+	key := sensorKey{attach: attach}
+	if len(request) == 0 {
+		return key
+	}
+	for _, v := range c.Config().GetLocalSensorList(attach) {
+		if v.Addr == request[0] {
+			key.sensorID = v.SensorID
+			break
+		}
+	}
+	return key
+}
+
+//=====================exposition=====================
+
+type metricWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", METRICS_NAMESPACE, name, help, METRICS_NAMESPACE, name, typ)
+}
+
+/**
+ * @param labels 依次为标签名及标签值
+ */
+func (mw *metricWriter) sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(METRICS_NAMESPACE + "_" + name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			mw.buf.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func sortedSensorKeys(m map[sensorKey]uint64) []sensorKey {
+	keys := make([]sensorKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].attach != keys[j].attach {
+			return keys[i].attach < keys[j].attach
+		}
+		return keys[i].sensorID < keys[j].sensorID
+	})
+	return keys
+}
+
+func (mw *metricWriter) sensorCounter(name, help string, m map[sensorKey]uint64) {
+	mw.family(name, "counter", help)
+	for _, k := range sortedSensorKeys(m) {
+		mw.sample(name, float64(m[k]), "attach", k.attach, "sensor_id", k.sensorID)
+	}
+}
+
+/**
+ * 以Prometheus文本格式写出全部指标
+ */
+func (c *Collector) WriteMetrics(w io.Writer) error {
+	mw := &metricWriter{}
+	dl := c.Config()
+
+	sessions := 0
+	queues := make(map[string]int)
+	c.sessions.Range(func(key, value interface{}) bool {
+		sessions++
+		return true
+	})
+	c.taskChannels.Range(func(key, value interface{}) bool {
+		queues[key.(string)] = len(value.(chan TaskSensorBody))
+		return true
+	})
+	mw.family("dtu_sessions", "gauge", "已连接的DTU数")
+	mw.sample("dtu_sessions", float64(sessions))
+	mw.family("sensors", "gauge", "各状态的传感器数")
+	states := make(map[string]int)
+	for _, v := range dl.LocalSensorInformation {
+		states[c.sensorState(v)]++
+	}
+	for _, v := range []string{SENSOR_NORMAL, SENSOR_DETACHED, SENSOR_CLOSED, SENSOR_BACKING_OFF} {
+		mw.sample("sensors", float64(states[v]), "status", v)
+	}
+	mw.family("task_queue_depth", "gauge", "DTU任务队列中等待的任务数")
+	attaches := make([]string, 0, len(queues))
+	for k := range queues {
+		attaches = append(attaches, k)
+	}
+	sort.Strings(attaches)
+	for _, v := range attaches {
+		mw.sample("task_queue_depth", float64(queues[v]), "attach", v)
+	}
+
+	c.metrics.Lock()
+	mw.sensorCounter("requests_total", "发送到总线的请求数", c.metrics.requests)
+	mw.sensorCounter("request_timeouts_total", "传感器应答超时次数", c.metrics.timeouts)
+	mw.sensorCounter("crc_failures_total", "CRC校验失败或无法解析的应答数", c.metrics.crcFailures)
+	mw.sensorCounter("scheduled_reads_dropped_total", "任务队列已满时丢弃的定时测量数", c.metrics.dropped)
+	mw.family("modbus_exceptions_total", "counter", "传感器返回的Modbus异常应答数")
+	exceptions := make([]exceptionKey, 0, len(c.metrics.exceptions))
+	for k := range c.metrics.exceptions {
+		exceptions = append(exceptions, k)
+	}
+	sort.Slice(exceptions, func(i, j int) bool {
+		return fmt.Sprint(exceptions[i]) < fmt.Sprint(exceptions[j])
+	})
+	for _, k := range exceptions {
+		mw.sample("modbus_exceptions_total", float64(c.metrics.exceptions[k]), "attach", k.attach, "sensor_id", k.sensorID,
+			"function", strconv.Itoa(int(k.function)), "code", strconv.Itoa(int(k.code)))
+	}
+	mw.family("request_duration_seconds", "histogram", "总线请求的往返时间")
+	attaches = attaches[:0]
+	for k := range c.metrics.latency {
+		attaches = append(attaches, k)
+	}
+	sort.Strings(attaches)
+	for _, v := range attaches {
+		h := c.metrics.latency[v]
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			mw.sample("request_duration_seconds_bucket", float64(cumulative), "attach", v, "le", strconv.FormatFloat(b, 'g', -1, 64))
+		}
+		mw.sample("request_duration_seconds_bucket", float64(h.count), "attach", v, "le", "+Inf")
+		mw.sample("request_duration_seconds_sum", h.sum, "attach", v)
+		mw.sample("request_duration_seconds_count", float64(h.count), "attach", v)
+	}
+	mw.family("mqtt_publish_failures_total", "counter", "MQTT发布失败次数")
+	names := make([]string, 0, len(streams))
+	for name := range streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mw.sample("mqtt_publish_failures_total", float64(c.metrics.publishFailures[name]), "stream", name)
+	}
+	c.metrics.Unlock()
+
+	mw.family("mqtt_connected", "gauge", "MQTT是否已连接")
+	connected := 0
+	if _, ok := c.connectedClient(); ok {
+		connected = 1
+	}
+	mw.sample("mqtt_connected", float64(connected))
+	mw.family("outbox_pending_bytes", "gauge", "数据缓存中未补发的字节数")
+	var pending int64
+	c.mu.Lock()
+	ob, tw := c.outbox, c.tw
+	c.mu.Unlock()
+	if ob != nil {
+		pending = ob.Pending()
+	}
+	mw.sample("outbox_pending_bytes", float64(pending))
+
+	if tw != nil {
+		last, lag := tw.LastTick()
+		mw.family("timewheel_tasks", "gauge", "TimeWheel中的定时任务数")
+		mw.sample("timewheel_tasks", float64(tw.TaskCount()))
+		mw.family("timewheel_lag_seconds", "gauge", "最近一次tick从触发到开始处理的延迟")
+		mw.sample("timewheel_lag_seconds", lag.Seconds())
+		if !last.IsZero() {
+			mw.family("timewheel_last_tick_timestamp_seconds", "gauge", "最近一次处理tick的时间")
+			mw.sample("timewheel_last_tick_timestamp_seconds", float64(last.UnixNano())/1e9)
+		}
+	}
+
+	readings := make(map[string]ReadResult)
+	for _, ls := range dl.LocalSensorInformation {
+		if p, ok := c.LatestReading(ls.SensorID); ok {
+			readings[ls.SensorID] = p
+		}
+	}
+	mw.family("reading", "gauge", "各传感器最近一次测量值")
+	for _, ls := range dl.LocalSensorInformation {
+		for _, v := range readings[ls.SensorID].Items {
+			mw.sample("reading", v.Value, "sensor_id", ls.SensorID, "item", v.Name)
+		}
+	}
+	mw.family("reading_timestamp_seconds", "gauge", "各传感器最近一次测量的时间")
+	for _, ls := range dl.LocalSensorInformation {
+		if p, ok := readings[ls.SensorID]; ok {
+			mw.sample("reading_timestamp_seconds", float64(p.Created.UnixNano())/1e9, "sensor_id", ls.SensorID)
+		}
+	}
+	_, err := w.Write(mw.buf.Bytes())
+	return err
+}
+
+func WriteMetrics(w io.Writer) error {
+	return Default().WriteMetrics(w)
+}
+
+/**
+ * GET /metrics, 配置http_token时同样需要令牌
+ */
+func (c *Collector) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !c.apiAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+		if err := c.WriteMetrics(w); err != nil {
+			fmt.Println("[WARN] 写出指标失败", err)
+		}
+	})
+}
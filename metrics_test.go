@@ -0,0 +1,182 @@
+package sensor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewCollector(WithConfigPath(filepath.Join(dir, "conf.json")), WithConfig(&LocalDeviceDetail{Name: "c1", HTTPAddress: "127.0.0.1:0", HTTPToken: "t0ken", LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 3600, SensorID: "s"},
+	}}), WithListenAddress("127.0.0.1:0"), WithMQTTClient(newFakeClient()))
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(context.Background())
+	conn := fakeDTU(t, c.Addr().String())
+	defer conn.Close()
+	// 扫描完成后创建定时任务
+	deadline := time.Now().Add(5 * time.Second)
+	for c.tw.TaskCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := c.Measure("s"); err != nil {
+		t.Fatal(err)
+	}
+	c.metrics.exception(sensorKey{"127.0.0.1", "s"}, 0x03, 0x02)
+	c.metrics.incr(c.metrics.crcFailures, sensorKey{"127.0.0.1", `a"b`})
+
+	url := "http://" + c.HTTPAddr().String() + METRICS_PATH
+	if resp, _ := http.Get(url); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("metrics without token: %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != METRICS_CONTENT_TYPE {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	text := string(body)
+	for _, v := range []string{
+		"pond_sensor_dtu_sessions 1\n",
+		`pond_sensor_sensors{status="normal"} 1` + "\n",
+		`pond_sensor_task_queue_depth{attach="127.0.0.1"} 0` + "\n",
+		`pond_sensor_requests_total{attach="127.0.0.1",sensor_id="s"} `,
+		`pond_sensor_request_duration_seconds_bucket{attach="127.0.0.1",le="+Inf"} `,
+		`pond_sensor_modbus_exceptions_total{attach="127.0.0.1",sensor_id="s",function="3",code="2"} 1` + "\n",
+		`pond_sensor_crc_failures_total{attach="127.0.0.1",sensor_id="a\"b"} 1` + "\n",
+		`pond_sensor_mqtt_publish_failures_total{stream="measure"} 0` + "\n",
+		"pond_sensor_mqtt_connected 1\n",
+		"# TYPE pond_sensor_timewheel_tasks gauge\npond_sensor_timewheel_tasks 1\n",
+		`pond_sensor_reading{sensor_id="s",item="Oxygen"} 5.27` + "\n",
+		`pond_sensor_reading{sensor_id="s",item="Temp"} 25` + "\n",
+		`pond_sensor_reading_timestamp_seconds{sensor_id="s"} `,
+	} {
+		if !strings.Contains(text, v) {
+			t.Errorf("missing %q in\n%s", v, text)
+		}
+	}
+	// 同一指标的样本连续, 且在其TYPE之后
+	var family string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			family = strings.Fields(line)[2]
+			continue
+		}
+		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, family) {
+			t.Errorf("sample %s outside family %s", line, family)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	m := newCollectorMetrics()
+	m.observeLatency("a", 30*time.Millisecond)
+	m.observeLatency("a", 700*time.Millisecond)
+	m.observeLatency("a", 20*time.Second)
+	c := NewCollector(WithConfig(&LocalDeviceDetail{}))
+	c.metrics = m
+	var buf bytes.Buffer
+	if err := c.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		`pond_sensor_request_duration_seconds_bucket{attach="a",le="0.05"} 1`,
+		`pond_sensor_request_duration_seconds_bucket{attach="a",le="0.5"} 1`,
+		`pond_sensor_request_duration_seconds_bucket{attach="a",le="1"} 2`,
+		`pond_sensor_request_duration_seconds_bucket{attach="a",le="10"} 2`,
+		`pond_sensor_request_duration_seconds_bucket{attach="a",le="+Inf"} 3`,
+		`pond_sensor_request_duration_seconds_sum{attach="a"} 20.73`,
+		`pond_sensor_request_duration_seconds_count{attach="a"} 3`,
+	} {
+		if !strings.Contains(buf.String(), v+"\n") {
+			t.Errorf("missing %q", v)
+		}
+	}
+}
+
+// 发布失败的MQTT连接
+type failingClient struct {
+	*fakeClient
+}
+
+type errToken struct{ doneToken }
+
+func (errToken) Error() error { return mqtt.ErrNotConnected }
+
+func (f failingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return errToken{}
+}
+
+func TestPublishFailures(t *testing.T) {
+	client := failingClient{newFakeClient()}
+	c := NewCollector(WithConfig(&LocalDeviceDetail{}), WithMQTTClient(client))
+	c.publishStream(client, STREAM_ALARM, "a", []byte(`{}`))
+	c.publishStream(client, STREAM_LOG, "l", []byte(`{}`))
+	c.publishStream(client, STREAM_LOG, "l", []byte(`{}`))
+	c.MQTTPublish("p", "x")
+
+	want := []string{
+		`pond_sensor_mqtt_publish_failures_total{stream="alarm"} 1` + "\n",
+		`pond_sensor_mqtt_publish_failures_total{stream="log"} 2` + "\n",
+		`pond_sensor_mqtt_publish_failures_total{stream="publish"} 1` + "\n",
+		`pond_sensor_mqtt_publish_failures_total{stream="measure"} 0` + "\n",
+	}
+	var text string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var buf bytes.Buffer
+		if err := c.WriteMetrics(&buf); err != nil {
+			t.Fatal(err)
+		}
+		text = buf.String()
+		if strings.Contains(text, want[0]) && strings.Contains(text, want[1]) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, v := range want {
+		if !strings.Contains(text, v) {
+			t.Errorf("missing %q in\n%s", v, text)
+		}
+	}
+}
+
+func TestDroppedReads(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{}))
+	ch := make(chan TaskSensorBody, 1)
+	c.taskChannels.Store("127.0.0.1", ch)
+	body := TaskSensorBody{SensorID: "s", SensorAttachIP: "127.0.0.1", collector: c}
+	for i := 0; i < 3; i++ {
+		TaskSensorPush(TaskData{"Data": body, "Channel": ch})
+	}
+	var buf bytes.Buffer
+	if err := c.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if v := `pond_sensor_scheduled_reads_dropped_total{attach="127.0.0.1",sensor_id="s"} 2` + "\n"; !strings.Contains(buf.String(), v) {
+		t.Errorf("missing %q in\n%s", v, buf.String())
+	}
+	if taskQueueSize(1) != TASK_QUEUE_MIN_SIZE || taskQueueSize(8) != 16 {
+		t.Error("task queue not sized by sensors")
+	}
+}
@@ -10,21 +10,52 @@ import (
 )
 
 func SensorMapping() {
+	CollectorMapping(sensor.Default())
+}
+
+/**
+ * 为指定收集器订阅主题
+ * 主题均相对于收集器的命名空间(topic_prefix), 见sensor.Topic()
+ */
+func CollectorMapping(c *sensor.Collector) {
 	// 订阅示例: 下位 -> MQTT -> 上位
 
 	// 测量
-	sensor.MQTTMapping("sensor/oxygen/measure", sensor.FncTest)
+	c.MQTTMapping(c.SensorTopic("+", sensor.TOPIC_MEASURE), sensor.FncTest)
 
 	// CONFIG更新(重启生效)
-	sensor.MQTTMapping("sensor/setting/all", sensor.SettingConfigHandler)
+	c.MQTTMapping("setting/all", c.SettingConfigHandler)
+
+	// CONFIG局部更新(立即生效)
+	c.MQTTMapping("setting/patch", c.ConfigPatchHandler)
+	c.MQTTMapping("action/add", c.DynamicAdd)
+	c.MQTTMapping("action/remove", c.RemoveSensorHandler)
+	c.MQTTMapping("action/modify", c.ModifySensorHandler)
+	c.MQTTMapping("action/setAttachIP", c.ChangeAttachIPHandler)
+
+	// 历史数据查询
+	c.MQTTMapping("action/history", c.HistoryHandler)
+
+	// 历史数据补发, 分批发布到replyTo
+	c.MQTTMapping("action/backfill", c.BackfillHandler)
+
+	// 报警确认, 报警事件发布到alarm
+	c.MQTTMapping("action/alarm/ack", c.AlarmAckHandler)
+
+	// 继电器手动覆盖, 控制记录发布到control
+	c.MQTTMapping("action/relay/override", c.RelayOverrideHandler)
+
+	// 以下指令同时接受广播(broadcast_prefix)
 
 	// Status&&Exception动态更新
-	sensor.MQTTMapping("sensor/action/clear", sensor.ClearExceptionHandler)
+	c.MQTTMappingBroadcast("action/clear", c.ClearExceptionHandler)
 
 	// 重启
-	sensor.MQTTMapping("sensor/action/restart", sensor.RestartHandler)
+	c.MQTTMappingBroadcast("action/restart", c.RestartHandler)
 
 	// 状态开关
-	sensor.MQTTMapping("sensor/action/switch", sensor.SwitchSensorHandler)
+	c.MQTTMappingBroadcast("action/switch", c.SwitchSensorHandler)
 
+	// 传感器写指令(校准/地址/出厂设置), 结果发布到command/result
+	c.MQTTMappingBroadcast("action/command", c.CommandHandler)
 }
@@ -1,8 +1,12 @@
 package sensor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/eclipse/paho.mqtt.golang"
+	"sync/atomic"
+	"time"
 )
 
 // ws/ssl/tcp
@@ -15,51 +19,202 @@ import (
 // var Username = "r3inb"
 // var Password = "159463"
 
+// MQTT连接参数的缺省值
+const (
+	MQTT_KEEPALIVE              = 30 * time.Second
+	MQTT_MAX_RECONNECT_INTERVAL = time.Minute
+	MQTT_SUBSCRIBE_TIMEOUT      = 10 * time.Second
+	MQTT_CONNECT_TIMEOUT        = 10 * time.Second // 中间件接受TCP但不应答时的连接超时
+	MQTT_MAX_HANDLERS           = 16               // 同时执行的订阅回调数, 超过时阻塞接收
+)
+
+var ErrMQTTBackoff = errors.New("mqtt connect backoff")
+
 var defaultPublishHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	// drop
 }
 
-var client mqtt.Client = nil
+/**
+ * 获得该收集器的MQTT连接, 未连接时重新连接
+ * 连接断开后由客户端自动重连, 重连期间继续使用原连接; 首次连接失败后按指数退避重试
+ * 连接过程不持有mu, 期间Config()等不受影响, 同时只有一个调用者进行连接
+ */
+func (c *Collector) GetMQTTInstance() (mqtt.Client, error) {
+	if cli, ok := c.mqttClient(); ok {
+		return cli, nil
+	}
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+	// 等待期间其他调用者可能已连接或失败
+	if cli, ok := c.mqttClient(); ok {
+		return cli, nil
+	}
+	c.mu.Lock()
+	backoff := time.Now().Before(c.nextConnect)
+	c.mu.Unlock()
+	if backoff {
+		return nil, ErrMQTTBackoff
+	}
 
-func GetMQTTInstance() (mqtt.Client, error) {
-	if client == nil || !client.IsConnectionOpen() {
-		if ins, err := pMQTTClient(); err != nil {
-			return nil, err
-		} else {
-			client = ins
-			fmt.Println("[CONN] 已连接到MQ: " + GetBrokerIP())
+	dl := c.Config()
+	ins, err := c.pMQTTClient(dl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.connectDelay *= 2
+		if c.connectDelay < time.Second {
+			c.connectDelay = time.Second
+		}
+		if max := dl.maxReconnectInterval(); c.connectDelay > max {
+			c.connectDelay = max
 		}
+		c.nextConnect = time.Now().Add(c.connectDelay)
+		fmt.Printf("[WARN] MQ连接失败, %s后重试\n", c.connectDelay)
+		return nil, err
 	}
-	return client, nil
+	c.connectDelay = 0
+	c.nextConnect = time.Time{}
+	c.client = ins
+	return c.client, nil
 }
 
-func pMQTTClient() (mqtt.Client, error) {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(GetBrokerScheme() + "://" + GetBrokerIP() + ":" + GetBrokerPort())
-	// MQ ClientID
-	opts.SetClientID(GetBrokerClientID())
-	// MQ 账号/密码
-	opts.SetUsername(GetBrokerUsername())
-	opts.SetPassword(GetBrokerPassword())
-	// opts.SetKeepAlive(2 * time.Second)
+/**
+ * 等待token完成, 超时返回false
+ * paho v1.2.0的WaitTimeout在等待期间持有token的锁, 出错时setError要等到超时后才能完成, 因此不使用
+ */
+func waitToken(token mqtt.Token, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+/**
+ * 已连接(或自动重连中)的MQTT连接
+ */
+func (c *Collector) mqttClient() (mqtt.Client, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil && c.client.IsConnected() {
+		return c.client, true
+	}
+	return nil, false
+}
+
+func GetMQTTInstance() (mqtt.Client, error) {
+	return Default().GetMQTTInstance()
+}
+
+func (c *Collector) pMQTTClient(dl *LocalDeviceDetail) (mqtt.Client, error) {
+	opts, err := brokerOptions(dl, dl.GetBrokerClientID())
+	if err != nil {
+		return nil, err
+	}
+	opts.SetConnectionLostHandler(c.onConnectionLost)
 	// 默认消费方式
 	//opts.SetDefaultPublishHandler(defaultPublishHandler)
 	// ping超时
 	//opts.SetPingTimeout(1 * time.Second)
+	// 遗嘱消息
+	setPresence(opts, dl)
+	opts.SetOnConnectHandler(c.onConnect)
 
-	c := mqtt.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
+	cli := mqtt.NewClient(opts)
+	// ConnectTimeout只限制建立TCP, 等待CONNACK同样需要超时
+	token := cli.Connect()
+	if !waitToken(token, MQTT_CONNECT_TIMEOUT) {
+		fmt.Println("[FAIL] MQTT Broker connect timeout")
+		cli.Disconnect(0)
+		return nil, errors.New("mqtt connect timeout")
+	}
+	if token.Error() != nil {
 		fmt.Println("[FAIL] MQTT Broker connect failed")
 		return nil, token.Error()
 	}
-	return c, nil
+	return cli, nil
+}
+
+/**
+ * 中间件地址/认证/TLS/心跳/重连等连接参数
+ */
+func brokerOptions(dl *LocalDeviceDetail, clientID string) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(dl.BrokerScheme + "://" + dl.BrokerIP + ":" + dl.BrokerPort)
+	// MQ ClientID
+	opts.SetClientID(clientID)
+	// MQ 账号/密码
+	opts.SetUsername(dl.BrokerUsername)
+	opts.SetPassword(dl.BrokerPassword)
+	// TLS(ssl/tls/wss)
+	tlsConfig, err := dl.TLSConfig()
+	if err != nil {
+		fmt.Println("[FAIL] 加载中间件证书失败", err)
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if tlsConfig.InsecureSkipVerify {
+			fmt.Println("[WARN] 未校验中间件证书, 仅用于测试环境")
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	// opts.SetKeepAlive(2 * time.Second)
+	opts.SetKeepAlive(dl.keepAlive())
+	opts.SetConnectTimeout(MQTT_CONNECT_TIMEOUT)
+	opts.SetCleanSession(dl.CleanSession())
+	// 断开后自动重连, 间隔从1s开始倍增
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(dl.maxReconnectInterval())
+	return opts, nil
+}
+
+/**
+ * 订阅该收集器命名空间内的主题, topic为相对主题, 见Topic()
+ * action/... 及 setting/... 主题在配置command_auth后需要签名
+ */
+func (c *Collector) MQTTMapping(topic string, callback mqtt.MessageHandler) bool {
+	return c.mqttSubscribe(c.Topic(topic), c.authorize(topic, callback))
 }
 
 func MQTTMapping(topic string, callback mqtt.MessageHandler) bool {
-	if mq, err := GetMQTTInstance(); err != nil {
+	return Default().MQTTMapping(topic, callback)
+}
+
+/**
+ * 同时订阅命名空间内及广播命名空间内的主题, 用于可以发给所有收集器的指令
+ */
+func (c *Collector) MQTTMappingBroadcast(topic string, callback mqtt.MessageHandler) bool {
+	ok := c.MQTTMapping(topic, callback)
+	if broadcast, has := c.BroadcastTopic(topic); has {
+		ok = c.mqttSubscribe(broadcast, c.authorize(topic, callback)) && ok
+	}
+	return ok
+}
+
+func MQTTMappingBroadcast(topic string, callback mqtt.MessageHandler) bool {
+	return Default().MQTTMappingBroadcast(topic, callback)
+}
+
+/**
+ * 订阅并记录主题, 重新连接后自动重新订阅
+ * 未连接时返回false, 连接建立后订阅
+ */
+func (c *Collector) mqttSubscribe(topic string, callback mqtt.MessageHandler) bool {
+	c.subMu.Lock()
+	c.subscriptions[topic] = callback
+	c.subMu.Unlock()
+	if mq, err := c.GetMQTTInstance(); err != nil {
 		return false
 	} else {
-		if token := mq.Subscribe(topic, 1, callback); token.Wait() && token.Error() != nil {
+		if token := mq.Subscribe(topic, 1, c.dispatch(callback)); token.Wait() && token.Error() != nil {
 			fmt.Printf("subscribe failed by %s\n", topic)
 			return false
 		}
@@ -68,11 +223,108 @@ func MQTTMapping(topic string, callback mqtt.MessageHandler) bool {
 	return true
 }
 
-func MQTTPublish(topic string, payload interface{}) {
-	if mq, err := GetMQTTInstance(); err != nil {
+/**
+ * 在独立的goroutine中执行订阅回调
+ * 客户端按顺序在同一goroutine中调用回调, 回调阻塞(等待应答、重启等)时会阻塞全部主题的接收及确认
+ * 同时执行的回调不超过MQTT_MAX_HANDLERS
+ */
+func (c *Collector) dispatch(callback mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		c.handlerSlots <- struct{}{}
+		atomic.AddInt32(&c.handling, 1)
+		go func() {
+			defer func() {
+				atomic.AddInt32(&c.handling, -1)
+				<-c.handlerSlots
+			}()
+			callback(client, message)
+		}()
+	}
+}
+
+/**
+ * 等待执行中的订阅回调完成, 直到ctx结束
+ */
+func (c *Collector) waitHandlers(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&c.handling) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+/**
+ * 连接(及自动重连)成功后重新订阅全部主题并发布上线消息
+ */
+func (c *Collector) onConnect(client mqtt.Client) {
+	fmt.Println("[CONN] 已连接到MQ: " + c.Config().BrokerIP)
+	c.subscribeHomeAssistant()
+	c.resubscribe(client)
+	c.publishBirth(client)
+	c.publishDiscovery(client, nil)
+}
+
+func (c *Collector) onConnectionLost(client mqtt.Client, err error) {
+	fmt.Println("[WARN] MQ连接断开, 自动重连中:", err)
+}
+
+func (c *Collector) resubscribe(client mqtt.Client) {
+	c.subMu.Lock()
+	subscriptions := make(map[string]mqtt.MessageHandler, len(c.subscriptions))
+	for k, v := range c.subscriptions {
+		subscriptions[k] = v
+	}
+	c.subMu.Unlock()
+	for topic, callback := range subscriptions {
+		token := client.Subscribe(topic, 1, c.dispatch(callback))
+		if !token.WaitTimeout(MQTT_SUBSCRIBE_TIMEOUT) || token.Error() != nil {
+			fmt.Printf("[WARN] 重新订阅失败 %s\n", topic)
+		}
+	}
+	if len(subscriptions) > 0 {
+		fmt.Printf("[INFO] 已重新订阅%d个主题\n", len(subscriptions))
+	}
+}
+
+/**
+ * 发布到该收集器命名空间内的主题
+ */
+func (c *Collector) MQTTPublish(topic string, payload interface{}) {
+	if mq, err := c.GetMQTTInstance(); err != nil {
+		c.metrics.publishFailed(STREAM_PUBLISH)
 		fmt.Println("[FAIL] 发布失败")
 	} else {
-		token := mq.Publish(topic, 1, false, payload)
-		token.Wait()
+		ps := c.Config().Stream(STREAM_PUBLISH)
+		token := mq.Publish(c.Topic(topic), ps.QoS, ps.Retain, payload)
+		if token.Wait() && token.Error() != nil {
+			c.metrics.publishFailed(STREAM_PUBLISH)
+		}
+	}
+}
+
+func MQTTPublish(topic string, payload interface{}) {
+	Default().MQTTPublish(topic, payload)
+}
+
+func (dl *LocalDeviceDetail) CleanSession() bool {
+	return dl.MQTTCleanSession == nil || *dl.MQTTCleanSession
+}
+
+func (dl *LocalDeviceDetail) keepAlive() time.Duration {
+	if dl.MQTTKeepAlive > 0 {
+		return time.Duration(dl.MQTTKeepAlive) * time.Second
+	}
+	return MQTT_KEEPALIVE
+}
+
+func (dl *LocalDeviceDetail) maxReconnectInterval() time.Duration {
+	if dl.MQTTMaxReconnectInterval > 0 {
+		return time.Duration(dl.MQTTMaxReconnectInterval) * time.Second
 	}
+	return MQTT_MAX_RECONNECT_INTERVAL
 }
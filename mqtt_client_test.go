@@ -1,9 +1,12 @@
 package sensor
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -51,3 +54,110 @@ func TestGetInformation(t *testing.T) {
 
 	time.Sleep(time.Second * 20)
 }
+
+func TestResubscribe(t *testing.T) {
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1"}), WithMQTTClient(client))
+	if !c.MQTTMapping("action/switch", c.SwitchSensorHandler) {
+		t.Fatal("subscribe failed")
+	}
+	// 重连后的新会话
+	reconnected := newFakeClient()
+	c.onConnect(reconnected)
+	if _, ok := reconnected.handlers["sensor/action/switch"]; !ok {
+		t.Error("handler not resubscribed")
+	}
+	if len(reconnected.messages(c.PresenceTopic())) != 1 {
+		t.Error("birth not published after reconnect")
+	}
+}
+
+func TestMQTTConnectBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{BrokerScheme: "tcp", BrokerIP: "127.0.0.1", BrokerPort: port}))
+	if _, err := c.GetMQTTInstance(); err == nil || err == ErrMQTTBackoff {
+		t.Fatal("unexpected", err)
+	}
+	if _, err := c.GetMQTTInstance(); err != ErrMQTTBackoff {
+		t.Error("reconnected without backoff", err)
+	}
+}
+
+func TestMQTTConnectUnlocked(t *testing.T) {
+	// 接受TCP但不应答的中间件
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	c := NewCollector(WithConfig(&LocalDeviceDetail{BrokerScheme: "tcp", BrokerIP: "127.0.0.1", BrokerPort: port}))
+	go func() {
+		_, _ = c.GetMQTTInstance()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		c.Config()
+		c.connectedClient()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("config blocked while connecting")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{}))
+	release := make(chan struct{})
+	handled := make(chan string, 2)
+	handler := c.dispatch(func(client mqtt.Client, message mqtt.Message) {
+		if message.Topic() == "slow" {
+			<-release
+		}
+		handled <- message.Topic()
+	})
+
+	// 阻塞的回调不影响之后的消息
+	done := make(chan struct{})
+	go func() {
+		handler(nil, fakeMessage{topic: "slow"})
+		handler(nil, fakeMessage{topic: "fast"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked by a running handler")
+	}
+	if topic := <-handled; topic != "fast" {
+		t.Errorf("unexpected handler %s", topic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.waitHandlers(ctx); err == nil {
+		t.Error("running handler not awaited")
+	}
+	close(release)
+	if err := c.waitHandlers(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,105 @@
+package sensor
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// 记录发布内容的MQTT连接, 用于不依赖中间件的测试
+type fakeClient struct {
+	published []fakeMessage
+	handlers  map[string]mqtt.MessageHandler
+	offline   bool // 模拟连接断开
+	sync.Mutex
+}
+
+type fakeMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return m.retained }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{handlers: make(map[string]mqtt.MessageHandler)}
+}
+
+func (f *fakeClient) IsConnected() bool { return f.IsConnectionOpen() }
+func (f *fakeClient) IsConnectionOpen() bool {
+	f.Lock()
+	defer f.Unlock()
+	return !f.offline
+}
+func (f *fakeClient) Connect() mqtt.Token     { return doneToken{} }
+func (f *fakeClient) Disconnect(quiesce uint) {}
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.Lock()
+	defer f.Unlock()
+	var data []byte
+	switch v := payload.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	}
+	f.published = append(f.published, fakeMessage{topic, retained, data})
+	return doneToken{}
+}
+
+func (f *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.Lock()
+	defer f.Unlock()
+	f.handlers[topic] = callback
+	return doneToken{}
+}
+
+func (f *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic := range filters {
+		f.Subscribe(topic, 1, callback)
+	}
+	return doneToken{}
+}
+
+func (f *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	f.Lock()
+	defer f.Unlock()
+	for _, v := range topics {
+		delete(f.handlers, v)
+	}
+	return doneToken{}
+}
+
+func (f *fakeClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+
+func (f *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// 发布到topic的消息
+func (f *fakeClient) messages(topic string) []fakeMessage {
+	f.Lock()
+	defer f.Unlock()
+	var ret []fakeMessage
+	for _, v := range f.published {
+		if v.topic == topic {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
@@ -1,7 +1,9 @@
 package sensor
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"sensor/count"
@@ -30,100 +32,282 @@ type SensorAction struct {
 	SensorID  string `json:"sensorID"`
 	Operation string `json:"operation"`
 	Data      []byte `json:"data"`
+	Version   *int64 `json:"version,omitempty"` // 期望的CONFIG版本, 修改CONFIG时作为前置条件
+
+	ActionEnvelope
+}
+
+/**
+ * 解析请求并应答, 广播的指令只处理本收集器的传感器
+ * @param exec 执行过程, 请求无法解析时不会被调用
+ */
+func (c *Collector) handleAction(message mqtt.Message, exec func(ctx context.Context, sa *SensorAction) (interface{}, error)) {
+	sa, err := RequestMap(message)
+	if err == nil && sa.SensorID != "" && c.IsBroadcastTopic(message.Topic()) {
+		if _, e := c.GetLocalSensor(sa.SensorID); e != nil {
+			return
+		}
+	}
+	c.reply(message, sa.ActionEnvelope, sa.SensorID, func(ctx context.Context) (interface{}, error) {
+		if err != nil {
+			return nil, invalid(err)
+		}
+		return exec(ctx, sa)
+	})
 }
 
 /**
  * 传感器开关控制
- * @Topic sensor/action/switch
+ * @param operation open/close
  */
-func SwitchSensorHandler(client mqtt.Client, message mqtt.Message) {
-	sa, _ := RequestMap(message)
-	ld, _ := GetLocalSensor(sa.SensorID)
-	switch sa.Operation {
+func (c *Collector) SwitchSensor(sensorID, operation string) error {
+	ld, err := c.GetLocalSensor(sensorID)
+	if err != nil {
+		return invalid(err)
+	}
+	switch operation {
 	case count.SWITCH_CLOSE:
 		ld.Close()
-		break
 	case count.SWITCH_OPEN:
 		ld.Open()
-		break
+		c.dispatchCommands(sensorID)
 	default:
+		return invalid(errors.New("unknown operation " + operation))
 	}
+	return nil
+}
+
+/**
+ * 传感器开关控制
+ * @Topic sensor/action/switch
+ */
+func (c *Collector) SwitchSensorHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleAction(message, func(ctx context.Context, sa *SensorAction) (interface{}, error) {
+		if err := commitAction(ctx); err != nil {
+			return nil, err
+		}
+		return nil, c.SwitchSensor(sa.SensorID, sa.Operation)
+	})
+}
+
+func SwitchSensorHandler(client mqtt.Client, message mqtt.Message) {
+	Default().SwitchSensorHandler(client, message)
 }
 
 /*
  * 清除错误次数&&状态
- * @Topic sensor/action/clear
- *
+ * @param operation all/one, one时清除sensorID
  */
-func ClearExceptionHandler(client mqtt.Client, message mqtt.Message) {
-	sa, _ := RequestMap(message)
-	switch sa.Operation {
+func (c *Collector) ClearException(sensorID, operation string) error {
+	switch operation {
 	case count.CLEAR_ALL_EXCEPTION:
-		count.ClsAll()
-		for _, v := range GetLocalDevicesInstance().LocalSensorInformation {
+		c.tracker.ClsAll()
+		for _, v := range c.Config().LocalSensorInformation {
 			v.Open()
+			c.dispatchCommands(v.SensorID)
 		}
-		break
 	case count.CLEAR_ONE_EXCEPTION:
-		count.ClsErrorCount(sa.SensorID)
-		ld, _ := GetLocalSensor(sa.SensorID)
+		ld, err := c.GetLocalSensor(sensorID)
+		if err != nil {
+			return invalid(err)
+		}
+		c.tracker.ClsErrorCount(sensorID)
 		ld.Open()
-		break
+		c.dispatchCommands(sensorID)
 	default:
+		return invalid(errors.New("unknown operation " + operation))
 	}
+	return nil
+}
+
+/*
+ * 清除错误次数&&状态
+ * @Topic sensor/action/clear
+ *
+ */
+func (c *Collector) ClearExceptionHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleAction(message, func(ctx context.Context, sa *SensorAction) (interface{}, error) {
+		if err := commitAction(ctx); err != nil {
+			return nil, err
+		}
+		return nil, c.ClearException(sa.SensorID, sa.Operation)
+	})
+}
+
+func ClearExceptionHandler(client mqtt.Client, message mqtt.Message) {
+	Default().ClearExceptionHandler(client, message)
 }
 
 /**
  * 设置/更改传感器关联Attach
  * @Topic sensor/action/setAttachIP
- *
+ * data 为新的attach IP
  */
+func (c *Collector) ChangeAttachIPHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleConfigAction(message, func(ctx context.Context, sa *SensorAction) (*LocalDeviceDetail, error) {
+		ip := string(sa.Data)
+		if !IsIp(ip) {
+			return nil, invalid(errors.New("invalid attach ip " + ip))
+		}
+		patch, _ := json.Marshal(map[string]string{"attach": ip})
+		return c.ModifySensorConfig(ctx, *sa.Version, sa.SensorID, patch)
+	})
+}
+
 func ChangeAttachIPHandler(client mqtt.Client, message mqtt.Message) {
-	//sa, _ := RequestMap(message)
-	//if IsIp(sa.Data.(string)) {
-	//
-	//}
+	Default().ChangeAttachIPHandler(client, message)
+}
+
+/**
+ * 以RFC 6902(json-patch)或RFC 7386(merge-patch)局部修改CONFIG
+ * @Topic sensor/setting/patch
+ * operation 为 json-patch 或 merge-patch, data 为补丁内容
+ */
+func (c *Collector) ConfigPatchHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleConfigAction(message, func(ctx context.Context, sa *SensorAction) (*LocalDeviceDetail, error) {
+		return c.PatchConfig(ctx, *sa.Version, sa.Operation, sa.Data)
+	})
+}
+
+func ConfigPatchHandler(client mqtt.Client, message mqtt.Message) {
+	Default().ConfigPatchHandler(client, message)
+}
+
+/**
+ * 移除传感器
+ * @Topic sensor/action/remove
+ */
+func (c *Collector) RemoveSensorHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleConfigAction(message, func(ctx context.Context, sa *SensorAction) (*LocalDeviceDetail, error) {
+		return c.RemoveSensorConfig(ctx, *sa.Version, sa.SensorID)
+	})
+}
+
+func RemoveSensorHandler(client mqtt.Client, message mqtt.Message) {
+	Default().RemoveSensorHandler(client, message)
+}
+
+/**
+ * 以merge-patch修改单个传感器参数, 例如 {"interval": 30}
+ * @Topic sensor/action/modify
+ */
+func (c *Collector) ModifySensorHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleConfigAction(message, func(ctx context.Context, sa *SensorAction) (*LocalDeviceDetail, error) {
+		return c.ModifySensorConfig(ctx, *sa.Version, sa.SensorID, sa.Data)
+	})
+}
+
+func ModifySensorHandler(client mqtt.Client, message mqtt.Message) {
+	Default().ModifySensorHandler(client, message)
 }
 
 /*
  * 更改当前下位机上的CONFIG文件
  * Topic sensor/setting/all
+ * 携带version时按版本替换并立即生效, 否则以当前版本替换后重启TCP
+ * 两种方式都经过校验, 不合法的CONFIG不会被保存
  */
-func SettingConfigHandler(client mqtt.Client, message mqtt.Message) {
-	sa, _ := RequestMap(message)
-
-	// 反序列化
-	var jsonConfig LocalDeviceDetail
-	if err := json.Unmarshal(sa.Data, &jsonConfig); err != nil {
-		fmt.Println("[FAIL] CONFIG反序列化错误")
-		return
-	}
-
-	// 保存设置
-	if err := jsonConfig.DumpConfig(); err != nil {
-		fmt.Println("[FAIL] CONFIG保存时错误")
-		return
-	}
+func (c *Collector) SettingConfigHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleAction(message, func(ctx context.Context, sa *SensorAction) (interface{}, error) {
+		version := c.Config().Version
+		if sa.Version != nil {
+			version = *sa.Version
+		}
+		dl, err := c.ApplyConfigChange(ctx, version, func(doc []byte) ([]byte, error) {
+			return sa.Data, nil
+		})
+		c.reportConfigChange(sa, dl, err)
+		if err != nil {
+			return nil, err
+		}
+		if sa.Version == nil {
+			c.RestartDeviceTCP()
+		}
+		return configVersion(dl), nil
+	})
+}
 
-	jsonConfig.ReplaceLocalDeviceInstance()
-	RestartDeviceTCP()
-	// fmt.Println("[INFO] CONFIG已更新")
+func SettingConfigHandler(client mqtt.Client, message mqtt.Message) {
+	Default().SettingConfigHandler(client, message)
 }
 
 /**
  * 重启服务 + 重新加载数据
  */
+func (c *Collector) RestartHandler(client mqtt.Client, message mqtt.Message) {
+	c.handleAction(message, func(ctx context.Context, sa *SensorAction) (interface{}, error) {
+		if err := commitAction(ctx); err != nil {
+			return nil, err
+		}
+		fmt.Println("[INFO] 正在重启TCP")
+		// CONFIG无法加载时不重启, 继续使用当前CONFIG
+		if _, err := c.ReloadConfig(); err != nil {
+			return nil, err
+		}
+		c.RestartTCPSystem()
+		return nil, nil
+	})
+}
+
 func RestartHandler(client mqtt.Client, message mqtt.Message) {
-	fmt.Println("[INFO] 正在重启TCP")
-	ReloadDeviceInstance()
-	RestartTCPSystem()
+	Default().RestartHandler(client, message)
 }
 
 /**
- * 动态更新
+ * 动态添加传感器
+ * @Topic sensor/action/add
+ * data 为 LocalSensorInformation
  */
+func (c *Collector) DynamicAdd(client mqtt.Client, message mqtt.Message) {
+	c.handleConfigAction(message, func(ctx context.Context, sa *SensorAction) (*LocalDeviceDetail, error) {
+		var ls LocalSensorInformation
+		if err := json.Unmarshal(sa.Data, &ls); err != nil {
+			return nil, invalid(fmt.Errorf("传感器反序列化错误: %w", err))
+		}
+		if sa.SensorID == "" {
+			sa.SensorID = ls.SensorID
+		}
+		return c.AddSensorConfig(ctx, *sa.Version, ls)
+	})
+}
+
 func DynamicAdd(client mqtt.Client, message mqtt.Message) {
+	Default().DynamicAdd(client, message)
+}
+
+/**
+ * 修改CONFIG的请求, 必须携带version前置条件
+ * 应答中返回修改后的CONFIG版本
+ */
+func (c *Collector) handleConfigAction(message mqtt.Message, exec func(ctx context.Context, sa *SensorAction) (*LocalDeviceDetail, error)) {
+	c.handleAction(message, func(ctx context.Context, sa *SensorAction) (interface{}, error) {
+		if sa.Version == nil {
+			err := invalid(ErrVersionRequired)
+			c.reportConfigChange(sa, nil, err)
+			return nil, err
+		}
+		dl, err := exec(ctx, sa)
+		c.reportConfigChange(sa, dl, err)
+		if err != nil {
+			return nil, err
+		}
+		return configVersion(dl), nil
+	})
+}
 
+func configVersion(dl *LocalDeviceDetail) map[string]int64 {
+	return map[string]int64{"version": dl.Version}
+}
+
+/**
+ * 上报CONFIG修改结果
+ */
+func (c *Collector) reportConfigChange(sa *SensorAction, dl *LocalDeviceDetail, err error) {
+	if err != nil {
+		c.PushMQLog(MQ_LOG_FAIL, "CONFIG修改失败: "+err.Error(), sa.SensorID)
+		return
+	}
+	c.PushMQLog(MQ_LOG_INFO, fmt.Sprintf("CONFIG已更新 版本:%d", dl.Version), sa.SensorID)
 }
 
 /**
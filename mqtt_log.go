@@ -3,6 +3,7 @@ package sensor
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 //=====================LOG======================
@@ -20,6 +21,9 @@ const (
 	MQ_LOG_FAIL = 2
 )
 
+// 保留的最近日志条数
+const LOG_HISTORY_SIZE = 200
+
 type MQLog struct {
 	SensorID   string // 传感器ID(可无)
 	LogMessage string // 日志内容
@@ -27,14 +31,63 @@ type MQLog struct {
 
 }
 
-// 限制等级
-var messageLevel = MQ_LOG_FAIL
+/**
+ * 最近的日志, 供HTTP查看
+ */
+type LogEntry struct {
+	Time     time.Time `json:"time"`
+	Level    int       `json:"level"`
+	SensorID string    `json:"sensorID,omitempty"`
+	Message  string    `json:"message"`
+}
+
+/**
+ * 最近的日志, 按时间顺序
+ * @param limit 最多返回的条数, <=0时全部返回
+ */
+func (c *Collector) RecentLogs(limit int) []LogEntry {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	logs := c.logs
+	if limit > 0 && len(logs) > limit {
+		logs = logs[len(logs)-limit:]
+	}
+	return append([]LogEntry{}, logs...)
+}
+
+func RecentLogs(limit int) []LogEntry {
+	return Default().RecentLogs(limit)
+}
+
+func (c *Collector) recordLog(ml *MQLog) {
+	entry := LogEntry{Time: time.Now(), Level: ml.LogLevel, SensorID: ml.SensorID, Message: ml.LogMessage}
+	c.logMu.Lock()
+	c.logs = append(c.logs, entry)
+	if len(c.logs) > LOG_HISTORY_SIZE {
+		c.logs = c.logs[len(c.logs)-LOG_HISTORY_SIZE:]
+	}
+	c.logMu.Unlock()
+	ev := StreamEvent{Type: EVENT_LOG, Time: entry.Time, SensorID: entry.SensorID, Log: &entry}
+	if ev.SensorID != "" {
+		ev.Attach = c.sensorAttach(ev.SensorID)
+	}
+	c.publishEvent(ev)
+}
+
+/**
+ * 设置上报限制等级, 低于该等级的日志仅打印
+ */
+func (c *Collector) SetMQLogLevel(level int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logLevel = level
+}
 
 func SetMQLogLevel(level int) {
-	messageLevel = level
+	Default().SetMQLogLevel(level)
 }
 
-func PushMQLog(logLevel int, msg string, sensorID ...string) {
+func (c *Collector) PushMQLog(logLevel int, msg string, sensorID ...string) {
 
 	var mql MQLog
 	if len(sensorID) > 0 {
@@ -42,13 +95,21 @@ func PushMQLog(logLevel int, msg string, sensorID ...string) {
 	}
 	mql.LogLevel = logLevel
 	mql.LogMessage = msg
-	mql.Printf()
+	c.printLog(&mql)
+}
+
+func PushMQLog(logLevel int, msg string, sensorID ...string) {
+	Default().PushMQLog(logLevel, msg, sensorID...)
 }
 
 /**
  *
  */
 func (ml *MQLog) Printf() {
+	Default().printLog(ml)
+}
+
+func (c *Collector) printLog(ml *MQLog) {
 	var msg string
 	switch ml.LogLevel {
 	case MQ_LOG_INFO:
@@ -64,12 +125,19 @@ func (ml *MQLog) Printf() {
 	}
 
 	fmt.Println(msg)
+	c.recordLog(ml)
 
-	if messageLevel > ml.LogLevel {
+	c.mu.Lock()
+	level := c.logLevel
+	c.mu.Unlock()
+	if level > ml.LogLevel {
 		return
 	}
 
-	cli, _ := GetMQTTInstance()
+	cli, err := c.GetMQTTInstance()
+	if err != nil {
+		return
+	}
 	jml, _ := json.Marshal(ml)
-	cli.Publish("sensor/log", 1, false, jml)
+	c.publishStream(cli, STREAM_LOG, c.Topic(TOPIC_LOG), jml)
 }
@@ -0,0 +1,158 @@
+package sensor
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//=====================OPENAPI==================
+//
+//      由接口定义及Go类型生成OpenAPI 3描述
+//
+//=====================END======================
+
+const OPENAPI_VERSION = "3.0.3"
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+/**
+ * 以json标签生成的schema, 结构体放在components中引用
+ */
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+func (sb *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return sb.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.object(t)
+		}
+		if _, ok := sb.schemas[t.Name()]; !ok {
+			// 先占位, 避免递归类型无限展开
+			sb.schemas[t.Name()] = nil
+			sb.schemas[t.Name()] = sb.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func (sb *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	sb.fields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+/**
+ * 导出的字段, 匿名结构体的字段平铺
+ */
+func (sb *schemaBuilder) fields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			sb.fields(f.Type, properties)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = sb.schema(f.Type)
+	}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+/**
+ * 管理接口的OpenAPI描述
+ */
+func (c *Collector) OpenAPI() map[string]interface{} {
+	sb := &schemaBuilder{schemas: make(map[string]interface{})}
+	errorSchema := sb.schema(reflect.TypeOf(APIError{}))
+	paths := make(map[string]map[string]interface{})
+	for _, route := range c.apiRoutes() {
+		var params []interface{}
+		for _, v := range strings.Split(route.Pattern, "/") {
+			if strings.HasPrefix(v, "{") {
+				params = append(params, map[string]interface{}{"name": strings.Trim(v, "{}"), "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+			}
+		}
+		for _, v := range route.Query {
+			params = append(params, map[string]interface{}{"name": v, "in": "query", "schema": map[string]interface{}{"type": "string"}})
+		}
+		success := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			success["content"] = jsonContent(sb.schema(reflect.TypeOf(route.Response)))
+		}
+		op := map[string]interface{}{
+			"summary":     route.Summary,
+			"operationId": strings.ToLower(route.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_").Replace(route.Pattern),
+			"responses": map[string]interface{}{
+				strconv.Itoa(route.Status): success,
+				"default":                  map[string]interface{}{"description": "错误", "content": jsonContent(errorSchema)},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(sb.schema(reflect.TypeOf(route.Request)))}
+		}
+		if paths[route.Pattern] == nil {
+			paths[route.Pattern] = make(map[string]interface{})
+		}
+		paths[route.Pattern][strings.ToLower(route.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info":    map[string]interface{}{"title": "pond_sensor " + c.Config().Name, "version": Version},
+		"servers": []interface{}{map[string]interface{}{"url": API_PREFIX}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas":         sb.schemas,
+			"securitySchemes": map[string]interface{}{"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"}},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+}
@@ -0,0 +1,391 @@
+package sensor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=====================OUTBOX===================
+//
+//       MQ不可用时的数据缓存, 恢复后按顺序补发
+//
+//=====================END======================
+
+const (
+	OUTBOX_MAX_BYTES      int64 = 64 << 20         // 缓存的默认上限
+	OUTBOX_MAX_AGE        int64 = 7 * 24 * 3600    // 缓存的默认保留时间(秒)
+	OUTBOX_RETRY_INTERVAL       = 10 * time.Second // 补发的重试间隔
+	PUBLISH_TIMEOUT             = 5 * time.Second  // 单个消息的发布等待时间
+)
+
+const (
+	outboxDataFile   = "outbox.log"
+	outboxOffsetFile = "outbox.offset"
+)
+
+/**
+ * 缓存的消息, payload保持原样, 补发时不修改测量时间
+ */
+type OutboxMessage struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+	Created time.Time       `json:"created"`
+}
+
+/**
+ * 磁盘缓存队列
+ * 数据文件按行追加消息, 偏移文件记录已发送的位置
+ * 超过maxBytes时丢弃最早的消息, 超过maxAge的消息在补发时丢弃
+ */
+type Outbox struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	file   *os.File // 数据文件(追加)
+	base   int64    // 数据文件起始处的位置
+	offset int64    // 已发送的位置
+	size   int64    // 已写入的位置
+	mu     sync.Mutex
+
+	replayMutex sync.Mutex // 同一时间只有一个补发过程
+}
+
+func OpenOutbox(dir string, maxBytes int64, maxAge time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, outboxDataFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	o := &Outbox{dir: dir, maxBytes: maxBytes, maxAge: maxAge, file: f, size: fi.Size()}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, outboxOffsetFile)); err == nil {
+		o.offset, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if o.offset < 0 || o.offset > o.size {
+		o.offset = 0
+	}
+	return o, nil
+}
+
+/**
+ * 压入一条消息
+ */
+func (o *Outbox) Push(topic string, payload []byte) error {
+	line, err := json.Marshal(OutboxMessage{Topic: topic, Payload: payload, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		return errors.New("outbox closed")
+	}
+	if o.maxBytes > 0 && int64(len(line)) > o.maxBytes {
+		return errors.New("message too large")
+	}
+	// 超出上限时丢弃最早的消息
+	dropped := false
+	for o.maxBytes > 0 && o.size-o.offset+int64(len(line)) > o.maxBytes {
+		_, n, err := o.readAt(o.offset)
+		if err != nil {
+			return err
+		}
+		o.offset += n
+		dropped = true
+	}
+	if dropped {
+		fmt.Println("[WARN] 缓存已满, 丢弃最早的数据")
+		// 已丢弃的数据过多时重写数据文件
+		if o.offset-o.base > o.maxBytes/2 {
+			if err = o.rewrite(); err != nil {
+				return err
+			}
+		} else if err = o.saveOffset(); err != nil {
+			return err
+		}
+	}
+	if _, err = o.file.Write(line); err != nil {
+		return err
+	}
+	o.size += int64(len(line))
+	return nil
+}
+
+/**
+ * 待发送的字节数
+ */
+func (o *Outbox) Pending() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size - o.offset
+}
+
+/**
+ * 按顺序补发, 遇到发布失败时停止
+ * @return 补发成功的消息数
+ */
+func (o *Outbox) Replay(publish func(msg OutboxMessage) error) (int, error) {
+	o.replayMutex.Lock()
+	defer o.replayMutex.Unlock()
+
+	count := 0
+	for {
+		o.mu.Lock()
+		if o.file == nil {
+			o.mu.Unlock()
+			return count, errors.New("outbox closed")
+		}
+		if o.offset >= o.size {
+			err := o.truncate()
+			o.mu.Unlock()
+			return count, err
+		}
+		offset := o.offset
+		msg, n, err := o.readAt(offset)
+		o.mu.Unlock()
+		if err != nil {
+			return count, err
+		}
+
+		// 过期的消息直接丢弃
+		expired := o.maxAge > 0 && time.Since(msg.Created) > o.maxAge
+		if msg.Topic != "" && !expired {
+			if err := publish(msg); err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		o.mu.Lock()
+		// 补发期间该消息可能已因超出上限被丢弃
+		if o.offset == offset {
+			o.offset += n
+		}
+		err = o.saveOffset()
+		o.mu.Unlock()
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
+
+/**
+ * 读取offset处的一条消息, 调用者需持有锁
+ * @return 消息及其所占字节数
+ */
+func (o *Outbox) readAt(offset int64) (OutboxMessage, int64, error) {
+	var msg OutboxMessage
+	line, err := bufio.NewReader(io.NewSectionReader(o.file, offset-o.base, o.size-offset)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return msg, 0, err
+	}
+	if len(line) == 0 {
+		return msg, 0, io.EOF
+	}
+	// 损坏的行(例如写入时断电)跳过
+	if err = json.Unmarshal(line, &msg); err != nil || msg.Topic == "" {
+		fmt.Println("[WARN] 缓存数据损坏, 已跳过")
+		msg = OutboxMessage{}
+	}
+	return msg, int64(len(line)), nil
+}
+
+/**
+ * 记录已发送的位置(相对数据文件), 调用者需持有锁
+ */
+func (o *Outbox) saveOffset() error {
+	path := filepath.Join(o.dir, outboxOffsetFile)
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatInt(o.offset-o.base, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+/**
+ * 全部发送后清空数据文件, 调用者需持有锁
+ */
+func (o *Outbox) truncate() error {
+	if o.size == o.base {
+		return nil
+	}
+	if err := o.file.Truncate(0); err != nil {
+		return err
+	}
+	o.base = o.size
+	return o.saveOffset()
+}
+
+/**
+ * 只保留未发送的数据重写数据文件, 调用者需持有锁
+ */
+func (o *Outbox) rewrite() error {
+	path := filepath.Join(o.dir, outboxDataFile)
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, io.NewSectionReader(o.file, o.offset-o.base, o.size-o.offset)); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	o.file.Close()
+	if o.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	o.base = o.offset
+	return o.saveOffset()
+}
+
+// ========================collector===========================
+
+/**
+ * 该收集器的数据缓存, 首次调用时按CONFIG打开
+ * 目录缺省为CONFIG所在目录下的outbox, 无法打开时返回nil(不缓存)
+ */
+func (c *Collector) Outbox() *Outbox {
+	dl := c.Config()
+	c.outboxOnce.Do(func() {
+		dir := dl.OutboxDir
+		if dir == "" {
+			dir = filepath.Join(filepath.Dir(c.GetConfigPath()), "outbox")
+		}
+		maxBytes, maxAge := dl.OutboxMaxBytes, dl.OutboxMaxAge
+		if maxBytes <= 0 {
+			maxBytes = OUTBOX_MAX_BYTES
+		}
+		if maxAge <= 0 {
+			maxAge = OUTBOX_MAX_AGE
+		}
+		ob, err := OpenOutbox(dir, maxBytes, time.Duration(maxAge)*time.Second)
+		if err != nil {
+			fmt.Println("[FAIL] 打开数据缓存失败", err)
+			return
+		}
+		c.mu.Lock()
+		c.outbox = ob
+		c.mu.Unlock()
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outbox
+}
+
+/**
+ * 发布测量数据, 发布失败或仍有缓存未补发时存入缓存
+ * 不会尝试重新连接MQ, 重新连接及补发由runOutbox完成
+ * payload为json, 缓存中保存json, 发布时按measure数据流的配置编码
+ */
+func (c *Collector) PublishReading(topic string, payload []byte) error {
+	ob := c.Outbox()
+	// 缓存中有数据时排在其后, 保证顺序
+	if ob == nil || ob.Pending() == 0 {
+		err := c.publishWait(topic, payload)
+		if err == nil || ob == nil {
+			return err
+		}
+		fmt.Println("[WARN] 发布失败, 数据已缓存", err)
+	}
+	return ob.Push(topic, payload)
+}
+
+func PublishReading(topic string, payload []byte) error {
+	return Default().PublishReading(topic, payload)
+}
+
+/**
+ * 使用已建立的MQ连接按measure数据流的配置发布, 等待至PUBLISH_TIMEOUT
+ */
+func (c *Collector) publishWait(topic string, payload []byte) error {
+	client, ok := c.connectedClient()
+	if !ok {
+		c.metrics.publishFailed(STREAM_MEASURE)
+		return errors.New("mqtt not connected")
+	}
+	// 发布失败由publishStream计数
+	token := c.publishStream(client, STREAM_MEASURE, topic, payload)
+	if !waitToken(token, PUBLISH_TIMEOUT) {
+		return errors.New("mqtt publish timeout")
+	}
+	return token.Error()
+}
+
+/**
+ * 定时重新连接MQ并补发缓存, 收集器停止时退出
+ */
+func (c *Collector) runOutbox() {
+	ticker := time.NewTicker(OUTBOX_RETRY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.draining:
+			return
+		case <-ticker.C:
+			c.flushOutbox()
+		}
+	}
+}
+
+func (c *Collector) flushOutbox() {
+	ob := c.Outbox()
+	if ob == nil || ob.Pending() == 0 {
+		return
+	}
+	if _, err := c.GetMQTTInstance(); err != nil {
+		return
+	}
+	n, err := ob.Replay(func(msg OutboxMessage) error {
+		return c.publishWait(msg.Topic, msg.Payload)
+	})
+	if n > 0 {
+		fmt.Printf("[INFO] 已补发缓存数据 %d 条\n", n)
+	}
+	if err != nil {
+		fmt.Println("[WARN] 补发中断", err)
+	}
+}
+
+/**
+ * 关闭数据缓存, 未发送的数据保留到下次启动
+ */
+func (c *Collector) closeOutbox() {
+	c.mu.Lock()
+	ob := c.outbox
+	c.mu.Unlock()
+	if ob != nil {
+		_ = ob.Close()
+	}
+}
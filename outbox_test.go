@@ -0,0 +1,95 @@
+package sensor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutboxReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outbox")
+	defer os.RemoveAll(dir)
+
+	ob, err := OpenOutbox(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ob.Push("t", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第二条发布失败时停止
+	var got []string
+	n, err := ob.Replay(func(msg OutboxMessage) error {
+		if len(got) == 1 {
+			return errors.New("offline")
+		}
+		got = append(got, string(msg.Payload))
+		return nil
+	})
+	if n != 1 || err == nil {
+		t.Fatal(n, err)
+	}
+	_ = ob.Close()
+
+	// 重新打开后从未发送处继续
+	ob, err = OpenOutbox(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	if _, err := ob.Replay(func(msg OutboxMessage) error {
+		got = append(got, string(msg.Payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != "0" || got[1] != "1" || got[2] != "2" {
+		t.Errorf("unexpected replay order %v", got)
+	}
+	if ob.Pending() != 0 {
+		t.Error("outbox not drained")
+	}
+}
+
+func TestOutboxLimit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outbox")
+	defer os.RemoveAll(dir)
+
+	ob, err := OpenOutbox(dir, 400, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+	for i := 0; i < 20; i++ {
+		if err := ob.Push("t", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ob.Pending() > 400 {
+		t.Error("size limit exceeded", ob.Pending())
+	}
+
+	// 只保留最新的数据
+	var got []string
+	_, _ = ob.Replay(func(msg OutboxMessage) error {
+		got = append(got, string(msg.Payload))
+		return nil
+	})
+	if len(got) == 0 || got[len(got)-1] != "19" || got[0] == "0" {
+		t.Errorf("unexpected messages kept %v", got)
+	}
+
+	// 过期数据不补发
+	ob.maxAge = time.Nanosecond
+	_ = ob.Push("t", []byte("expired"))
+	time.Sleep(time.Millisecond)
+	if n, _ := ob.Replay(func(msg OutboxMessage) error { return nil }); n != 0 {
+		t.Error("expired message replayed")
+	}
+}
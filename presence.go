@@ -0,0 +1,169 @@
+package sensor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"time"
+)
+
+//=====================PRESENCE=================
+//
+//      收集器上线(birth)/遗嘱(LWT)与传感器状态
+//
+//=====================END======================
+
+// 收集器版本, 构建时通过 -ldflags "-X sensor.Version=..." 设置
+var Version = "dev"
+
+// 收集器在线状态的主题(命名空间内), 未配置topic_prefix时为 collectors/{name}
+const TOPIC_PRESENCE = "presence"
+
+// 上报的传感器状态, 收集器停止时为SENSOR_OFFLINE
+const (
+	SENSOR_NORMAL      = "normal"      // 正常
+	SENSOR_DETACHED    = "detached"    // 异常断开, 需清除异常
+	SENSOR_CLOSED      = "closed"      // 人为关闭
+	SENSOR_BACKING_OFF = "backing-off" // 查询失败, 等待重试
+)
+
+/**
+ * 收集器的上线消息, 保留消息
+ * 遗嘱消息只包含name/status, created为建立连接的时间
+ */
+type CollectorPresence struct {
+	Name       string    `json:"name"`
+	Status     string    `json:"status"` // online/offline
+	Version    string    `json:"version,omitempty"`
+	Config     int64     `json:"config,omitempty"`     // CONFIG版本
+	ConfigHash string    `json:"configHash,omitempty"` // 隐藏密钥后的CONFIG摘要
+	Sensors    []string  `json:"sensors,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+/**
+ * 收集器在线状态的完整主题
+ */
+func (c *Collector) PresenceTopic() string {
+	return c.Config().PresenceTopic()
+}
+
+func (dl *LocalDeviceDetail) PresenceTopic() string {
+	if dl.TopicPrefix == "" {
+		return dl.Topic("collectors/" + topicLevel(dl.Name))
+	}
+	return dl.Topic(TOPIC_PRESENCE)
+}
+
+/**
+ * CONFIG摘要, 用于判断各收集器的CONFIG是否一致
+ */
+func (dl *LocalDeviceDetail) Hash() string {
+	data, _ := json.Marshal(dl.Redacted())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+/**
+ * 注册遗嘱消息, 连接建立后由onConnect发布上线消息
+ */
+func setPresence(opts *mqtt.ClientOptions, dl *LocalDeviceDetail) {
+	will, _ := json.Marshal(CollectorPresence{Name: dl.Name, Status: SENSOR_OFFLINE, Created: time.Now()})
+	opts.SetBinaryWill(dl.PresenceTopic(), will, 1, true)
+}
+
+/**
+ * 发布上线消息及全部传感器的当前状态
+ */
+func (c *Collector) publishBirth(client mqtt.Client) {
+	dl := c.Config()
+	birth := CollectorPresence{
+		Name:       dl.Name,
+		Status:     SENSOR_ONLINE,
+		Version:    Version,
+		Config:     dl.Version,
+		ConfigHash: dl.Hash(),
+		Created:    time.Now(),
+	}
+	for _, v := range dl.LocalSensorInformation {
+		birth.Sensors = append(birth.Sensors, v.SensorID)
+	}
+	send, _ := json.Marshal(birth)
+	client.Publish(c.PresenceTopic(), 1, true, send)
+
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	for _, v := range dl.LocalSensorInformation {
+		status := c.sensorState(v)
+		c.sensorStatus[v.SensorID] = status
+		c.publishSensorStatus(client, v.SensorID, status)
+	}
+	fmt.Println("[INFO] 已发布上线消息")
+}
+
+/**
+ * CONFIG修改后重新发布上线消息, 并清除已移除传感器的保留状态
+ */
+func (c *Collector) republishPresence(prev *LocalDeviceDetail) {
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	c.statusMu.Lock()
+	for _, v := range prev.LocalSensorInformation {
+		// 未配置topic_prefix时所有传感器共用同一状态主题
+		if _, err := c.GetLocalSensor(v.SensorID); err != nil && c.Config().TopicPrefix != "" {
+			delete(c.sensorStatus, v.SensorID)
+			client.Publish(c.Topic(c.SensorTopic(v.SensorID, TOPIC_STATUS)), 1, true, []byte{})
+		}
+	}
+	c.statusMu.Unlock()
+	c.publishBirth(client)
+	c.publishDiscovery(client, prev)
+}
+
+/**
+ * 传感器当前状态
+ */
+func (c *Collector) sensorState(ls *LocalSensorInformation) string {
+	status := ls.status()
+	switch {
+	case status == STATUS_CLOSED:
+		return SENSOR_CLOSED
+	case status == STATUS_DETACH:
+		return SENSOR_DETACHED
+	case c.tracker.IsForbidden(ls.SensorID):
+		return SENSOR_BACKING_OFF
+	}
+	return SENSOR_NORMAL
+}
+
+/**
+ * 传感器状态变化时发布保留消息
+ */
+func (c *Collector) reportSensorStatus(sensorID string) {
+	ls, err := c.GetLocalSensor(sensorID)
+	if err != nil || c.IsStopping() {
+		return
+	}
+	status := c.sensorState(ls)
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if c.sensorStatus[sensorID] == status {
+		return
+	}
+	c.sensorStatus[sensorID] = status
+	c.publishEvent(StreamEvent{Type: EVENT_STATUS, SensorID: sensorID, Attach: ls.Attach, Status: status})
+	c.sparkplugStatus(sensorID, status)
+	// 未连接时在上线消息中发布
+	if client, ok := c.connectedClient(); ok {
+		c.publishSensorStatus(client, sensorID, status)
+	}
+}
+
+func (c *Collector) publishSensorStatus(client mqtt.Client, sensorID, status string) mqtt.Token {
+	send, _ := json.Marshal(SensorStatusReport{SensorID: sensorID, Status: status, Errors: c.tracker.GetErrorCount(sensorID), Created: time.Now()})
+	return c.publishStream(client, STREAM_STATUS, c.Topic(c.SensorTopic(sensorID, TOPIC_STATUS)), send)
+}
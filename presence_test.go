@@ -0,0 +1,86 @@
+package sensor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPresence(t *testing.T) {
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", TopicPrefix: "farm/{collector}", LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s1"},
+		{Addr: 2, Attach: "127.0.0.1", Interval: 60, SensorID: "s2"},
+	}}), WithMQTTClient(client))
+
+	opts := mqtt.NewClientOptions()
+	setPresence(opts, c.Config())
+	var will CollectorPresence
+	if err := json.Unmarshal(opts.WillPayload, &will); err != nil || !opts.WillRetained || opts.WillTopic != "farm/c1/presence" || will.Status != SENSOR_OFFLINE {
+		t.Errorf("unexpected will %s %s", opts.WillTopic, opts.WillPayload)
+	}
+
+	c.publishBirth(client)
+	msgs := client.messages("farm/c1/presence")
+	var birth CollectorPresence
+	if len(msgs) != 1 || !msgs[0].retained || json.Unmarshal(msgs[0].payload, &birth) != nil {
+		t.Fatal("birth not published")
+	}
+	if birth.Status != SENSOR_ONLINE || len(birth.Sensors) != 2 || birth.ConfigHash != c.Config().Hash() {
+		t.Errorf("unexpected birth %+v", birth)
+	}
+
+	status := func(sensorID string) []string {
+		var ret []string
+		for _, v := range client.messages("farm/c1/sensors/" + sensorID + "/status") {
+			var r SensorStatusReport
+			_ = json.Unmarshal(v.payload, &r)
+			if !v.retained {
+				t.Error("status not retained")
+			}
+			ret = append(ret, r.Status)
+		}
+		return ret
+	}
+	ls, _ := c.GetLocalSensor("s1")
+	ls.Close()
+	ls.Close()
+	ls.Open()
+	if s := status("s1"); len(s) != 3 || s[1] != SENSOR_CLOSED || s[2] != SENSOR_NORMAL {
+		t.Errorf("unexpected s1 status %v", s)
+	}
+	c.tracker.AddErrorOperation("s2")
+	c.tracker.ClsErrorCount("s2")
+	if s := status("s2"); len(s) != 3 || s[1] != SENSOR_BACKING_OFF || s[2] != SENSOR_NORMAL {
+		t.Errorf("unexpected s2 status %v", s)
+	}
+}
+
+func TestLegacySensorStatus(t *testing.T) {
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s1"},
+		{Addr: 2, Attach: "127.0.0.1", Interval: 60, SensorID: "s2"},
+	}}), WithMQTTClient(client))
+
+	ls, _ := c.GetLocalSensor("s1")
+	ls.Close()
+	c.tracker.AddErrorOperation("s2")
+
+	// 中间件对每个主题只保留最后一条保留消息
+	retained := make(map[string]string)
+	client.Lock()
+	for _, v := range client.published {
+		if v.retained && strings.HasPrefix(v.topic, "sensor/status") {
+			var r SensorStatusReport
+			_ = json.Unmarshal(v.payload, &r)
+			retained[v.topic] = r.SensorID + ":" + r.Status
+		}
+	}
+	client.Unlock()
+	if len(retained) != 2 || retained["sensor/status/s1"] != "s1:"+SENSOR_CLOSED || retained["sensor/status/s2"] != "s2:"+SENSOR_BACKING_OFF {
+		t.Errorf("unexpected retained status %v", retained)
+	}
+}
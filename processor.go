@@ -6,9 +6,9 @@ import (
 	"strings"
 )
 
-func HandleProcessor(conn net.Conn) {
+func (c *Collector) HandleProcessor(conn net.Conn) {
 	defer conn.Close()
-	b := RegDeviceSession(conn)
+	b := c.RegDeviceSession(conn)
 
 	go b.ReadConn()
 	go b.WriteConn()
@@ -19,7 +19,7 @@ func HandleProcessor(conn net.Conn) {
 	fmt.Println("[CONN]", conn.RemoteAddr())
 
 	// setup time wheel
-	ch := TaskSetup(dtuIpv4)
+	ch := c.TaskSetup(dtuIpv4)
 
 	// fmt.Println("already connected:", ShowNodeIPs())
 
@@ -29,25 +29,36 @@ func HandleProcessor(conn net.Conn) {
 	//	fmt.Println(data)
 	//})
 
-	//for {
-		select {
-		case stop := <-b.stopChan:
-			// pick out
-			if stop {
-				fmt.Println("[DISC]", conn.RemoteAddr())
-				// 资源释放过程
-
-				// 移除session
-				b.ReleaseDevice()
+	// DTU断开或会话被关闭
+	select {
+	case <-b.stopChan:
+	case <-b.Done():
+	}
+	fmt.Println("[DISC]", conn.RemoteAddr())
+	// 资源释放过程
+	b.Close()
 
-				// 移除task
-				b.ReleaseTask()
+	// 移除session
+	b.ReleaseDevice()
 
-				// 关闭任务通道
-				close(ch)
+	// 移除task
+	b.ReleaseTask()
 
-				break
+	// 停止时由publishOffline上报
+	if !c.IsStopping() {
+		for _, v := range c.Config().GetLocalSensorList(dtuIpv4) {
+			if !v.IsClosed() {
+				v.Detach()
 			}
 		}
-	//}
+	}
+
+	// 注销任务通道, 任务通道不再关闭, 已触发的任务由TaskSensorPush丢弃
+	if v, ok := c.taskChannels.Load(dtuIpv4); ok && v == ch {
+		c.taskChannels.Delete(dtuIpv4)
+	}
+}
+
+func HandleProcessor(conn net.Conn) {
+	Default().HandleProcessor(conn)
 }
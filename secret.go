@@ -0,0 +1,376 @@
+package sensor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+//=====================SECRET===================
+//
+//                 CONFIG中的密钥
+//
+//=====================END======================
+
+/**
+ * 密钥字段可以直接填写明文, 也可以填写以下引用, 在加载CONFIG时解析:
+ * env:NAME      环境变量
+ * secret:NAME   secrets_file中的同名项(yaml/json格式, 文件权限必须为0600)
+ * enc:BASE64    使用secret_key_file(AES-256-GCM)加密的值
+ * CONFIG文件中的${NAME}在加载时展开, 密钥字段写回时同样还原为${NAME}
+ *
+ * 写回CONFIG时还原为原来的引用, 配置了secret_key_file时明文会被加密后写回
+ */
+const (
+	SECRET_ENV      = "env:"
+	SECRET_FILE     = "secret:"
+	SECRET_ENC      = "enc:"
+	SECRET_REDACTED = "******"
+)
+
+// 可覆盖secret_key_file的环境变量
+const SECRET_KEY_ENV = "SENSOR_SECRET_KEY_FILE"
+
+var ErrSecretUnresolved = errors.New("unresolved secret")
+
+/**
+ * CONFIG中需要保护的字段
+ */
+func (dl *LocalDeviceDetail) secretFields() map[string]*string {
+	fields := map[string]*string{
+		"broker_password": &dl.BrokerPassword,
+		"http_token":      &dl.HTTPToken,
+	}
+	if dl.CommandAuth != nil {
+		for id, k := range dl.CommandAuth.Keys {
+			if k != nil {
+				fields["command_auth.keys."+id+".secret"] = &k.Secret
+			}
+		}
+	}
+	return fields
+}
+
+/**
+ * 复制CONFIG, 密钥字段所在的结构一并复制, 修改副本的密钥不影响原CONFIG
+ */
+func (dl *LocalDeviceDetail) copySecrets() *LocalDeviceDetail {
+	cp := *dl
+	if dl.CommandAuth != nil {
+		auth := *dl.CommandAuth
+		auth.Keys = make(map[string]*CommandKey, len(dl.CommandAuth.Keys))
+		for id, k := range dl.CommandAuth.Keys {
+			if k != nil {
+				key := *k
+				k = &key
+			}
+			auth.Keys[id] = k
+		}
+		cp.CommandAuth = &auth
+	}
+	return &cp
+}
+
+func IsSecretRef(v string) bool {
+	return strings.HasPrefix(v, SECRET_ENV) || strings.HasPrefix(v, SECRET_FILE) || strings.HasPrefix(v, SECRET_ENC)
+}
+
+/**
+ * 记录CONFIG文件中含环境变量(${NAME})的密钥字段, 写回时还原为原文
+ * @param raw 未展开环境变量时解析的CONFIG
+ */
+func (dl *LocalDeviceDetail) keepEnvSecrets(raw *LocalDeviceDetail) {
+	rawFields := raw.secretFields()
+	for name, field := range dl.secretFields() {
+		rawField, ok := rawFields[name]
+		// 展开后为引用时由ResolveSecrets记录
+		if !ok || *rawField == *field || IsSecretRef(*field) {
+			continue
+		}
+		if dl.secretRefs == nil {
+			dl.secretRefs = make(map[string]string)
+		}
+		dl.secretRefs[name] = *rawField
+	}
+}
+
+/**
+ * 解析所有密钥引用, 并记录原引用以便写回
+ */
+func (dl *LocalDeviceDetail) ResolveSecrets() error {
+	for name, field := range dl.secretFields() {
+		if !IsSecretRef(*field) {
+			continue
+		}
+		v, err := dl.resolveSecret(*field)
+		if err != nil {
+			return fmt.Errorf("%w %s: %v", ErrSecretUnresolved, name, err)
+		}
+		if dl.secretRefs == nil {
+			dl.secretRefs = make(map[string]string)
+		}
+		dl.secretRefs[name] = *field
+		*field = v
+	}
+	return nil
+}
+
+func (dl *LocalDeviceDetail) resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, SECRET_ENV):
+		v, ok := os.LookupEnv(strings.TrimPrefix(ref, SECRET_ENV))
+		if !ok {
+			return "", errors.New("environment variable not set")
+		}
+		return v, nil
+	case strings.HasPrefix(ref, SECRET_FILE):
+		secrets, err := LoadSecretsFile(dl.SecretsFile)
+		if err != nil {
+			return "", err
+		}
+		v, ok := secrets[strings.TrimPrefix(ref, SECRET_FILE)]
+		if !ok {
+			return "", errors.New("not found in secrets file")
+		}
+		return v, nil
+	default:
+		key, err := LoadSecretKey(dl.secretKeyFile())
+		if err != nil {
+			return "", err
+		}
+		return DecryptSecret(key, ref)
+	}
+}
+
+/**
+ * 检查远程修改的CONFIG中的密钥, 只能保持原值(或隐藏值)或填写明文
+ * 引用在本地解析, 远程修改引用可以把本地的其他密钥发送到远程指定的位置
+ * 密钥文件等不可远程修改的字段见checkRemoteChange
+ */
+func (dl *LocalDeviceDetail) checkRemoteSecrets(old *LocalDeviceDetail) error {
+	oldFields := old.secretFields()
+	for name, field := range dl.secretFields() {
+		if !IsSecretRef(*field) {
+			continue
+		}
+		if ref, ok := old.secretRefs[name]; ok && *field == ref {
+			continue
+		}
+		if oldField, ok := oldFields[name]; ok && *field == *oldField {
+			continue
+		}
+		return fmt.Errorf("%s cannot be set to a secret reference remotely", name)
+	}
+	return nil
+}
+
+/**
+ * 接收到新的CONFIG时沿用当前的密钥
+ * 未修改(与当前值相同)或被隐藏的字段保持原值及原引用
+ */
+func (dl *LocalDeviceDetail) inheritSecrets(old *LocalDeviceDetail) {
+	oldFields := old.secretFields()
+	for name, field := range dl.secretFields() {
+		oldField, ok := oldFields[name]
+		if !ok || *field != SECRET_REDACTED && *field != *oldField {
+			continue
+		}
+		*field = *oldField
+		if ref, ok := old.secretRefs[name]; ok {
+			if dl.secretRefs == nil {
+				dl.secretRefs = make(map[string]string)
+			}
+			dl.secretRefs[name] = ref
+		}
+	}
+}
+
+/**
+ * 生成用于写回的CONFIG副本, 密钥字段还原为引用或加密
+ */
+func (dl *LocalDeviceDetail) sealSecrets() (*LocalDeviceDetail, error) {
+	sealed := dl.copySecrets()
+	var key []byte
+	for name, field := range sealed.secretFields() {
+		if ref, ok := dl.secretRefs[name]; ok {
+			*field = ref
+			continue
+		}
+		if *field == "" || dl.secretKeyFile() == "" {
+			continue
+		}
+		if key == nil {
+			var err error
+			if key, err = LoadSecretKey(dl.secretKeyFile()); err != nil {
+				return nil, err
+			}
+		}
+		enc, err := EncryptSecret(key, *field)
+		if err != nil {
+			return nil, err
+		}
+		*field = enc
+	}
+	return sealed, nil
+}
+
+/**
+ * 隐藏密钥后的CONFIG副本, 用于通过MQTT/HTTP对外输出
+ */
+func (dl *LocalDeviceDetail) Redacted() *LocalDeviceDetail {
+	redacted := dl.copySecrets()
+	redacted.secretRefs = nil
+	for _, field := range redacted.secretFields() {
+		if *field != "" {
+			*field = SECRET_REDACTED
+		}
+	}
+	return redacted
+}
+
+func (dl *LocalDeviceDetail) secretKeyFile() string {
+	if path := os.Getenv(SECRET_KEY_ENV); path != "" {
+		return path
+	}
+	return dl.SecretKeyFile
+}
+
+/**
+ * 检查密钥文件权限, 不允许同组及其他用户访问
+ */
+func checkSecretPerm(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("permissions %v for %s are too open", fi.Mode().Perm(), path)
+	}
+	return nil
+}
+
+/**
+ * 加载secrets文件, 格式为 yaml/json 的 name: value
+ */
+func LoadSecretsFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, errors.New("secrets_file not configured")
+	}
+	if err := checkSecretPerm(path); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string)
+	if err = yaml.Unmarshal(data, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+/**
+ * 加载AES-256密钥, 文件内容为64位hex
+ */
+func LoadSecretKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("secret_key_file not configured")
+	}
+	if err := checkSecretPerm(path); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("secret key must be 32 bytes in hex")
+	}
+	return key, nil
+}
+
+/**
+ * 生成新的密钥文件
+ */
+func GenerateSecretKey(path string) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	return err
+}
+
+/**
+ * 使用CONFIG中配置的密钥加密
+ */
+func (dl *LocalDeviceDetail) EncryptSecret(plain string) (string, error) {
+	key, err := LoadSecretKey(dl.secretKeyFile())
+	if err != nil {
+		return "", err
+	}
+	return EncryptSecret(key, plain)
+}
+
+/**
+ * 加密, 返回 enc:BASE64(nonce+密文)
+ */
+func EncryptSecret(key []byte, plain string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return SECRET_ENC + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+/**
+ * 解密 enc:BASE64
+ */
+func DecryptSecret(key []byte, ref string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ref, SECRET_ENC))
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,178 @@
+package sensor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	if err := GenerateSecretKey(path); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadSecretKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptSecret(key, "159463")
+	if err != nil || !strings.HasPrefix(enc, SECRET_ENC) || strings.Contains(enc, "159463") {
+		t.Fatal(enc, err)
+	}
+	if plain, err := DecryptSecret(key, enc); err != nil || plain != "159463" {
+		t.Error(plain, err)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+
+	// env
+	_ = os.Setenv("SENSOR_TEST_PASSWORD", "from-env")
+	dl := LocalDeviceDetail{BrokerPassword: "env:SENSOR_TEST_PASSWORD"}
+	if err := dl.ResolveSecrets(); err != nil || dl.BrokerPassword != "from-env" {
+		t.Fatal(dl.BrokerPassword, err)
+	}
+	sealed, err := dl.sealSecrets()
+	if err != nil || sealed.BrokerPassword != "env:SENSOR_TEST_PASSWORD" {
+		t.Error("reference not written back", sealed.BrokerPassword, err)
+	}
+	if dl.Redacted().BrokerPassword != SECRET_REDACTED || dl.BrokerPassword != "from-env" {
+		t.Error("redact failed")
+	}
+
+	// secrets file
+	secrets := filepath.Join(dir, "secrets.yaml")
+	_ = ioutil.WriteFile(secrets, []byte("mq: from-file\n"), 0644)
+	dl = LocalDeviceDetail{BrokerPassword: "secret:mq", SecretsFile: secrets}
+	if err := dl.ResolveSecrets(); err == nil {
+		t.Error("secrets file with open permissions accepted")
+	}
+	_ = os.Chmod(secrets, 0600)
+	if err := dl.ResolveSecrets(); err != nil || dl.BrokerPassword != "from-file" {
+		t.Fatal(dl.BrokerPassword, err)
+	}
+
+	// 未修改或被隐藏的密钥沿用原引用
+	next := LocalDeviceDetail{BrokerPassword: SECRET_REDACTED, SecretsFile: secrets}
+	next.inheritSecrets(&dl)
+	if next.BrokerPassword != "from-file" || next.secretRefs["broker_password"] != "secret:mq" {
+		t.Error("secret not inherited", next.BrokerPassword)
+	}
+}
+
+func TestSealSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	_ = GenerateSecretKey(path)
+	dl := LocalDeviceDetail{BrokerPassword: "159463", SecretKeyFile: path}
+	sealed, err := dl.sealSecrets()
+	if err != nil || !strings.HasPrefix(sealed.BrokerPassword, SECRET_ENC) {
+		t.Fatal("plain secret written back", sealed.BrokerPassword, err)
+	}
+	if err := sealed.ResolveSecrets(); err != nil || sealed.BrokerPassword != "159463" {
+		t.Error(sealed.BrokerPassword, err)
+	}
+}
+
+func TestRemoteSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+
+	_ = os.Setenv("SENSOR_TEST_PASSWORD", "from-env")
+	_ = os.Setenv("SENSOR_TEST_OTHER", "other")
+	path := filepath.Join(dir, "conf.json")
+	_ = ioutil.WriteFile(path, []byte(`{"broker_password": "env:SENSOR_TEST_PASSWORD", "http_token": "token"}`), 0600)
+	c := NewCollector(WithConfigPath(path), WithMQTTClient(newFakeClient()))
+	if c.Config().BrokerPassword != "from-env" {
+		t.Fatal("secret not resolved", c.ConfigError())
+	}
+
+	// 远程不能改为新的引用或修改密钥文件
+	for _, v := range []string{
+		`{"broker_password": "env:SENSOR_TEST_OTHER"}`,
+		`{"http_token": "secret:mq"}`,
+		`{"command_auth": {"keys": {"k1": {"secret": "env:SENSOR_TEST_OTHER"}}}}`,
+		`{"secrets_file": "/tmp/secrets.yaml"}`,
+		`{"secret_key_file": "/tmp/key"}`,
+		// 中间件、指令签名及文件路径
+		`{"broker_ip": "10.0.0.1"}`,
+		`{"broker_password": "plain"}`,
+		`{"command_auth": {"keys": {"k1": {"algorithm": "hmac-sha256", "secret": "x"}}}}`,
+		`{"history_dir": "/tmp"}`,
+		`{"outbox_dir": "/tmp"}`,
+		`{"broker_ca_file": "/etc/passwd"}`,
+	} {
+		if _, err := c.PatchConfig(context.Background(), c.Config().Version, PATCH_MERGE, []byte(v)); !IsValidationError(err) {
+			t.Errorf("remote secret change %s accepted: %v", v, err)
+		}
+	}
+	if dl := c.Config(); dl.Version != 0 || dl.BrokerPassword != "from-env" || dl.HTTPToken != "token" {
+		t.Fatalf("config changed %+v", dl)
+	}
+
+	// 隐藏值、原引用及明文可以使用
+	for _, v := range []string{
+		`{"broker_password": "******", "http_token": "******"}`,
+		`{"broker_password": "env:SENSOR_TEST_PASSWORD"}`,
+		`{"http_token": "new-token"}`,
+	} {
+		if _, err := c.PatchConfig(context.Background(), c.Config().Version, PATCH_MERGE, []byte(v)); err != nil {
+			t.Errorf("remote change %s rejected: %v", v, err)
+		}
+	}
+	if dl := c.Config(); dl.BrokerPassword != "from-env" || dl.HTTPToken != "new-token" || dl.secretRefs["broker_password"] != "env:SENSOR_TEST_PASSWORD" {
+		t.Errorf("unexpected secrets %+v", dl)
+	}
+}
+
+func TestUnresolvedSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+
+	_ = os.Unsetenv("SENSOR_TEST_MISSING")
+	path := filepath.Join(dir, "conf.json")
+	_ = ioutil.WriteFile(path, []byte(`{"name": "c1", "broker_password": "env:SENSOR_TEST_MISSING"}`), 0600)
+	dl, err := ReadConfig(path)
+	if !errors.Is(err, ErrSecretUnresolved) || dl.Name != "" || dl.BrokerPassword != "" {
+		t.Errorf("unresolved secret loaded %+v %v", dl, err)
+	}
+	c := NewCollector(WithConfigPath(path), WithListenAddress("127.0.0.1:0"))
+	if err := c.Start(context.Background()); !errors.Is(err, ErrSecretUnresolved) {
+		t.Errorf("collector started with unresolved secret: %v", err)
+		_ = c.Stop(context.Background())
+	}
+}
+
+func TestEnvSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+
+	_ = os.Setenv("SENSOR_TEST_EXPAND", "expanded-password")
+	path := filepath.Join(dir, "conf.json")
+	_ = ioutil.WriteFile(path, []byte(`{"name": "c1", "broker_password": "${SENSOR_TEST_EXPAND}", "http_token": "plain"}`), 0600)
+	dl, err := ReadConfig(path)
+	if err != nil || dl.BrokerPassword != "expanded-password" {
+		t.Fatal(dl.BrokerPassword, err)
+	}
+	if err := dl.DumpConfigTo(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "expanded-password") || !strings.Contains(string(data), "${SENSOR_TEST_EXPAND}") {
+		t.Errorf("expanded secret written back in clear: %s", data)
+	}
+	if dl, err = ReadConfig(path); err != nil || dl.BrokerPassword != "expanded-password" || dl.HTTPToken != "plain" {
+		t.Error(dl.BrokerPassword, dl.HTTPToken, err)
+	}
+}
@@ -85,19 +85,11 @@ func (i Sensor) SetDefault() {
 //
 //}
 
-var StopSystem chan bool
-
-func WaitSystem() {
-	select {
-	case <-StopSystem:
-		break
-	}
-}
-
 // Freedom map
 var InfoMK = map[string][]byte{
-	"ReadFunc":  {0x03},
-	"WriteFunc": {0x06},
+	"ReadFunc":      {0x03},
+	"WriteFunc":     {0x06},
+	"WriteCoilFunc": {0x05},
 
 	"RMeasure": {0x00, 0x00, 0x00, 0x04},
 	"WOxygen":  {0x00, 0x04, 0x00, 0x01},
@@ -158,6 +150,9 @@ type ReadResult struct {
 	// create time
 	Created time.Time `json:"created"`
 
+	// resent from local history on request, not a new measurement
+	Backfill bool `json:"backfill,omitempty"`
+
 	// error tag
 	Status int `json:"status"`
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"sensor/count"
 	"sync"
 	"time"
 )
@@ -42,12 +41,29 @@ type TaskSensorBody struct {
 	SensorAttachIP string // 传感器依附IP
 
 	customFunction func(body TaskSensorBody, wg *sync.WaitGroup)
+	commandID      string             // 写指令ID, 仅CommandWrite
+	collector      *Collector         // 所属的收集器
+	done           chan<- taskOutcome // 按需任务的结果, 定时任务为nil
 }
 
-var tw *TimeWheel
+/**
+ * 任务所属的收集器, 未指定时为Default()
+ */
+func (ts *TaskSensorBody) owner() *Collector {
+	if ts.collector == nil {
+		return Default()
+	}
+	return ts.collector
+}
 
 const taskSecond int64 = 1000000000
 
+// DTU任务队列的长度: 每个传感器TASK_QUEUE_PER_SENSOR个, 至少TASK_QUEUE_MIN_SIZE
+const (
+	TASK_QUEUE_MIN_SIZE   = 10
+	TASK_QUEUE_PER_SENSOR = 2
+)
+
 const (
 	DissolvedOxygenAndTemperature = iota // 溶氧量
 	D2
@@ -61,6 +77,11 @@ const (
 
 )
 
+// 各类型传感器的测量项名称
+var MeasureItemNames = map[byte][]string{
+	DissolvedOxygenAndTemperature: {"Oxygen", "Temp"},
+}
+
 //// 指令类型Type
 //const DissolvedOxygenAndTemperature byte = 0x01 // 溶氧量和温度
 //const D2 byte = 0x02                            // 未定义的类型
@@ -99,15 +120,43 @@ func (ts *TaskSensorBody) CreateMeasureRequest() {
  * DefaultHandler中规定了几种默认的处理方式
  */
 func DefaultSensorHandler(body TaskSensorBody, wg *sync.WaitGroup) {
+	c := body.owner()
+	// 按需任务的结果
+	var outcome taskOutcome
+	if body.done != nil {
+		defer func() { body.done <- outcome }()
+	}
+	// 写指令
+	if body.Type == CommandWrite {
+		c.executeCommand(body)
+		wg.Done()
+		return
+	}
+	// 写线圈, 目标不是传感器
+	if body.Type == CoilWrite {
+		outcome.result, outcome.err = c.executeCoilWrite(body)
+		wg.Done()
+		return
+	}
+
 	// 传感器异常
-	if count.IsForbidden(body.SensorID) {
+	if c.tracker.IsForbidden(body.SensorID) {
+		outcome.err = invalid(ErrSensorUnavailable)
 		wg.Done()
 		return
 	}
 
 	// 关闭
-	ls, _ := GetLocalSensor(body.SensorID)
-	if ls.IsClosed() {
+	ls, err := c.GetLocalSensor(body.SensorID)
+	if err != nil || ls.IsClosed() {
+		outcome.err = invalid(ErrSensorUnavailable)
+		wg.Done()
+		return
+	}
+
+	// 读寄存器
+	if body.Type == RegisterRead {
+		outcome.result, outcome.err = c.executeRegisterRead(body)
 		wg.Done()
 		return
 	}
@@ -122,31 +171,43 @@ func DefaultSensorHandler(body TaskSensorBody, wg *sync.WaitGroup) {
 
 	switch body.Type {
 	case DissolvedOxygenAndTemperature:
-		// 得到透传conn
-		b, _ := GetDeviceSession(body.SensorAttachIP)
 		// 合成地址
 		body.CreateMeasureRequest()
 		fmt.Printf("[INFO] 测量请求 ID:%s 设备地址:%d 任务类型:%d 请求数据:%b\n", body.SensorID, body.SensorAddr, body.Type, body.RequestData)
-		// 向传感器发送对应测量请求
-		p, err := b.MeasureRequest(body.RequestData, []string{"Oxygen", "Temp"})
+		// 得到透传conn, 向传感器发送对应测量请求
+		var p ReadResult
+		b, err := c.GetDeviceSession(body.SensorAttachIP)
+		if err == nil {
+			p, err = b.MeasureRequest(body.RequestData, MeasureItemNames[body.Type])
+		}
 		if err != nil {
 			fmt.Println("[FAIL] 请求失败")
 			// TODO 超时处理
-			v, _ := GetLocalSensor(body.SensorID)
 			// 超时标记
-			if count.AddErrorOperation(body.SensorID) > 3 {
-				v.Status = STATUS_DETACH
+			if c.tracker.AddErrorOperation(body.SensorID) > 3 {
+				ls.Detach()
 			}
-			fmt.Printf("[WARN] 查询错误 ID:%s 发生第%d次错误 恢复时间: %s\n", body.SensorID, count.GetErrorCount(body.SensorID), count.GetRetryTime(body.SensorID).Format("2006/1/2 15:04:05"))
+			fmt.Printf("[WARN] 查询错误 ID:%s 发生第%d次错误 恢复时间: %s\n", body.SensorID, c.tracker.GetErrorCount(body.SensorID), c.tracker.GetRetryTime(body.SensorID).Format("2006/1/2 15:04:05"))
+			outcome.err = err
 			// v.Status = STATUS_DETACH
 			// waitGroup完成
 
 			break
 		}
 		p.SensorID = body.SensorID
-		send, err := json.Marshal(p)
-		client, _ := GetMQTTInstance()
-		client.Publish("sensor/oxygen/measure", 1, false, send)
+		outcome.result = p
+		c.setReading(p)
+		c.recordHistory(p)
+		c.evaluateAlarms(p)
+		c.evaluateControl(p)
+		c.publishEvent(StreamEvent{Type: EVENT_READING, SensorID: p.SensorID, Attach: body.SensorAttachIP, Reading: &p})
+		// 传感器可用, 发送缓存的指令
+		c.dispatchCommands(body.SensorID)
+		send, _ := json.Marshal(p)
+		if err := c.PublishReading(c.Topic(c.SensorTopic(body.SensorID, TOPIC_MEASURE)), send); err != nil {
+			fmt.Println("[FAIL] 数据发布失败", err)
+		}
+		c.sparkplugReading(p)
 		break
 	case D2:
 		// TODO
@@ -218,6 +279,7 @@ func (ls *LocalSensorInformation) CreateTask(times int, queueChannel chan TaskSe
 	body.RequestData = nil
 	body.SensorID = ls.SensorID
 	body.SensorAttachIP = ls.Attach
+	body.collector = ls.owner()
 
 	// 是否存在自定义任务
 	// 这里应该不需要这个自定义任务了, 应该改到pop中
@@ -229,43 +291,60 @@ func (ls *LocalSensorInformation) CreateTask(times int, queueChannel chan TaskSe
 
 	// data由信息体data + 阻塞channel构成
 	data := TaskData{"Data": body, "Channel": queueChannel}
-	return GetTimeWheel().AddTask(time.Duration(ls.Interval*taskSecond), times, key, data, TaskSensorPush)
+	return ls.owner().GetTimeWheel().AddTask(time.Duration(ls.Interval*taskSecond), times, key, data, TaskSensorPush)
 }
 
 /**
  * 单DTU任务阻塞队列的压入
+ * DTU已断开或队列已满时丢弃本次任务, 不阻塞TimeWheel; 队列已满时计入scheduled_reads_dropped_total
  * @param queueChannel 单DTU内任务的阻塞队列
  */
 func TaskSensorPush(data TaskData) {
 	body := data["Data"].(TaskSensorBody)
 	queueChannel := data["Channel"].(chan TaskSensorBody)
-	defer func() {
-		if recover() != nil {
-			fmt.Println("[INFO] 通道已关闭, 尝试再次关闭任务")
-			key := TaskSensorKey{body.SensorAddr, body.SensorAttachIP, body.Type}
-			if err := GetTimeWheel().RemoveTask(key); err != nil {
-				fmt.Println("[WARN] 尝试失败, 不存在的任务Key")
-			}
-		}
-	}()
-	queueChannel <- body
+	c := body.owner()
+	// DTU已断开(任务通道已注销)或收集器正在停止
+	if ch, ok := c.GetTaskChannel(body.SensorAttachIP); !ok || ch != queueChannel || c.IsStopping() {
+		fmt.Println("[INFO] 任务通道已失效, 丢弃任务 ID:" + body.SensorID)
+		return
+	}
+	select {
+	case queueChannel <- body:
+	default:
+		c.metrics.incr(c.metrics.dropped, sensorKey{body.SensorAttachIP, body.SensorID})
+		fmt.Println("[WARN] 任务队列已满, 丢弃任务 ID:" + body.SensorID)
+	}
 }
 
 /**
  * 单DTU任务调度Routine
  * 特别说明: 当遇到的任务不是定时执行的时候, 比如是用户修改了传感器的某一项参数时, 需要提前得知queueChannel的地址
+ * 会话关闭或收集器开始停止后退出, 正在进行的请求会被执行完
  * @param queueChannel 单DTU内任务的阻塞队列
  */
 func (ds *DeviceSession) TaskSensorPop(queueChannel chan TaskSensorBody) {
 	var wg sync.WaitGroup
-
-	for v := range queueChannel {
-		wg.Add(1)
-		DefaultSensorHandler(v, &wg)
-		wg.Wait()
+	c := ds.collector
+
+	for {
+		select {
+		case v := <-queueChannel:
+			if !c.beginTransaction() {
+				fmt.Println("[INFO] POP成功关闭")
+				return
+			}
+			wg.Add(1)
+			DefaultSensorHandler(v, &wg)
+			wg.Wait()
+			c.endTransaction()
+		case <-ds.Done():
+			fmt.Println("[INFO] POP成功关闭")
+			return
+		case <-c.draining:
+			fmt.Println("[INFO] POP成功关闭")
+			return
+		}
 	}
-
-	fmt.Println("[INFO] POP成功关闭")
 }
 
 /**
@@ -274,7 +353,7 @@ func (ds *DeviceSession) TaskSensorPop(queueChannel chan TaskSensorBody) {
  */
 func (ls *LocalSensorInformation) RemoveTask() error {
 	key := TaskSensorKey{ls.Addr, ls.Attach, ls.Type}
-	return GetTimeWheel().RemoveTask(key)
+	return ls.owner().GetTimeWheel().RemoveTask(key)
 }
 
 /**
@@ -289,65 +368,108 @@ func (ls *LocalSensorInformation) UpdateTask(interval time.Duration, queueChanne
 	body.Type = ls.Type
 	body.RequestData = nil
 	body.SensorID = ls.SensorID
+	body.collector = ls.owner()
 	if ls.TaskHandler == nil {
 		body.customFunction = nil
 	} else {
 		body.customFunction = ls.TaskHandler
 	}
 	data := TaskData{"Data": body, "Channel": queueChannel}
-	return GetTimeWheel().UpdateTask(key, interval, data)
+	return ls.owner().GetTimeWheel().UpdateTask(key, interval, data)
 }
 
 /**
  * 初始化TimeWheel
  */
 func TimeWheelInit() *TimeWheel {
-	tw = New(time.Second, 180)
-	tw.Start()
-	return tw
+	return Default().GetTimeWheel()
+}
+
+/*
+ * 获得该收集器的TimeWheel, 首次调用时创建并启动
+ */
+func (c *Collector) GetTimeWheel() *TimeWheel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tw == nil {
+		c.tw = New(time.Second, 180)
+		c.tw.Start()
+	}
+	return c.tw
 }
 
 /*
  * 获得TimeWheel单例
  */
 func GetTimeWheel() *TimeWheel {
-	if tw == nil {
-		tw = New(time.Second, 180)
-		tw.Start()
+	return Default().GetTimeWheel()
+}
+
+func taskQueueSize(sensors int) int {
+	if size := sensors * TASK_QUEUE_PER_SENSOR; size > TASK_QUEUE_MIN_SIZE {
+		return size
 	}
-	return tw
+	return TASK_QUEUE_MIN_SIZE
+}
+
+/*
+ * 获得DTU的任务阻塞队列, 用于DTU已连接时动态添加任务
+ */
+func (c *Collector) GetTaskChannel(attachIP string) (chan TaskSensorBody, bool) {
+	if v, ok := c.taskChannels.Load(attachIP); ok {
+		return v.(chan TaskSensorBody), true
+	}
+	return nil, false
 }
 
 /*
  * 定时任务设置
+ * 队列长度按该DTU上的传感器数分配, 总线较慢时定时任务可以排队而不被丢弃
  * @return ch 给processor进行回收
  */
-func TaskSetup(attachIP string) chan TaskSensorBody {
-	ch := make(chan TaskSensorBody, 10)
+func (c *Collector) TaskSetup(attachIP string) chan TaskSensorBody {
+	ch := make(chan TaskSensorBody, taskQueueSize(len(c.Config().GetLocalSensorList(attachIP))))
+	c.taskChannels.Store(attachIP, ch)
 	// 这个pop每个dtu有且只有一个, 生命周期应与tcp挂钩
-	ds, _ := GetDeviceSession(attachIP)
+	ds, err := c.GetDeviceSession(attachIP)
+	if err != nil {
+		return ch
+	}
 	go ds.TaskSensorPop(ch)
 	// 此处得到attach到该dtu的至少0个, 至多3个传感器的参数
 
 	// 为attach的每一个传感器设置定时任务
-	for _, v := range GetLocalDevicesInstance().GetLocalSensorList(attachIP) {
+	for _, v := range c.Config().GetLocalSensorList(attachIP) {
 		v.ScanSensorStatus()
 		if err := v.CreateTask(-1, ch); err != nil {
 			continue
 		}
 		fmt.Println("[INFO] 进入队列 ID:" + v.SensorID)
 	}
+	// 发送DTU断开期间缓存的指令
+	c.dispatchAttachCommands(attachIP)
+	// 写入该DTU上继电器的目标状态
+	c.applyControl(time.Now())
 
 	return ch
 }
 
+func TaskSetup(attachIP string) chan TaskSensorBody {
+	return Default().TaskSetup(attachIP)
+}
+
 /*
  * 扫描attach(下位机)内传感器状态
  * 在processor内的for进行首次判断
  */
 func (ls *LocalSensorInformation) ScanSensorStatus() {
 	fmt.Println("[INFO] 等待连接 ID:" + ls.SensorID + " FROM " + ls.Attach)
-	ds, _ := GetDeviceSession(ls.Attach)
+	c := ls.owner()
+	ds, err := c.GetDeviceSession(ls.Attach)
+	if err != nil {
+		ls.Detach()
+		return
+	}
 	var sr []byte
 	// 设备ADDR
 	sr = append(sr, ls.Addr)
@@ -359,13 +481,13 @@ func (ls *LocalSensorInformation) ScanSensorStatus() {
 	sr = append(sr, CreateCRC(sr)...)
 	if _, err := ds.SendToSensor(sr); err != nil {
 		// 超时
-		ls.Status = STATUS_DETACH
-		count.AddErrorOperationBan(ls.SensorID)
+		ls.Detach()
+		c.tracker.AddErrorOperationBan(ls.SensorID)
 		fmt.Println("[WARN] 连接超时 ID:" + ls.SensorID + " FROM " + ls.Attach)
 	} else {
 		// TODO: 最后记得把fmt换成日志log输出
-		ls.Status = STATUS_NORMAL
-		count.ClsErrorCount(ls.SensorID)
+		ls.Open()
+		c.tracker.ClsErrorCount(ls.SensorID)
 		fmt.Println("[INFO] 连接成功 ID:" + ls.SensorID + " FROM " + ls.Attach)
 	}
 }
@@ -373,8 +495,8 @@ func (ls *LocalSensorInformation) ScanSensorStatus() {
 /*
  * 通过sensorID获得LocalSensorInformation
  */
-func GetLocalSensor(sensorID string) (*LocalSensorInformation, error) {
-	ins := GetLocalDevicesInstance().LocalSensorInformation
+func (c *Collector) GetLocalSensor(sensorID string) (*LocalSensorInformation, error) {
+	ins := c.Config().LocalSensorInformation
 	for _, v := range ins {
 		if v.SensorID == sensorID {
 			return v, nil
@@ -383,21 +505,70 @@ func GetLocalSensor(sensorID string) (*LocalSensorInformation, error) {
 	return nil, errors.New("not find sensorID for this device")
 }
 
+func GetLocalSensor(sensorID string) (*LocalSensorInformation, error) {
+	return Default().GetLocalSensor(sensorID)
+}
+
+/*
+ * 传感器最近一次成功的测量结果
+ */
+func (c *Collector) LatestReading(sensorID string) (ReadResult, bool) {
+	c.readingMu.Lock()
+	defer c.readingMu.Unlock()
+	p, ok := c.readings[sensorID]
+	return p, ok
+}
+
+func LatestReading(sensorID string) (ReadResult, bool) {
+	return Default().LatestReading(sensorID)
+}
+
+func (c *Collector) setReading(p ReadResult) {
+	c.readingMu.Lock()
+	defer c.readingMu.Unlock()
+	c.readings[p.SensorID] = p
+}
+
+/*
+ * 传感器所属的收集器, 未关联时为Default()
+ */
+func (ls *LocalSensorInformation) owner() *Collector {
+	if ls.collector == nil {
+		return Default()
+	}
+	return ls.collector
+}
+
+func (ls *LocalSensorInformation) status() int {
+	c := ls.owner()
+	c.sensorMu.RLock()
+	defer c.sensorMu.RUnlock()
+	return ls.Status
+}
+
 func (ls *LocalSensorInformation) IsClosed() bool {
-	if ls.Status == STATUS_CLOSED {
+	if ls.status() == STATUS_CLOSED {
 		return true
 	}
 	return false
 }
 
 func (ls *LocalSensorInformation) Open() {
-	ls.Status = STATUS_NORMAL
+	ls.setStatus(STATUS_NORMAL)
 }
 
 func (ls *LocalSensorInformation) Close() {
-	ls.Status = STATUS_CLOSED
+	ls.setStatus(STATUS_CLOSED)
 }
 
 func (ls *LocalSensorInformation) Detach() {
-	ls.Status = STATUS_DETACH
+	ls.setStatus(STATUS_DETACH)
+}
+
+func (ls *LocalSensorInformation) setStatus(status int) {
+	c := ls.owner()
+	c.sensorMu.Lock()
+	ls.Status = status
+	c.sensorMu.Unlock()
+	c.reportSensorStatus(ls.SensorID)
 }
@@ -13,7 +13,10 @@ type DeviceSession struct {
 	readChan  chan []byte
 	writeChan chan []byte
 	stopChan  chan bool
+	done      chan struct{} // 会话关闭后被close
+	closeOnce sync.Once
 	conn      net.Conn
+	collector *Collector // 所属的收集器
 	sync.Mutex
 	interfaceDevice
 }
@@ -44,56 +47,104 @@ type interfaceDevice interface {
 	GetResultInstance(meta DeviceMeta) (ReadResult, error)
 }
 
-var SessionsCollection sync.Map
-
 /**
  * reg device to map
  */
-func RegDeviceSession(conn net.Conn) DeviceSession {
-	var s DeviceSession
+func (c *Collector) RegDeviceSession(conn net.Conn) *DeviceSession {
+	s := &DeviceSession{}
 	s.readChan = make(chan []byte)
 	s.writeChan = make(chan []byte)
-	s.stopChan = make(chan bool)
+	// ReadConn/WriteConn各自可能发出一次停止信号
+	s.stopChan = make(chan bool, 2)
+	s.done = make(chan struct{})
 	s.conn = conn
+	s.collector = c
 	addr := strings.Split(conn.RemoteAddr().String(), ":")[0]
-	SessionsCollection.Store(addr, s)
+	c.sessions.Store(addr, s)
 	return s
 }
 
+func RegDeviceSession(conn net.Conn) *DeviceSession {
+	return Default().RegDeviceSession(conn)
+}
+
 /**
  * return the device session which search for
  * if a non-existent key, return err
  */
-func GetDeviceSession(addr string) (DeviceSession, error) {
-	if v, ok := SessionsCollection.Load(addr); ok {
-		return v.(DeviceSession), nil
+func (c *Collector) GetDeviceSession(addr string) (*DeviceSession, error) {
+	if v, ok := c.sessions.Load(addr); ok {
+		return v.(*DeviceSession), nil
 	} else {
-		return DeviceSession{}, errors.New("not found session")
+		return nil, errors.New("not found session")
 	}
 }
 
-func GetDeviceSessions() sync.Map {
-	return SessionsCollection
+func GetDeviceSession(addr string) (*DeviceSession, error) {
+	return Default().GetDeviceSession(addr)
+}
+
+func (c *Collector) GetDeviceSessions() *sync.Map {
+	return &c.sessions
+}
+
+func GetDeviceSessions() *sync.Map {
+	return Default().GetDeviceSessions()
 }
 
 /**
  * show all device node ip in this -> lan
  * @return a string array include all node server ip
  */
-func ShowNodeIPs() []string {
+func (c *Collector) ShowNodeIPs() []string {
 	var ret []string
-	SessionsCollection.Range(func(key, value interface{}) bool {
+	c.sessions.Range(func(key, value interface{}) bool {
 		ret = append(ret, key.(string))
 		return true
 	})
 	return ret
 }
 
+func ShowNodeIPs() []string {
+	return Default().ShowNodeIPs()
+}
+
+/**
+ * DTU的IP
+ */
+func (ds *DeviceSession) AttachIP() string {
+	return strings.Split(ds.conn.RemoteAddr().String(), ":")[0]
+}
+
+// 会话已关闭时的读写错误
+var ErrSessionClosed = errors.New("session closed")
+
+/**
+ * 断开DTU连接, 由processor完成资源释放
+ * 正在等待该会话的读写立即返回ErrSessionClosed
+ */
+func (ds *DeviceSession) Close() {
+	ds.closeOnce.Do(func() {
+		close(ds.done)
+	})
+	_ = ds.conn.Close()
+}
+
+/**
+ * 会话关闭时被close
+ */
+func (ds *DeviceSession) Done() <-chan struct{} {
+	return ds.done
+}
+
 /**
  * 释放Map中session
  */
 func (ds *DeviceSession) ReleaseDevice() {
-	SessionsCollection.Delete(strings.Split(ds.conn.RemoteAddr().String(), ":")[0])
+	// DTU可能已经重新连接, 只移除自身
+	if v, ok := ds.collector.sessions.Load(ds.AttachIP()); ok && v == ds {
+		ds.collector.sessions.Delete(ds.AttachIP())
+	}
 }
 
 /**
@@ -101,7 +152,7 @@ func (ds *DeviceSession) ReleaseDevice() {
  */
 func (ds *DeviceSession) ReleaseTask() {
 	// 移除任务
-	for _, v := range GetLocalDevicesInstance().GetLocalSensorList(strings.Split(ds.conn.RemoteAddr().String(), ":")[0]) {
+	for _, v := range ds.collector.Config().GetLocalSensorList(ds.AttachIP()) {
 		if err := v.RemoveTask(); err != nil {
 			fmt.Println("[WARN] 释放任务过程出现错误 ", err)
 		} else {
@@ -126,11 +177,17 @@ type DeviceMeta struct {
  *
  */
 func (ds *DeviceSession) SendToSensor(requestData []byte) ([]byte, error) {
-	ds.writeChan <- requestData
+	select {
+	case ds.writeChan <- requestData:
+	case <-ds.done:
+		return nil, ErrSessionClosed
+	}
 	for {
 		select {
 		case readData := <- ds.readChan:
 			return readData, nil
+		case <-ds.done:
+			return nil, ErrSessionClosed
 		case <-time.After(10 * time.Second):
 			return nil, errors.New("connected timeout")
 		}
@@ -144,16 +201,31 @@ func (ds *DeviceSession) SendToSensor(requestData []byte) ([]byte, error) {
  * @param timeout 超时channel处理
  */
 func (ds *DeviceSession) SendWord(data []byte, callback func(dm DeviceMeta, data []byte) (ReadResult, error)) (ReadResult, error) {
-	ds.writeChan <- data
+	m := ds.collector.metrics
+	key := ds.collector.requestSensor(ds.AttachIP(), data)
+	select {
+	case ds.writeChan <- data:
+	case <-ds.done:
+		return ReadResult{}, ErrSessionClosed
+	}
+	m.incr(m.requests, key)
+	start := time.Now()
 	for {
 		select {
+		case <-ds.done:
+			return ReadResult{}, ErrSessionClosed
 		case readData := <-ds.readChan:
+			m.observeLatency(key.attach, time.Since(start))
 			// 检测数据
 			dm, md, err := SplitAndValidate(readData)
 			var rs ReadResult
 			if err != nil {
+				m.incr(m.crcFailures, key)
 				fmt.Println("error data")
 			} else {
+				if dm.FuncCode > 0x80 && len(md) > 0 {
+					m.exception(key, dm.FuncCode-0x80, md[0])
+				}
 				// 回调的自定义处理
 				rs, err = callback(dm, md)
 			}
@@ -162,6 +234,7 @@ func (ds *DeviceSession) SendWord(data []byte, callback func(dm DeviceMeta, data
 			// 超时处理, 识别为不存在的传感器, 即失去物理连接的
 			// 是否考虑多次才出现
 			fmt.Println("[WARN] 传感器连接超时")
+			m.incr(m.timeouts, key)
 			return ReadResult{}, errors.New("sensor timeout")
 		}
 	}
@@ -200,7 +273,11 @@ func (ds *DeviceSession) ReadConn() {
 		if err != nil {
 			break
 		}
-		ds.readChan <- data[:n]
+		select {
+		case ds.readChan <- data[:n]:
+		case <-ds.done:
+			return
+		}
 	}
 	ds.stopChan <- true
 }
@@ -210,7 +287,12 @@ func (ds *DeviceSession) ReadConn() {
  */
 func (ds *DeviceSession) WriteConn() {
 	for {
-		data := <-ds.writeChan
+		var data []byte
+		select {
+		case data = <-ds.writeChan:
+		case <-ds.done:
+			return
+		}
 		if _, err := ds.conn.Write(data); err != nil {
 			break
 		}
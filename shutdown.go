@@ -0,0 +1,169 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//=====================SHUTDOWN=================
+//
+//            信号处理与收集器的优雅停止
+//
+//=====================END======================
+
+// 默认的停止等待时间
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// ctx没有截止时间时, 单个MQTT消息的最长等待时间
+const FLUSH_TIMEOUT = 5 * time.Second
+
+// 上报的传感器状态
+const (
+	SENSOR_ONLINE  = "online"
+	SENSOR_OFFLINE = "offline"
+)
+
+type SensorStatusReport struct {
+	SensorID string    `json:"sensorID"`
+	Status   string    `json:"status"`
+	Errors   int       `json:"errors,omitempty"` // 连续错误次数
+	Created  time.Time `json:"created"`
+}
+
+/**
+ * 启动收集器并阻塞, 收到SIGINT/SIGTERM后在timeout内停止
+ * 停止过程中再次收到信号时立即退出
+ */
+func (c *Collector) Run(timeout time.Duration) error {
+	if err := c.Start(context.Background()); err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case s := <-sig:
+		fmt.Println("[INFO] 收到信号", s)
+	case <-c.done:
+		return nil
+	}
+
+	go func() {
+		select {
+		case <-sig:
+			fmt.Println("[WARN] 强制退出")
+			os.Exit(1)
+		case <-c.done:
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.Stop(ctx)
+}
+
+/**
+ * 开始一次总线请求, 收集器已开始停止时返回false
+ */
+func (c *Collector) beginTransaction() bool {
+	atomic.AddInt32(&c.inflight, 1)
+	if c.IsStopping() {
+		atomic.AddInt32(&c.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (c *Collector) endTransaction() {
+	atomic.AddInt32(&c.inflight, -1)
+}
+
+/**
+ * 等待进行中的总线请求完成, 直到ctx结束
+ */
+func (c *Collector) waitInflight(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&c.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+/**
+ * 停止时MQTT的剩余等待时间
+ */
+func flushTimeout(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return FLUSH_TIMEOUT
+	}
+	if d := time.Until(deadline); d > 0 {
+		return d
+	}
+	return 0
+}
+
+/**
+ * 已建立的MQTT连接, 停止过程中不再重新连接
+ */
+func (c *Collector) connectedClient() (mqtt.Client, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil || !c.client.IsConnectionOpen() {
+		return nil, false
+	}
+	return c.client, true
+}
+
+/**
+ * 上报收集器及全部传感器离线, 正常断开时不会发布遗嘱消息
+ */
+func (c *Collector) publishOffline(ctx context.Context) {
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	var tokens []mqtt.Token
+	for _, v := range c.Config().LocalSensorInformation {
+		send, _ := json.Marshal(SensorStatusReport{SensorID: v.SensorID, Status: SENSOR_OFFLINE, Created: time.Now()})
+		tokens = append(tokens, c.publishStream(client, STREAM_STATUS, c.Topic(c.SensorTopic(v.SensorID, TOPIC_STATUS)), send))
+	}
+	send, _ := json.Marshal(CollectorPresence{Name: c.Config().Name, Status: SENSOR_OFFLINE, Created: time.Now()})
+	tokens = append(tokens, client.Publish(c.PresenceTopic(), 1, true, send))
+	for _, token := range tokens {
+		if !token.WaitTimeout(flushTimeout(ctx)) || token.Error() != nil {
+			fmt.Println("[WARN] 离线状态上报失败")
+			return
+		}
+	}
+	fmt.Println("[INFO] 已上报传感器离线")
+}
+
+/**
+ * 发送剩余的MQTT消息后断开
+ */
+func (c *Collector) disconnectMQTT(ctx context.Context) {
+	client, ok := c.connectedClient()
+	if !ok {
+		return
+	}
+	quiesce := flushTimeout(ctx)
+	if quiesce > time.Second {
+		quiesce = time.Second
+	}
+	client.Disconnect(uint(quiesce / time.Millisecond))
+	fmt.Println("[INFO] 已断开MQ")
+}
@@ -0,0 +1,537 @@
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"sensor/count"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=====================SPARKPLUG================
+//
+//   Sparkplug B: 收集器为Edge Node, 传感器为Device
+//
+//=====================END======================
+
+const SPARKPLUG_NAMESPACE = "spBv1.0"
+
+// 消息类型
+const (
+	SPB_NBIRTH = "NBIRTH"
+	SPB_NDEATH = "NDEATH"
+	SPB_DBIRTH = "DBIRTH"
+	SPB_DDEATH = "DDEATH"
+	SPB_DDATA  = "DDATA"
+	SPB_NCMD   = "NCMD"
+	SPB_DCMD   = "DCMD"
+)
+
+// Metric名称, 测量项使用MeasureItemNames中的名称
+const (
+	SPB_BDSEQ           = "bdSeq"
+	SPB_NODE_REBIRTH    = "Node Control/Rebirth"
+	SPB_NODE_CLEAR      = "Node Control/Clear Exception" // 清除全部传感器异常
+	SPB_NODE_VERSION    = "Properties/Version"
+	SPB_NODE_CONFIG     = "Properties/Config"
+	SPB_DEVICE_REBIRTH  = "Device Control/Rebirth"
+	SPB_STATUS          = "Status"                  // 传感器状态, 见SENSOR_NORMAL等
+	SPB_SWITCH          = "Control/Switch"          // open/close
+	SPB_CLEAR           = "Control/Clear Exception" // 清除异常
+	SPB_INTERVAL        = "Properties/Interval"     // 测量间隔(秒), 可写
+	SPB_ADDR            = "Properties/Address"
+	SPB_ATTACH          = "Properties/Attach"
+	SPB_COMMAND_PREFIX  = "Command/" // 写指令, 如 Command/zero
+	SPB_DEATH_QOS       = 1
+	SPB_PUBLISH_QOS     = 0
+	SPB_CONNECT_TIMEOUT = 10 * time.Second
+)
+
+/**
+ * Sparkplug B配置, 配置后以独立的MQTT连接运行
+ */
+type SparkplugOptions struct {
+	GroupID    string `json:"group_id" yaml:"group_id" toml:"group_id"`
+	EdgeNodeID string `json:"edge_node_id,omitempty" yaml:"edge_node_id,omitempty" toml:"edge_node_id,omitempty"` // 缺省为name
+}
+
+func (so *SparkplugOptions) nodeID(dl *LocalDeviceDetail) string {
+	if so.EdgeNodeID != "" {
+		return so.EdgeNodeID
+	}
+	return topicLevel(dl.Name)
+}
+
+func (so *SparkplugOptions) validate(dl *LocalDeviceDetail) error {
+	if so.GroupID == "" || strings.ContainsAny(so.GroupID, "/+#") {
+		return fmt.Errorf("invalid sparkplug group_id %q", so.GroupID)
+	}
+	if id := so.nodeID(dl); id == "" || strings.ContainsAny(id, "/+#") {
+		return fmt.Errorf("invalid sparkplug edge_node_id %q", id)
+	}
+	return nil
+}
+
+/**
+ * Edge Node状态, seq为0-255循环的消息序号, NBIRTH时归零
+ */
+type SparkplugNode struct {
+	c      *Collector
+	client mqtt.Client
+	group  string
+	node   string
+	bdSeq  uint64 // 当前连接的bdSeq, NBIRTH与该连接的NDEATH遗嘱一致
+	next   uint64 // 下次连接使用的bdSeq, 从0开始, 0-255循环
+	seq    uint64
+	births map[string]bool // 已发布DBIRTH的传感器
+	sync.Mutex
+}
+
+func (c *Collector) newSparkplugNode(dl *LocalDeviceDetail) *SparkplugNode {
+	return &SparkplugNode{
+		c:      c,
+		group:  dl.Sparkplug.GroupID,
+		node:   dl.Sparkplug.nodeID(dl),
+		births: make(map[string]bool),
+	}
+}
+
+func (n *SparkplugNode) topic(msgType string, device ...string) string {
+	return strings.Join(append([]string{SPARKPLUG_NAMESPACE, n.group, msgType, n.node}, device...), "/")
+}
+
+// ========================collector===========================
+
+func (c *Collector) sparkplugNode() *SparkplugNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sparkplug
+}
+
+func (c *Collector) runSparkplug() {
+	dl := c.Config()
+	if dl.Sparkplug == nil {
+		return
+	}
+	n := c.newSparkplugNode(dl)
+	c.mu.Lock()
+	c.sparkplug = n
+	c.mu.Unlock()
+	n.reconnect()
+}
+
+/**
+ * 测量成功后发布DDATA
+ */
+func (c *Collector) sparkplugReading(rr ReadResult) {
+	if n := c.sparkplugNode(); n != nil {
+		n.data(rr)
+	}
+}
+
+/**
+ * 传感器状态变化: 异常断开时DDEATH, 恢复时DBIRTH, 其余发布Status
+ */
+func (c *Collector) sparkplugStatus(sensorID, status string) {
+	if n := c.sparkplugNode(); n != nil {
+		n.status(sensorID, status)
+	}
+}
+
+/**
+ * CONFIG修改后重新发布NBIRTH/DBIRTH
+ */
+func (c *Collector) sparkplugRebirth() {
+	if n := c.sparkplugNode(); n != nil {
+		n.birth()
+	}
+}
+
+/**
+ * 发布NDEATH后断开, 正常断开时不会发布遗嘱消息
+ */
+func (c *Collector) stopSparkplug(ctx context.Context) {
+	n := c.sparkplugNode()
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.client == nil {
+		return
+	}
+	if n.client.IsConnectionOpen() {
+		send, _ := deathPayload(n.bdSeq)
+		n.client.Publish(n.topic(SPB_NDEATH), SPB_DEATH_QOS, false, send).WaitTimeout(flushTimeout(ctx))
+	}
+	n.client.Disconnect(250)
+}
+
+// ========================node===========================
+
+/**
+ * 连接中间件, 失败时按指数退避重试直到成功或收集器停止
+ * 每次连接的遗嘱都使用新的bdSeq, 因此不使用客户端的自动重连, 断开后重新调用
+ */
+func (n *SparkplugNode) reconnect() {
+	c := n.c
+	delay := time.Second
+	for !c.IsStopping() {
+		dl := c.Config()
+		cli, err := n.connect(dl)
+		if err == nil {
+			// 连接期间收集器已停止
+			if c.IsStopping() {
+				cli.Disconnect(0)
+			}
+			return
+		}
+		fmt.Printf("[WARN] Sparkplug连接失败, %s后重试: %s\n", delay, err)
+		select {
+		case <-c.draining:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > dl.maxReconnectInterval() {
+			delay = dl.maxReconnectInterval()
+		}
+	}
+}
+
+func (n *SparkplugNode) connect(dl *LocalDeviceDetail) (mqtt.Client, error) {
+	opts, err := n.clientOptions(dl)
+	if err != nil {
+		return nil, err
+	}
+	cli := mqtt.NewClient(opts)
+	token := cli.Connect()
+	if !waitToken(token, SPB_CONNECT_TIMEOUT) {
+		cli.Disconnect(0)
+		return nil, errors.New("connect timeout")
+	}
+	return cli, token.Error()
+}
+
+/**
+ * 连接参数, 每次调用使用下一个bdSeq生成NDEATH遗嘱, 连接成功后的NBIRTH使用同一bdSeq
+ */
+func (n *SparkplugNode) clientOptions(dl *LocalDeviceDetail) (*mqtt.ClientOptions, error) {
+	opts, err := brokerOptions(dl, "spb-"+n.group+"-"+n.node)
+	if err != nil {
+		return nil, err
+	}
+	// Edge Node必须使用clean session
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(false)
+	n.Lock()
+	bdSeq := n.next
+	n.next = (n.next + 1) % 256
+	n.Unlock()
+	will, err := deathPayload(bdSeq)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetBinaryWill(n.topic(SPB_NDEATH), will, SPB_DEATH_QOS, false)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		n.onConnect(client, bdSeq)
+	})
+	opts.SetConnectionLostHandler(n.onConnectionLost)
+	return opts, nil
+}
+
+/**
+ * 连接断开后以新的bdSeq重新连接
+ */
+func (n *SparkplugNode) onConnectionLost(client mqtt.Client, err error) {
+	fmt.Println("[WARN] Sparkplug连接断开, 重新连接中:", err)
+	go n.reconnect()
+}
+
+/**
+ * 连接(及重连)后订阅NCMD/DCMD并发布NBIRTH/DBIRTH
+ */
+func (n *SparkplugNode) onConnect(client mqtt.Client, bdSeq uint64) {
+	n.Lock()
+	n.client = client
+	n.bdSeq = bdSeq
+	n.Unlock()
+	fmt.Printf("[CONN] Sparkplug已连接 %s/%s\n", n.group, n.node)
+	client.Subscribe(n.topic(SPB_NCMD), 1, n.c.dispatch(n.handleNCMD))
+	client.Subscribe(n.topic(SPB_DCMD, "+"), 1, n.c.dispatch(n.handleDCMD))
+	n.birth()
+}
+
+func deathPayload(bdSeq uint64) ([]byte, error) {
+	p := SparkplugPayload{Timestamp: sparkplugTime(time.Now()), Metrics: []SparkplugMetric{
+		{Name: SPB_BDSEQ, Datatype: SPB_UINT64, Value: bdSeq},
+	}}
+	return p.Marshal()
+}
+
+/**
+ * 发布消息并递增seq, 未连接时不发布, 重新连接后由birth重新发布
+ * 调用者需持有锁
+ */
+func (n *SparkplugNode) publish(msgType string, device string, metrics []SparkplugMetric) bool {
+	if n.client == nil || !n.client.IsConnectionOpen() {
+		return false
+	}
+	seq := n.seq
+	p := SparkplugPayload{Timestamp: sparkplugTime(time.Now()), Metrics: metrics, Seq: &seq}
+	send, err := p.Marshal()
+	if err != nil {
+		fmt.Println("[FAIL] Sparkplug编码失败", err)
+		return false
+	}
+	topic := n.topic(msgType)
+	if device != "" {
+		topic = n.topic(msgType, device)
+	}
+	n.client.Publish(topic, SPB_PUBLISH_QOS, false, send)
+	n.seq = (n.seq + 1) % 256
+	return true
+}
+
+/**
+ * 发布NBIRTH及全部未断开传感器的DBIRTH
+ */
+func (n *SparkplugNode) birth() {
+	n.Lock()
+	defer n.Unlock()
+	dl := n.c.Config()
+	n.seq = 0
+	n.births = make(map[string]bool)
+	if !n.publish(SPB_NBIRTH, "", []SparkplugMetric{
+		{Name: SPB_BDSEQ, Datatype: SPB_UINT64, Value: n.bdSeq},
+		{Name: SPB_NODE_REBIRTH, Datatype: SPB_BOOLEAN, Value: false},
+		{Name: SPB_NODE_CLEAR, Datatype: SPB_BOOLEAN, Value: false},
+		{Name: SPB_NODE_VERSION, Datatype: SPB_STRING, Value: Version},
+		{Name: SPB_NODE_CONFIG, Datatype: SPB_INT64, Value: dl.Version},
+	}) {
+		return
+	}
+	for _, v := range dl.LocalSensorInformation {
+		if n.c.sensorState(v) != SENSOR_DETACHED {
+			n.deviceBirth(v)
+		}
+	}
+}
+
+/**
+ * DBIRTH, 包含测量项及可写的Metric定义
+ * 调用者需持有锁
+ */
+func (n *SparkplugNode) deviceBirth(ls *LocalSensorInformation) {
+	metrics := measureMetrics(ls, nil)
+	switchValue := count.SWITCH_OPEN
+	if ls.IsClosed() {
+		switchValue = count.SWITCH_CLOSE
+	}
+	metrics = append(metrics,
+		SparkplugMetric{Name: SPB_STATUS, Datatype: SPB_STRING, Value: n.c.sensorState(ls)},
+		SparkplugMetric{Name: SPB_SWITCH, Datatype: SPB_STRING, Value: switchValue},
+		SparkplugMetric{Name: SPB_CLEAR, Datatype: SPB_BOOLEAN, Value: false},
+		SparkplugMetric{Name: SPB_DEVICE_REBIRTH, Datatype: SPB_BOOLEAN, Value: false},
+		SparkplugMetric{Name: SPB_INTERVAL, Datatype: SPB_INT64, Value: ls.Interval},
+		SparkplugMetric{Name: SPB_ADDR, Datatype: SPB_UINT8, Value: uint64(ls.Addr)},
+		SparkplugMetric{Name: SPB_ATTACH, Datatype: SPB_STRING, Value: ls.Attach},
+		SparkplugMetric{Name: SPB_COMMAND_PREFIX + COMMAND_ZERO, Datatype: SPB_BOOLEAN, Value: false},
+		SparkplugMetric{Name: SPB_COMMAND_PREFIX + COMMAND_TILT, Datatype: SPB_BOOLEAN, Value: false},
+		SparkplugMetric{Name: SPB_COMMAND_PREFIX + COMMAND_FACTORY, Datatype: SPB_BOOLEAN, Value: false},
+		SparkplugMetric{Name: SPB_COMMAND_PREFIX + COMMAND_ADDR, Datatype: SPB_UINT8, IsNull: true},
+		SparkplugMetric{Name: SPB_COMMAND_PREFIX + COMMAND_WRITE, Datatype: SPB_STRING, IsNull: true},
+	)
+	if n.publish(SPB_DBIRTH, ls.SensorID, metrics) {
+		n.births[ls.SensorID] = true
+	}
+}
+
+/**
+ * 测量项Metric, rr为nil时值为null
+ */
+func measureMetrics(ls *LocalSensorInformation, rr *ReadResult) []SparkplugMetric {
+	var metrics []SparkplugMetric
+	for _, name := range MeasureItemNames[ls.Type] {
+		m := SparkplugMetric{Name: name, Datatype: SPB_DOUBLE, IsNull: true}
+		if rr != nil {
+			m.Timestamp = sparkplugTime(rr.Created)
+			for _, v := range rr.Items {
+				if v.Name == name {
+					m.Value, m.IsNull = v.Value, false
+				}
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func (n *SparkplugNode) data(rr ReadResult) {
+	ls, err := n.c.GetLocalSensor(rr.SensorID)
+	if err != nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	if !n.births[ls.SensorID] {
+		n.deviceBirth(ls)
+	}
+	n.publish(SPB_DDATA, ls.SensorID, measureMetrics(ls, &rr))
+}
+
+func (n *SparkplugNode) status(sensorID, status string) {
+	ls, err := n.c.GetLocalSensor(sensorID)
+	if err != nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	switch {
+	case status == SENSOR_DETACHED:
+		if n.births[sensorID] {
+			n.publish(SPB_DDEATH, sensorID, nil)
+			delete(n.births, sensorID)
+		}
+	case !n.births[sensorID]:
+		n.deviceBirth(ls)
+	default:
+		switchValue := count.SWITCH_OPEN
+		if status == SENSOR_CLOSED {
+			switchValue = count.SWITCH_CLOSE
+		}
+		n.publish(SPB_DDATA, sensorID, []SparkplugMetric{
+			{Name: SPB_STATUS, Datatype: SPB_STRING, Value: status},
+			{Name: SPB_SWITCH, Datatype: SPB_STRING, Value: switchValue},
+		})
+	}
+}
+
+// ========================command===========================
+
+func (n *SparkplugNode) handleNCMD(client mqtt.Client, message mqtt.Message) {
+	p, err := UnmarshalSparkplug(message.Payload())
+	if err != nil {
+		fmt.Println("[WARN] 无法解析NCMD", err)
+		return
+	}
+	for _, m := range p.Metrics {
+		if v, ok := m.Bool(); !ok || !v {
+			continue
+		}
+		switch m.Name {
+		case SPB_NODE_REBIRTH:
+			n.birth()
+		case SPB_NODE_CLEAR:
+			if n.c.Config().CommandAuth != nil {
+				n.c.PushMQLog(MQ_LOG_FAIL, "NCMD "+m.Name+" 被拒绝: "+ErrUnsigned.Error())
+				continue
+			}
+			_ = n.c.ClearException("", count.CLEAR_ALL_EXCEPTION)
+		}
+	}
+}
+
+/**
+ * DCMD通过与MQTT指令相同的方法执行, 失败时上报日志
+ */
+func (n *SparkplugNode) handleDCMD(client mqtt.Client, message mqtt.Message) {
+	levels := strings.Split(message.Topic(), "/")
+	sensorID := levels[len(levels)-1]
+	p, err := UnmarshalSparkplug(message.Payload())
+	if err != nil {
+		fmt.Println("[WARN] 无法解析DCMD", err)
+		return
+	}
+	for _, m := range p.Metrics {
+		if err := n.deviceCommand(sensorID, m); err != nil {
+			n.c.PushMQLog(MQ_LOG_WARN, fmt.Sprintf("DCMD %s 执行失败: %s", m.Name, err), sensorID)
+		}
+	}
+}
+
+func (n *SparkplugNode) deviceCommand(sensorID string, m SparkplugMetric) error {
+	c := n.c
+	ls, err := c.GetLocalSensor(sensorID)
+	if err != nil {
+		return err
+	}
+	if m.IsNull {
+		return nil
+	}
+	if m.Name == SPB_DEVICE_REBIRTH {
+		if v, _ := m.Bool(); v {
+			n.Lock()
+			n.deviceBirth(ls)
+			n.Unlock()
+		}
+		return nil
+	}
+	// Sparkplug B指令无法签名, 配置command_auth后只允许Rebirth
+	if c.Config().CommandAuth != nil {
+		return ErrUnsigned
+	}
+	switch m.Name {
+	case SPB_SWITCH:
+		v, _ := m.String()
+		return c.SwitchSensor(sensorID, v)
+	case SPB_CLEAR:
+		if v, _ := m.Bool(); v {
+			return c.ClearException(sensorID, count.CLEAR_ONE_EXCEPTION)
+		}
+		return nil
+	case SPB_INTERVAL:
+		v, ok := m.Int()
+		if !ok {
+			return errors.New("interval must be an integer")
+		}
+		patch, _ := json.Marshal(map[string]int64{"interval": v})
+		_, err := c.ModifySensorConfig(context.Background(), c.Config().Version, sensorID, patch)
+		return err
+	}
+	if !strings.HasPrefix(m.Name, SPB_COMMAND_PREFIX) {
+		return fmt.Errorf("unknown metric %s", m.Name)
+	}
+	cmd := SensorCommand{SensorID: sensorID, Name: strings.TrimPrefix(m.Name, SPB_COMMAND_PREFIX)}
+	switch cmd.Name {
+	case COMMAND_ADDR:
+		v, ok := m.Int()
+		if !ok || v > 0xffff {
+			return errors.New("invalid addr")
+		}
+		cmd.Value = uint16(v)
+	case COMMAND_WRITE:
+		// register=value
+		v, _ := m.String()
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("write expects register=value")
+		}
+		reg, err := strconv.ParseUint(kv[0], 0, 16)
+		if err != nil {
+			return err
+		}
+		value, err := strconv.ParseUint(kv[1], 0, 16)
+		if err != nil {
+			return err
+		}
+		cmd.Register, cmd.Value = uint16(reg), uint16(value)
+	default:
+		if v, _ := m.Bool(); !v {
+			return nil
+		}
+	}
+	_, err = c.SubmitCommand(cmd)
+	return err
+}
+
+/**
+ * Sparkplug时间戳, UTC毫秒
+ */
+func sparkplugTime(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
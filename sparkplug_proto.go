@@ -0,0 +1,346 @@
+package sensor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+//=====================SPARKPLUG PROTO==========
+//
+//     Sparkplug B Payload的protobuf编解码
+//     仅实现本收集器用到的字段(sparkplug_b.proto)
+//
+//=====================END======================
+
+// Metric数据类型
+const (
+	SPB_INT8     = 1
+	SPB_INT16    = 2
+	SPB_INT32    = 3
+	SPB_INT64    = 4
+	SPB_UINT8    = 5
+	SPB_UINT16   = 6
+	SPB_UINT32   = 7
+	SPB_UINT64   = 8
+	SPB_FLOAT    = 9
+	SPB_DOUBLE   = 10
+	SPB_BOOLEAN  = 11
+	SPB_STRING   = 12
+	SPB_DATETIME = 13
+	SPB_TEXT     = 14
+)
+
+// protobuf字段序号
+const (
+	pbPayloadTimestamp = 1
+	pbPayloadMetrics   = 2
+	pbPayloadSeq       = 3
+
+	pbMetricName      = 1
+	pbMetricAlias     = 2
+	pbMetricTimestamp = 3
+	pbMetricDatatype  = 4
+	pbMetricIsNull    = 7
+	pbMetricInt       = 10
+	pbMetricLong      = 11
+	pbMetricFloat     = 12
+	pbMetricDouble    = 13
+	pbMetricBoolean   = 14
+	pbMetricString    = 15
+)
+
+// protobuf wire type
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+type SparkplugPayload struct {
+	Timestamp uint64 // 毫秒
+	Metrics   []SparkplugMetric
+	Seq       *uint64 // NDEATH不含seq
+}
+
+/**
+ * Value按Datatype取值:
+ * 有符号整数为int64, 无符号整数及DateTime为uint64, Float为float32, Double为float64
+ */
+type SparkplugMetric struct {
+	Name      string
+	Timestamp uint64
+	Datatype  uint32
+	IsNull    bool
+	Value     interface{}
+}
+
+func (m *SparkplugMetric) Bool() (bool, bool) {
+	v, ok := m.Value.(bool)
+	return v, ok
+}
+
+func (m *SparkplugMetric) String() (string, bool) {
+	v, ok := m.Value.(string)
+	return v, ok
+}
+
+/**
+ * 整数类型的值
+ */
+func (m *SparkplugMetric) Int() (int64, bool) {
+	switch v := m.Value.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// ========================encode===========================
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendFixed32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendTag(b []byte, field, wire int) []byte {
+	return appendVarint(b, uint64(field<<3|wire))
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, pbBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func (p *SparkplugPayload) Marshal() ([]byte, error) {
+	var b []byte
+	if p.Timestamp != 0 {
+		b = appendVarint(appendTag(b, pbPayloadTimestamp, pbVarint), p.Timestamp)
+	}
+	for i := range p.Metrics {
+		m, err := p.Metrics[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, pbPayloadMetrics, m)
+	}
+	if p.Seq != nil {
+		b = appendVarint(appendTag(b, pbPayloadSeq, pbVarint), *p.Seq)
+	}
+	return b, nil
+}
+
+func (m *SparkplugMetric) marshal() ([]byte, error) {
+	var b []byte
+	if m.Name != "" {
+		b = appendBytes(b, pbMetricName, []byte(m.Name))
+	}
+	if m.Timestamp != 0 {
+		b = appendVarint(appendTag(b, pbMetricTimestamp, pbVarint), m.Timestamp)
+	}
+	b = appendVarint(appendTag(b, pbMetricDatatype, pbVarint), uint64(m.Datatype))
+	if m.IsNull || m.Value == nil {
+		return appendVarint(appendTag(b, pbMetricIsNull, pbVarint), 1), nil
+	}
+	switch m.Datatype {
+	case SPB_INT8, SPB_INT16, SPB_INT32, SPB_UINT8, SPB_UINT16, SPB_UINT32:
+		v, ok := m.Int()
+		if !ok {
+			return nil, fmt.Errorf("metric %s: expected integer", m.Name)
+		}
+		b = appendVarint(appendTag(b, pbMetricInt, pbVarint), uint64(uint32(v)))
+	case SPB_INT64, SPB_UINT64, SPB_DATETIME:
+		var v uint64
+		switch t := m.Value.(type) {
+		case int64:
+			v = uint64(t)
+		case uint64:
+			v = t
+		default:
+			return nil, fmt.Errorf("metric %s: expected integer", m.Name)
+		}
+		b = appendVarint(appendTag(b, pbMetricLong, pbVarint), v)
+	case SPB_FLOAT:
+		v, ok := m.Value.(float32)
+		if !ok {
+			return nil, fmt.Errorf("metric %s: expected float32", m.Name)
+		}
+		b = appendFixed32(appendTag(b, pbMetricFloat, pbFixed32), math.Float32bits(v))
+	case SPB_DOUBLE:
+		v, ok := m.Value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("metric %s: expected float64", m.Name)
+		}
+		b = appendFixed64(appendTag(b, pbMetricDouble, pbFixed64), math.Float64bits(v))
+	case SPB_BOOLEAN:
+		v, ok := m.Bool()
+		if !ok {
+			return nil, fmt.Errorf("metric %s: expected bool", m.Name)
+		}
+		var i uint64
+		if v {
+			i = 1
+		}
+		b = appendVarint(appendTag(b, pbMetricBoolean, pbVarint), i)
+	case SPB_STRING, SPB_TEXT:
+		v, ok := m.String()
+		if !ok {
+			return nil, fmt.Errorf("metric %s: expected string", m.Name)
+		}
+		b = appendBytes(b, pbMetricString, []byte(v))
+	default:
+		return nil, fmt.Errorf("metric %s: unsupported datatype %d", m.Name, m.Datatype)
+	}
+	return b, nil
+}
+
+// ========================decode===========================
+
+var errProtoTruncated = errors.New("sparkplug: truncated payload")
+
+/**
+ * 逐个读取字段, 不支持的字段跳过
+ */
+func readFields(b []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		field, wire := int(tag>>3), int(tag&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case pbVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case pbFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case pbBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtoTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("sparkplug: unsupported wire type %d", wire)
+		}
+		if err := fn(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func UnmarshalSparkplug(b []byte) (*SparkplugPayload, error) {
+	var p SparkplugPayload
+	err := readFields(b, func(field, wire int, v uint64, data []byte) error {
+		switch field {
+		case pbPayloadTimestamp:
+			p.Timestamp = v
+		case pbPayloadSeq:
+			p.Seq = &v
+		case pbPayloadMetrics:
+			m, err := unmarshalMetric(data)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func unmarshalMetric(b []byte) (SparkplugMetric, error) {
+	var m SparkplugMetric
+	var raw uint64
+	var str string
+	var hasRaw, hasStr bool
+	err := readFields(b, func(field, wire int, v uint64, data []byte) error {
+		switch field {
+		case pbMetricName:
+			m.Name = string(data)
+		case pbMetricTimestamp:
+			m.Timestamp = v
+		case pbMetricDatatype:
+			m.Datatype = uint32(v)
+		case pbMetricIsNull:
+			m.IsNull = v != 0
+		case pbMetricInt, pbMetricLong, pbMetricFloat, pbMetricDouble, pbMetricBoolean:
+			raw, hasRaw = v, true
+		case pbMetricString:
+			str, hasStr = string(data), true
+		}
+		return nil
+	})
+	if err != nil || m.IsNull {
+		return m, err
+	}
+	// 未携带值时视为null
+	if m.Datatype == SPB_STRING || m.Datatype == SPB_TEXT {
+		hasRaw = hasStr
+	}
+	if !hasRaw {
+		m.IsNull = true
+		return m, nil
+	}
+	switch m.Datatype {
+	case SPB_INT8:
+		m.Value = int64(int8(raw))
+	case SPB_INT16:
+		m.Value = int64(int16(raw))
+	case SPB_INT32:
+		m.Value = int64(int32(raw))
+	case SPB_INT64:
+		m.Value = int64(raw)
+	case SPB_UINT8, SPB_UINT16, SPB_UINT32, SPB_UINT64, SPB_DATETIME:
+		m.Value = raw
+	case SPB_FLOAT:
+		m.Value = math.Float32frombits(uint32(raw))
+	case SPB_DOUBLE:
+		m.Value = math.Float64frombits(raw)
+	case SPB_BOOLEAN:
+		m.Value = raw != 0
+	case SPB_STRING, SPB_TEXT:
+		m.Value = str
+	default:
+		m.IsNull = true
+	}
+	return m, nil
+}
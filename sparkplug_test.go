@@ -0,0 +1,182 @@
+package sensor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestSparkplugPayload(t *testing.T) {
+	seq := uint64(3)
+	p := SparkplugPayload{Timestamp: 1577934245000, Seq: &seq, Metrics: []SparkplugMetric{
+		{Name: "a", Datatype: SPB_INT16, Value: int64(-2)},
+		{Name: "b", Datatype: SPB_UINT64, Value: uint64(1) << 40},
+		{Name: "c", Datatype: SPB_FLOAT, Value: float32(1.5)},
+		{Name: "d", Datatype: SPB_DOUBLE, Value: 7.25, Timestamp: 1},
+		{Name: "e", Datatype: SPB_BOOLEAN, Value: true},
+		{Name: "f", Datatype: SPB_STRING, Value: "x"},
+		{Name: "g", Datatype: SPB_DOUBLE, IsNull: true},
+	}}
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalSparkplug(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, p) {
+		t.Errorf("got %+v", got)
+	}
+	// timestamp=1, metrics=[{name:"a", datatype:2, int_value:0xfffffffe}]
+	p = SparkplugPayload{Timestamp: 1, Metrics: []SparkplugMetric{{Name: "a", Datatype: SPB_INT16, Value: int64(-2)}}}
+	data, _ = p.Marshal()
+	want := []byte{0x08, 0x01, 0x12, 0x0b, 0x0a, 0x01, 'a', 0x20, 0x02, 0x50, 0xfe, 0xff, 0xff, 0xff, 0x0f}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %x", data)
+	}
+	if _, err := UnmarshalSparkplug(data[:len(data)-1]); err == nil {
+		t.Error("truncated payload accepted")
+	}
+}
+
+func TestSparkplugNode(t *testing.T) {
+	client := newFakeClient()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", Sparkplug: &SparkplugOptions{GroupID: "farm"}, LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 60, SensorID: "s"},
+	}}), WithMQTTClient(newFakeClient()))
+	if err := c.Config().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	n := c.newSparkplugNode(c.Config())
+	c.sparkplug = n
+	n.onConnect(client, 0)
+
+	last := func(topic string) *SparkplugPayload {
+		msgs := client.messages(topic)
+		if len(msgs) == 0 {
+			t.Fatalf("nothing published to %s", topic)
+		}
+		p, err := UnmarshalSparkplug(msgs[len(msgs)-1].payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	metric := func(p *SparkplugPayload, name string) *SparkplugMetric {
+		for i := range p.Metrics {
+			if p.Metrics[i].Name == name {
+				return &p.Metrics[i]
+			}
+		}
+		t.Fatalf("metric %s not found", name)
+		return nil
+	}
+	if p := last("spBv1.0/farm/NBIRTH/c1"); *p.Seq != 0 || metric(p, SPB_BDSEQ).Value != uint64(0) {
+		t.Errorf("unexpected NBIRTH %+v", p)
+	}
+	if p := last("spBv1.0/farm/DBIRTH/c1/s"); *p.Seq != 1 || !metric(p, "Oxygen").IsNull || metric(p, SPB_INTERVAL).Value != int64(60) {
+		t.Errorf("unexpected DBIRTH %+v", p)
+	}
+
+	c.sparkplugReading(ReadResult{SensorID: "s", Items: []MeasureItem{{"Oxygen", 7.5}, {"Temp", 21}}, Created: time.Now()})
+	if p := last("spBv1.0/farm/DDATA/c1/s"); *p.Seq != 2 || metric(p, "Oxygen").Value != 7.5 {
+		t.Errorf("unexpected DDATA %+v", p)
+	}
+
+	// DCMD通过SwitchSensor关闭传感器
+	cmd := SparkplugPayload{Metrics: []SparkplugMetric{{Name: SPB_SWITCH, Datatype: SPB_STRING, Value: "close"}}}
+	data, _ := cmd.Marshal()
+	n.handleDCMD(client, fakeMessage{topic: "spBv1.0/farm/DCMD/c1/s", payload: data})
+	if ls, _ := c.GetLocalSensor("s"); !ls.IsClosed() {
+		t.Error("DCMD switch not applied")
+	}
+	if p := last("spBv1.0/farm/DDATA/c1/s"); metric(p, SPB_STATUS).Value != SENSOR_CLOSED {
+		t.Errorf("status not published %+v", p)
+	}
+
+	ls, _ := c.GetLocalSensor("s")
+	ls.Detach()
+	if p := last("spBv1.0/farm/DDEATH/c1/s"); *p.Seq != 4 {
+		t.Errorf("unexpected DDEATH %+v", p)
+	}
+
+	cmd = SparkplugPayload{Metrics: []SparkplugMetric{{Name: SPB_NODE_REBIRTH, Datatype: SPB_BOOLEAN, Value: true}}}
+	data, _ = cmd.Marshal()
+	n.handleNCMD(client, fakeMessage{topic: "spBv1.0/farm/NCMD/c1", payload: data})
+	if len(client.messages("spBv1.0/farm/NBIRTH/c1")) != 2 || len(client.messages("spBv1.0/farm/DBIRTH/c1/s")) != 1 {
+		t.Error("rebirth should skip detached sensors")
+	}
+}
+
+func TestSparkplugReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", BrokerScheme: "tcp", BrokerIP: "127.0.0.1", BrokerPort: port, Sparkplug: &SparkplugOptions{GroupID: "farm"}}))
+	n := c.newSparkplugNode(c.Config())
+
+	// 每次连接的遗嘱使用新的bdSeq, 不由客户端以旧的遗嘱自动重连
+	bdSeq := func(opts *mqtt.ClientOptions) interface{} {
+		p, err := UnmarshalSparkplug(opts.WillPayload)
+		if err != nil || len(p.Metrics) != 1 || p.Metrics[0].Name != SPB_BDSEQ {
+			t.Fatalf("unexpected will %+v %v", p, err)
+		}
+		return p.Metrics[0].Value
+	}
+	first, _ := n.clientOptions(c.Config())
+	second, _ := n.clientOptions(c.Config())
+	if first.AutoReconnect || bdSeq(first) != uint64(0) || bdSeq(second) != uint64(1) || first.WillTopic != "spBv1.0/farm/NDEATH/c1" {
+		t.Errorf("unexpected options %v %v %v", first.AutoReconnect, bdSeq(first), bdSeq(second))
+	}
+	// 连接后NBIRTH的bdSeq与该连接的遗嘱一致, 即使之后又生成了新的连接参数
+	client := newFakeClient()
+	first.OnConnect(client)
+	msgs := client.messages("spBv1.0/farm/NBIRTH/c1")
+	if len(msgs) != 1 {
+		t.Fatalf("expected one NBIRTH, got %d", len(msgs))
+	}
+	if p, err := UnmarshalSparkplug(msgs[0].payload); err != nil || p.Metrics[0].Name != SPB_BDSEQ || p.Metrics[0].Value != uint64(0) {
+		t.Errorf("NBIRTH bdSeq does not match will %+v %v", p, err)
+	}
+	// 0-255循环
+	n.Lock()
+	n.next = 255
+	n.Unlock()
+	last, _ := n.clientOptions(c.Config())
+	wrapped, _ := n.clientOptions(c.Config())
+	if bdSeq(last) != uint64(255) || bdSeq(wrapped) != uint64(0) {
+		t.Errorf("bdSeq not wrapped %v %v", bdSeq(last), bdSeq(wrapped))
+	}
+	n.Lock()
+	n.client = nil
+	n.Unlock()
+
+	// 断开后重新连接
+	n.onConnectionLost(newFakeClient(), errors.New("lost"))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n.Lock()
+		seq := n.next
+		n.Unlock()
+		if seq > 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.Lock()
+	if n.next <= 1 {
+		t.Error("not reconnected after connection lost")
+	}
+	n.Unlock()
+	_ = c.Stop(context.Background())
+}
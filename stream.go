@@ -0,0 +1,341 @@
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+//=====================STREAM===================
+//
+//   测量结果/状态变化/日志的实时推送(SSE及WebSocket)
+//
+//=====================END======================
+
+// 事件类型
+const (
+	EVENT_READING = "reading" // 测量结果
+	EVENT_STATUS  = "status"  // 传感器状态变化
+	EVENT_LOG     = "log"     // 日志
+	EVENT_ALARM   = "alarm"   // 报警状态变化
+)
+
+const (
+	EVENT_BUFFER_SIZE   = 64               // 单个订阅者缓存的事件数, 已满时丢弃新事件
+	EVENT_KEEPALIVE     = 15 * time.Second // SSE空闲时发送注释行的间隔
+	EVENT_WRITE_TIMEOUT = 10 * time.Second // WebSocket单次发送的超时
+)
+
+/**
+ * 推送的事件, 按Type只有Reading/Status/Log/Alarm之一
+ */
+type StreamEvent struct {
+	ID       uint64      `json:"id,omitempty"` // 递增序号, 连接时补发的当前状态为0
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	SensorID string      `json:"sensorID,omitempty"`
+	Attach   string      `json:"attach,omitempty"`
+	Reading  *ReadResult `json:"reading,omitempty"`
+	Status   string      `json:"status,omitempty"`
+	Log      *LogEntry   `json:"log,omitempty"`
+	Alarm    *Alarm      `json:"alarm,omitempty"`
+}
+
+/**
+ * 事件过滤, 各项为空时不过滤
+ * 指定传感器或DTU时, 不属于任何传感器的日志不推送
+ */
+type EventFilter struct {
+	Types     []string // 事件类型
+	SensorIDs []string // 传感器ID
+	Attaches  []string // DTU地址
+	Items     []string // 测量项, 只保留匹配的测量项, 没有匹配项的测量结果不推送
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * 过滤后的事件
+ */
+func (f EventFilter) match(ev StreamEvent) (StreamEvent, bool) {
+	if len(f.Types) > 0 && !contains(f.Types, ev.Type) {
+		return ev, false
+	}
+	if len(f.SensorIDs) > 0 && !contains(f.SensorIDs, ev.SensorID) {
+		return ev, false
+	}
+	if len(f.Attaches) > 0 && !contains(f.Attaches, ev.Attach) {
+		return ev, false
+	}
+	if len(f.Items) > 0 && ev.Reading != nil {
+		rs := *ev.Reading
+		rs.Items = nil
+		for _, v := range ev.Reading.Items {
+			if contains(f.Items, v.Name) {
+				rs.Items = append(rs.Items, v)
+			}
+		}
+		if len(rs.Items) == 0 {
+			return ev, false
+		}
+		ev.Reading = &rs
+	}
+	return ev, true
+}
+
+/**
+ * 由查询参数解析, 参数可重复或以逗号分隔: ?sensor=s1,s2&attach=...&item=Oxygen&type=reading
+ */
+func parseEventFilter(q url.Values) (EventFilter, error) {
+	values := func(key string) []string {
+		var ret []string
+		for _, v := range q[key] {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					ret = append(ret, s)
+				}
+			}
+		}
+		return ret
+	}
+	f := EventFilter{Types: values("type"), SensorIDs: values("sensor"), Attaches: values("attach"), Items: values("item")}
+	for _, v := range f.Types {
+		if v != EVENT_READING && v != EVENT_STATUS && v != EVENT_LOG && v != EVENT_ALARM {
+			return f, invalid(fmt.Errorf("unknown event type %s", v))
+		}
+	}
+	return f, nil
+}
+
+type eventSubscriber struct {
+	filter  EventFilter
+	ch      chan StreamEvent
+	dropped int // 因缓存已满丢弃的事件数
+}
+
+/**
+ * 事件订阅
+ */
+type eventHub struct {
+	sync.Mutex
+	seq         uint64
+	subscribers map[*eventSubscriber]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]bool)}
+}
+
+/**
+ * 订阅事件, 不再需要时调用cancel
+ * 读取过慢时丢弃新事件, 不会阻塞采集
+ */
+func (c *Collector) SubscribeEvents(filter EventFilter) (events <-chan StreamEvent, cancel func()) {
+	sub := &eventSubscriber{filter: filter, ch: make(chan StreamEvent, EVENT_BUFFER_SIZE)}
+	c.events.Lock()
+	c.events.subscribers[sub] = true
+	c.events.Unlock()
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			c.events.Lock()
+			delete(c.events.subscribers, sub)
+			c.events.Unlock()
+			if sub.dropped > 0 {
+				fmt.Printf("[WARN] 事件订阅者读取过慢, 已丢弃%d个事件\n", sub.dropped)
+			}
+		})
+	}
+}
+
+func SubscribeEvents(filter EventFilter) (<-chan StreamEvent, func()) {
+	return Default().SubscribeEvents(filter)
+}
+
+func (c *Collector) publishEvent(ev StreamEvent) {
+	c.events.Lock()
+	defer c.events.Unlock()
+	if len(c.events.subscribers) == 0 {
+		return
+	}
+	c.events.seq++
+	ev.ID = c.events.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for sub := range c.events.subscribers {
+		v, ok := sub.filter.match(ev)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.ch <- v:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+/**
+ * 连接时补发的当前状态: 各传感器的状态及最近一次测量结果
+ */
+func (c *Collector) eventSnapshot(filter EventFilter) []StreamEvent {
+	var ret []StreamEvent
+	now := time.Now()
+	for _, ls := range c.Config().LocalSensorInformation {
+		events := []StreamEvent{{Type: EVENT_STATUS, Time: now, SensorID: ls.SensorID, Attach: ls.Attach, Status: c.sensorState(ls)}}
+		if p, ok := c.LatestReading(ls.SensorID); ok {
+			events = append(events, StreamEvent{Type: EVENT_READING, Time: p.Created, SensorID: ls.SensorID, Attach: ls.Attach, Reading: &p})
+		}
+		for _, ev := range events {
+			if v, ok := filter.match(ev); ok {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+func (c *Collector) sensorAttach(sensorID string) string {
+	if ls, err := c.GetLocalSensor(sensorID); err == nil {
+		return ls.Attach
+	}
+	return ""
+}
+
+/**
+ * 在接口处理中已自行写出应答
+ */
+type apiResponded struct{}
+
+/**
+ * Server-Sent Events, 事件名为事件类型, 数据为StreamEvent
+ */
+func (c *Collector) apiEvents(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+	events, cancel := c.SubscribeEvents(filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	write := func(ev StreamEvent) error {
+		data, _ := json.Marshal(ev)
+		if ev.ID > 0 {
+			if _, err := fmt.Fprintf(w, "id: %d\n", ev.ID); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		return err
+	}
+	for _, ev := range c.eventSnapshot(filter) {
+		if write(ev) != nil {
+			return apiResponded{}, nil
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(EVENT_KEEPALIVE)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if write(ev) != nil {
+				return apiResponded{}, nil
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return apiResponded{}, nil
+			}
+		case <-r.Context().Done():
+			return apiResponded{}, nil
+		case <-c.draining:
+			return apiResponded{}, nil
+		}
+		flusher.Flush()
+	}
+}
+
+/**
+ * WebSocket, 每条文本消息为一个StreamEvent
+ * 浏览器无法设置Authorization, 令牌可放在access_token参数中
+ */
+func (c *Collector) apiEventsWS(w http.ResponseWriter, r *http.Request, p apiParams) (interface{}, error) {
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	srv := websocket.Server{
+		// 只接受同源页面或非浏览器客户端的连接, 避免其他站点的页面订阅事件
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			if !sameOrigin(r) {
+				return errors.New("cross-origin websocket rejected")
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			c.serveEventsWS(ws, filter)
+		},
+	}
+	srv.ServeHTTP(w, r)
+	return apiResponded{}, nil
+}
+
+func (c *Collector) serveEventsWS(ws *websocket.Conn, filter EventFilter) {
+	defer ws.Close()
+	events, cancel := c.SubscribeEvents(filter)
+	defer cancel()
+
+	// 不处理客户端消息, 读取失败即连接已关闭
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+	send := func(ev StreamEvent) error {
+		_ = ws.SetWriteDeadline(time.Now().Add(EVENT_WRITE_TIMEOUT))
+		return websocket.JSON.Send(ws, ev)
+	}
+	for _, ev := range c.eventSnapshot(filter) {
+		if send(ev) != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case ev := <-events:
+			if send(ev) != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-c.draining:
+			return
+		}
+	}
+}
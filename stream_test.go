@@ -0,0 +1,147 @@
+package sensor
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func waitSubscribers(t *testing.T, c *Collector, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.events.Lock()
+		count := len(c.events.subscribers)
+		c.events.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers", n)
+}
+
+func TestEventFilter(t *testing.T) {
+	rs := &ReadResult{SensorID: "s1", Items: []MeasureItem{{Name: "Oxygen", Value: 5}, {Name: "Temp", Value: 20}}}
+	ev := StreamEvent{Type: EVENT_READING, SensorID: "s1", Attach: "127.0.0.1", Reading: rs}
+	if v, ok := (EventFilter{Items: []string{"Temp"}}).match(ev); !ok || len(v.Reading.Items) != 1 || v.Reading.Items[0].Name != "Temp" || len(rs.Items) != 2 {
+		t.Errorf("item filter %+v", v.Reading)
+	}
+	if _, ok := (EventFilter{Items: []string{"PH"}}).match(ev); ok {
+		t.Error("reading without matching items")
+	}
+	if _, ok := (EventFilter{Attaches: []string{"127.0.0.2"}}).match(ev); ok {
+		t.Error("attach filter")
+	}
+	if _, ok := (EventFilter{SensorIDs: []string{"s1"}}).match(StreamEvent{Type: EVENT_LOG, Log: &LogEntry{}}); ok {
+		t.Error("log without sensor matched sensor filter")
+	}
+	if _, ok := (EventFilter{Types: []string{EVENT_STATUS}, Items: []string{"Temp"}}).match(StreamEvent{Type: EVENT_STATUS, Status: SENSOR_NORMAL}); !ok {
+		t.Error("status filtered by item")
+	}
+	f, err := parseEventFilter(map[string][]string{"sensor": {"s1, s2", "s3"}, "type": {"reading"}})
+	if err != nil || len(f.SensorIDs) != 3 || f.SensorIDs[1] != "s2" || f.Types[0] != EVENT_READING {
+		t.Errorf("unexpected filter %+v %v", f, err)
+	}
+	if _, err := parseEventFilter(map[string][]string{"type": {"command"}}); !IsValidationError(err) {
+		t.Errorf("unknown type: %v", err)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", HTTPToken: "t0ken", LocalSensorInformation: []*LocalSensorInformation{
+		{Addr: 1, Attach: "127.0.0.1", Interval: 3600, SensorID: "s1"},
+		{Addr: 2, Attach: "127.0.0.2", Interval: 3600, SensorID: "s2"},
+	}}))
+	c.setReading(ReadResult{SensorID: "s1", Items: []MeasureItem{{Name: "Oxygen", Value: 5.27}, {Name: "Temp", Value: 25}}})
+	srv := httptest.NewServer(c.HTTPHandler())
+	defer srv.Close()
+
+	if resp, _ := http.Get(srv.URL + API_PREFIX + "/events"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("events without token: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Get(srv.URL + API_PREFIX + "/events?type=x&access_token=t0ken"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown type: %d", resp.StatusCode)
+	}
+
+	// SSE
+	resp, err := http.Get(srv.URL + API_PREFIX + "/events?sensor=s1&item=Oxygen&access_token=t0ken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := make(chan StreamEvent, 16)
+	go func() {
+		defer close(events)
+		r := bufio.NewReader(resp.Body)
+		var name string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				var ev StreamEvent
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev)
+				if ev.Type != name {
+					t.Errorf("event name %s for %s", name, ev.Type)
+				}
+				events <- ev
+			}
+		}
+	}()
+	next := func() StreamEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return StreamEvent{}
+	}
+	// 连接时补发当前状态
+	if ev := next(); ev.Type != EVENT_STATUS || ev.SensorID != "s1" || ev.Status != SENSOR_NORMAL {
+		t.Errorf("unexpected snapshot %+v", ev)
+	}
+	if ev := next(); ev.Type != EVENT_READING || len(ev.Reading.Items) != 1 || ev.Reading.Items[0].Value != 5.27 {
+		t.Errorf("unexpected snapshot %+v", ev)
+	}
+	waitSubscribers(t, c, 1)
+	c.publishEvent(StreamEvent{Type: EVENT_READING, SensorID: "s2", Attach: "127.0.0.2", Reading: &ReadResult{SensorID: "s2", Items: []MeasureItem{{Name: "Oxygen", Value: 1}}}})
+	c.publishEvent(StreamEvent{Type: EVENT_READING, SensorID: "s1", Attach: "127.0.0.1", Reading: &ReadResult{SensorID: "s1", Items: []MeasureItem{{Name: "Temp", Value: 1}}}})
+	c.publishEvent(StreamEvent{Type: EVENT_READING, SensorID: "s1", Attach: "127.0.0.1", Reading: &ReadResult{SensorID: "s1", Items: []MeasureItem{{Name: "Oxygen", Value: 4.1}}}})
+	if ev := next(); ev.SensorID != "s1" || ev.ID == 0 || ev.Reading.Items[0].Value != 4.1 {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	resp.Body.Close()
+	waitSubscribers(t, c, 0)
+
+	// WebSocket
+	if _, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+API_PREFIX+"/events/ws?access_token=t0ken", "", "http://evil.example"); err == nil {
+		t.Error("cross-origin websocket accepted")
+	}
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+API_PREFIX+"/events/ws?type=log&attach=127.0.0.2&access_token=t0ken", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	waitSubscribers(t, c, 1)
+	c.PushMQLog(MQ_LOG_WARN, "s1 log", "s1")
+	c.PushMQLog(MQ_LOG_WARN, "s2 log", "s2")
+	var ev StreamEvent
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &ev); err != nil || ev.Type != EVENT_LOG || ev.Attach != "127.0.0.2" || ev.Log.Message != "s2 log" || ev.Log.Level != MQ_LOG_WARN {
+		t.Errorf("unexpected event %+v %v", ev, err)
+	}
+}
@@ -22,58 +22,85 @@ func testStatus() {
 	}
 }
 
-var listener net.Listener
-
 /**
  * 关闭TCP
  */
+func (c *Collector) StopDeviceTCP() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listener != nil {
+		c.listener.Close()
+	}
+}
+
 func StopDeviceTCP() {
-	listener.Close()
+	Default().StopDeviceTCP()
 }
 
 /**
  * 重启设备TCP
  */
-func RestartDeviceTCP() {
-	listener.Close()
-	go RunDeviceTCP()
+func (c *Collector) RestartDeviceTCP() {
+	c.StopDeviceTCP()
+	go c.RunDeviceTCP()
 
 }
 
+func RestartDeviceTCP() {
+	Default().RestartDeviceTCP()
+}
+
 /**
  * 重启System
  */
-func RestartTCPSystem() {
-	listener.Close()
-	s := GetDeviceSessions()
-	s.Range(func(key, value interface{}) bool {
-		h := value.(DeviceSession)
-		h.stopChan <- true
+func (c *Collector) RestartTCPSystem() {
+	c.StopDeviceTCP()
+	c.sessions.Range(func(key, value interface{}) bool {
+		value.(*DeviceSession).Close()
 		fmt.Println("[INFO] 已移除" + key.(string))
 		return true
 	})
 
 	fmt.Println("[INFO] 重启TCP")
-	go RunDeviceTCP()
+	go c.RunDeviceTCP()
+}
+
+func RestartTCPSystem() {
+	Default().RestartTCPSystem()
 }
 
-func SensorServiceStart()  {
+/**
+ * 启动默认收集器, 阻塞直到收到SIGINT/SIGTERM并完成停止
+ */
+func SensorServiceStart() {
 	// 服务示例: 下位 -> DTU -> Sensor
-	RunDeviceTCP()
-	WaitSystem()
+	if err := Default().Run(SHUTDOWN_TIMEOUT); err != nil {
+		fmt.Println("[FAIL] 停止收集器", err)
+	}
 }
 
-func RunDeviceTCP() {
+/**
+ * 阻塞直到默认收集器停止
+ */
+func WaitSystem() {
+	Default().Wait()
+}
+
+func (c *Collector) RunDeviceTCP() {
 	// go testStatus()
-	listener, _ = net.Listen(NETWORK, ADDRESS)
+	ln, err := net.Listen(NETWORK, c.address)
+	if err != nil {
+		fmt.Println("[FAIL] 监听TCP失败", err)
+		return
+	}
+	c.mu.Lock()
+	c.listener = ln
+	c.mu.Unlock()
 
 	// defer listener.Close()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("[FAIL] " + "退出TCP")
-			return
-		}
-		go HandleProcessor(conn)
-	}
+	c.serve(ln)
+}
+
+func RunDeviceTCP() {
+	Default().RunDeviceTCP()
 }
@@ -1,89 +1,99 @@
 package sensor
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 )
 
-func OpenKit() {
+//=====================HTTP=====================
+//
+//            HTTP服务, 管理接口等
+//
+//=====================END======================
 
-	http.HandleFunc("/", index)
-	http.HandleFunc("/test/", test)
+// OpenKit的监听地址
+const HTTP_ADDRESS = "0.0.0.0:6666"
 
-	if err := http.ListenAndServe("0.0.0.0:6666", nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
-}
+const HTTP_READ_TIMEOUT = 30 * time.Second
 
-type User struct {
-	Name string `json:"name"`
-	Age  int    `json:"age"`
+/**
+ * 该收集器的HTTP路由
+ */
+func (c *Collector) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(API_PREFIX+"/", c.apiHandler())
+	mux.Handle(METRICS_PATH, c.metricsHandler())
+	mux.Handle(HEALTHZ_PATH, c.healthHandler(false))
+	mux.Handle(READYZ_PATH, c.healthHandler(true))
+	mux.Handle("/", c.webUIHandler())
+	return mux
 }
 
-func index(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	fmt.Println("Form: ", r.Form)
-	fmt.Println("Path: ", r.URL.Path)
-	fmt.Println(r.Form["a"])
-	fmt.Println(r.Form["b"])
-	for k, v := range r.Form {
-		fmt.Println(k, "=>", v, strings.Join(v, "-"))
+/**
+ * 开始监听HTTP, 收集器停止时关闭
+ * 监听非本机地址时必须配置http_token
+ */
+func (c *Collector) StartHTTP(address string) error {
+	if err := checkHTTPExposure(address, c.Config().HTTPToken); err != nil {
+		return err
+	}
+	ln, err := net.Listen(NETWORK, address)
+	if err != nil {
+		return err
 	}
-	fmt.Fprint(w, "It works !")
+	srv := &http.Server{Handler: c.HTTPHandler(), ReadHeaderTimeout: HTTP_READ_TIMEOUT}
+	c.mu.Lock()
+	c.httpServer = srv
+	c.httpListener = ln
+	c.mu.Unlock()
+	fmt.Println("[INFO] HTTP监听 " + ln.Addr().String())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("[FAIL] HTTP服务退出", err)
+		}
+	}()
+	return nil
 }
 
-type RequestBody struct {
-	SData  []byte
-	NodeIP string
+/**
+ * HTTP实际监听地址, 未启动时为nil
+ */
+func (c *Collector) HTTPAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.httpListener == nil {
+		return nil
+	}
+	return c.httpListener.Addr()
 }
 
-func CreateRequest(r *http.Request) (RequestBody, error) {
-	_ = r.ParseForm()
-	if len(r.Form["addr"]) == 0 || len(r.Form["reg"]) == 0 || len(r.Form["nodeIP"]) == 0 {
-		return RequestBody{}, errors.New("error request")
+/**
+ * 等待进行中的HTTP请求完成后关闭
+ */
+func (c *Collector) stopHTTP(ctx context.Context) {
+	c.mu.Lock()
+	srv := c.httpServer
+	c.mu.Unlock()
+	if srv == nil {
+		return
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("[WARN] HTTP关闭超时", err)
+		_ = srv.Close()
 	}
-	reg := r.Form["reg"][0]
-	i, _ := strconv.Atoi(r.Form["addr"][0])
-	var sr []byte
-	sr = append(sr, byte(i))
-	sr = append(sr, InfoMK["ReadFunc"]...)
-	sr = append(sr, InfoMK[reg]...)
-	sr = append(sr, CreateCRC(sr)...)
-	var rq RequestBody
-	rq.SData = sr
-	rq.NodeIP = r.Form["nodeIP"][0]
-	return rq, nil
 }
 
-func test(w http.ResponseWriter, r *http.Request) {
-	if rq, err := CreateRequest(r); err != nil {
-		var rd ReadResult
-		rd.Status = 2
-		if bs, err := json.Marshal(rd); err == nil {
-			_, err := w.Write(bs)
-			if err != nil {
-				log.Println("发送操作失败: ", err)
-			}
-		} else {
-			fmt.Println(err)
-		}
-	} else {
-		b, _ := GetDeviceSession(rq.NodeIP)
-		p, err := b.MeasureRequest(rq.SData, []string{"测量值", "温度"})
-		if err == nil {
-			if bs, err := json.Marshal(p); err == nil {
-				_, err := w.Write(bs)
-				if err != nil {
-					log.Println("发送操作失败: ", err)
-				}
-			} else {
-				fmt.Println(err)
-			}
-		}
+/**
+ * 在HTTP_ADDRESS上启动默认收集器的HTTP服务并阻塞
+ */
+func OpenKit() {
+	if err := Default().StartHTTP(HTTP_ADDRESS); err != nil {
+		log.Fatal("ListenAndServe: ", err)
 	}
+	select {}
 }
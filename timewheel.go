@@ -15,7 +15,12 @@ type TimeWheel struct {
 	slotNum        int
 	addTaskChannel chan *task
 	stopChannel    chan bool
+	stopOnce       sync.Once
 	taskRecord     *sync.Map
+
+	tickMu   sync.Mutex
+	lastTick time.Time     // 最近一次处理tick的时间
+	lag      time.Duration // 最近一次tick从触发到开始处理的延迟
 }
 
 type Job func(TaskData)
@@ -49,18 +54,31 @@ func New(interval time.Duration, slotNum int) *TimeWheel {
 }
 
 func (tw *TimeWheel) Start() {
+	tw.tickMu.Lock()
+	tw.lastTick = time.Now()
+	tw.tickMu.Unlock()
 	tw.ticker = time.NewTicker(tw.interval)
 	go tw.start()
 }
 
+/**
+ * 停止后不再执行任何任务, 也不再接受新的任务, 可重复调用
+ */
 func (tw *TimeWheel) Stop() {
-	tw.stopChannel <- true
+	tw.stopOnce.Do(func() {
+		close(tw.stopChannel)
+	})
 }
 
 func (tw *TimeWheel) start() {
 	for {
 		select {
-		case <-tw.ticker.C:
+		case t := <-tw.ticker.C:
+			now := time.Now()
+			tw.tickMu.Lock()
+			tw.lastTick = now
+			tw.lag = now.Sub(t)
+			tw.tickMu.Unlock()
 			tw.tickHandler()
 		case task := <-tw.addTaskChannel:
 			tw.addTask(task)
@@ -71,6 +89,27 @@ func (tw *TimeWheel) start() {
 	}
 }
 
+/**
+ * 任务数
+ */
+func (tw *TimeWheel) TaskCount() int {
+	n := 0
+	tw.taskRecord.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+/**
+ * 最近一次处理tick的时间及延迟, 尚未处理过tick时为启动时间
+ */
+func (tw *TimeWheel) LastTick() (time.Time, time.Duration) {
+	tw.tickMu.Lock()
+	defer tw.tickMu.Unlock()
+	return tw.lastTick, tw.lag
+}
+
 func (tw *TimeWheel) AddTask(interval time.Duration, times int, key interface{}, data TaskData, job Job) error {
 	if interval <= 0 || key == nil || job == nil || times < -1 || times == 0 {
 		return errors.New("非法的参数")
@@ -79,8 +118,12 @@ func (tw *TimeWheel) AddTask(interval time.Duration, times int, key interface{},
 	if ok {
 		return errors.New("重复的Key")
 	}
-	tw.addTaskChannel <- &task{interval: interval, times: times, key: key, taskData: data, job: job}
-	return nil
+	select {
+	case tw.addTaskChannel <- &task{interval: interval, times: times, key: key, taskData: data, job: job}:
+		return nil
+	case <-tw.stopChannel:
+		return errors.New("TimeWheel已停止")
+	}
 }
 
 func (tw *TimeWheel) RemoveTask(key interface{}) error {
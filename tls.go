@@ -0,0 +1,135 @@
+package sensor
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+//=====================TLS======================
+//
+//          中间件的TLS及客户端证书认证
+//
+//=====================END======================
+
+// 使用TLS的broker_scheme
+var tlsSchemes = map[string]bool{"ssl": true, "tls": true, "wss": true}
+
+/**
+ * 是否使用TLS连接中间件
+ */
+func (dl *LocalDeviceDetail) UseTLS() bool {
+	return tlsSchemes[dl.BrokerScheme]
+}
+
+/**
+ * 中间件连接的TLS配置, 非TLS连接时返回nil
+ * 未指定CA时使用系统根证书
+ */
+func (dl *LocalDeviceDetail) TLSConfig() (*tls.Config, error) {
+	if !dl.UseTLS() {
+		return nil, nil
+	}
+	conf := &tls.Config{
+		ServerName:         dl.BrokerServerName,
+		InsecureSkipVerify: dl.BrokerInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if dl.BrokerCAFile != "" {
+		data, err := ioutil.ReadFile(dl.BrokerCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", dl.BrokerCAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if dl.BrokerCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(dl.BrokerCertFile, dl.BrokerKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if len(dl.BrokerPinSHA256) > 0 {
+		pins, err := decodePins(dl.BrokerPinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		conf.VerifyPeerCertificate = verifyPins(pins)
+	}
+	return conf, nil
+}
+
+/**
+ * 证书公钥(SubjectPublicKeyInfo)的SHA-256, base64编码, 与broker_pin_sha256比较
+ */
+func PinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func decodePins(pins []string) ([][]byte, error) {
+	ret := make([][]byte, len(pins))
+	for i, v := range pins {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid broker_pin_sha256 %q", v)
+		}
+		ret[i] = b
+	}
+	return ret, nil
+}
+
+/**
+ * 证书固定: 证书链中须有公钥与pins之一相同的证书
+ * 证书链已校验时检查链上全部证书(可固定CA), 跳过校验时只检查中间件自身的证书
+ */
+func verifyPins(pins [][]byte) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	match := func(cert *x509.Certificate) bool {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if match(cert) {
+					return nil
+				}
+			}
+		}
+		if len(verifiedChains) == 0 && len(rawCerts) > 0 {
+			if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil && match(cert) {
+				return nil
+			}
+		}
+		return errors.New("broker certificate does not match broker_pin_sha256")
+	}
+}
+
+/**
+ * 检查TLS配置项
+ */
+func (dl *LocalDeviceDetail) validateTLS() error {
+	if (dl.BrokerCertFile == "") != (dl.BrokerKeyFile == "") {
+		return errors.New("broker_cert_file and broker_key_file must be set together")
+	}
+	tlsOptions := dl.BrokerCAFile != "" || dl.BrokerCertFile != "" || dl.BrokerServerName != "" || dl.BrokerInsecureSkipVerify || len(dl.BrokerPinSHA256) > 0
+	if tlsOptions && !dl.UseTLS() {
+		return fmt.Errorf("tls options require broker_scheme ssl/tls/wss, got %q", dl.BrokerScheme)
+	}
+	_, err := decodePins(dl.BrokerPinSHA256)
+	return err
+}
@@ -0,0 +1,163 @@
+package sensor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 签发证书, parent为nil时自签名
+func issueCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, ca bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestBrokerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	ca, caKey, caPem, _ := issueCert(t, "ca", nil, nil, true)
+	server, _, serverPem, serverKey := issueCert(t, "broker.local", ca, caKey, false)
+	_, _, clientPem, clientKey := issueCert(t, "collector", ca, caKey, false)
+
+	// 要求客户端证书的中间件
+	serverCert, _ := tls.X509KeyPair(serverPem, serverKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dl := &LocalDeviceDetail{
+		BrokerScheme:     "ssl",
+		BrokerCAFile:     write("ca.pem", caPem),
+		BrokerCertFile:   write("client.pem", clientPem),
+		BrokerKeyFile:    write("client.key", clientKey),
+		BrokerServerName: "broker.local",
+	}
+	if err := dl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := dl.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr().String(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// 证书固定
+	other, _, _, _ := issueCert(t, "other", nil, nil, true)
+	dial := func() error {
+		conf, err := dl.TLSConfig()
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", l.Addr().String(), conf)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	dl.BrokerPinSHA256 = []string{PinSHA256(other), PinSHA256(ca)}
+	if err := dial(); err != nil {
+		t.Errorf("pinned ca rejected: %v", err)
+	}
+	dl.BrokerPinSHA256 = []string{PinSHA256(other)}
+	if dial() == nil {
+		t.Error("unpinned certificate accepted")
+	}
+	// 跳过校验时只比较中间件自身的证书
+	dl.BrokerInsecureSkipVerify = true
+	dl.BrokerPinSHA256 = []string{PinSHA256(ca)}
+	if dial() == nil {
+		t.Error("unverified chain matched by ca pin")
+	}
+	dl.BrokerPinSHA256 = []string{PinSHA256(server)}
+	if err := dial(); err != nil {
+		t.Errorf("pinned server rejected: %v", err)
+	}
+	dl.BrokerInsecureSkipVerify, dl.BrokerPinSHA256 = false, []string{"abc"}
+	if dl.Validate() == nil {
+		t.Error("invalid pin accepted")
+	}
+	dl.BrokerPinSHA256 = nil
+
+	dl.BrokerServerName = "other.local"
+	conf, _ = dl.TLSConfig()
+	if conn, err := tls.Dial("tcp", l.Addr().String(), conf); err == nil {
+		conn.Close()
+		t.Error("server name not verified")
+	}
+
+	dl.BrokerScheme = "tcp"
+	if dl.Validate() == nil {
+		t.Error("tls options accepted for tcp")
+	}
+	dl.BrokerScheme = "tcps"
+	if dl.Validate() == nil {
+		t.Error("tls options accepted for tcps")
+	}
+	dl.BrokerScheme, dl.BrokerKeyFile = "wss", ""
+	if dl.Validate() == nil {
+		t.Error("client cert without key accepted")
+	}
+}
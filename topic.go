@@ -0,0 +1,131 @@
+package sensor
+
+import (
+	"errors"
+	"strings"
+)
+
+//=====================TOPIC====================
+//
+//             收集器的MQTT主题命名空间
+//
+//=====================END======================
+
+/**
+ * 未配置topic_prefix时使用原有的全局主题:
+ *   sensor/oxygen/measure, sensor/status/{sensorID}, sensor/log, sensor/action/...
+ * 配置topic_prefix(例如 farm/{site}/{collector})后:
+ *   {prefix}/sensors/{sensorID}/measure   测量数据
+ *   {prefix}/sensors/{sensorID}/status    传感器状态
+ *   {prefix}/log, {prefix}/action/..., {prefix}/setting/...
+ * 配置broadcast_prefix后, 广播指令同时订阅 {broadcast_prefix}/action/...
+ */
+const TOPIC_LEGACY_ROOT = "sensor"
+
+// 命名空间内的主题
+const (
+	TOPIC_MEASURE        = "measure"
+	TOPIC_STATUS         = "status"
+	TOPIC_LOG            = "log"
+	TOPIC_COMMAND_RESULT = "command/result"
+)
+
+// 原有的传感器主题, 保留消息按传感器区分
+var legacySensorTopics = map[string]string{
+	TOPIC_MEASURE: "oxygen/measure",
+	TOPIC_STATUS:  "status/{sensorID}",
+}
+
+// topic_prefix中可用的占位符
+const (
+	TOPIC_SITE      = "{site}"
+	TOPIC_COLLECTOR = "{collector}"
+)
+
+/**
+ * 展开后的主题命名空间
+ */
+func (dl *LocalDeviceDetail) TopicNamespace() string {
+	if dl.TopicPrefix == "" {
+		return TOPIC_LEGACY_ROOT
+	}
+	ns := strings.Replace(dl.TopicPrefix, TOPIC_SITE, topicLevel(dl.Site), -1)
+	ns = strings.Replace(ns, TOPIC_COLLECTOR, topicLevel(dl.Name), -1)
+	return strings.Trim(ns, "/")
+}
+
+/**
+ * 广播主题的命名空间, 未配置时为空
+ */
+func (dl *LocalDeviceDetail) BroadcastNamespace() string {
+	return strings.Trim(dl.BroadcastPrefix, "/")
+}
+
+/**
+ * 作为单个主题层级使用时替换其中的分隔符和通配符
+ */
+func topicLevel(v string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(v)
+}
+
+/**
+ * 主题中不允许出现通配符
+ */
+func validTopic(v string) error {
+	if strings.ContainsAny(v, "+#") {
+		return errors.New("topic must not contain wildcards")
+	}
+	return nil
+}
+
+/**
+ * 相对主题 -> 该收集器命名空间内的完整主题
+ * 兼容原有写法, 以 sensor/ 开头的主题视为相对于命名空间
+ */
+func (c *Collector) Topic(topic string) string {
+	return c.Config().Topic(topic)
+}
+
+func (dl *LocalDeviceDetail) Topic(topic string) string {
+	return dl.TopicNamespace() + "/" + strings.TrimPrefix(topic, TOPIC_LEGACY_ROOT+"/")
+}
+
+func Topic(topic string) string {
+	return Default().Topic(topic)
+}
+
+/**
+ * 广播命名空间内的完整主题
+ * @return 未配置broadcast_prefix时返回false
+ */
+func (c *Collector) BroadcastTopic(topic string) (string, bool) {
+	ns := c.Config().BroadcastNamespace()
+	if ns == "" {
+		return "", false
+	}
+	return ns + "/" + strings.TrimPrefix(topic, TOPIC_LEGACY_ROOT+"/"), true
+}
+
+/**
+ * 是否为广播命名空间内的主题
+ */
+func (c *Collector) IsBroadcastTopic(topic string) bool {
+	ns := c.Config().BroadcastNamespace()
+	return ns != "" && strings.HasPrefix(topic, ns+"/")
+}
+
+/**
+ * 传感器的相对主题, sensorID可以为通配符+
+ */
+func (c *Collector) SensorTopic(sensorID, topic string) string {
+	if c.Config().TopicPrefix == "" {
+		if v, ok := legacySensorTopics[topic]; ok {
+			return strings.Replace(v, "{sensorID}", sensorID, -1)
+		}
+	}
+	return "sensors/" + sensorID + "/" + topic
+}
+
+func SensorTopic(sensorID, topic string) string {
+	return Default().SensorTopic(sensorID, topic)
+}
@@ -0,0 +1,36 @@
+package sensor
+
+import "testing"
+
+func TestTopicNamespace(t *testing.T) {
+	// 未配置前缀时保持原有主题
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "a"}))
+	if v := c.Topic("sensor/action/switch"); v != "sensor/action/switch" {
+		t.Error(v)
+	}
+	if v := c.Topic(c.SensorTopic("s1", TOPIC_MEASURE)); v != "sensor/oxygen/measure" {
+		t.Error(v)
+	}
+	if _, ok := c.BroadcastTopic("action/restart"); ok {
+		t.Error("broadcast without broadcast_prefix")
+	}
+
+	c = NewCollector(WithConfig(&LocalDeviceDetail{Name: "pond/1", Site: "east", TopicPrefix: "farm/{site}/{collector}/", BroadcastPrefix: "farm/all"}))
+	if v := c.Topic("action/switch"); v != "farm/east/pond_1/action/switch" {
+		t.Error(v)
+	}
+	if v := c.Topic("sensor/action/switch"); v != "farm/east/pond_1/action/switch" {
+		t.Error("legacy topic not mapped into namespace", v)
+	}
+	if v := c.Topic(c.SensorTopic("s1", TOPIC_MEASURE)); v != "farm/east/pond_1/sensors/s1/measure" {
+		t.Error(v)
+	}
+	if v, ok := c.BroadcastTopic("action/restart"); !ok || v != "farm/all/action/restart" || !c.IsBroadcastTopic(v) {
+		t.Error(v)
+	}
+
+	dl := LocalDeviceDetail{TopicPrefix: "farm/+/x"}
+	if dl.Validate() == nil {
+		t.Error("wildcard topic_prefix accepted")
+	}
+}
@@ -0,0 +1,443 @@
+package sensor
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//=====================WEBUI====================
+//
+//        内置管理页面, 基于管理接口实现
+//
+//=====================END======================
+
+// 页面中替换为MeasureItemMetas的占位
+const webUIMetaPlaceholder = "/*MEASURE_ITEM_METAS*/{}"
+
+/**
+ * 管理页面, 挂载于/
+ * 页面本身不需要令牌, 配置http_token后由页面提示输入并保存在浏览器中
+ */
+func (c *Collector) webUIHandler() http.Handler {
+	metas, _ := json.Marshal(MeasureItemMetas)
+	page := strings.Replace(webUIIndex, webUIMetaPlaceholder, string(metas), 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, _ = io.WriteString(w, page)
+	})
+}
+
+// 单页面, 不依赖外部资源
+const webUIIndex = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>pond_sensor</title>
+<style>
+body{font-family:-apple-system,"Segoe UI",Helvetica,Arial,sans-serif;margin:0;background:#f4f6f8;color:#222;font-size:14px}
+header{background:#1f3a4d;color:#fff;padding:10px 16px;display:flex;align-items:center;gap:16px}
+header h1{font-size:18px;margin:0}
+header .info{opacity:.8;flex:1}
+nav{display:flex;gap:4px;padding:8px 16px 0}
+nav button{border:0;background:#dde3e8;padding:8px 14px;border-radius:4px 4px 0 0;cursor:pointer}
+nav button.active{background:#fff;font-weight:bold}
+main{background:#fff;margin:0 16px 16px;padding:16px;border-radius:0 4px 4px 4px}
+table{border-collapse:collapse;width:100%}
+th,td{border-bottom:1px solid #e3e7ea;padding:6px 8px;text-align:left;vertical-align:top}
+th{background:#f7f9fa}
+button{cursor:pointer}
+.actions button{margin:0 2px 2px 0}
+.badge{display:inline-block;padding:1px 8px;border-radius:10px;color:#fff;font-size:12px}
+.normal{background:#2e8b57}.detached{background:#c0392b}.closed{background:#7f8c8d}.backing-off{background:#d68910}
+.muted{color:#888}
+.err{color:#c0392b}
+.log-1{color:#d68910}.log-2{color:#c0392b}
+#toast{position:fixed;right:16px;bottom:16px;max-width:420px;padding:10px 14px;border-radius:4px;color:#fff;display:none;white-space:pre-wrap}
+#toast.ok{background:#2e8b57}#toast.fail{background:#c0392b}
+#dialog{position:fixed;inset:0;background:rgba(0,0,0,.35);display:none;align-items:center;justify-content:center}
+#dialog form{background:#fff;padding:16px 20px;border-radius:6px;min-width:320px}
+label{display:block;margin:8px 0}
+label span{display:inline-block;width:140px}
+input:invalid{border-color:#c0392b}
+textarea{width:100%;min-height:360px;font-family:monospace}
+.hidden{display:none}
+</style>
+</head>
+<body>
+<header><h1>pond_sensor</h1><span class="info" id="info"></span><button id="token">令牌</button></header>
+<nav>
+<button data-tab="sensors" class="active">传感器</button>
+<button data-tab="sessions">DTU</button>
+<button data-tab="settings">设置</button>
+<button data-tab="logs">日志</button>
+</nav>
+<main>
+<section id="tab-sensors">
+<p><button id="add-sensor">新增传感器</button> <span class="muted" id="updated"></span></p>
+<table><thead><tr><th>传感器</th><th>地址</th><th>DTU</th><th>间隔(秒)</th><th>状态</th><th>错误/重试</th><th>最新数据</th><th>操作</th></tr></thead><tbody id="sensors"></tbody></table>
+</section>
+<section id="tab-sessions" class="hidden">
+<table><thead><tr><th>DTU</th><th>远端地址</th><th>传感器</th></tr></thead><tbody id="sessions"></tbody></table>
+</section>
+<section id="tab-settings" class="hidden">
+<form id="settings">
+<label><span>名称</span><input name="name" required></label>
+<label><span>站点</span><input name="site"></label>
+<label><span>主题前缀</span><input name="topic_prefix" placeholder="{site}/{collector}"></label>
+<label><span>广播前缀</span><input name="broadcast_prefix"></label>
+<label><span>MQTT心跳(秒)</span><input name="mqtt_keepalive" type="number" min="0"></label>
+<label><span>最大重连间隔(秒)</span><input name="mqtt_max_reconnect_interval" type="number" min="0"></label>
+<label><span>缓存上限(字节)</span><input name="outbox_max_bytes" type="number" min="0"></label>
+<label><span>缓存保留(秒)</span><input name="outbox_max_age" type="number" min="0"></label>
+<button type="submit">保存</button> <span class="muted" id="version"></span>
+</form>
+<h3>完整CONFIG</h3>
+<p class="muted">密钥已隐藏, 保持隐藏值时沿用原密钥</p>
+<textarea id="raw" spellcheck="false"></textarea>
+<p><button id="save-raw">替换CONFIG</button> <button id="reload-raw">重新读取</button> <button id="restart">重启TCP</button></p>
+</section>
+<section id="tab-logs" class="hidden">
+<table><thead><tr><th>时间</th><th>传感器</th><th>内容</th></tr></thead><tbody id="logs"></tbody></table>
+</section>
+</main>
+<div id="dialog"><form id="sensor-form">
+<h3 id="sensor-title"></h3>
+<label><span>传感器ID</span><input name="sensorID" required pattern="[^/+#]+"></label>
+<label><span>设备地址</span><input name="addr" type="number" min="0" max="255" required></label>
+<label><span>类型</span><input name="type" type="number" min="0" max="255" required></label>
+<label><span>DTU地址</span><input name="attach" required pattern="\d{1,3}(\.\d{1,3}){3}"></label>
+<label><span>间隔(秒)</span><input name="interval" type="number" min="1" required></label>
+<p><button type="submit">保存</button> <button type="button" id="sensor-cancel">取消</button></p>
+</form></div>
+<div id="toast"></div>
+<script>
+(function(){
+"use strict";
+var API = "/api/v1";
+var METAS = /*MEASURE_ITEM_METAS*/{};
+var NUMERIC = {addr:1, type:1, interval:1, mqtt_keepalive:1, mqtt_max_reconnect_interval:1, outbox_max_bytes:1, outbox_max_age:1};
+var state = {tab: "sensors", version: null, editing: null};
+
+function $(id){ return document.getElementById(id); }
+
+function el(tag, attrs, children){
+  var e = document.createElement(tag);
+  for (var k in attrs || {}) {
+    if (k === "text") e.textContent = attrs[k];
+    else if (k.indexOf("on") === 0) e.addEventListener(k.slice(2), attrs[k]);
+    else e.setAttribute(k, attrs[k]);
+  }
+  (children || []).forEach(function(c){ if (c) e.appendChild(typeof c === "string" ? document.createTextNode(c) : c); });
+  return e;
+}
+
+function toast(msg, ok){
+  var t = $("toast");
+  t.textContent = msg;
+  t.className = ok ? "ok" : "fail";
+  t.style.display = "block";
+  clearTimeout(toast.timer);
+  toast.timer = setTimeout(function(){ t.style.display = "none"; }, 4000);
+}
+
+function api(method, path, body, headers){
+  var opts = {method: method, headers: headers || {}};
+  var token = localStorage.getItem("pond_sensor_token");
+  if (token) opts.headers["Authorization"] = "Bearer " + token;
+  if (body !== undefined) {
+    opts.body = typeof body === "string" ? body : JSON.stringify(body);
+    if (!opts.headers["Content-Type"]) opts.headers["Content-Type"] = "application/json";
+  }
+  return fetch(API + path, opts).then(function(resp){
+    var etag = resp.headers.get("ETag");
+    if (etag) setVersion(JSON.parse(etag));
+    if (resp.status === 401) {
+      askToken();
+      throw new Error("需要令牌");
+    }
+    if (resp.status === 204) return null;
+    return resp.json().then(function(data){
+      if (!resp.ok) {
+        if (resp.status === 412) loadConfig();
+        throw new Error(resp.status + " " + (data && data.error || resp.statusText));
+      }
+      return data;
+    });
+  });
+}
+
+// 修改CONFIG需要当前版本
+function changeConfig(method, path, body, headers){
+  headers = headers || {};
+  headers["If-Match"] = JSON.stringify(String(state.version));
+  return api(method, path, body, headers);
+}
+
+function setVersion(v){
+  state.version = v;
+  $("version").textContent = "版本 " + v;
+}
+
+function askToken(){
+  if (state.asking) return;
+  state.asking = true;
+  var token = prompt("请输入管理接口令牌", localStorage.getItem("pond_sensor_token") || "");
+  state.asking = false;
+  if (token !== null) {
+    localStorage.setItem("pond_sensor_token", token);
+    listen();
+    loadConfig();
+    refresh();
+  }
+}
+
+function fail(err){ toast(err.message || String(err), false); }
+
+function fmtTime(s){
+  if (!s) return "";
+  var d = new Date(s);
+  return isNaN(d.getTime()) ? s : d.toLocaleString();
+}
+
+function readingCell(rs){
+  if (!rs) return el("span", {"class": "muted", text: "无"});
+  var parts = (rs.items || []).map(function(item){
+    var meta = METAS[item.name] || {};
+    return el("div", {text: item.name + ": " + item.value + (meta.unit ? " " + meta.unit : "")});
+  });
+  parts.push(el("div", {"class": "muted", text: fmtTime(rs.created)}));
+  return el("div", {}, parts);
+}
+
+function errorCell(s){
+  var parts = [el("div", {text: "错误 " + s.errorCount})];
+  if (s.retryTime) parts.push(el("div", {"class": "err", text: "重试 " + fmtTime(s.retryTime)}));
+  if (s.pendingCommands) parts.push(el("div", {"class": "muted", text: "待执行指令 " + s.pendingCommands}));
+  return el("div", {}, parts);
+}
+
+function sensorAction(s, op){
+  return function(){
+    api("POST", "/sensors/" + encodeURIComponent(s.sensorID) + "/" + op).then(function(res){
+      if (op === "measure") toast(s.sensorID + " 测量完成 " + (res.items || []).map(function(i){ return i.name + "=" + i.value; }).join(" "), true);
+      else toast(s.sensorID + " " + op + " 完成", true);
+      loadSensors();
+    }).catch(fail);
+  };
+}
+
+// 校准等写指令异步执行, 轮询结果
+function submitCommand(s, name){
+  return function(){
+    if (!confirm("确认对 " + s.sensorID + " 执行 " + name + " ?")) return;
+    api("POST", "/sensors/" + encodeURIComponent(s.sensorID) + "/commands", {name: name}).then(function(res){
+      toast("指令已提交 " + res.id, true);
+      pollCommand(res.id, 0);
+    }).catch(fail);
+  };
+}
+
+function pollCommand(id, n){
+  api("GET", "/commands/" + encodeURIComponent(id)).then(function(res){
+    if (res.status === "pending" && n < 60) {
+      setTimeout(function(){ pollCommand(id, n + 1); }, 1000);
+      return;
+    }
+    toast("指令 " + id + " " + res.status + (res.error ? " " + res.error : ""), res.status === "acked");
+    loadSensors();
+  }).catch(fail);
+}
+
+function removeSensor(s){
+  return function(){
+    if (!confirm("确认移除传感器 " + s.sensorID + " ?")) return;
+    changeConfig("DELETE", "/sensors/" + encodeURIComponent(s.sensorID)).then(function(){
+      toast(s.sensorID + " 已移除", true);
+      loadSensors();
+    }).catch(fail);
+  };
+}
+
+function loadSensors(){
+  return api("GET", "/sensors").then(function(list){
+    var body = $("sensors");
+    body.textContent = "";
+    list.forEach(function(s){
+      var closed = s.status === "closed";
+      body.appendChild(el("tr", {}, [
+        el("td", {text: s.sensorID}),
+        el("td", {text: s.addr + " / 类型" + s.type}),
+        el("td", {}, [el("span", {text: s.attach + " "}), el("span", {"class": s.connected ? "" : "err", text: s.connected ? "已连接" : "未连接"})]),
+        el("td", {text: String(s.interval)}),
+        el("td", {}, [el("span", {"class": "badge " + s.status, text: s.status})]),
+        el("td", {}, [errorCell(s)]),
+        el("td", {}, [readingCell(s.reading)]),
+        el("td", {"class": "actions"}, [
+          el("button", {text: "测量", onclick: sensorAction(s, "measure")}),
+          el("button", {text: closed ? "开启" : "关闭", onclick: sensorAction(s, closed ? "open" : "close")}),
+          el("button", {text: "清除错误", onclick: sensorAction(s, "clear")}),
+          el("button", {text: "零点校准", onclick: submitCommand(s, "zero")}),
+          el("button", {text: "斜率校准", onclick: submitCommand(s, "tilt")}),
+          el("button", {text: "恢复出厂", onclick: submitCommand(s, "factory")}),
+          el("button", {text: "编辑", onclick: function(){ openSensor(s); }}),
+          el("button", {text: "移除", onclick: removeSensor(s)})
+        ])
+      ]));
+    });
+    $("updated").textContent = "更新于 " + new Date().toLocaleTimeString();
+  }).catch(fail);
+}
+
+function loadSessions(){
+  return api("GET", "/sessions").then(function(list){
+    var body = $("sessions");
+    body.textContent = "";
+    if (!list.length) body.appendChild(el("tr", {}, [el("td", {colspan: "3", "class": "muted", text: "没有已连接的DTU"})]));
+    list.forEach(function(s){
+      body.appendChild(el("tr", {}, [el("td", {text: s.attachIP}), el("td", {text: s.remoteAddr}), el("td", {text: s.sensors.join(", ")})]));
+    });
+  }).catch(fail);
+}
+
+function loadLogs(){
+  return api("GET", "/logs?limit=200").then(function(list){
+    var body = $("logs");
+    body.textContent = "";
+    list.reverse().forEach(function(l){
+      body.appendChild(el("tr", {"class": "log-" + l.level}, [el("td", {text: fmtTime(l.time)}), el("td", {text: l.sensorID || ""}), el("td", {text: l.message})]));
+    });
+  }).catch(fail);
+}
+
+function loadConfig(){
+  return api("GET", "/config").then(function(dl){
+    $("info").textContent = dl.name + (dl.site ? " @ " + dl.site : "");
+    var form = $("settings");
+    Array.prototype.forEach.call(form.elements, function(input){
+      if (input.name) input.value = dl[input.name] === undefined || dl[input.name] === null ? "" : dl[input.name];
+    });
+    $("raw").value = JSON.stringify(dl, null, 2);
+  }).catch(fail);
+}
+
+function formValues(form, omitEmpty){
+  var ret = {};
+  Array.prototype.forEach.call(form.elements, function(input){
+    if (!input.name) return;
+    if (input.value === "") {
+      if (!omitEmpty) ret[input.name] = null;
+      return;
+    }
+    ret[input.name] = NUMERIC[input.name] ? Number(input.value) : input.value;
+  });
+  return ret;
+}
+
+function openSensor(s){
+  state.editing = s;
+  var form = $("sensor-form");
+  form.reset();
+  $("sensor-title").textContent = s ? "编辑 " + s.sensorID : "新增传感器";
+  form.elements.sensorID.readOnly = !!s;
+  if (s) ["sensorID", "addr", "type", "attach", "interval"].forEach(function(k){ form.elements[k].value = s[k]; });
+  $("dialog").style.display = "flex";
+}
+
+function closeSensor(){ $("dialog").style.display = "none"; }
+
+$("sensor-form").addEventListener("submit", function(e){
+  e.preventDefault();
+  var values = formValues(e.target, true);
+  var s = state.editing;
+  var req = s ? changeConfig("PATCH", "/sensors/" + encodeURIComponent(s.sensorID), values, {"Content-Type": "application/merge-patch+json"}) : changeConfig("POST", "/sensors", values);
+  req.then(function(){
+    toast(values.sensorID + " 已保存", true);
+    closeSensor();
+    loadSensors();
+  }).catch(fail);
+});
+
+$("settings").addEventListener("submit", function(e){
+  e.preventDefault();
+  changeConfig("PATCH", "/config", formValues(e.target, false), {"Content-Type": "application/merge-patch+json"}).then(function(){
+    toast("设置已保存", true);
+    loadConfig();
+  }).catch(fail);
+});
+
+$("save-raw").addEventListener("click", function(){
+  var raw = $("raw").value;
+  try { JSON.parse(raw); } catch (err) { fail(new Error("JSON格式错误: " + err.message)); return; }
+  changeConfig("PUT", "/config", raw).then(function(){
+    toast("CONFIG已替换", true);
+    loadConfig();
+    loadSensors();
+  }).catch(fail);
+});
+
+$("reload-raw").addEventListener("click", loadConfig);
+$("restart").addEventListener("click", function(){
+  if (!confirm("确认重启TCP? 所有DTU将断开重连")) return;
+  api("POST", "/restart").then(function(){ toast("正在重启TCP", true); }).catch(fail);
+});
+$("add-sensor").addEventListener("click", function(){ openSensor(null); });
+$("sensor-cancel").addEventListener("click", closeSensor);
+$("token").addEventListener("click", askToken);
+
+Array.prototype.forEach.call(document.querySelectorAll("nav button"), function(b){
+  b.addEventListener("click", function(){
+    state.tab = b.getAttribute("data-tab");
+    Array.prototype.forEach.call(document.querySelectorAll("nav button"), function(x){ x.className = x === b ? "active" : ""; });
+    Array.prototype.forEach.call(document.querySelectorAll("main section"), function(s){ s.className = s.id === "tab-" + state.tab ? "" : "hidden"; });
+    refresh();
+  });
+});
+
+function refresh(){
+  if (state.tab === "sensors") loadSensors();
+  if (state.tab === "sessions") loadSessions();
+  if (state.tab === "logs") loadLogs();
+}
+
+// 测量结果及状态变化时立即刷新, 轮询作为补充
+function listen(){
+  if (!window.EventSource) return;
+  if (state.events) state.events.close();
+  var token = localStorage.getItem("pond_sensor_token");
+  state.events = new EventSource(API + "/events?type=reading,status" + (token ? "&access_token=" + encodeURIComponent(token) : ""));
+  var changed = function(){
+    if (state.tab !== "sensors") return;
+    clearTimeout(state.pending);
+    state.pending = setTimeout(loadSensors, 300);
+  };
+  state.events.addEventListener("reading", changed);
+  state.events.addEventListener("status", changed);
+}
+
+loadConfig();
+refresh();
+listen();
+setInterval(function(){ if (!document.hidden && state.tab !== "settings") refresh(); }, 3000);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,38 @@
+package sensor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebUI(t *testing.T) {
+	c := NewCollector(WithConfig(&LocalDeviceDetail{Name: "c1", HTTPToken: "t0ken"}))
+	srv := httptest.NewServer(c.HTTPHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// 页面不需要令牌
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected page %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if strings.Contains(string(body), webUIMetaPlaceholder) || !strings.Contains(string(body), `"Oxygen":{"unit":"mg/L"`) {
+		t.Error("measure item metas not injected")
+	}
+	if resp, _ := http.Get(srv.URL + "/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Post(srv.URL+"/", "text/plain", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected method: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Get(srv.URL + API_PREFIX + "/sensors"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("api without token: %d", resp.StatusCode)
+	}
+}